@@ -40,6 +40,8 @@ const (
 	Taddr         // file address (name, ln, ch)
 	Tdir          // map[string]string, directory entry
 	Tzx           // zx protocol msg
+	Tzbytes       // byte[], compressed (see Mux.Compress)
+	Tns           // ns protocol msg
 	Tusr          // first user defined type value
 )
 
@@ -220,6 +222,12 @@ func ReadMsg(r io.Reader) (n int, tag uint32, m face{}, err error) {
 	switch typ {
 	case Tbytes:
 		return sz, tag, b, nil
+	case Tzbytes:
+		b, err = unzip(b)
+		if err != nil {
+			return sz, tag, nil, err
+		}
+		return sz, tag, b, nil
 	case Tstr:
 		return sz, tag, string(b), nil
 	case Terr:
@@ -5,6 +5,8 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"math/rand"
 	"os"
 	"strings"
 	"sync"
@@ -652,6 +654,181 @@ func TestMuxFlow(t *testing.T) {
 	wg.Wait()
 }
 
+func TestMuxCompress(t *testing.T) {
+	m1, m2, _ := NewMuxPair()
+	m1.Tag = "m1"
+	m1.Debug = testing.Verbose()
+	m2.Tag = "m2"
+	m2.Debug = testing.Verbose()
+	defer m1.Close()
+	defer m2.Close()
+	echo := func(m *Mux) {
+		for c := range m.In {
+			for msg := range c.In {
+				if ok := c.Out <- msg; !ok {
+					break
+				}
+			}
+			close(c.Out, cerror(c.In))
+		}
+	}
+	go echo(m1)
+	go echo(m2)
+	nz := func(m *Mux) int {
+		m.wlk.Lock()
+		defer m.wlk.Unlock()
+		return m.nz
+	}
+	call := func(m *Mux, msg []byte) {
+		r := m.Rpc()
+		r.Out <- msg
+		close(r.Out)
+		rm, ok := (<-r.In).([]byte)
+		if !ok || !bytes.Equal(rm, msg) {
+			t.Fatalf("bad reply: %v", cerror(r.In))
+		}
+		close(r.In)
+	}
+
+	m1.Compress(100)
+	// once a call is done, both know they can decompress
+	call(m1, []byte("hi"))
+	txt := []byte(strings.Repeat("some text to be compressed\n", 300))
+	rnd := make([]byte, 8*1024)
+	for i := range rnd {
+		rnd[i] = byte(rand.Intn(256))
+	}
+	call(m1, txt)
+	if n := nz(m1); n != 1 {
+		t.Fatalf("m1 compressed %d msgs", n)
+	}
+	if n := nz(m2); n != 0 {
+		t.Fatalf("m2 compressed %d msgs", n)
+	}
+	call(m1, txt[:50])
+	call(m1, rnd)
+	if n := nz(m1); n != 1 {
+		t.Fatalf("m1 compressed %d msgs", n)
+	}
+	m2.Compress(100)
+	call(m1, txt)
+	if n := nz(m2); n != 1 {
+		t.Fatalf("m2 compressed %d msgs", n)
+	}
+	m1.Compress(0)
+	call(m1, txt)
+	if n := nz(m1); n != 2 {
+		t.Fatalf("m1 compressed %d msgs", n)
+	}
+}
+
+func TestMuxKeepAlive(t *testing.T) {
+	m1, m2, _ := NewMuxPair()
+	m1.Tag = "m1"
+	m1.Debug = testing.Verbose()
+	m2.Tag = "m2"
+	m2.Debug = testing.Verbose()
+	defer m1.Close()
+	defer m2.Close()
+	m1.KeepAlive(20*time.Millisecond, 100*time.Millisecond)
+	time.Sleep(300 * time.Millisecond)
+	select {
+	case <-m1.Hup:
+		t.Fatalf("hup: %v", cerror(m1.Hup))
+	default:
+	}
+	m1.klk.Lock()
+	n := m1.npongs
+	m1.klk.Unlock()
+	if n == 0 {
+		t.Fatalf("no pongs")
+	}
+	t.Logf("%d pongs", n)
+
+	// a silent peer
+	fd := &muxpipe{}
+	var pr io.ReadCloser
+	var pw io.WriteCloser
+	var err error
+	fd.r, pw, err = os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pw.Close()
+	pr, fd.w, err = os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go io.Copy(ioutil.Discard, pr)
+	m3 := NewMux(fd, true)
+	m3.Tag = "m3"
+	m3.Debug = testing.Verbose()
+	defer m3.Close()
+	m3.KeepAlive(20*time.Millisecond, 100*time.Millisecond)
+	select {
+	case <-m3.Hup:
+		err := cerror(m3.Hup)
+		t.Logf("hup: %v", err)
+		if err == nil || !strings.Contains(err.Error(), ErrTimeout.Error()) {
+			t.Fatalf("bad hup sts %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no hup for silent peer")
+	}
+}
+
+func TestMuxCancel(t *testing.T) {
+	m1, m2, _ := NewMuxPair()
+	m1.Tag = "m1"
+	m1.Debug = testing.Verbose()
+	m2.Tag = "m2"
+	m2.Debug = testing.Verbose()
+	defer m1.Close()
+	defer m2.Close()
+	errc := make(chan error)
+	syncc := make(chan bool)
+	go func() {
+		for c := range m2.In {
+			<-c.In
+			for i := 0; ; i++ {
+				if i == 10 {
+					<-syncc
+				}
+				if ok := c.Out <- i; !ok {
+					errc <- cerror(c.Out)
+					break
+				}
+			}
+		}
+	}()
+	for i := 0; i < 2; i++ {
+		c := m1.Rpc()
+		c.Out <- "go"
+		close(c.Out)
+		for j := 0; j < 10; j++ {
+			if _, ok := <-c.In; !ok {
+				t.Fatalf("recv: %v", cerror(c.In))
+			}
+		}
+		if i == 0 {
+			m1.Cancel(c, nil)
+		} else {
+			// the mux cancels when the next reply arrives
+			close(c.In)
+		}
+		syncc <- true
+		select {
+		case err := <-errc:
+			if err == nil || err.Error() != ErrCanceled.Error() {
+				t.Fatalf("server sts %v", err)
+			}
+			t.Logf("server sts %v", err)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("server not canceled")
+		}
+	}
+}
+
 func benchmarkRawChans(b *testing.B, msz int) {
 	b.StopTimer()
 	c := make(chan []byte)
@@ -1165,10 +1342,18 @@ func BenchmarkRCCs65536(b *testing.B) {
 }
 
 func benchmarkMuxRpc(b *testing.B, msz int) {
+	benchmarkMuxZRpc(b, msz, 0)
+}
+
+// Compress msgs of at least zsz bytes; if zsz is not 0,
+// msgs are text and not just zeros.
+func benchmarkMuxZRpc(b *testing.B, msz, zsz int) {
 	b.StopTimer()
 	m1, m2, _ := NewMuxPair()
 	m1.Tag = "m1"
 	m2.Tag = "m2"
+	m1.Compress(zsz)
+	m2.Compress(zsz)
 	failed := false
 	var wg sync.WaitGroup
 	wg.Add(4)
@@ -1191,6 +1376,12 @@ func benchmarkMuxRpc(b *testing.B, msz int) {
 		wg.Done()
 	}
 	msg := make([]byte, msz)
+	if zsz > 0 {
+		txt := "func (m *Mux) Compress(sz int) {\n\tm.wlk.Lock()\n}\n"
+		for i := range msg {
+			msg[i] = txt[i%len(txt)]
+		}
+	}
 	go msrv(m1)
 	go msrv(m2)
 	go mwait(m1)
@@ -1239,3 +1430,15 @@ func BenchmarkMuxRpc32768(b *testing.B) {
 func BenchmarkMuxRpc64k(b *testing.B) {
 	benchmarkMuxRpc(b, 64*1024)
 }
+func BenchmarkMuxZRpc1024(b *testing.B) {
+	benchmarkMuxZRpc(b, 1024, 512)
+}
+func BenchmarkMuxZRpc8192(b *testing.B) {
+	benchmarkMuxZRpc(b, 8192, 512)
+}
+func BenchmarkMuxZRpc32768(b *testing.B) {
+	benchmarkMuxZRpc(b, 32768, 512)
+}
+func BenchmarkMuxZRpc64k(b *testing.B) {
+	benchmarkMuxZRpc(b, 64*1024, 512)
+}
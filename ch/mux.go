@@ -7,6 +7,7 @@ import (
 	"io"
 	"os"
 	"sync"
+	"time"
 )
 
 const (
@@ -19,6 +20,20 @@ const (
 	flowtag
 	endtag
 	tagmask = firsttag | rpctag | flowtag | endtag
+
+	// tag 0 is never used by conns; we use it to say we
+	// can decompress messages (see Mux.Compress)
+	hellotag = flowtag
+
+	// flow and end bits set in a tag cancel the conn: the
+	// sender won't read more messages from it (see Mux.Cancel)
+	canceltag = flowtag | endtag
+
+	// tag 0 with the end bit is a keep alive ping, and
+	// with the rpc bit as well, the reply (see Mux.KeepAlive).
+	// Older peers discard them.
+	pingtag = endtag
+	pongtag = endtag | rpctag
 )
 
 struct conn {
@@ -47,15 +62,27 @@ struct Mux {
 	tags map[uint32]*conn // muxed chans
 	err  error
 	lk   sync.Mutex // for everything buf for writemsg
-	wlk  sync.Mutex // for writemsg
+	wlk  sync.Mutex // for writemsg and compression
 	dbg.Flag
+
+	zsz   int  // compress []byte msgs of at least this size, if > 0
+	zpeer bool // the peer can decompress
+	zsent bool // we told the peer we can decompress
+	nz    int  // number of msgs compressed (for testing)
+
+	klk    sync.Mutex // for the keep alive fields
+	lastrd time.Time  // when we last heard from the peer
+	kac    chan bool  // to stop the keep alive proc
+	npongs int        // number of pongs received (for testing)
 }
 
 var (
 	// Number of messages in chan buffers; can't be < 2
 	nbuf = 1024
 
-	ErrBadPeer = errors.New("both peers are caller/callee")
+	ErrBadPeer  = errors.New("both peers are caller/callee")
+	ErrCanceled = errors.New("canceled by peer")
+	ErrTimeout  = errors.New("peer timed out")
 )
 
 // Create a Mux on the given underlying device.
@@ -67,13 +94,14 @@ var (
 func NewMux(rw io.ReadWriter, iscaller bool) *Mux {
 	in := make(chan Conn, 10)
 	m := &Mux{
-		Flag: dbg.Flag{Tag: "mux"},
-		In:   in,
-		in:   in,
-		Hup:  make(chan bool),
-		rw:   rw,
-		tag:  0,
-		tags: map[uint32]*conn{},
+		Flag:   dbg.Flag{Tag: "mux"},
+		In:     in,
+		in:     in,
+		Hup:    make(chan bool),
+		rw:     rw,
+		tag:    0,
+		tags:   map[uint32]*conn{},
+		lastrd: time.Now(),
 	}
 	m.fl, _ = rw.(flusher)
 	if iscaller {
@@ -83,6 +111,124 @@ func NewMux(rw io.ReadWriter, iscaller bool) *Mux {
 	return m
 }
 
+// Compress []byte messages of at least sz bytes sent through m, or
+// stop doing so if sz is 0.
+// Messages are compressed only if the peer can decompress them:
+// the peer is told we can when this is called for the first time, and
+// it does the same if it can. Older peers just ignore it.
+func (m *Mux) Compress(sz int) {
+	m.wlk.Lock()
+	defer m.wlk.Unlock()
+	m.zsz = sz
+	if sz > 0 && !m.zsent {
+		m.hello()
+	}
+}
+
+// Tell the peer we can decompress messages.
+// m.wlk is locked.
+func (m *Mux) hello() {
+	m.zsent = true
+	_, err := WriteMsg(m.rw, hellotag, zalg)
+	if err == nil && m.fl != nil {
+		err = m.fl.Flush()
+	}
+	m.Dprintf("-> hello sts %v\n", err)
+}
+
+// The peer says it can decompress messages.
+func (m *Mux) gotHello(d face{}) {
+	m.wlk.Lock()
+	defer m.wlk.Unlock()
+	if s, ok := d.(string); !ok || s != zalg {
+		m.Dprintf("<- hello: %v: ignored\n", d)
+		return
+	}
+	m.Dprintf("<- hello\n")
+	m.zpeer = true
+	if !m.zsent {
+		m.hello()
+	}
+}
+
+// Write a message, compressing it if we should.
+// m.wlk is locked.
+func (m *Mux) writeMsg(tag uint32, d face{}) (int64, error) {
+	if b, ok := d.([]byte); ok && m.zsz > 0 && m.zpeer && len(b) >= m.zsz {
+		if zb := zip(b); zb != nil {
+			m.nz++
+			return writeBytes(m.rw, tag, Tzbytes, zb)
+		}
+	}
+	return WriteMsg(m.rw, tag, d)
+}
+
+/*
+	Send keep alive pings to the peer when it is silent for ival, and
+	close the mux (and Hup) with ErrTimeout if nothing is heard from it
+	for timeout.
+	Any message from the peer counts as a sign of life, and
+	peers reply to pings, so the mux is closed only if the peer or the
+	network are gone.
+	Older peers ignore pings and may be closed when idle for timeout.
+	Calling KeepAlive again changes the intervals, and a zero ival stops it.
+*/
+func (m *Mux) KeepAlive(ival, timeout time.Duration) {
+	m.klk.Lock()
+	defer m.klk.Unlock()
+	if m.kac != nil {
+		close(m.kac)
+		m.kac = nil
+	}
+	if ival <= 0 {
+		return
+	}
+	if timeout < ival {
+		timeout = 3 * ival
+	}
+	m.kac = make(chan bool)
+	go m.keepalive(m.kac, ival, timeout)
+}
+
+func (m *Mux) keepalive(kac chan bool, ival, timeout time.Duration) {
+	tick := time.NewTicker(ival / 2)
+	defer tick.Stop()
+	doselect {
+	case <-kac:
+		return
+	case <-m.Hup:
+		return
+	case <-tick.C:
+		m.klk.Lock()
+		idle := time.Since(m.lastrd)
+		m.klk.Unlock()
+		if idle >= timeout {
+			m.Dprintf("keep alive: idle %v\n", idle)
+			m.lk.Lock()
+			if m.err == nil {
+				m.err = fmt.Errorf("%s: %s", ErrIO, ErrTimeout)
+			}
+			m.lk.Unlock()
+			m.Close()
+			return
+		}
+		if idle >= ival {
+			m.ping(pingtag)
+		}
+	}
+}
+
+// Send a keep alive ping or pong to the peer
+func (m *Mux) ping(tag uint32) {
+	m.wlk.Lock()
+	defer m.wlk.Unlock()
+	_, err := WriteMsg(m.rw, tag, empty)
+	if err == nil && m.fl != nil {
+		err = m.fl.Flush()
+	}
+	m.Dprintf("-> %x ping sts %v\n", tag, err)
+}
+
 func (m *Mux) newConn(tag uint32, in, out chan face{}) *conn {
 	tv := tag &^ tagmask
 	mc := &conn{tag: tv, in: in, out: out, flow: make(chan bool, 3)}
@@ -138,6 +284,42 @@ func (m *Mux) Rpc() Conn {
 	return uc
 }
 
+// Tell the peer we won't read more from c (e.g., replies for an RPC)
+// and close c with the given error (ErrCanceled if nil).
+// The peer's out chan for c is closed with the error, so it can abort
+// whatever it was doing to produce the messages.
+// This is also done if c.In is closed and a message arrives for it,
+// but calling Cancel does not depend on the peer sending more.
+func (m *Mux) Cancel(c Conn, err error) {
+	if err == nil {
+		err = ErrCanceled
+	}
+	m.lk.Lock()
+	for _, mc := range m.tags {
+		if mc.in != nil && (<-chan face{})(mc.in) == c.In {
+			m.closeConn(mc, err)
+			m.lk.Unlock()
+			m.cancel(mc, err)
+			return
+		}
+	}
+	m.lk.Unlock()
+	close(c.In, err)
+	close(c.Out, err)
+}
+
+// Send a cancel for mc to the peer.
+// m.lk must not be locked, so a slow peer does not block other conns.
+func (m *Mux) cancel(mc *conn, err error) {
+	m.wlk.Lock()
+	defer m.wlk.Unlock()
+	_, e := WriteMsg(m.rw, mc.tag|canceltag, err)
+	if e == nil && m.fl != nil {
+		e = m.fl.Flush()
+	}
+	m.Dprintf("-> %x cancel %v sts %v\n", mc.tag|canceltag, err, e)
+}
+
 func (m *Mux) out(mc *conn, isreply bool) {
 	tag := mc.tag
 	c := mc.out
@@ -172,7 +354,7 @@ func (m *Mux) out(mc *conn, isreply bool) {
 			panic("mux out nbuf too large")
 		}
 		m.wlk.Lock()
-		_, err := WriteMsg(m.rw, tag, d)
+		_, err := m.writeMsg(tag, d)
 		if err == nil && m.fl != nil {
 			err = m.fl.Flush()
 			if err != nil {
@@ -258,7 +440,24 @@ func (m *Mux) demux() {
 			m.err = err
 			break
 		}
+		m.klk.Lock()
+		m.lastrd = time.Now()
+		m.klk.Unlock()
 		tv := tag &^ tagmask
+		if tv == 0 && tag&hellotag != 0 {
+			m.gotHello(d)
+			continue
+		}
+		if tv == 0 && tag&pingtag != 0 {
+			if tag == pingtag {
+				m.ping(pongtag)
+			} else {
+				m.klk.Lock()
+				m.npongs++
+				m.klk.Unlock()
+			}
+			continue
+		}
 		m.lk.Lock()
 		if mc, ok := m.tags[tv]; !ok {
 			if tag&firsttag == 0 {
@@ -297,6 +496,19 @@ func (m *Mux) demux() {
 			}
 		} else {
 			m.lk.Unlock()
+			// The peer won't read more: stop sending.
+			if tag&canceltag == canceltag {
+				err, _ := d.(error)
+				if err == nil {
+					err = ErrCanceled
+				}
+				m.Dprintf("cancel<-%x: %v\n", tag, err)
+				m.lk.Lock()
+				close(mc.out, err)
+				close(mc.flow, err)
+				m.lk.Unlock()
+				continue
+			}
 			// flow control: If this is a grant, make a ticket for out
 			if tag&flowtag != 0 {
 				m.Dprintf("flow<-%x\n", tag)
@@ -324,13 +536,18 @@ func (m *Mux) demux() {
 				// may be nil for flow cntl replies on Out requests
 				ok = mc.in <- d
 			}
-			m.lk.Lock()
 			m.Dprintf("in<-%x sent\n", tag)
 			if !ok {
 				m.Dprintf("in<-%x not ok\n", tag)
-				m.closeConn(mc, cerror(mc.in))
+				err := cerror(mc.in)
+				if err == nil {
+					err = ErrCanceled
+				}
+				m.lk.Lock()
+				m.closeConn(mc, err)
+				m.lk.Unlock()
+				m.cancel(mc, err)
 			}
-			m.lk.Unlock()
 		}
 	}
 	m.Dprintf("in done\n")
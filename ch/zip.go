@@ -0,0 +1,48 @@
+package ch
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"sync"
+)
+
+// Compression algorithm announced to peers (see Mux.Compress)
+const zalg = "flate"
+
+var zpool = sync.Pool{
+	New: func() face{} {
+		w, _ := flate.NewWriter(nil, flate.BestSpeed)
+		return w
+	},
+}
+
+// Compress b and return the compressed data, or nil if it's not worth it.
+func zip(b []byte) []byte {
+	var buf bytes.Buffer
+	w := zpool.Get().(*flate.Writer)
+	w.Reset(&buf)
+	_, err := w.Write(b)
+	if err == nil {
+		err = w.Close()
+	}
+	zpool.Put(w)
+	if err != nil || buf.Len() >= len(b) {
+		return nil
+	}
+	return buf.Bytes()
+}
+
+// Decompress a Tzbytes message.
+func unzip(b []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(b))
+	defer r.Close()
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, io.LimitReader(r, MaxMsgSz+1)); err != nil {
+		return nil, err
+	}
+	if buf.Len() > MaxMsgSz {
+		return nil, ErrTooLarge
+	}
+	return buf.Bytes(), nil
+}
@@ -1,14 +1,47 @@
 /*
-	Create authentication keys for Clive.
+	Create and manage authentication keys for Clive.
 
 	usage: auth [-f] [-d adir] name user secret [group...]
+	       auth [-d adir] -a name user secret [group...]
+	       auth [-d adir] -r name user
+	       auth [-d adir] -k name user secret
+	       auth [-d adir] -g name user [+group|-group|group...]
+	       auth [-d adir] -l name
+	       auth [-d adir] -p name user
+	       auth [-d adir] -A name user pubkey [group...]
+	       auth [-d adir] -R name user
+	       auth -c name tree path ro|rw ttl [pred]
 		-d adir: clive auth dir
 		-f: force write of key file when file already exists
+		-a: add or replace a user in the auth domain
+		-r: remove a user from the auth domain
+		-k: rotate the key for a user, keeping its groups
+		-g: set, add (+group), or remove (-group) groups for a user
+		-l: list users and groups in the auth domain
+		-p: generate a private key for public key auth
+		-A: authorize a public key for a user in the auth domain
+		-R: remove the public key authorized for a user
+		-c: mint a capability token
 
-	Creates a key file at the clive auth dir for the authdomain name
-	and user given, containing the key corresponding to the given secret.
-
+	With no flags, it creates a key file at the clive auth dir for the
+	authdomain name and user given, containing the key corresponding to
+	the given secret.
 	Under flag -f it rewrites the key file even if it exists.
+
+	Other flags update the key file for the domain, which may hold
+	keys for multiple users. The first user in the file is the one used
+	when dialing, and servers accept any user in the file.
+
+	Flag -p generates an Ed25519 private key for the user in the
+	auth domain, replacing any previous one, and prints the public key.
+	Flags -A and -R manage the public keys accepted by servers for the
+	domain. Those listed by -l are printed as "pk user groups...".
+
+	Flag -c prints a token granting access to the path in the named
+	tree (or any tree if it's "-") for ttl (eg. 2h), read-only or read-write,
+	and, if given, just to files matching the zx/pred predicate.
+	The token is signed with the keys of the local user at the default
+	clive auth dir, and may be used to dial servers as that user.
 */
 package main
 
@@ -16,45 +49,221 @@ import (
 	"clive/cmd"
 	"clive/cmd/opt"
 	"clive/net/auth"
+	"encoding/hex"
+	"fmt"
 	"os"
+	"strings"
+	"time"
 )
 
 var (
-	dir   string
-	force bool
-	opts  = opt.New("name user secret [group...]")
+	dir                              string
+	force, add, rm, rot, grps, lflag bool
+	gen, authz, unauthz, mint        bool
+	opts                             = opt.New("name [user [secret] [group...]]")
 )
 
+func load(name string) []auth.Key {
+	ks, err := auth.LoadKey(dir, name)
+	if err != nil {
+		cmd.Fatal("can't load key: %s", err)
+	}
+	return ks
+}
+
+func lookup(name, user string) auth.Key {
+	for _, k := range load(name) {
+		if k.Uid == user {
+			return k
+		}
+	}
+	cmd.Fatal("%s: %s", user, auth.ErrNoUser)
+	return auth.Key{}
+}
+
+// Apply +g, -g, and g group changes to the groups in gs.
+func chgroups(gs []string, args ...string) ([]string, error) {
+	for _, a := range args {
+		if strings.TrimLeft(a, "+-") == "" {
+			return nil, fmt.Errorf("bad group name '%s'", a)
+		}
+	}
+	set := map[string]bool{}
+	for _, g := range gs {
+		set[g] = true
+	}
+	if len(args) > 0 && args[0][0] != '+' && args[0][0] != '-' {
+		set = map[string]bool{}
+	}
+	for _, a := range args {
+		switch a[0] {
+		case '+':
+			set[a[1:]] = true
+		case '-':
+			delete(set, a[1:])
+		default:
+			set[a] = true
+		}
+	}
+	ngs := []string{}
+	for _, g := range gs {
+		if set[g] {
+			ngs = append(ngs, g)
+			delete(set, g)
+		}
+	}
+	for _, a := range args {
+		g := strings.TrimLeft(a, "+")
+		if set[g] {
+			ngs = append(ngs, g)
+			delete(set, g)
+		}
+	}
+	return ngs, nil
+}
+
 func main() {
 	cmd.UnixIO()
 	dfltdir := auth.KeyDir()
 	dir = dfltdir
 	opts.NewFlag("d", "adir: clive auth dir", &dir)
 	opts.NewFlag("f", "force write of key file when file already exists", &force)
+	opts.NewFlag("a", "add or replace a user in the auth domain", &add)
+	opts.NewFlag("r", "remove a user from the auth domain", &rm)
+	opts.NewFlag("k", "rotate the key for a user, keeping its groups", &rot)
+	opts.NewFlag("g", "set, add (+group), or remove (-group) groups for a user", &grps)
+	opts.NewFlag("l", "list users and groups in the auth domain", &lflag)
+	opts.NewFlag("p", "generate a private key for public key auth", &gen)
+	opts.NewFlag("A", "authorize a public key for a user in the auth domain", &authz)
+	opts.NewFlag("R", "remove the public key authorized for a user", &unauthz)
+	opts.NewFlag("c", "mint a capability token", &mint)
 	args := opts.Parse()
-	if len(args) < 3 {
+	nflags := 0
+	for _, f := range []bool{add, rm, rot, grps, lflag, gen, authz, unauthz, mint} {
+		if f {
+			nflags++
+		}
+	}
+	if nflags > 1 || (nflags > 0 && force) || len(args) < 1 {
 		opts.Usage()
 	}
-	name, user, secret := args[0], args[1], args[2]
-	groups := args[3:]
+	name := args[0]
 	file := auth.KeyFile(dir, name)
-	fi, _ := os.Stat(file)
-	if fi != nil && !force {
-		cmd.Fatal("key file already exists")
+	var err error
+	switch {
+	case lflag:
+		if len(args) != 1 {
+			opts.Usage()
+		}
+		ks, err := auth.LoadKey(dir, name)
+		pks, perr := auth.LoadAuthKeys(dir, name)
+		if err != nil && perr != nil {
+			cmd.Fatal("can't load key: %s", err)
+		}
+		for _, k := range ks {
+			cmd.Printf("%s %s\n", k.Uid, strings.Join(k.Gids, " "))
+		}
+		for _, k := range pks {
+			cmd.Printf("pk %s %s\n", k.Uid, strings.Join(k.Gids, " "))
+		}
+		return
+	case mint:
+		if len(args) < 5 || len(args) > 6 || dir != dfltdir {
+			opts.Usage()
+		}
+		ttl, err := time.ParseDuration(args[4])
+		if err != nil || (args[3] != "ro" && args[3] != "rw") {
+			opts.Usage()
+		}
+		c := &auth.Cap{
+			Tree:    args[1],
+			Path:    args[2],
+			RW:      args[3] == "rw",
+			Expires: time.Now().Add(ttl),
+		}
+		if c.Tree == "-" {
+			c.Tree = ""
+		}
+		if len(args) == 6 {
+			c.Pred = args[5]
+		}
+		var ai *auth.Info
+		tok, err := ai.Mint(name, c)
+		if err != nil {
+			cmd.Fatal("%s", err)
+		}
+		cmd.Printf("%s\n", tok)
+		return
+	case gen:
+		if len(args) != 2 {
+			opts.Usage()
+		}
+		pub, err := auth.GenKey(dir, name, args[1])
+		if err != nil {
+			cmd.Fatal("%s: %s", auth.PrivKeyFile(dir, name), err)
+		}
+		cmd.Printf("%x\n", pub)
+		return
+	case authz:
+		if len(args) < 3 {
+			opts.Usage()
+		}
+		file = auth.AuthKeysFile(dir, name)
+		pub, err := hex.DecodeString(args[2])
+		if err != nil {
+			cmd.Fatal("bad public key: %s", err)
+		}
+		if err := auth.AuthorizeKey(dir, name, args[1], pub, args[3:]...); err != nil {
+			cmd.Fatal("%s: %s", file, err)
+		}
+		cmd.Warn("%s", file)
+		return
+	case unauthz:
+		if len(args) != 2 {
+			opts.Usage()
+		}
+		file = auth.AuthKeysFile(dir, name)
+		if err := auth.UnauthorizeKey(dir, name, args[1]); err != nil {
+			cmd.Fatal("%s: %s", file, err)
+		}
+		cmd.Warn("%s", file)
+		return
+	case rm:
+		if len(args) != 2 {
+			opts.Usage()
+		}
+		err = auth.DelKey(dir, name, args[1])
+	case rot:
+		if len(args) != 3 {
+			opts.Usage()
+		}
+		k := lookup(name, args[1])
+		err = auth.SaveKey(dir, name, k.Uid, args[2], k.Gids...)
+	case grps:
+		if len(args) < 3 {
+			opts.Usage()
+		}
+		k := lookup(name, args[1])
+		gs, gerr := chgroups(k.Gids, args[2:]...)
+		if gerr != nil {
+			cmd.Fatal(gerr)
+		}
+		err = auth.SetGroups(dir, name, k.Uid, gs...)
+	default:
+		if len(args) < 3 {
+			opts.Usage()
+		}
+		fi, _ := os.Stat(file)
+		if fi != nil && !force && !add {
+			cmd.Fatal("key file already exists")
+		}
+		err = auth.SaveKey(dir, name, args[1], args[2], args[3:]...)
 	}
-	err := auth.SaveKey(dir, name, user, secret, groups...)
 	if err != nil {
 		cmd.Fatal("%s: %s", file, err)
 	}
-	ks, err := auth.LoadKey(dir, name)
-	if err != nil {
-		cmd.Fatal("can't load key: %s", err)
-	}
-	for _, k := range ks {
-		if k.Uid == user {
-			cmd.Warn("%s", file)
-			return
-		}
+	if !rm {
+		lookup(name, args[1])
 	}
-	cmd.Fatal("bad user")
+	cmd.Warn("%s", file)
 }
@@ -31,10 +31,13 @@
 	the same way a roff pipeline works.
 
 	The name space is constructed by the first method that works:
-		1. Using $NS as the description (see ns.Parse).
+		1. Using $NS as the description (see ns.Parse), or
+		importing the one served at addr if $NS is ns!addr (see ns/rns).
 		2. Using the contents of $HOME/NS as the description.
 		3. Using "/"
 	Methods 2 and 3 set $NS to the resulting name space.
+	Mount and Unmount update $NS as well, and the name space and
+	environment may be saved and loaded later (see SaveSession).
 */
 package cmd
 
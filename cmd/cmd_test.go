@@ -1,7 +1,9 @@
 package cmd
 
 import (
+	"clive/ns"
 	"clive/u"
+	"clive/zx"
 	"os"
 	"testing"
 )
@@ -34,3 +36,33 @@ func TestCmd(t *testing.T) {
 	Warn("ho")
 	close(out)
 }
+
+func TestSession(t *testing.T) {
+	UnixIO()
+	file := "/tmp/cmd_session_test"
+	os.Remove(file)
+	defer os.Remove(file)
+	SetEnv("foo", "bar\tbaz\n")
+	old := NS().String()
+	if err := SaveSession(file); err != nil {
+		t.Fatal(err)
+	}
+	SetEnv("foo", "other")
+	d := zx.Dir{"path": "/tmp/x", "addr": "lfs!/tmp!/"}
+	if err := Mount(d, ns.Repl); err != nil {
+		t.Fatal(err)
+	}
+	if NS().String() == old || GetEnv("NS") != NS().String() {
+		t.Fatalf("mount didn't update $NS")
+	}
+	if err := LoadSession(file); err != nil {
+		t.Fatal(err)
+	}
+	if GetEnv("foo") != "bar\tbaz\n" {
+		t.Fatalf("bad env after load")
+	}
+	t.Logf("ns is %s", NS())
+	if NS().String() != old {
+		t.Fatalf("bad ns after load")
+	}
+}
@@ -60,7 +60,7 @@ func find(dpref, rel string, dc chan<- zx.Dir, ufile zx.Dir) {
 			cmd.Warn("%s: %s", ypath, err)
 			continue
 		}
-		lastsz, lastmt, lastm := "", "", ""
+		lastsz, lastmt, lastm, lastsum := "", "", "", ""
 		for j := len(days) - 1; j >= 0; j-- {
 			day := days[j]["name"]
 			if ignored(year, day) {
@@ -75,11 +75,15 @@ func find(dpref, rel string, dc chan<- zx.Dir, ufile zx.Dir) {
 				}
 				continue
 			}
-			newm, newsz, newmt := d["mode"], d["size"], d["mtime"]
+			newm, newsz, newmt, newsum := d["mode"], d["size"], d["mtime"], d["sum"]
 			if newsz == lastsz && newmt == lastmt && newm == lastm {
 				continue
 			}
-			lastm, lastsz, lastmt = newm, newsz, newmt
+			// same contents, just touched
+			if newsum != "" && newsum == lastsum && newm == lastm {
+				continue
+			}
+			lastm, lastsz, lastmt, lastsum = newm, newsz, newmt, newsum
 			d["upath"] = ufile["path"]
 			d["uupath"] = ufile["upath"]
 			if ok := dc <- d; !ok {
@@ -2,12 +2,15 @@ package cmd
 
 import (
 	"clive/dbg"
+	"clive/net/auth"
 	"clive/ns"
+	"clive/ns/rns"
 	"clive/u"
 	"clive/zx"
 	"fmt"
 	"os"
 	fpath "path"
+	"strings"
 	"sync"
 )
 
@@ -65,8 +68,28 @@ func (c *cwd) dup() *cwd {
 	return nc
 }
 
+// Import the name space served at addr (see ns/rns).
+func importNS(addr string) (string, error) {
+	x, err := rns.Dial(addr, auth.TLSclient)
+	if err != nil {
+		return "", err
+	}
+	defer x.Close()
+	return x.Text()
+}
+
+// The name space is taken from $NS, which may be a file, the ns text,
+// or ns!addr to import the name space served at addr.
 func mkNS() *ns.NS {
 	s := GetEnv("NS")
+	if strings.HasPrefix(s, "ns!") {
+		txt, err := importNS(s[3:])
+		if err != nil {
+			dbg.Warn("mkNS: %s: %s", s, err)
+			txt = "/"
+		}
+		s = txt
+	}
 	if s == "" {
 		nsf := fpath.Join(u.Home, "lib", "NS")
 		if fi, err := os.Stat(nsf); err == nil && !fi.IsDir() {
@@ -2,7 +2,9 @@ package main
 
 import (
 	"clive/cmd"
+	"clive/ns"
 	"clive/u"
+	"clive/zx"
 	"errors"
 	"fmt"
 	"sort"
@@ -42,6 +44,89 @@ func init() {
 	builtins["exit"] = bexit
 	builtins["break"] = bbreak
 	builtins["shift"] = bshift
+	builtins["mount"] = bmount
+	builtins["unmount"] = bunmount
+	builtins["ns"] = bns
+}
+
+// mount [-b|-a] [-c] path addr
+func bmount(x *xEnv, args ...string) error {
+	flag := ns.Repl
+	args = args[1:]
+	for len(args) > 0 && len(args[0]) > 1 && args[0][0] == '-' {
+		for _, r := range args[0][1:] {
+			switch r {
+			case 'b':
+				flag = (flag & ns.Create) | ns.Before
+			case 'a':
+				flag = (flag & ns.Create) | ns.After
+			case 'c':
+				flag |= ns.Create
+			default:
+				args = nil
+			}
+		}
+		if args != nil {
+			args = args[1:]
+		}
+	}
+	if len(args) != 2 {
+		x.Eprintf("usage: mount [-b|-a] [-c] path addr\n")
+		cmd.SetEnv("sts", "usage")
+		return nil
+	}
+	d, err := ns.ParseEntry(cmd.AbsPath(args[0]) + "\t" + args[1])
+	if err == nil {
+		err = cmd.Mount(d, flag)
+	}
+	if err != nil {
+		x.Eprintf("mount: %s\n", err)
+		cmd.SetEnv("sts", err.Error())
+	} else {
+		cmd.SetEnv("sts", "")
+	}
+	return nil
+}
+
+// unmount path [addr]
+func bunmount(x *xEnv, args ...string) error {
+	if len(args) < 2 || len(args) > 3 {
+		x.Eprintf("usage: unmount path [addr]\n")
+		cmd.SetEnv("sts", "usage")
+		return nil
+	}
+	name := cmd.AbsPath(args[1])
+	var d zx.Dir
+	var err error
+	if len(args) == 3 {
+		d, err = ns.ParseEntry(name + "\t" + args[2])
+		if err == nil {
+			d = zx.Dir{"addr": d["addr"]}
+		}
+	}
+	if err == nil {
+		err = cmd.Unmount(name, d)
+	}
+	if err != nil {
+		x.Eprintf("unmount: %s\n", err)
+		cmd.SetEnv("sts", err.Error())
+	} else {
+		cmd.SetEnv("sts", "")
+	}
+	return nil
+}
+
+// ns: list the mounts in the name space
+func bns(x *xEnv, args ...string) error {
+	if len(args) > 1 {
+		err := errors.New("too many arguments")
+		x.Eprintf("ns: %s\n", err)
+		cmd.SetEnv("sts", err.Error())
+		return nil
+	}
+	x.Printf("%s", cmd.NS())
+	cmd.SetEnv("sts", "")
+	return nil
 }
 
 func bshift(x *xEnv, args ...string) error {
@@ -0,0 +1,163 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"clive/ns"
+	"clive/zx"
+	"fmt"
+	fpath "path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+	Sessions.
+
+	The name space and environment of a context can be saved to a
+	file and loaded later on, to restore a session or to load a profile.
+	The file is kept in the name space of the context and has one line
+	per name space entry, as printed by ns.NS.String, and one line per
+	environment variable:
+		ns	entry
+		env	name	"value"
+	Lines starting with # and empty lines are ignored.
+	Either set of lines may be missing, eg., in profiles.
+*/
+
+// Update $NS to reflect the name space, so commands started
+// from the context get the same one.
+func (c *Ctx) syncNS() {
+	c.lk.Lock()
+	n, e := c.ns, c.env
+	c.lk.Unlock()
+	e.set("NS", n.String())
+}
+
+func (c *Ctx) absPath(p string) string {
+	p = fpath.Clean(p)
+	if len(p) == 0 || p[0] != '/' {
+		p = fpath.Join(c.Dot(), p)
+	}
+	return p
+}
+
+// Save the name space and environment for the context at the given file.
+func (c *Ctx) SaveSession(file string) error {
+	c.lk.Lock()
+	n, e := c.ns, c.env
+	c.lk.Unlock()
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "# clive session\n")
+	for _, ln := range strings.Split(n.String(), "\n") {
+		if ln != "" {
+			fmt.Fprintf(&b, "ns\t%s\n", ln)
+		}
+	}
+	e.Lock()
+	names := make([]string, 0, len(e.vars))
+	for k := range e.vars {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		fmt.Fprintf(&b, "env\t%s\t%s\n", k, strconv.Quote(e.vars[k]))
+	}
+	e.Unlock()
+	return zx.PutAll(n, c.absPath(file), b.Bytes(), "0600")
+}
+
+// Save the name space and environment for the current context at the given file.
+func SaveSession(file string) error {
+	return ctx().SaveSession(file)
+}
+
+// Load the name space and environment for the context from the given file.
+// The name space is replaced if the file has one, and variables
+// defined in the file are set, leaving others untouched.
+// $NS is updated to reflect the name space.
+func (c *Ctx) LoadSession(file string) error {
+	file = c.absPath(file)
+	dat, err := zx.GetAll(c.NS(), file)
+	if err != nil {
+		return err
+	}
+	var nsb bytes.Buffer
+	vars := map[string]string{}
+	scn := bufio.NewScanner(bytes.NewReader(dat))
+	for nln := 1; scn.Scan(); nln++ {
+		ln := strings.TrimSpace(scn.Text())
+		if ln == "" || ln[0] == '#' {
+			continue
+		}
+		toks := strings.SplitN(ln, "\t", 3)
+		switch {
+		case toks[0] == "ns" && len(toks) >= 2:
+			fmt.Fprintf(&nsb, "%s\n", strings.Join(toks[1:], "\t"))
+		case toks[0] == "env" && len(toks) == 3 && toks[1] != "":
+			v, err := strconv.Unquote(toks[2])
+			if err != nil {
+				return fmt.Errorf("%s:%d: %s", file, nln, err)
+			}
+			vars[toks[1]] = v
+		default:
+			return fmt.Errorf("%s:%d: bad session line", file, nln)
+		}
+	}
+	if err := scn.Err(); err != nil {
+		return err
+	}
+	var n *ns.NS
+	if nsb.Len() > 0 {
+		if n, err = ns.Parse(nsb.String()); err != nil {
+			return fmt.Errorf("%s: %s", file, err)
+		}
+	}
+	c.lk.Lock()
+	e := c.env
+	if n != nil {
+		c.ns = n
+	}
+	c.lk.Unlock()
+	for k, v := range vars {
+		e.set(k, v)
+	}
+	c.syncNS()
+	return nil
+}
+
+// Load the name space and environment for the current context from the given file.
+func LoadSession(file string) error {
+	return ctx().LoadSession(file)
+}
+
+// Mount d at the name space for the context and update $NS.
+func (c *Ctx) Mount(d zx.Dir, flag ns.Flag) error {
+	if err := c.NS().Mount(d, flag); err != nil {
+		return err
+	}
+	c.syncNS()
+	return nil
+}
+
+// Mount d at the name space for the current context and update $NS.
+func Mount(d zx.Dir, flag ns.Flag) error {
+	return ctx().Mount(d, flag)
+}
+
+// Unmount name (or just entries matching d, if not nil) from the name
+// space for the context and update $NS.
+func (c *Ctx) Unmount(name string, d zx.Dir) error {
+	if err := c.NS().Unmount(name, d); err != nil {
+		return err
+	}
+	c.syncNS()
+	return nil
+}
+
+// Unmount name (or just entries matching d, if not nil) from the name
+// space for the current context and update $NS.
+func Unmount(name string, d zx.Dir) error {
+	return ctx().Unmount(name, d)
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"clive/net/auth"
+	"clive/zx"
+	"fmt"
+	"html"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	fpath "path"
+	"strings"
+	"sync"
+)
+
+// HTTP/WebDAV gateway to a zx tree.
+// Requests use the tree as authenticated for the user, when it can be.
+// Updates are made only if rw is set, over TLS, by users the tree
+// has been authenticated for.
+struct gw {
+	fs zx.Fs
+	rw bool
+
+	sync.Mutex
+	fss map[string]zx.Fs // the tree for each user
+}
+
+const davProps = `<D:displayname>%s</D:displayname>
+<D:resourcetype>%s</D:resourcetype>
+<D:getcontentlength>%d</D:getcontentlength>
+<D:getlastmodified>%s</D:getlastmodified>
+`
+
+// Report err as an HTTP error
+func httpError(w http.ResponseWriter, err error) {
+	code := http.StatusInternalServerError
+	switch {
+	case zx.IsNotExist(err):
+		code = http.StatusNotFound
+	case zx.IsPerm(err):
+		code = http.StatusForbidden
+	case zx.IsExists(err) || zx.IsNotEmpty(err):
+		code = http.StatusConflict
+	}
+	dprintf("error %d: %s\n", code, err)
+	http.Error(w, err.Error(), code)
+}
+
+func notAllowed(w http.ResponseWriter, what string) {
+	http.Error(w, what+" not supported by the tree", http.StatusMethodNotAllowed)
+}
+
+func forbidden(w http.ResponseWriter, what string) {
+	dprintf("forbidden: %s\n", what)
+	http.Error(w, what, http.StatusForbidden)
+}
+
+func (g *gw) ro(fs zx.Fs) zx.Fs {
+	if g.rw {
+		return fs
+	}
+	return zx.MakeRO(fs)
+}
+
+func updates(method string) bool {
+	switch method {
+	case "PUT", "DELETE", "MKCOL", "MOVE":
+		return true
+	}
+	return false
+}
+
+// Return the tree for the user (nil if auth is disabled), and
+// whether it is authenticated for the user.
+// The tree is read-only unless rw is set.
+func (g *gw) tree(ai *auth.Info) (zx.Fs, bool, error) {
+	afs, ok := g.fs.(zx.Auther)
+	if ai == nil || !ok {
+		return g.ro(g.fs), false, nil
+	}
+	g.Lock()
+	defer g.Unlock()
+	if fs := g.fss[ai.Uid]; fs != nil {
+		return fs, true, nil
+	}
+	fs, err := afs.Auth(ai)
+	if err != nil {
+		return nil, false, err
+	}
+	fs = g.ro(fs)
+	if g.fss == nil {
+		g.fss = map[string]zx.Fs{}
+	}
+	g.fss[ai.Uid] = fs
+	return fs, true, nil
+}
+
+// Serve the request for the user authenticated by ai,
+// or nil if auth is disabled.
+func (g *gw) serve(w http.ResponseWriter, r *http.Request, ai *auth.Info) {
+	p := fpath.Clean("/" + r.URL.Path)
+	dprintf("%s %s\n", r.Method, p)
+	fs, authed, err := g.tree(ai)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	if updates(r.Method) {
+		switch {
+		case !g.rw:
+			forbidden(w, "read-only tree")
+			return
+		case r.TLS == nil || !authed:
+			forbidden(w, "updates require TLS and auth")
+			return
+		case r.Method == "DELETE" && p == "/":
+			forbidden(w, "won't remove /")
+			return
+		}
+	}
+	switch r.Method {
+	case "GET", "HEAD":
+		g.get(w, r, fs, p)
+	case "PUT":
+		g.put(w, r, fs, p)
+	case "DELETE":
+		g.remove(w, r, fs, p)
+	case "MKCOL":
+		g.mkcol(w, r, fs, p)
+	case "MOVE":
+		g.move(w, r, fs, p)
+	case "PROPFIND":
+		g.propfind(w, r, fs, p)
+	case "OPTIONS":
+		w.Header().Set("DAV", "1")
+		if g.rw {
+			w.Header().Set("Allow", "OPTIONS, GET, HEAD, PUT, DELETE, MKCOL, MOVE, PROPFIND")
+		} else {
+			w.Header().Set("Allow", "OPTIONS, GET, HEAD, PROPFIND")
+		}
+	default:
+		http.Error(w, "unknown method", http.StatusMethodNotAllowed)
+	}
+}
+
+func (g *gw) get(w http.ResponseWriter, r *http.Request, fs zx.Fs, p string) {
+	d, err := zx.Stat(fs, p)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	gfs, ok := fs.(zx.Getter)
+	if !ok {
+		notAllowed(w, "get")
+		return
+	}
+	if d["type"] == "d" {
+		if !strings.HasSuffix(r.URL.Path, "/") {
+			http.Redirect(w, r, fpath.Base(p)+"/", http.StatusMovedPermanently)
+			return
+		}
+		g.getdir(w, r, gfs, p)
+		return
+	}
+	h := w.Header()
+	ct := mime.TypeByExtension(fpath.Ext(p))
+	if ct == "" {
+		ct = "application/octet-stream"
+	}
+	h.Set("Content-Type", ct)
+	h.Set("Content-Length", d["size"])
+	h.Set("Last-Modified", d.Time("mtime").UTC().Format(http.TimeFormat))
+	if r.Method == "HEAD" {
+		return
+	}
+	dc := gfs.Get(p, 0, zx.All)
+	for b := range dc {
+		if _, err := w.Write(b); err != nil {
+			close(dc, err)
+			return
+		}
+	}
+	if err := cerror(dc); err != nil {
+		dprintf("get %s: %s\n", p, err)
+	}
+}
+
+func (g *gw) getdir(w http.ResponseWriter, r *http.Request, gfs zx.Getter, p string) {
+	ds, err := zx.GetDir(gfs, p)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if r.Method == "HEAD" {
+		return
+	}
+	t := html.EscapeString(p)
+	fmt.Fprintf(w, "<html><head><title>%s</title></head><body>\n<h3>%s</h3>\n<pre>\n", t, t)
+	if p != "/" {
+		fmt.Fprintf(w, "<a href=\"../\">../</a>\n")
+	}
+	for _, d := range ds {
+		nm := d["name"]
+		if d["type"] == "d" {
+			nm += "/"
+		}
+		u := &url.URL{Path: nm}
+		fmt.Fprintf(w, "%s %10d %s <a href=\"%s\">%s</a>\n", d["type"], d.Size(),
+			d.Time("mtime").Format("2006 Jan 02 15:04"), u.String(), html.EscapeString(nm))
+	}
+	fmt.Fprintf(w, "</pre>\n</body></html>\n")
+}
+
+func (g *gw) put(w http.ResponseWriter, r *http.Request, fs zx.Fs, p string) {
+	pfs, ok := fs.(zx.Putter)
+	if !ok {
+		notAllowed(w, "put")
+		return
+	}
+	_, err := zx.Stat(fs, p)
+	created := err != nil
+	dc := make(chan []byte)
+	rc := pfs.Put(p, zx.Dir{"type": "-", "size": "0"}, 0, dc)
+	var rerr error
+	for rerr == nil {
+		buf := make([]byte, 16*1024)
+		n, err := r.Body.Read(buf)
+		if n > 0 {
+			if ok := dc <- buf[:n]; !ok {
+				break
+			}
+		}
+		if err != io.EOF {
+			rerr = err
+		} else {
+			break
+		}
+	}
+	close(dc, rerr)
+	<-rc
+	if err := cerror(rc); err != nil {
+		httpError(w, err)
+		return
+	}
+	if created {
+		w.WriteHeader(http.StatusCreated)
+	} else {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (g *gw) remove(w http.ResponseWriter, r *http.Request, fs zx.Fs, p string) {
+	rfs, ok := fs.(zx.Remover)
+	if !ok {
+		notAllowed(w, "remove")
+		return
+	}
+	if _, err := zx.Stat(fs, p); err != nil {
+		httpError(w, err)
+		return
+	}
+	// WebDAV removes collections with all their contents.
+	if err := <-rfs.RemoveAll(p); err != nil {
+		httpError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (g *gw) mkcol(w http.ResponseWriter, r *http.Request, fs zx.Fs, p string) {
+	pfs, ok := fs.(zx.Putter)
+	if !ok {
+		notAllowed(w, "mkdir")
+		return
+	}
+	if _, err := zx.Stat(fs, p); err == nil {
+		http.Error(w, p+": "+zx.ErrExists.Error(), http.StatusMethodNotAllowed)
+		return
+	}
+	if _, err := zx.Stat(fs, fpath.Dir(p)); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	rc := pfs.Put(p, zx.Dir{"type": "d", "mode": "0755"}, 0, nil)
+	<-rc
+	if err := cerror(rc); err != nil {
+		httpError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (g *gw) move(w http.ResponseWriter, r *http.Request, fs zx.Fs, p string) {
+	mfs, ok := fs.(zx.Mover)
+	if !ok {
+		notAllowed(w, "move")
+		return
+	}
+	du, err := url.Parse(r.Header.Get("Destination"))
+	if err != nil || du.Path == "" {
+		http.Error(w, "bad destination", http.StatusBadRequest)
+		return
+	}
+	to := fpath.Clean("/" + du.Path)
+	_, err = zx.Stat(fs, to)
+	exists := err == nil
+	if exists && r.Header.Get("Overwrite") == "F" {
+		http.Error(w, to+": "+zx.ErrExists.Error(), http.StatusPreconditionFailed)
+		return
+	}
+	if err := <-mfs.Move(p, to); err != nil {
+		httpError(w, err)
+		return
+	}
+	if exists {
+		w.WriteHeader(http.StatusNoContent)
+	} else {
+		w.WriteHeader(http.StatusCreated)
+	}
+}
+
+// Write the WebDAV response for d.
+func davResponse(w io.Writer, d zx.Dir) {
+	p := d["path"]
+	rt := ""
+	if d["type"] == "d" {
+		rt = "<D:collection/>"
+		if p != "/" {
+			p += "/"
+		}
+	}
+	u := &url.URL{Path: p}
+	fmt.Fprintf(w, "<D:response>\n<D:href>%s</D:href>\n<D:propstat>\n<D:prop>\n",
+		html.EscapeString(u.String()))
+	fmt.Fprintf(w, davProps, html.EscapeString(d["name"]), rt, d.Size(),
+		d.Time("mtime").UTC().Format(http.TimeFormat))
+	fmt.Fprintf(w, "</D:prop>\n<D:status>HTTP/1.1 200 OK</D:status>\n")
+	fmt.Fprintf(w, "</D:propstat>\n</D:response>\n")
+}
+
+// Properties requested are ignored and all known ones are reported.
+// Depths other than 0 are handled as 1.
+func (g *gw) propfind(w http.ResponseWriter, r *http.Request, fs zx.Fs, p string) {
+	d, err := zx.Stat(fs, p)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	ds := []zx.Dir{d}
+	if d["type"] == "d" && r.Header.Get("Depth") != "0" {
+		gfs, ok := fs.(zx.Getter)
+		if !ok {
+			notAllowed(w, "get")
+			return
+		}
+		cds, err := zx.GetDir(gfs, p)
+		if err != nil {
+			httpError(w, err)
+			return
+		}
+		ds = append(ds, cds...)
+	}
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(207)
+	fmt.Fprintf(w, "<?xml version=\"1.0\" encoding=\"utf-8\"?>\n")
+	fmt.Fprintf(w, "<D:multistatus xmlns:D=\"DAV:\">\n")
+	for _, d := range ds {
+		davResponse(w, d)
+	}
+	fmt.Fprintf(w, "</D:multistatus>\n")
+}
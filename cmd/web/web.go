@@ -1,27 +1,68 @@
 /*
-	Simple static web server for UNIX files.
+	Web server for zx trees.
+
+	Serves a UNIX directory, a zx tree, or the user's name space through
+	HTTP and WebDAV, so it can be reached from WebDAV clients and from curl.
+	GET retrieves files and directory listings, and PROPFIND inspects the tree.
+
+	The tree is read-only unless -w is given. Even then, PUT, DELETE, MKCOL,
+	and MOVE are accepted only over TLS, with auth enabled, and for trees
+	that can be authenticated for the user (UNIX dirs), which are served
+	as the authenticated user and not as the user running the server.
+	Removing / is never allowed.
 */
 package main
 
 import (
 	"clive/cmd"
 	"clive/cmd/opt"
+	"clive/net/auth"
+	"clive/net/ink"
+	"clive/ns"
+	"clive/zx"
+	"clive/zx/zux"
 	"net/http"
+	"path/filepath"
+	"strings"
 )
 
 var (
-	dir   = "/zx/usr/web"
-	port  = "8080"
-	tport = "8083"
-	opts  = opt.New("[dir]")
+	dir     = "/zx/usr/web"
+	port    = "8080"
+	tport   = "8083"
+	opts    = opt.New("[tree]")
+	dprintf = cmd.Dprintf
 )
 
+// Return the tree for the dir or the ns address given.
+func tree(t string) (zx.Fs, error) {
+	if !strings.ContainsRune(t, '!') {
+		t, _ = filepath.Abs(t)
+		fs, err := zux.NewZX(t)
+		if err != nil {
+			return nil, err
+		}
+		fs.CheckZXPerms()
+		return fs, nil
+	}
+	n, err := ns.Parse("/ " + t)
+	if err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
 func main() {
 	cmd.UnixIO()
-	local := false
+	opts.AddUsage("\ttree is a dir or a ns address (eg. zx!host!zx!main or 9p!host)\n")
+	local, usens, rw := false, false, false
 	opts.NewFlag("p", "port: port used (8080 by default)", &port)
 	opts.NewFlag("t", "port: TLS port (8083 by default)", &tport)
 	opts.NewFlag("l", "localhost and TLS only", &local)
+	opts.NewFlag("n", "serve the user's name space", &usens)
+	opts.NewFlag("w", "allow updates over TLS by authenticated users", &rw)
+	c := cmd.AppCtx()
+	opts.NewFlag("D", "debug", &c.Debug)
 	args := opts.Parse()
 	switch len(args) {
 	case 0:
@@ -29,16 +70,46 @@ func main() {
 			dir = "/zx"
 		}
 	case 1:
+		if usens {
+			cmd.Warn("can't use -n with a tree")
+			opts.Usage()
+		}
 		dir = args[0]
 	default:
 		cmd.Warn("too many arguments")
 		opts.Usage()
 	}
+	var fs zx.Fs
+	if usens {
+		fs = cmd.NS()
+	} else {
+		t, err := tree(dir)
+		if err != nil {
+			cmd.Fatal("%s: %s", dir, err)
+		}
+		fs = t
+	}
+	if auth.TLSserver != nil && auth.Enabled {
+		// for the login page
+		ink.ServeJS()
+	}
+	g := &gw{fs: fs, rw: rw}
+	http.HandleFunc("/", ink.AuthUidHandler(func(w http.ResponseWriter, r *http.Request, uid string) {
+		var ai *auth.Info
+		if uid != "" {
+			var err error
+			if ai, err = auth.UserInfo("wax", uid); err != nil {
+				httpError(w, err)
+				return
+			}
+		}
+		g.serve(w, r, ai)
+	}))
 	cert := "/zx/lib/webcert.pem"
 	key := "/zx/lib/webcert.key"
 	addr := ":"
 	go func() {
-		err := http.ListenAndServeTLS(addr+tport, cert, key, http.FileServer(http.Dir(dir)))
+		err := http.ListenAndServeTLS(addr+tport, cert, key, nil)
 		if err != nil {
 			cmd.Fatal(err)
 		}
@@ -47,11 +118,11 @@ func main() {
 		if local {
 			return
 		}
-		err := http.ListenAndServe(addr+port, http.FileServer(http.Dir(dir)))
+		err := http.ListenAndServe(addr+port, nil)
 		if err != nil {
 			cmd.Fatal(err)
 		}
 	}()
-	c := make(chan bool)
-	<-c
+	endc := make(chan bool)
+	<-endc
 }
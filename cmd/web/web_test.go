@@ -0,0 +1,137 @@
+package main
+
+import (
+	"clive/net/auth"
+	"clive/zx"
+	"clive/zx/fstest"
+	"clive/zx/zux"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/user"
+	"strings"
+	"testing"
+)
+
+const tdir = "/tmp/webtest"
+
+struct req {
+	method, path, body string
+	hdr                map[string]string
+	code               int
+	out                string // expected to be in the reply body
+}
+
+var reqs = [...]req{
+	{method: "GET", path: "/a/a1", code: 200},
+	{method: "GET", path: "/a/", code: 200, out: `<a href="a2">a2</a>`},
+	{method: "GET", path: "/a", code: 301},
+	{method: "GET", path: "/nothere", code: 404},
+	{method: "PUT", path: "/a/n", body: "hello there", code: 201},
+	{method: "PUT", path: "/a/n", body: "hi", code: 204},
+	{method: "GET", path: "/a/n", code: 200, out: "hi"},
+	{method: "PUT", path: "/x/y/n", body: "hi", code: 404},
+	{method: "MKCOL", path: "/a/d", code: 201},
+	{method: "MKCOL", path: "/a/d", code: 405},
+	{method: "MKCOL", path: "/x/y", code: 409},
+	{method: "MOVE", path: "/a/n", hdr: map[string]string{"Destination": "http://h/a/d/m"}, code: 201},
+	{method: "MOVE", path: "/a/a1", hdr: map[string]string{"Destination": "/a/d/m",
+		"Overwrite": "F"}, code: 412},
+	{method: "PROPFIND", path: "/a/d", hdr: map[string]string{"Depth": "1"}, code: 207,
+		out: "<D:href>/a/d/m</D:href>"},
+	{method: "PROPFIND", path: "/a/d", hdr: map[string]string{"Depth": "0"}, code: 207,
+		out: "<D:collection/>"},
+	{method: "DELETE", path: "/a/d", code: 204},
+	{method: "DELETE", path: "/a/d", code: 404},
+	{method: "DELETE", path: "/", code: 403},
+	{method: "OPTIONS", path: "/", code: 200},
+}
+
+// Requests refused by gateways that can't update the tree.
+var roreqs = [...]req{
+	{method: "GET", path: "/a/a1", code: 200},
+	{method: "PUT", path: "/a/n", body: "hi", code: 403},
+	{method: "MKCOL", path: "/a/d", code: 403},
+	{method: "MOVE", path: "/a/a1", hdr: map[string]string{"Destination": "/a/m"}, code: 403},
+	{method: "DELETE", path: "/a/a1", code: 403},
+}
+
+func runReqs(t *testing.T, srv *httptest.Server, reqs []req) {
+	cli := srv.Client()
+	cli.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	for _, rq := range reqs {
+		r, err := http.NewRequest(rq.method, srv.URL+rq.path, strings.NewReader(rq.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range rq.hdr {
+			r.Header.Set(k, v)
+		}
+		rr, err := cli.Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, _ := ioutil.ReadAll(rr.Body)
+		rr.Body.Close()
+		t.Logf("%s %s: %d", rq.method, rq.path, rr.StatusCode)
+		if rr.StatusCode != rq.code {
+			t.Fatalf("%s %s: status %d: %s", rq.method, rq.path, rr.StatusCode, out)
+		}
+		if !strings.Contains(string(out), rq.out) {
+			t.Fatalf("%s %s: bad reply: %s", rq.method, rq.path, out)
+		}
+	}
+}
+
+func gwHandler(g *gw, ai *auth.Info) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		g.serve(w, r, ai)
+	})
+}
+
+func TestGw(t *testing.T) {
+	fstest.MkTree(t, tdir)
+	defer os.RemoveAll(tdir)
+	fs, err := zux.NewZX(tdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := user.Current()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ai := &auth.Info{Uid: u.Username, SpeaksFor: u.Username, Ok: true}
+
+	t.Logf("read only")
+	srv := httptest.NewTLSServer(gwHandler(&gw{fs: fs}, ai))
+	runReqs(t, srv, roreqs[:])
+	srv.Close()
+	t.Logf("no TLS")
+	srv = httptest.NewServer(gwHandler(&gw{fs: fs, rw: true}, ai))
+	runReqs(t, srv, roreqs[:])
+	srv.Close()
+	t.Logf("no auth")
+	srv = httptest.NewTLSServer(gwHandler(&gw{fs: fs, rw: true}, nil))
+	runReqs(t, srv, roreqs[:])
+	srv.Close()
+
+	t.Logf("rw")
+	srv = httptest.NewTLSServer(gwHandler(&gw{fs: fs, rw: true}, ai))
+	defer srv.Close()
+	runReqs(t, srv, reqs[:])
+	rr, err := srv.Client().Get(srv.URL + "/a/a1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dat, err := ioutil.ReadAll(rr.Body)
+	rr.Body.Close()
+	if err != nil || string(dat) != string(fstest.FileData["/a/a1"]) {
+		t.Fatalf("bad /a/a1 %v", err)
+	}
+	if _, err := zx.Stat(fs, "/a/d"); !zx.IsNotExist(err) {
+		t.Fatalf("/a/d not removed")
+	}
+}
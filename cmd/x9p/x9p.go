@@ -0,0 +1,150 @@
+/*
+	9P file server.
+
+	Export zx trees to 9P2000 clients (Plan 9, plan9port, Linux v9fs).
+
+	9P user names are trusted, thus the server listens just on a
+	local unix socket unless flag -t is given, to listen on tcp.
+	Unless auth is disabled, zx permissions are checked for the users.
+*/
+package main
+
+import (
+	"clive/cmd"
+	"clive/cmd/opt"
+	"clive/dbg"
+	"clive/net"
+	"clive/zx"
+	"clive/zx/p9"
+	"clive/zx/zux"
+	"clive/zx/zxc"
+	fpath "path"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	noauth, wsync bool
+	tcp           bool
+	Zdebug        bool
+	dprintf       = cmd.Dprintf
+	vprintf       = cmd.VWarn
+
+	opts       = opt.New("{spec}")
+	port, addr string
+)
+
+func main() {
+	cmd.UnixIO()
+	opts.AddUsage("\tspec is name | name!file | name!file!flags \n")
+	opts.AddUsage("\tspec flags are ro | rw | ncro | ncrw \n")
+	opts.AddUsage("\tthe first tree is also served as main, the default attach name\n")
+	port = "564"
+	opts.NewFlag("p", "port: tcp server port (564 by default)", &port)
+	opts.NewFlag("a", "addr: service address (unix!local!9fs, or tcp!*!9fs with -t, by default)", &addr)
+	opts.NewFlag("t", "listen on tcp; 9P user names are trusted", &tcp)
+	opts.NewFlag("s", "use writesync for caches", &wsync)
+	c := cmd.AppCtx()
+	opts.NewFlag("D", "debug", &c.Debug)
+	opts.NewFlag("v", "verbose", &c.Verb)
+	opts.NewFlag("Z", "verbose debug", &Zdebug)
+	opts.NewFlag("n", "no auth: trust user names and use trees as they are", &noauth)
+	args := opts.Parse()
+	if len(args) == 0 {
+		cmd.Warn("missing arguments")
+		opts.Usage()
+	}
+	c.Debug = c.Debug || Zdebug
+	net.DefSvc("9fs", port)
+	if addr == "" {
+		addr = "unix!local!9fs"
+		if tcp {
+			addr = "tcp!*!9fs"
+		}
+	} else if !tcp && !strings.HasPrefix(addr, "unix!") {
+		cmd.Fatal("%s: use -t to listen on tcp", addr)
+	}
+
+	trs := map[string]zx.Fs{}
+	ros := map[bool]string{false: "rw", true: "ro"}
+	cs := map[bool]string{false: "uncached", true: "cached"}
+	var mainfs zx.Fs
+	for i := 0; i < len(args); i++ {
+		al := strings.Split(args[i], "!")
+		if len(al) == 1 {
+			al = append(al, al[0])
+			al[0] = fpath.Base(al[0])
+		}
+		if _, ok := trs[al[0]]; ok {
+			cmd.Warn("dup tree name %s", al[0])
+			continue
+		}
+		ronly := false
+		caching := true
+		if len(al) == 3 && strings.Contains(al[2], "ro") {
+			ronly = true
+		}
+		if len(al) == 3 && strings.Contains(al[2], "nc") {
+			caching = false
+		}
+		fp, _ := filepath.Abs(al[1])
+		t, err := zux.NewZX(fp)
+		if err != nil {
+			cmd.Warn("%s: %s", al[0], err)
+			continue
+		}
+		t.Tag = al[0]
+		if !noauth && !caching {
+			// zxc checks them on its own
+			t.CheckZXPerms()
+		}
+		cmd.Warn("%s %s %s", al[0], ros[ronly], cs[caching])
+		var x zx.Fs = t
+		if caching {
+			x, err = zxc.New(t)
+			if err != nil {
+				dbg.Warn("%s: zxc: %s", al[0], err)
+				continue
+			}
+			if Zdebug {
+				x.(*zxc.Fs).Debug = true
+			}
+			if wsync {
+				x.(*zxc.Fs).Flags.Set("writesync", true)
+			}
+		} else if Zdebug {
+			x.(*zux.Fs).Debug = true
+		}
+		if ronly {
+			x = zx.MakeRO(x)
+		}
+		trs[t.Tag] = x
+		if mainfs == nil {
+			mainfs = x
+		}
+	}
+	if len(trs) == 0 {
+		cmd.Fatal("no trees to serve")
+	}
+	if _, ok := trs["main"]; !ok {
+		trs["main"] = mainfs
+	}
+	vprintf("serve %s...", addr)
+	srv, err := p9.NewServer(addr)
+	if err != nil {
+		cmd.Fatal("serve: %s", err)
+	}
+	if noauth {
+		srv.NoAuth()
+	}
+	srv.Debug = c.Debug
+	for nm, fs := range trs {
+		dprintf("tree %s\n", nm)
+		if err := srv.Serve(nm, fs); err != nil {
+			cmd.Fatal("serve: %s: %s", nm, err)
+		}
+	}
+	if err := srv.Wait(); err != nil {
+		cmd.Fatal("srv: %s", err)
+	}
+}
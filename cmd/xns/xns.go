@@ -0,0 +1,80 @@
+/*
+	Name space server.
+
+	Export a name space using the ns service, where each user gets
+	its own copy of the name space, or the sns service (flag -s), where
+	all users share the same name space.
+	Users may only mount the trees given with flag -m, and only the
+	owner of the server may change a shared name space.
+	In the ns service, trees are used authenticated for each user, and
+	those that can't authenticate users are not used.
+*/
+package main
+
+import (
+	"clive/cmd"
+	"clive/cmd/opt"
+	"clive/net/auth"
+	"clive/ns"
+	"clive/ns/rns"
+)
+
+var (
+	noauth, shared bool
+	vprintf        = cmd.VWarn
+
+	opts = opt.New("[ns]")
+	addr string
+	mnts []string
+)
+
+func main() {
+	cmd.UnixIO()
+	opts.AddUsage("\tns is a name space file or text, the current one by default\n")
+	opts.NewFlag("a", "addr: service address (*!*!ns or *!*!sns by default)", &addr)
+	opts.NewFlag("s", "serve a shared name space (sns)", &shared)
+	opts.NewFlag("m", "addr: let users mount trees at addr (or under it)", &mnts)
+	c := cmd.AppCtx()
+	opts.NewFlag("D", "debug", &c.Debug)
+	opts.NewFlag("v", "verbose", &c.Verb)
+	opts.NewFlag("n", "no auth", &noauth)
+	args := opts.Parse()
+	if len(args) > 1 {
+		opts.Usage()
+	}
+	auth.Debug = c.Debug
+	n := cmd.NS()
+	if len(args) == 1 {
+		var err error
+		if n, err = ns.Parse(args[0]); err != nil {
+			cmd.Fatal("%s: %s", args[0], err)
+		}
+	}
+	if addr == "" {
+		addr = "*!*!ns"
+		if shared {
+			addr = "*!*!sns"
+		}
+	}
+	vprintf("serve %s...", addr)
+	var srv *rns.Server
+	var err error
+	if shared {
+		srv, err = rns.NewSharedServer(addr, n, auth.TLSserver)
+	} else {
+		srv, err = rns.NewServer(addr, n, auth.TLSserver)
+	}
+	if err != nil {
+		cmd.Fatal("serve: %s", err)
+	}
+	if noauth {
+		srv.NoAuth()
+	}
+	srv.AllowMount(mnts...)
+	if c.Debug {
+		srv.Debug = true
+	}
+	if err := srv.Wait(); err != nil {
+		cmd.Fatal("srv: %s", err)
+	}
+}
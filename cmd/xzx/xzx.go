@@ -1,7 +1,8 @@
 /*
 	ZX file server.
 
-	Export zx trees
+	Export zx trees, and announce them in the local network
+	if flag -A is given (see clive/net/disc).
 */
 package main
 
@@ -14,6 +15,7 @@ import (
 	"clive/zx/rzx"
 	"clive/zx/zux"
 	"clive/zx/zxc"
+	"os"
 	fpath "path"
 	"path/filepath"
 	"strings"
@@ -21,6 +23,7 @@ import (
 
 var (
 	noauth, wsync bool
+	announce      bool
 	Zdebug        bool
 	dprintf       = cmd.Dprintf
 	vprintf       = cmd.VWarn
@@ -43,6 +46,7 @@ func main() {
 	opts.NewFlag("v", "report users logged in/out (verbose)", &c.Verb)
 	opts.NewFlag("Z", "verbose debug", &Zdebug)
 	opts.NewFlag("n", "no auth", &noauth)
+	opts.NewFlag("A", "announce the server in the local network", &announce)
 	args := opts.Parse()
 	if len(args) == 0 {
 		cmd.Warn("missing arguments")
@@ -137,6 +141,12 @@ func main() {
 			cmd.Fatal("serve: %s: %s", nm, err)
 		}
 	}
+	if announce {
+		name, _ := os.Hostname()
+		if err := srv.Announce(name); err != nil {
+			cmd.Warn("%s", err)
+		}
+	}
 	if err := srv.Wait(); err != nil {
 		cmd.Fatal("srv: %s", err)
 	}
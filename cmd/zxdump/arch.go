@@ -10,6 +10,7 @@ import (
 	fpath "path"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -18,6 +19,17 @@ struct aFile {
 	D zx.Dir
 }
 
+// What we dumped for a file, to skip it while it's unchanged.
+struct dumped {
+	mtime, size, sum string // as reported by the tree
+	s                string // data path for the hash of the data read
+}
+
+var (
+	dumpedlk sync.Mutex
+	dumps    = map[string]dumped{} // by dump name
+)
+
 func Path(names ...string) string {
 	p := fpath.Join(names...)
 	if p == "" {
@@ -210,6 +222,7 @@ func dumpDir(data, name string, rf aFile) (string, error) {
 // saveAttrs and afname must be updated.
 func saveAttrs(dpath string, d zx.Dir) {
 	d = d.Dup()
+	delete(d, "sum")
 	delete(d, "path")
 	delete(d, "addr")
 	delete(d, "mode")
@@ -281,28 +294,49 @@ func newDumpDir(data, dfpath string, rf aFile, ds []zx.Dir, dhash []string) erro
 // name is the dump name for the file dumped, eg. "lsub/usr/nemo/guide"
 // and rf is the zx.Fs/zx.Dir for that file being dumped
 //
+// The data is stored by the hash of what we read.
+// The sum reported by the tree is just a hint: if it's the one we
+// saw when the file was last dumped, the file is not read again.
 func dumpFile(data, name string, f aFile) (string, error) {
 	dprintf("dump file %s %s %s...\n", data, name, f.D["path"])
-	dc := f.T.Get(f.D["path"], 0, zx.All)
+	d := f.D
+	dumpedlk.Lock()
+	old, ok := dumps[name]
+	dumpedlk.Unlock()
+	if ok && d["sum"] != "" && old.sum == d["sum"] &&
+		old.mtime == d["mtime"] && old.size == d["size"] {
+		if fi, _ := os.Stat(fpath.Join(data, old.s)); fi != nil {
+			dprintf("dump file %s %s %s -> %s (unchanged)\n", data, name, d["path"], old.s)
+			return old.s, nil
+		}
+	}
+	dc := f.T.Get(d["path"], 0, zx.All)
 	h := sha1.New()
 	for dat := range dc {
 		h.Write(dat)
 	}
 	err := cerror(dc)
 	if err != nil {
-		dprintf("dump file %s: get: %s\n", f.D["path"], err)
+		dprintf("dump file %s: get: %s\n", d["path"], err)
 		return "", err
 	}
 	sum := h.Sum(nil)
 	s := fmt.Sprintf("%02x/%02x/%036x", sum[0], sum[1], sum[2:])
 	dfpath := fpath.Join(data, s)
 	fi, err := os.Stat(dfpath)
-	dprintf("dump file %s %s %s -> %s\n", data, name, f.D["path"], s)
-	if fi != nil {
-		return s, nil
+	dprintf("dump file %s %s %s -> %s\n", data, name, d["path"], s)
+	if fi == nil {
+		vprintf("new %s", name)
+		if err := newDumpFile(dfpath, f); err != nil {
+			return s, err
+		}
 	}
-	vprintf("new %s", name)
-	return s, newDumpFile(dfpath, f)
+	if d["sum"] != "" {
+		dumpedlk.Lock()
+		dumps[name] = dumped{mtime: d["mtime"], size: d["size"], sum: d["sum"], s: s}
+		dumpedlk.Unlock()
+	}
+	return s, nil
 }
 
 // dfpath is the full path in the data dir for the file
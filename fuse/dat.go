@@ -16,6 +16,12 @@ interface FS {
 	Root() (Node, fuse.Error)
 }
 
+interface FSStatfser {
+	// Report file system usage.
+	// Made up values are reported otherwise.
+	Statfs(Intr) (*fuse.StatfsResponse, fuse.Error)
+}
+
 // A Node is the interface required of a file or directory.
 // See the documentation for type FS for general information
 // pertaining to all methods.
@@ -45,9 +51,10 @@ interface NodeSetAttrer {
 }
 
 interface NodeXAttrer {
-	// get the named attribute
+	// get the named attribute, ENODATA if there is none
 	Xattr(name string) ([]byte, fuse.Error)
 	// set the named attribute (use nil val to remove)
+	// ENOTSUP if such attributes are not supported
 	Wxattr(name string, val []byte) fuse.Error
 	// list named attributes
 	Xattrs() []string
@@ -92,6 +99,23 @@ interface NodeRenamer {
 	Rename(oldelem, newelem string, newDir Node, intr Intr) fuse.Error
 }
 
+interface NodeSymlinker {
+	// Create a symbolic link named elem in the receiver,
+	// which must be a directory, pointing to target.
+	Symlink(elem, target string, i Intr) (Node, fuse.Error)
+}
+
+interface NodeReadlinker {
+	// Return the target of the receiver, which must be a symbolic link.
+	Readlink(i Intr) (string, fuse.Error)
+}
+
+interface NodeLinker {
+	// Create a hard link named elem in the receiver,
+	// which must be a directory, for the old node.
+	Link(elem string, old Node, i Intr) (Node, fuse.Error)
+}
+
 // TODO this should be on Handle not Node
 interface NodeFsyncer {
 	Fsync(intr Intr) fuse.Error
@@ -623,6 +623,7 @@ func All(t Fataler, dirs ...string) {
 	Puts(t, dirs...)
 	Mkdirs(t, dirs...)
 	Wstats(t, dirs...)
+	Posix(t, dirs...)
 	Removes(t, dirs...)
 	for _, d := range dirs {
 		os.Remove(fpath.Join(d, "/foo"))
@@ -159,3 +159,27 @@ func TestFsTest(t *testing.T) {
 
 	AsAFs(t, tdir)
 }
+
+func TestPosix(t *testing.T) {
+	RmTree(t, tdir)
+	RmTree(t, tdir2)
+	defer RmTree(t, tdir)
+	defer RmTree(t, tdir2)
+	MkTree(t, tdir)
+	ResetTime()
+	MkTree(t, tdir2)
+
+	Posix(t, tdir, tdir2)
+}
+
+func TestXattrs(t *testing.T) {
+	RmTree(t, tdir)
+	RmTree(t, tdir2)
+	defer RmTree(t, tdir)
+	defer RmTree(t, tdir2)
+	MkTree(t, tdir)
+	ResetTime()
+	MkTree(t, tdir2)
+
+	Xattrs(t, tdir, tdir2)
+}
@@ -0,0 +1,243 @@
+package ostest
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	fpath "path"
+	"syscall"
+)
+
+/*
+	Tests for the POSIX calls used by ordinary tools (git, make, editors)
+	besides those issued by the other tests.
+	All of them leave the tree as it was.
+*/
+
+// Create, read, and remove symlinks, including dangling ones.
+func Symlinks(t Fataler, dirs ...string) {
+	if len(dirs) == 0 {
+		t.Fatalf("not enough dirs")
+	}
+	for _, d := range dirs {
+		p := fpath.Join(d, "/a/l1")
+		printf("symlink %s\n", p)
+		if err := os.Symlink("a1", p); err != nil {
+			t.Fatalf("symlink: %s", err)
+		}
+		if err := os.Symlink("a1", p); err == nil {
+			t.Fatalf("symlink: could create twice")
+		}
+		tgt, err := os.Readlink(p)
+		if err != nil {
+			t.Fatalf("readlink: %s", err)
+		}
+		if tgt != "a1" {
+			t.Fatalf("readlink: got %s", tgt)
+		}
+		fi, err := os.Lstat(p)
+		if err != nil {
+			t.Fatalf("lstat: %s", err)
+		}
+		if fi.Mode()&os.ModeSymlink == 0 {
+			t.Fatalf("lstat: mode %s", fi.Mode())
+		}
+		dat, err := ioutil.ReadFile(p)
+		if err != nil {
+			t.Fatalf("read: %s", err)
+		}
+		if !bytes.Equal(dat, FileData["/a/a1"]) {
+			t.Fatalf("read: bad data through link")
+		}
+		dp := fpath.Join(d, "/a/l2")
+		if err := os.Symlink("nothere", dp); err != nil {
+			t.Fatalf("symlink: %s", err)
+		}
+		if tgt, err := os.Readlink(dp); err != nil || tgt != "nothere" {
+			t.Fatalf("readlink dangling: %s %v", tgt, err)
+		}
+		if _, err := os.Stat(dp); err == nil {
+			t.Fatalf("stat dangling: did not fail")
+		}
+		if err := os.Remove(p); err != nil {
+			t.Fatalf("rm: %s", err)
+		}
+		if err := os.Remove(dp); err != nil {
+			t.Fatalf("rm: %s", err)
+		}
+		if _, err := os.Stat(fpath.Join(d, "/a/a1")); err != nil {
+			t.Fatalf("link target removed: %s", err)
+		}
+	}
+}
+
+// Create and remove hard links.
+func Links(t Fataler, dirs ...string) {
+	if len(dirs) == 0 {
+		t.Fatalf("not enough dirs")
+	}
+	for _, d := range dirs {
+		op := fpath.Join(d, "/2")
+		p := fpath.Join(d, "/a/h1")
+		printf("link %s %s\n", op, p)
+		if err := os.Link(op, p); err != nil {
+			t.Fatalf("link: %s", err)
+		}
+		if err := os.Link(op, p); err == nil {
+			t.Fatalf("link: could create twice")
+		}
+		dat, err := ioutil.ReadFile(p)
+		if err != nil {
+			t.Fatalf("read: %s", err)
+		}
+		if !bytes.Equal(dat, FileData["/2"]) {
+			t.Fatalf("read: bad data through link")
+		}
+		if err := os.Remove(p); err != nil {
+			t.Fatalf("rm: %s", err)
+		}
+		dat, err = ioutil.ReadFile(op)
+		if err != nil {
+			t.Fatalf("read: %s", err)
+		}
+		if !bytes.Equal(dat, FileData["/2"]) {
+			t.Fatalf("read: bad data after unlink")
+		}
+	}
+}
+
+func chkSize(t Fataler, p string, sz int64) {
+	fi, err := os.Stat(p)
+	if err != nil {
+		t.Fatalf("stat: %s", err)
+	}
+	if fi.Size() != sz {
+		t.Fatalf("%s: size %d; expected %d", p, fi.Size(), sz)
+	}
+}
+
+// Truncate files by name and through open files, and sync them.
+func Truncates(t Fataler, dirs ...string) {
+	if len(dirs) == 0 {
+		t.Fatalf("not enough dirs")
+	}
+	for _, d := range dirs {
+		p := fpath.Join(d, "/a/a2")
+		printf("truncate %s\n", p)
+		old := FileData["/a/a2"]
+		fd, err := os.OpenFile(p, os.O_RDWR, 0)
+		if err != nil {
+			t.Fatalf("open: %s", err)
+		}
+		if err := fd.Truncate(10); err != nil {
+			t.Fatalf("ftruncate: %s", err)
+		}
+		if err := fd.Sync(); err != nil {
+			t.Fatalf("fsync: %s", err)
+		}
+		chkSize(t, p, 10)
+		if _, err := fd.WriteAt(old[10:], 10); err != nil {
+			t.Fatalf("write: %s", err)
+		}
+		if err := fd.Close(); err != nil {
+			t.Fatalf("close: %s", err)
+		}
+		chkSize(t, p, int64(len(old)))
+		if err := os.Truncate(p, 5); err != nil {
+			t.Fatalf("truncate: %s", err)
+		}
+		chkSize(t, p, 5)
+		if err := ioutil.WriteFile(p, old, 0644); err != nil {
+			t.Fatalf("write: %s", err)
+		}
+		dat, err := ioutil.ReadFile(p)
+		if err != nil {
+			t.Fatalf("read: %s", err)
+		}
+		if !bytes.Equal(dat, old) {
+			t.Fatalf("read: bad data")
+		}
+	}
+}
+
+// Check out O_APPEND and O_EXCL semantics.
+func OpenFlags(t Fataler, dirs ...string) {
+	if len(dirs) == 0 {
+		t.Fatalf("not enough dirs")
+	}
+	for _, d := range dirs {
+		p := fpath.Join(d, "/a/a1")
+		printf("append %s\n", p)
+		old := FileData["/a/a1"]
+		fd, err := os.OpenFile(p, os.O_WRONLY|os.O_APPEND, 0)
+		if err != nil {
+			t.Fatalf("open: %s", err)
+		}
+		// even if we seek, writes go at the end
+		fd.Seek(0, 0)
+		if _, err := fd.Write([]byte("more\n")); err != nil {
+			t.Fatalf("write: %s", err)
+		}
+		if _, err := fd.Write([]byte("and more\n")); err != nil {
+			t.Fatalf("write: %s", err)
+		}
+		fd.Close()
+		dat, err := ioutil.ReadFile(p)
+		if err != nil {
+			t.Fatalf("read: %s", err)
+		}
+		if string(dat) != string(old)+"more\nand more\n" {
+			t.Fatalf("append: bad data")
+		}
+		if err := os.Truncate(p, int64(len(old))); err != nil {
+			t.Fatalf("truncate: %s", err)
+		}
+
+		printf("excl %s\n", p)
+		if _, err := os.OpenFile(p, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644); !os.IsExist(err) {
+			t.Fatalf("excl create of existing file: %v", err)
+		}
+		fd, err = os.OpenFile(p, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			t.Fatalf("create: %s", err)
+		}
+		fd.Close()
+		chkSize(t, p, int64(len(old)))
+		np := fpath.Join(d, "/a/x1")
+		fd, err = os.OpenFile(np, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+		if err != nil {
+			t.Fatalf("excl create: %s", err)
+		}
+		fd.Close()
+		if err := os.Remove(np); err != nil {
+			t.Fatalf("rm: %s", err)
+		}
+	}
+}
+
+// Check that statfs reports something sensible.
+func Statfs(t Fataler, dirs ...string) {
+	if len(dirs) == 0 {
+		t.Fatalf("not enough dirs")
+	}
+	for _, d := range dirs {
+		var st syscall.Statfs_t
+		if err := syscall.Statfs(d, &st); err != nil {
+			t.Fatalf("statfs: %s", err)
+		}
+		printf("statfs %s: bsize %d blocks %d bavail %d\n", d, st.Bsize, st.Blocks, st.Bavail)
+		if st.Bsize == 0 || st.Blocks == 0 || st.Bavail == 0 {
+			t.Fatalf("statfs: no space reported")
+		}
+	}
+}
+
+// Run all the POSIX tests.
+func Posix(t Fataler, dirs ...string) {
+	Symlinks(t, dirs...)
+	Links(t, dirs...)
+	Truncates(t, dirs...)
+	OpenFlags(t, dirs...)
+	Statfs(t, dirs...)
+	Xattrs(t, dirs...)
+}
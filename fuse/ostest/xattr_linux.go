@@ -0,0 +1,79 @@
+package ostest
+
+import (
+	fpath "path"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+func listxattr(t Fataler, p string) []string {
+	buf := make([]byte, 4096)
+	n, err := syscall.Listxattr(p, buf)
+	if err != nil {
+		t.Fatalf("listxattr: %s", err)
+	}
+	var names []string
+	for _, s := range strings.Split(string(buf[:n]), "\x00") {
+		if strings.HasPrefix(s, "user.") {
+			names = append(names, s)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Set, get, list, and remove user extended attributes.
+// Trees without xattr support are ignored.
+func Xattrs(t Fataler, dirs ...string) {
+	if len(dirs) == 0 {
+		t.Fatalf("not enough dirs")
+	}
+	for _, d := range dirs {
+		for _, fn := range []string{"/a/a1", "/a/b"} {
+			p := fpath.Join(d, fn)
+			printf("xattrs %s\n", p)
+			err := syscall.Setxattr(p, "user.tag", []byte("foo bar"), 0)
+			if err == syscall.ENOTSUP {
+				printf("%s: no xattrs\n", d)
+				break
+			}
+			if err != nil {
+				t.Fatalf("setxattr: %s", err)
+			}
+			if err := syscall.Setxattr(p, "user.tag2", []byte("x"), 0); err != nil {
+				t.Fatalf("setxattr: %s", err)
+			}
+			buf := make([]byte, 100)
+			n, err := syscall.Getxattr(p, "user.tag", buf)
+			if err != nil {
+				t.Fatalf("getxattr: %s", err)
+			}
+			if string(buf[:n]) != "foo bar" {
+				t.Fatalf("getxattr: got %q", buf[:n])
+			}
+			if _, err := syscall.Getxattr(p, "user.tag", buf[:2]); err != syscall.ERANGE {
+				t.Fatalf("getxattr: short buffer: %v", err)
+			}
+			if _, err := syscall.Getxattr(p, "user.none", buf); err != syscall.ENODATA {
+				t.Fatalf("getxattr: missing attr: %v", err)
+			}
+			names := listxattr(t, p)
+			if strings.Join(names, " ") != "user.tag user.tag2" {
+				t.Fatalf("listxattr: got %v", names)
+			}
+			if err := syscall.Removexattr(p, "user.tag"); err != nil {
+				t.Fatalf("removexattr: %s", err)
+			}
+			if err := syscall.Removexattr(p, "user.tag"); err != syscall.ENODATA {
+				t.Fatalf("removexattr: missing attr: %v", err)
+			}
+			if err := syscall.Removexattr(p, "user.tag2"); err != nil {
+				t.Fatalf("removexattr: %s", err)
+			}
+			if names := listxattr(t, p); len(names) != 0 {
+				t.Fatalf("listxattr: got %v", names)
+			}
+		}
+	}
+}
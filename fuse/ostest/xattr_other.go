@@ -0,0 +1,10 @@
+// +build !linux
+
+package ostest
+
+// Extended attributes are tested only on Linux.
+func Xattrs(t Fataler, dirs ...string) {
+	if len(dirs) == 0 {
+		t.Fatalf("not enough dirs")
+	}
+}
@@ -502,6 +502,15 @@ Req:
 	case *fuse.StatfsRequest:
 		// fake it so the other end always thinks we have resources
 		s := &fuse.StatfsResponse{}
+		if fs, ok := c.fs.(FSStatfser); ok {
+			st, err := fs.Statfs(intr)
+			if err != nil {
+				done(err)
+				r.RespondError(err)
+				break
+			}
+			s = st
+		}
 		done(s)
 		r.Respond(s)
 
@@ -555,8 +564,13 @@ Req:
 		}
 		v, err := n.Xattr(r.Name)
 		if err != nil {
-			done(fuse.ENODATA)
-			r.RespondError(fuse.ENODATA)
+			done(err)
+			r.RespondError(err)
+			break
+		}
+		if r.Size > 0 && int(r.Size) < len(v) {
+			done(fuse.ERANGE)
+			r.RespondError(fuse.ERANGE)
 			break
 		}
 		s.Xattr = v
@@ -571,6 +585,11 @@ Req:
 				s.Append(v...)
 			}
 		}
+		if r.Size > 0 && int(r.Size) < len(s.Xattr) {
+			done(fuse.ERANGE)
+			r.RespondError(fuse.ERANGE)
+			break
+		}
 		done(s)
 		r.Respond(s)
 
@@ -583,8 +602,8 @@ Req:
 		}
 		err := n.Wxattr(r.Name, r.Xattr)
 		if err != nil {
-			done(fuse.EPERM)
-			r.RespondError(fuse.EPERM)
+			done(err)
+			r.RespondError(err)
 			break
 		}
 		done(nil)
@@ -599,24 +618,79 @@ Req:
 		}
 		err := n.Wxattr(r.Name, nil)
 		if err != nil {
-			done(fuse.EPERM)
-			r.RespondError(fuse.EPERM)
+			done(err)
+			r.RespondError(err)
 			break
 		}
 		done(nil)
 		r.Respond()
 
 	case *fuse.SymlinkRequest:
-		done(fuse.EPERM)
-		r.RespondError(fuse.EPERM)
+		s := &fuse.SymlinkResponse{}
+		n, ok := node.(NodeSymlinker)
+		if !ok {
+			done(fuse.EPERM)
+			r.RespondError(fuse.EPERM)
+			break
+		}
+		n2, err := n.Symlink(r.NewName, r.Target, intr)
+		if err != nil {
+			done(err)
+			r.RespondError(err)
+			break
+		}
+		c.saveLookup(&s.LookupResponse, snode, r.NewName, n2)
+		done(s)
+		r.Respond(s)
 
 	case *fuse.ReadlinkRequest:
-		done(fuse.EPERM)
-		r.RespondError(fuse.EPERM)
+		n, ok := node.(NodeReadlinker)
+		if !ok {
+			done(fuse.EPERM)
+			r.RespondError(fuse.EPERM)
+			break
+		}
+		target, err := n.Readlink(intr)
+		if err != nil {
+			done(err)
+			r.RespondError(err)
+			break
+		}
+		done(target)
+		r.Respond(target)
 
 	case *fuse.LinkRequest:
-		done(fuse.EPERM)
-		r.RespondError(fuse.EPERM)
+		c.meta.Lock()
+		var oldNode *serveNode
+		if int(r.OldNode) < len(c.node) {
+			oldNode = c.node[r.OldNode]
+		}
+		c.meta.Unlock()
+		if oldNode == nil {
+			dprintf("%v\n", &logLinkRequestOldNodeNotFound{
+				Request: r.Hdr(),
+				In:      r,
+			})
+			done(fuse.EIO)
+			r.RespondError(fuse.EIO)
+			break
+		}
+		n, ok := node.(NodeLinker)
+		if !ok {
+			done(fuse.EPERM)
+			r.RespondError(fuse.EPERM)
+			break
+		}
+		n2, err := n.Link(r.NewName, oldNode.node, intr)
+		if err != nil {
+			done(err)
+			r.RespondError(err)
+			break
+		}
+		s := &fuse.LookupResponse{}
+		c.saveLookup(s, snode, r.NewName, n2)
+		done(s)
+		r.Respond(s)
 
 	case *fuse.RemoveRequest:
 		n, ok := node.(NodeRemover)
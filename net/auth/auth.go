@@ -1,7 +1,8 @@
 /*
 	Authentication services for clive.
 
-	Clive relies on challenge response authentication using shared keys.
+	Clive relies on challenge response authentication using shared keys,
+	or Ed25519 public keys when both peers speak PKProto.
 	This package provides tools to authenticate clients and servers and
 	to authenticate acess to wax interfaces.
 
@@ -11,11 +12,9 @@
 */
 package auth
 
-// BUG(x): the secrets file for a domain should keep multiple user/key pairs.
-
 // REFERENCE(x): nchan, channels for I/O devices.
 
-// REFERENCE(x): cmd/auth, to generate key files.
+// REFERENCE(x): cmd/auth, to generate and manage key files.
 
 import (
 	"bufio"
@@ -93,6 +92,7 @@ struct Info {
 	SpeaksFor string          // user name as reported by the remote peer.
 	Proto     map[string]bool // protocols spoken by the peer.
 	Ok        bool            // auth was successful?
+	Cap       *Cap            // capability used to authenticate, if any
 }
 
 /*
@@ -214,6 +214,9 @@ func (m *msg) String() string {
 	}
 	fmt.Fprintf(&buf, " %s", m.user)
 	for k := range m.proto {
+		if strings.HasPrefix(k, CapProto+"=") {
+			k = CapProto + "=..."
+		}
 		fmt.Fprintf(&buf, " %s", k)
 	}
 	return buf.String()
@@ -263,8 +266,14 @@ func (m *msg) unpack(buf []byte) error {
 	return nil
 }
 
+// If set, used instead of the default key directory (for testing).
+var keyDir string
+
 // Return the path to the directory where clive keys and certificates are kept.
 func KeyDir() string {
+	if keyDir != "" {
+		return keyDir
+	}
 	return path.Join(u.Home, ".ssh")
 }
 
@@ -279,7 +288,7 @@ func KeyFile(dir, name string) string {
 // Save the key for the given secret of the given user in the named auth domain
 // at KeyFile(dir, name).
 // The key is added if there is no such user in the auth domain or replaced
-// if the user already exists.
+// if the user already exists (keeping its place in the file).
 func SaveKey(dir, name, user, secret string, groups ...string) error {
 	if dir == "" {
 		dir = KeyDir()
@@ -291,43 +300,14 @@ func SaveKey(dir, name, user, secret string, groups ...string) error {
 	data := []byte(secret)
 	key := pbkdf2.Key(data, []byte("ltsa"), 1000, 32, sha1.New)
 
-	old, _ := LoadKey(dir, name)
-	new := []Key{}
-	for _, o := range old {
-		if o.Uid != user {
-			new = append(new, o)
-		}
-	}
-	new = append(new, Key{Uid: user, Gids: groups, Key: key})
-	fd, err := os.Create(file)
-	if err != nil {
-		return err
-	}
-	for _, k := range new {
-		if _, err := fmt.Fprintf(fd, "%s", k.Uid); err != nil {
-			os.Remove(file)
-			return err
-		}
-		for _, g := range k.Gids {
-			if _, err := fmt.Fprintf(fd, " %s", g); err != nil {
-				os.Remove(file)
-				return err
-			}
-		}
-		if _, err := fmt.Fprintf(fd, "\n%x\n", k.Key); err != nil {
-			os.Remove(file)
-			return err
-		}
-	}
-	if err := fd.Close(); err != nil {
-		os.Remove(file)
-		return err
-	}
-	if err := os.Chmod(file, 0600); err != nil {
-		os.Remove(file)
-		return err
+	ks, _ := LoadKey(dir, name)
+	nk := Key{Uid: user, Gids: groups, Key: key}
+	if k := findKey(ks, user); k != nil {
+		*k = nk
+	} else {
+		ks = append(ks, nk)
 	}
-	return nil
+	return writeKeys(file, ks)
 }
 
 // Load the key for the named auth domain kept at dir. Return the user name for the key,
@@ -339,7 +319,11 @@ func LoadKey(dir, name string) (ks []Key, err error) {
 	if name == "" {
 		name = "default"
 	}
-	file := path.Join(dir, "clive."+name)
+	return loadKeys(path.Join(dir, "clive."+name))
+}
+
+// Load the keys kept in the given file.
+func loadKeys(file string) (ks []Key, err error) {
 	fd, err := os.Open(file)
 	if err != nil {
 		return nil, err
@@ -381,30 +365,28 @@ func LoadKey(dir, name string) (ks []Key, err error) {
 	Returns the user who authenticates and the status for authentication.
 	Always returns true when Auth is not enabled.
 */
+// Any user with a key in the auth domain may authenticate.
 func ChallengeResponseOk(name, ch, resp string) (user string, ok bool) {
 	usr := u.Uid
 	if !Enabled {
 		return usr, true
 	}
-	if keys == nil || iv == nil {
+	ks, err := domainKeys(name)
+	if err != nil {
+		dbg.Warn("auth: loadkey %s: %s", name, err)
 		return usr, false
 	}
-	usr = keys[0].Uid
-	key := keys[0].Key
-	if name != "" && name != "default" {
-		var err error
-		ks, err := LoadKey(KeyDir(), name)
-		if err != nil {
-			dbg.Warn("auth: loadkey %s: %s", name, err)
-			return usr, false
-		}
-		usr, key = ks[0].Uid, ks[0].Key
-	}
-	chresp, ok := encrypt(key, iv, []byte(ch))
-	if !ok || len(chresp) == 0 {
+	if len(ks) == 0 || iv == nil {
 		return usr, false
 	}
-	return usr, fmt.Sprintf("%x", chresp) == resp
+	usr = ks[0].Uid
+	for _, k := range ks {
+		chresp, ok := encrypt(k.Key, iv, []byte(ch))
+		if ok && len(chresp) > 0 && fmt.Sprintf("%x", chresp) == resp {
+			return k.Uid, true
+		}
+	}
+	return usr, false
 }
 
 /*
@@ -417,7 +399,13 @@ func ChallengeResponseOk(name, ch, resp string) (user string, ok bool) {
 	By convention, the dialer takes the first key and user name kept in the key file
 	and uses those. The callee waits until it has received a proposed user name
 	to complete its part of the protocol, and selects the key for that user name
-	as kept in the key file. The iscaller argument indicates if it's the dialer or not.
+	as kept in the key file, so any user with a key in the file may authenticate,
+	and the groups listed for it there are those in the auth info.
+	The key file is read on each authentication, so changes made to it
+	(eg., by cmd/auth) apply to new connections.
+	If the dialer has a private key for the domain and the callee has authorized
+	keys for it, public key auth is used instead (see PKProto).
+	The iscaller argument indicates if it's the dialer or not.
 
 	If there's no key, or TLS is not configured for the network, or auth is not enabled, c is left
 	undisturbed and an error is returned instead. The error is ErrDisabled when auth
@@ -427,14 +415,14 @@ func ChallengeResponseOk(name, ch, resp string) (user string, ok bool) {
 	from the protocol is returned.
 */
 func AtClient(c ch.Conn, name string, proto ...string) (*Info, error) {
-	return conn(c, true, name, true, proto...)
+	return conn(c, true, name, true, "", false, proto...)
 }
 
 /*
 	Like AtClient(), but with auth disabled for this client/server
 */
 func NoneAtClient(c ch.Conn, name string, proto ...string) (*Info, error) {
-	return conn(c, true, name, false, proto...)
+	return conn(c, true, name, false, "", false, proto...)
 }
 
 /*
@@ -443,14 +431,35 @@ func NoneAtClient(c ch.Conn, name string, proto ...string) (*Info, error) {
 	See Caller for a description.
 */
 func AtServer(c ch.Conn, name string, proto ...string) (*Info, error) {
-	return conn(c, false, name, true, proto...)
+	return conn(c, false, name, true, "", false, proto...)
 }
 
 /*
 	Like AtServer(), but with auth disabled for this client/server
 */
 func NoneAtServer(c ch.Conn, name string, proto ...string) (*Info, error) {
-	return conn(c, false, name, false, proto...)
+	return conn(c, false, name, false, "", false, proto...)
+}
+
+/*
+	Like AtClient(), but authenticates using the capability token given
+	instead of the keys for the auth domain (see Cap).
+*/
+func CapAtClient(c ch.Conn, name, token string, proto ...string) (*Info, error) {
+	if _, err := ParseCap(token); err != nil {
+		return nil, err
+	}
+	return conn(c, true, name, true, token, false, proto...)
+}
+
+/*
+	Like AtServer(), but accepts also clients using capability tokens
+	minted for the auth domain, in which case Info.Cap is set to the capability,
+	and Info.Uid and Info.Gids are those of the user granting access.
+	Servers using this must honour Info.Cap (zx.Dir.Can* do so).
+*/
+func CapAtServer(c ch.Conn, name string, proto ...string) (*Info, error) {
+	return conn(c, false, name, true, "", true, proto...)
 }
 
 /*
@@ -476,10 +485,22 @@ func NoneAtServer(c ch.Conn, name string, proto ...string) (*Info, error) {
 	4.
 	cli checks the response, hangup or it's ok
 	srv checks the response (using the client's uid), hangup or it's ok
+
+	If both sides offer PKProto in the auth msg, responses in 3 are signatures
+	made with the private keys and 4 checks them using the authorized keys
+	(see PKProto).
+
+	If both sides offer CapProto, the client sends its token in the auth msg,
+	the server checks it before responding in 3, and responses are just CapProto
+	(see Cap).
 */
-func conn(c ch.Conn, iscaller bool, name string, enabled bool, proto ...string) (*Info, error) {
+func conn(c ch.Conn, iscaller bool, name string, enabled bool, token string, acceptcap bool,
+	proto ...string) (*Info, error) {
 	ch := make([]byte, 16)
 	var k []byte
+	var ks []Key
+	var pk *pkKeys
+	var cp *Cap
 	user := u.Uid
 	groups := []string{user}
 	if keys != nil {
@@ -491,15 +512,24 @@ func conn(c ch.Conn, iscaller bool, name string, enabled bool, proto ...string)
 		if TLSclient == nil || TLSserver == nil {
 			return nil, errors.New("no tls")
 		}
-		if name != "" && name != "default" {
-			var err error
-			ks, err := LoadKey(KeyDir(), name)
-			if err != nil {
-				return nil, fmt.Errorf("no key: %s", err)
-			}
+		var err error
+		ks, err = domainKeys(name)
+		pk = domainPKKeys(name)
+		if err != nil && !pk.offers() && token == "" {
+			return nil, fmt.Errorf("no key: %s", err)
+		}
+		if len(ks) > 0 {
 			user, k, groups = ks[0].Uid, ks[0].Key, ks[0].Gids
 		}
-		if k == nil {
+		if pk.offers() {
+			user = pk.user
+		}
+		if token != "" {
+			// use just the token, even if we have keys
+			cp, _ = ParseCap(token)
+			user, k, pk = cp.Uid, nil, &pkKeys{}
+		}
+		if k == nil && !pk.offers() && token == "" {
 			return nil, errors.New("no key")
 		}
 		binary.LittleEndian.PutUint64(ch[0:], <-chc)
@@ -512,6 +542,15 @@ func conn(c ch.Conn, iscaller bool, name string, enabled bool, proto ...string)
 	for _, s := range proto {
 		m.proto[s] = true
 	}
+	if enabled && pk.offers() {
+		m.proto[PKProto] = true
+	}
+	if enabled && (token != "" || acceptcap) {
+		m.proto[CapProto] = true
+	}
+	if enabled && token != "" {
+		m.proto[CapProto+"="+token] = true
+	}
 	dprintf("-> %s\n", m)
 	tc := time.After(Tmout)
 	select {
@@ -557,13 +596,22 @@ func conn(c ch.Conn, iscaller bool, name string, enabled bool, proto ...string)
 		Proto:     rm.proto,
 		Gids:      make(map[string]bool),
 	}
+	rtoken := ""
 	for k := range rm.proto {
+		if acceptcap && strings.HasPrefix(k, CapProto+"=") {
+			rtoken = k[len(CapProto)+1:]
+		}
 		if !m.proto[k] {
 			delete(rm.proto, k)
 		}
 	}
+	capmode := rm.proto[CapProto]
+	pkmode := rm.proto[PKProto] && !capmode
+	delete(rm.proto, CapProto)
+	delete(rm.proto, PKProto)
 	if iscaller {
 		info.Uid = user
+		info.Cap = cp
 	}
 
 	switch {
@@ -581,15 +629,30 @@ func conn(c ch.Conn, iscaller bool, name string, enabled bool, proto ...string)
 	}
 
 	// 3. respond (but server relies on the key for the user given by the caller).
-	if !iscaller {
+	if capmode && !iscaller {
+		var key *Key
+		var err error
+		if cp, key, err = checkCap(name, rtoken); err != nil {
+			dbg.Warn("auth failed: %s: %s", info.SpeaksFor, err)
+			close(c.In, err)
+			close(c.Out, err)
+			return info, err
+		}
+		info.Uid = cp.Uid
+		info.Cap = cp
+		for _, g := range key.Gids {
+			info.Gids[g] = true
+		}
+	} else if !iscaller {
 		k = nil
 		groups = nil
-		for _, key := range keys {
-			if key.Uid == rm.user {
-				k = key.Key
-				user = key.Uid
-				groups = key.Gids
-			}
+		if pkmode {
+			ks = pk.auth
+		}
+		if key := findKey(ks, rm.user); key != nil {
+			k = key.Key
+			user = key.Uid
+			groups = key.Gids
 		}
 		for _, g := range groups {
 			info.Gids[g] = true
@@ -601,7 +664,21 @@ func conn(c ch.Conn, iscaller bool, name string, enabled bool, proto ...string)
 			return info, err
 		}
 	}
-	resp, ok := encrypt(k, iv, rm.ch)
+	var resp []byte
+	ok := true
+	switch {
+	case capmode:
+		resp = []byte(CapProto)
+	case pkmode:
+		resp = pk.sign(rm.ch)
+	case k == nil:
+		err := errors.New("no key")
+		close(c.In, err)
+		close(c.Out, err)
+		return info, err
+	default:
+		resp, ok = encrypt(k, iv, rm.ch)
+	}
 	if !ok {
 		err := errors.New("encrypt failed")
 		close(c.In, err)
@@ -638,6 +715,25 @@ func conn(c ch.Conn, iscaller bool, name string, enabled bool, proto ...string)
 	}
 
 	// check the response
+	if capmode {
+		if iscaller && string(repl) != CapProto {
+			close(c.In, ErrFailed)
+			close(c.Out, ErrFailed)
+			return info, fmt.Errorf("%s: bad reply", ErrFailed)
+		}
+		info.Ok = true
+		return info, nil
+	}
+	if pkmode {
+		if !pk.verify(rm.user, m.ch, repl) {
+			dbg.Warn("auth failed: %s (as %s)", info.SpeaksFor, info.Uid)
+			close(c.In, ErrFailed)
+			close(c.Out, ErrFailed)
+			return info, fmt.Errorf("%s: bad signature", ErrFailed)
+		}
+		info.Ok = true
+		return info, nil
+	}
 	chresp, ok := encrypt(k, iv, m.ch[:])
 	if !ok {
 		err := errors.New("encrypt failed")
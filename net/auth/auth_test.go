@@ -1,11 +1,15 @@
 package auth
 
 import (
+	"bytes"
 	"clive/ch"
 	"clive/dbg"
 	"clive/net"
 	"encoding/binary"
+	"os"
+	"strings"
 	"testing"
+	"time"
 )
 
 var debug = testing.Verbose()
@@ -204,3 +208,228 @@ func TestMuxDisabledAuth(t *testing.T) {
 	close(ec)
 	<-donec
 }
+
+func TestKeys(t *testing.T) {
+	dir := "/tmp/authtest"
+	os.RemoveAll(dir)
+	if err := os.Mkdir(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := SaveKey(dir, "test", "u1", "secret1", "g1", "g2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := SaveKey(dir, "test", "u2", "secret2"); err != nil {
+		t.Fatal(err)
+	}
+	ks, err := LoadKey(dir, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ks) != 2 || ks[0].Uid != "u1" || ks[1].Uid != "u2" {
+		t.Fatalf("bad keys %v", ks)
+	}
+	if strings.Join(ks[0].Gids, " ") != "g1 g2" || strings.Join(ks[1].Gids, " ") != "u2" {
+		t.Fatalf("bad groups %v", ks)
+	}
+	old := ks[0].Key
+
+	// rotate u1: same place, new key
+	if err := SaveKey(dir, "test", "u1", "secret3", "g1", "g2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetGroups(dir, "test", "u2", "u2", "g1"); err != nil {
+		t.Fatal(err)
+	}
+	if ks, err = LoadKey(dir, "test"); err != nil {
+		t.Fatal(err)
+	}
+	if len(ks) != 2 || ks[0].Uid != "u1" || bytes.Equal(ks[0].Key, old) {
+		t.Fatalf("bad keys %v", ks)
+	}
+	if k := findKey(ks, "u2"); k == nil || strings.Join(k.Gids, " ") != "u2 g1" {
+		t.Fatalf("bad keys %v", ks)
+	}
+
+	if err := DelKey(dir, "test", "u1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := DelKey(dir, "test", "u1"); err == nil {
+		t.Fatal("del didn't fail")
+	}
+	if err := SetGroups(dir, "test", "u1", "g1"); err == nil {
+		t.Fatal("set groups didn't fail")
+	}
+	if ks, err = LoadKey(dir, "test"); err != nil {
+		t.Fatal(err)
+	}
+	if len(ks) != 1 || ks[0].Uid != "u2" {
+		t.Fatalf("bad keys %v", ks)
+	}
+	fi, err := os.Stat(KeyFile(dir, "test"))
+	if err != nil || fi.Mode()&0077 != 0 {
+		t.Fatalf("bad key file mode: %v", err)
+	}
+}
+
+func pkAuth(t *testing.T, name string) (*Info, error) {
+	c1, c2 := ch.NewPipePair(5)
+	ec := make(chan error, 1)
+	go func() {
+		_, err := AtClient(c1, name, "foo")
+		ec <- err
+	}()
+	ai, err := AtServer(c2, name, "foo")
+	cerr := <-ec
+	if err == nil && cerr != nil {
+		t.Fatalf("client: %s", cerr)
+	}
+	return ai, err
+}
+
+// Use a temporary key dir for the keys of the test domains.
+func testKeyDir(t *testing.T) string {
+	dir := "/tmp/authtest.keys"
+	os.RemoveAll(dir)
+	if err := os.Mkdir(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	keyDir = dir
+	return dir
+}
+
+func TestPKAuth(t *testing.T) {
+	debug = testing.Verbose()
+	dir, name := testKeyDir(t), "pktest"
+	defer os.RemoveAll(dir)
+	defer func() { keyDir = "" }()
+	pub, err := GenKey(dir, name, "pkuser")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pk, err := PubKey(dir, name); err != nil || !bytes.Equal(pk, pub) {
+		t.Fatalf("bad pub key: %v", err)
+	}
+	if err := AuthorizeKey(dir, name, "pkuser", pub, "g1"); err != nil {
+		t.Fatal(err)
+	}
+	ai, err := pkAuth(t, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	printf("ai %v\n", ai)
+	if !ai.Ok || ai.Uid != "pkuser" || !ai.Gids["g1"] || ai.Proto[PKProto] {
+		t.Fatalf("bad auth info %v", ai)
+	}
+
+	// a different key for the user must fail
+	opub := pub
+	if pub, err = GenKey(dir, name, "pkuser"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pkAuth(t, name); err == nil {
+		t.Fatal("auth with a bad key didn't fail")
+	}
+	if err := AuthorizeKey(dir, name, "pkuser", pub); err != nil {
+		t.Fatal(err)
+	}
+	ks, err := LoadAuthKeys(dir, name)
+	if err != nil || len(ks) != 1 || bytes.Equal(ks[0].Key, opub) {
+		t.Fatalf("bad auth keys %v %v", ks, err)
+	}
+	if _, err := pkAuth(t, name); err != nil {
+		t.Fatal(err)
+	}
+	if err := UnauthorizeKey(dir, name, "pkuser"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pkAuth(t, name); err == nil {
+		t.Fatal("auth for an unauthorized user didn't fail")
+	}
+
+	// the dialer must not accept servers it has not authorized
+	pk := &pkKeys{auth: ks}
+	if pk.verify("other", []byte("ch"), []byte("nokey")) {
+		t.Fatal("unauthorized server accepted")
+	}
+}
+
+func capAuth(t *testing.T, name, token string) (*Info, error) {
+	c1, c2 := ch.NewPipePair(5)
+	ec := make(chan error, 1)
+	go func() {
+		_, err := CapAtClient(c1, name, token, "foo")
+		ec <- err
+	}()
+	ai, err := CapAtServer(c2, name, "foo")
+	cerr := <-ec
+	if err == nil && cerr != nil {
+		t.Fatalf("client: %s", cerr)
+	}
+	return ai, err
+}
+
+func TestCap(t *testing.T) {
+	debug = testing.Verbose()
+	dir, name := testKeyDir(t), "captest"
+	defer os.RemoveAll(dir)
+	defer func() { keyDir = "" }()
+	if err := SaveKey(dir, name, "cuser", "csecret", "g1"); err != nil {
+		t.Fatal(err)
+	}
+	c := &Cap{Tree: "main", Path: "/a/b", Expires: time.Now().Add(time.Minute)}
+	var ai *Info
+	tok, err := ai.Mint(name, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	printf("token %s\n", tok)
+	ai, err = capAuth(t, name, tok)
+	if err != nil {
+		t.Fatal(err)
+	}
+	printf("ai %v %s\n", ai, ai.Cap)
+	if !ai.Ok || ai.Uid != "cuser" || !ai.Gids["g1"] || ai.Cap == nil || ai.Cap.Path != "/a/b" {
+		t.Fatalf("bad auth info %v", ai)
+	}
+	if _, err := ai.Mint(name, c); err == nil {
+		t.Fatal("could mint from a cap")
+	}
+	cp := ai.Cap
+	if !cp.Allows("main", "/a/b/c", 0444) || cp.Allows("main", "/a/b/c", 0222) ||
+		cp.Allows("other", "/a/b", 0111) || !cp.Allows("main", "/a", 0111) ||
+		cp.Allows("main", "/a", 0444) || cp.Allows("main", "/a/bc", 0444) {
+		t.Fatal("bad cap access checks")
+	}
+
+	// tampered tokens and expired tokens must fail
+	toks := strings.Split(tok, ".")
+	c.RW = true
+	rw, err := ai.Mint(name, c)
+	if err == nil {
+		t.Fatal("could mint from a cap")
+	}
+	var nai *Info
+	if rw, err = nai.Mint(name, c); err != nil {
+		t.Fatal(err)
+	}
+	bad := strings.Split(rw, ".")[0] + "." + toks[1]
+	if _, err := capAuth(t, name, bad); err == nil {
+		t.Fatal("tampered token didn't fail")
+	}
+	c.Expires = time.Now().Add(-time.Second)
+	old, err := nai.Mint(name, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := capAuth(t, name, old); err == nil {
+		t.Fatal("expired token didn't fail")
+	}
+
+	// servers not accepting caps must fail
+	c1, c2 := ch.NewPipePair(5)
+	go CapAtClient(c1, name, tok, "foo")
+	if _, err := AtServer(c2, name, "foo"); err == nil {
+		t.Fatal("cap accepted by AtServer")
+	}
+}
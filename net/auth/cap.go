@@ -0,0 +1,248 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+	A capability grants access to a subtree of a zx tree, read-only
+	or read-write, and optionally only to files matching a zx/pred predicate,
+	on behalf of a user and until it expires.
+
+	Capabilities are minted as tokens by users holding keys for an auth domain
+	(see Info.Mint) and are signed using the user's private key for the domain,
+	if any, or the shared key otherwise.
+	A peer holding a token authenticates using CapAtClient instead of
+	keys, and servers willing to accept tokens use CapAtServer, which sets
+	Info.Cap to the capability.
+	The capability is negotiated using CapProto in the proto list of the auth msg.
+
+	The ancestors of the capability path may be walked but not read or written.
+	The predicate is checked at the directories and files in the subtree, except
+	for walking directories, which is always allowed within the subtree.
+*/
+struct Cap {
+	Uid     string    // user granting access
+	Tree    string    // tree name, or "" for any tree
+	Path    string    // root of the subtree granted
+	RW      bool      // read-write or read-only
+	Pred    string    // zx/pred predicate for files granted, or ""
+	Expires time.Time // when the capability expires
+	alg     string    // PKProto or "hmac"
+	sig     []byte
+}
+
+const CapProto = "cap"
+
+var (
+	ErrExpired = errors.New("capability expired")
+	ErrBadCap  = errors.New("bad capability")
+
+	capEnc = base64.RawURLEncoding
+)
+
+// Return the data signed for the capability.
+func (c *Cap) body() []byte {
+	mode := "ro"
+	if c.RW {
+		mode = "rw"
+	}
+	flds := []string{"cap1", c.Uid, c.Tree, c.Path, mode,
+		strconv.FormatInt(c.Expires.Unix(), 10), c.Pred, c.alg}
+	return []byte(strings.Join(flds, "\n"))
+}
+
+func (c *Cap) String() string {
+	if c == nil {
+		return "<nil cap>"
+	}
+	mode := "ro"
+	if c.RW {
+		mode = "rw"
+	}
+	s := fmt.Sprintf("cap %s %s!%s %s until %s", c.Uid, c.Tree, c.Path, mode,
+		c.Expires.Format(time.RFC3339))
+	if c.Pred != "" {
+		s += " if " + c.Pred
+	}
+	return s
+}
+
+/*
+	Mint a token for a capability on behalf of the user authenticated by ai,
+	using its keys for the named auth domain.
+	The Uid, alg, and signature in c are ignored and set by Mint.
+	A nil ai means the local user.
+	Tokens can't be minted using auth info resulting from a capability.
+*/
+func (ai *Info) Mint(name string, c *Cap) (string, error) {
+	if ai != nil && ai.Cap != nil {
+		return "", errors.New("can't mint from a capability")
+	}
+	if c.Path == "" {
+		c.Path = "/"
+	}
+	if !path.IsAbs(c.Path) {
+		return "", fmt.Errorf("%s: %s", c.Path, ErrBadCap)
+	}
+	c.Path = path.Clean(c.Path)
+	if c.Expires.IsZero() {
+		return "", fmt.Errorf("no expiration time: %s", ErrBadCap)
+	}
+	user := ""
+	if ai != nil {
+		user = ai.Uid
+	}
+	if puser, k, err := LoadPrivKey(KeyDir(), name); err == nil && (user == "" || puser == user) {
+		c.Uid, c.alg = puser, PKProto
+		c.sig = ed25519.Sign(k, c.body())
+		return c.token(), nil
+	}
+	ks, err := domainKeys(name)
+	if err != nil {
+		return "", fmt.Errorf("no key: %s", err)
+	}
+	k := &ks[0]
+	if user != "" {
+		if k = findKey(ks, user); k == nil {
+			return "", fmt.Errorf("%s: %s", user, ErrNoUser)
+		}
+	}
+	c.Uid, c.alg = k.Uid, "hmac"
+	c.sig = capMAC(k.Key, c.body())
+	return c.token(), nil
+}
+
+func capMAC(k, dat []byte) []byte {
+	h := hmac.New(sha256.New, k)
+	h.Write(dat)
+	return h.Sum(nil)
+}
+
+func (c *Cap) token() string {
+	return capEnc.EncodeToString(c.body()) + "." + capEnc.EncodeToString(c.sig)
+}
+
+// Parse a capability token without checking its signature.
+func ParseCap(token string) (*Cap, error) {
+	toks := strings.Split(token, ".")
+	if len(toks) != 2 {
+		return nil, ErrBadCap
+	}
+	body, err := capEnc.DecodeString(toks[0])
+	if err != nil {
+		return nil, ErrBadCap
+	}
+	sig, err := capEnc.DecodeString(toks[1])
+	if err != nil {
+		return nil, ErrBadCap
+	}
+	flds := strings.Split(string(body), "\n")
+	if len(flds) != 8 || flds[0] != "cap1" || flds[1] == "" ||
+		(flds[4] != "ro" && flds[4] != "rw") || !path.IsAbs(flds[3]) {
+		return nil, ErrBadCap
+	}
+	exp, err := strconv.ParseInt(flds[5], 10, 64)
+	if err != nil {
+		return nil, ErrBadCap
+	}
+	c := &Cap{
+		Uid:     flds[1],
+		Tree:    flds[2],
+		Path:    path.Clean(flds[3]),
+		RW:      flds[4] == "rw",
+		Expires: time.Unix(exp, 0),
+		Pred:    flds[6],
+		alg:     flds[7],
+		sig:     sig,
+	}
+	if !bytes.Equal(c.body(), body) {
+		return nil, ErrBadCap
+	}
+	return c, nil
+}
+
+// Check the token for the named auth domain and return the capability
+// and the key for its user.
+func checkCap(name, token string) (*Cap, *Key, error) {
+	c, err := ParseCap(token)
+	if err != nil {
+		return nil, nil, err
+	}
+	var k *Key
+	ok := false
+	switch c.alg {
+	case PKProto:
+		ks, _ := LoadAuthKeys(KeyDir(), name)
+		if k = findKey(ks, c.Uid); k != nil {
+			ok = ed25519.Verify(ed25519.PublicKey(k.Key), c.body(), c.sig)
+		}
+	case "hmac":
+		ks, _ := domainKeys(name)
+		if k = findKey(ks, c.Uid); k != nil {
+			ok = hmac.Equal(capMAC(k.Key, c.body()), c.sig)
+		}
+	}
+	if !ok {
+		return nil, nil, fmt.Errorf("%s: %s", c.Uid, ErrBadCap)
+	}
+	if time.Now().After(c.Expires) {
+		return nil, nil, ErrExpired
+	}
+	return c, k, nil
+}
+
+// Is p the same as pref or a path under pref?
+func inPath(p, pref string) bool {
+	return p == pref || pref == "/" || strings.HasPrefix(p, pref+"/")
+}
+
+/*
+	Does the capability allow access to the path p in the tree named
+	(or any tree if the name is "")?
+	The access is given by permission bits 0111, 0222, 0444, as used
+	by zx.Dir.Can; the predicate is not checked here.
+	A nil capability allows everything.
+*/
+func (c *Cap) Allows(tree, p string, what int) bool {
+	if c == nil {
+		return true
+	}
+	if time.Now().After(c.Expires) {
+		return false
+	}
+	if c.Tree != "" && tree != "" && tree != c.Tree {
+		return false
+	}
+	if what&0222 != 0 && !c.RW {
+		return false
+	}
+	p = path.Clean(p)
+	if inPath(p, c.Path) {
+		return true
+	}
+	return what&^0111 == 0 && inPath(c.Path, p)
+}
+
+// Return the depth of p in the capability subtree, or -1 if it's not in it.
+func (c *Cap) Depth(p string) int {
+	p = path.Clean(p)
+	if !inPath(p, c.Path) {
+		return -1
+	}
+	if p == c.Path {
+		return 0
+	}
+	rel := strings.TrimPrefix(p[len(c.Path):], "/")
+	return strings.Count(rel, "/") + 1
+}
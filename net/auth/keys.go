@@ -0,0 +1,132 @@
+package auth
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+)
+
+var ErrNoUser = errors.New("no such user")
+
+// Return the key for user in ks, or nil.
+func findKey(ks []Key, user string) *Key {
+	for i := range ks {
+		if ks[i].Uid == user {
+			return &ks[i]
+		}
+	}
+	return nil
+}
+
+// Return the keys for the named auth domain.
+// The key file is read again to pick up changes, but we still use the
+// keys for the default domain loaded on init if it can't be read.
+func domainKeys(name string) ([]Key, error) {
+	ks, err := LoadKey(KeyDir(), name)
+	if err != nil && (name == "" || name == "default") && keys != nil {
+		return keys, nil
+	}
+	return ks, err
+}
+
+// Write the keys to the given key file, replacing its contents.
+func writeKeys(file string, ks []Key) error {
+	tmp := file + ".tmp"
+	fd, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(fd)
+	for _, k := range ks {
+		fmt.Fprintf(w, "%s", k.Uid)
+		for _, g := range k.Gids {
+			fmt.Fprintf(w, " %s", g)
+		}
+		fmt.Fprintf(w, "\n%x\n", k.Key)
+	}
+	err = w.Flush()
+	if cerr := fd.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp, 0600)
+	}
+	if err == nil {
+		err = os.Rename(tmp, file)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// Remove the key for the given user from the named auth domain
+// kept at KeyFile(dir, name).
+func DelKey(dir, name, user string) error {
+	if dir == "" {
+		dir = KeyDir()
+	}
+	ks, err := LoadKey(dir, name)
+	if err != nil {
+		return err
+	}
+	nks := []Key{}
+	for _, k := range ks {
+		if k.Uid != user {
+			nks = append(nks, k)
+		}
+	}
+	if len(nks) == len(ks) {
+		return fmt.Errorf("%s: %s", user, ErrNoUser)
+	}
+	return writeKeys(KeyFile(dir, name), nks)
+}
+
+// Set the groups for the given user in the named auth domain
+// kept at KeyFile(dir, name).
+// A user with no groups is a member of just the group with its name.
+func SetGroups(dir, name, user string, groups ...string) error {
+	if dir == "" {
+		dir = KeyDir()
+	}
+	ks, err := LoadKey(dir, name)
+	if err != nil {
+		return err
+	}
+	k := findKey(ks, user)
+	if k == nil {
+		return fmt.Errorf("%s: %s", user, ErrNoUser)
+	}
+	if len(groups) == 0 {
+		groups = []string{user}
+	}
+	k.Gids = groups
+	return writeKeys(KeyFile(dir, name), ks)
+}
+
+// Return the auth info for user as kept in the key file for the named auth
+// domain, without authenticating the user.
+// This is meant for servers speaking protocols without clive auth
+// (eg., 9P), which must trust the user name given by the peer.
+func UserInfo(name, user string) (*Info, error) {
+	ks, err := domainKeys(name)
+	if err != nil {
+		return nil, err
+	}
+	k := findKey(ks, user)
+	if k == nil {
+		return nil, fmt.Errorf("%s: %s", user, ErrNoUser)
+	}
+	ai := &Info{
+		Uid:       k.Uid,
+		SpeaksFor: user,
+		Gids:      map[string]bool{},
+		Proto:     map[string]bool{},
+		Ok:        true,
+	}
+	for _, g := range k.Gids {
+		ai.Gids[g] = true
+	}
+	return ai, nil
+}
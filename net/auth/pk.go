@@ -0,0 +1,182 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	crand "crypto/rand"
+	"fmt"
+	"path"
+)
+
+/*
+	Public key authentication.
+
+	A user may keep an Ed25519 private key for an auth domain at PrivKeyFile(),
+	and servers keep at AuthKeysFile() the public keys for the users they accept
+	in the domain (and their groups), using the same format used for key files.
+
+	The mode is negotiated using the proto list in the auth msg: each end
+	offers PKProto if it has both a private key and authorized keys for the domain.
+	If both offer it, each end signs the challenge from the other one, which checks
+	the signature using the public key authorized for the peer's user.
+	Users not authorized fail, on both ends, so the dialer must authorize
+	the key of the callee's user as well.
+	Peers not speaking PKProto use the shared key protocol.
+*/
+const PKProto = "ed25519"
+
+// Return the path to the file at dir where the private key for the auth domain named is kept.
+func PrivKeyFile(dir, name string) string {
+	if name == "" {
+		name = "default"
+	}
+	return path.Join(dir, "clive."+name+".ed25519")
+}
+
+// Return the path to the file at dir where the authorized public keys for the
+// auth domain named are kept.
+func AuthKeysFile(dir, name string) string {
+	if name == "" {
+		name = "default"
+	}
+	return path.Join(dir, "clive."+name+".authorized")
+}
+
+// Generate a new private key for user in the named auth domain and save it
+// at PrivKeyFile(dir, name), replacing any previous one.
+// The public key is returned, to be authorized at servers (see AuthorizeKey).
+func GenKey(dir, name, user string) (ed25519.PublicKey, error) {
+	if dir == "" {
+		dir = KeyDir()
+	}
+	pub, priv, err := ed25519.GenerateKey(crand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	ks := []Key{Key{Uid: user, Key: priv}}
+	if err := writeKeys(PrivKeyFile(dir, name), ks); err != nil {
+		return nil, err
+	}
+	return pub, nil
+}
+
+// Load the private key for the named auth domain kept at dir.
+// Return the user name for the key and the key.
+func LoadPrivKey(dir, name string) (string, ed25519.PrivateKey, error) {
+	if dir == "" {
+		dir = KeyDir()
+	}
+	file := PrivKeyFile(dir, name)
+	ks, err := loadKeys(file)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(ks[0].Key) != ed25519.PrivateKeySize {
+		return "", nil, fmt.Errorf("%s: bad private key", file)
+	}
+	return ks[0].Uid, ed25519.PrivateKey(ks[0].Key), nil
+}
+
+// Return the public key for the private key kept for the named auth domain.
+func PubKey(dir, name string) (ed25519.PublicKey, error) {
+	_, k, err := LoadPrivKey(dir, name)
+	if err != nil {
+		return nil, err
+	}
+	return k.Public().(ed25519.PublicKey), nil
+}
+
+// Load the public keys authorized for the named auth domain kept at dir.
+func LoadAuthKeys(dir, name string) ([]Key, error) {
+	if dir == "" {
+		dir = KeyDir()
+	}
+	ks, err := loadKeys(AuthKeysFile(dir, name))
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range ks {
+		if len(k.Key) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("%s: bad public key", k.Uid)
+		}
+	}
+	return ks, nil
+}
+
+// Authorize the public key for user, as a member of the given groups, in the named
+// auth domain kept at AuthKeysFile(dir, name).
+// The key is added or replaced as done by SaveKey.
+func AuthorizeKey(dir, name, user string, pub ed25519.PublicKey, groups ...string) error {
+	if dir == "" {
+		dir = KeyDir()
+	}
+	if len(pub) != ed25519.PublicKeySize {
+		return fmt.Errorf("%s: bad public key", user)
+	}
+	ks, _ := loadKeys(AuthKeysFile(dir, name))
+	nk := Key{Uid: user, Gids: groups, Key: pub}
+	if k := findKey(ks, user); k != nil {
+		*k = nk
+	} else {
+		ks = append(ks, nk)
+	}
+	return writeKeys(AuthKeysFile(dir, name), ks)
+}
+
+// Remove the public key authorized for user in the named auth domain.
+func UnauthorizeKey(dir, name, user string) error {
+	if dir == "" {
+		dir = KeyDir()
+	}
+	ks, err := LoadAuthKeys(dir, name)
+	if err != nil {
+		return err
+	}
+	nks := []Key{}
+	for _, k := range ks {
+		if k.Uid != user {
+			nks = append(nks, k)
+		}
+	}
+	if len(nks) == len(ks) {
+		return fmt.Errorf("%s: %s", user, ErrNoUser)
+	}
+	return writeKeys(AuthKeysFile(dir, name), nks)
+}
+
+// Keys used for public key auth in a conn.
+struct pkKeys {
+	user string
+	priv ed25519.PrivateKey
+	auth []Key
+}
+
+// Load the keys used for public key auth in the named domain, if any.
+func domainPKKeys(name string) *pkKeys {
+	pk := &pkKeys{}
+	pk.user, pk.priv, _ = LoadPrivKey(KeyDir(), name)
+	pk.auth, _ = LoadAuthKeys(KeyDir(), name)
+	return pk
+}
+
+// Should we offer PKProto?
+func (pk *pkKeys) offers() bool {
+	return pk.priv != nil && len(pk.auth) > 0
+}
+
+// Response for the challenge ch.
+func (pk *pkKeys) sign(ch []byte) []byte {
+	if pk.priv == nil {
+		return []byte("nokey")
+	}
+	return ed25519.Sign(pk.priv, ch)
+}
+
+// Check sig, the response from user for the challenge ch.
+// Users not authorized fail.
+func (pk *pkKeys) verify(user string, ch, sig []byte) bool {
+	k := findKey(pk.auth, user)
+	if k == nil {
+		return false
+	}
+	return ed25519.Verify(ed25519.PublicKey(k.Key), ch, sig)
+}
@@ -0,0 +1,362 @@
+/*
+	Discovery of clive services in the local network.
+
+	Servers announce themselves using an Announcer, which answers
+	queries multicast to a well-known group (GroupV4 and GroupV6, at Port)
+	with an ad including their name, address, and tree names.
+	Clients find them using Lookup.
+
+	Queries and ads are text datagrams:
+		clive q	name
+		clive ad	name	addr	tree,tree...
+	An empty name in a query matches all ads.
+*/
+package disc
+
+import (
+	"clive/dbg"
+	"clive/x/code.google.com/p/go.net/ipv4"
+	"clive/x/code.google.com/p/go.net/ipv6"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// An ad for a service found in the local network.
+struct Ad {
+	Name  string   // symbolic name, the host name by default
+	Addr  string   // network!host!port to dial the service
+	Trees []string // names of the trees served
+}
+
+// An announcer answering queries for an ad.
+struct Announcer {
+	*dbg.Flag
+	lk sync.Mutex
+	ad Ad
+	cs []net.PacketConn
+}
+
+interface mcaster {
+	JoinGroup(ifi *net.Interface, group net.Addr) error
+	SetMulticastInterface(ifi *net.Interface) error
+	SetMulticastLoopback(on bool) error
+}
+
+var (
+	// Multicast groups and UDP port used for discovery.
+	GroupV4 = "239.255.0.42"
+	GroupV6 = "ff02::42"
+	Port    = 8003
+
+	// Interface used for multicast, or nil to let the system pick one.
+	// Set to the loopback interface to discover just local services.
+	Iface *net.Interface
+
+	// Time waited for replies to a query.
+	Timeout = 500 * time.Millisecond
+
+	ErrNotFound = errors.New("no such service")
+	ErrUnix     = errors.New("can't announce unix addresses")
+
+	_p4 mcaster = &ipv4.PacketConn{}
+	_p6 mcaster = &ipv6.PacketConn{}
+)
+
+const (
+	qhdr  = "clive q\t"
+	adhdr = "clive ad\t"
+)
+
+func (a *Ad) String() string {
+	return fmt.Sprintf("%s\t%s\t%s", a.Name, a.Addr, strings.Join(a.Trees, ","))
+}
+
+// Return true if the ad lists the given tree.
+func (a *Ad) Has(tree string) bool {
+	for _, t := range a.Trees {
+		if t == tree {
+			return true
+		}
+	}
+	return false
+}
+
+func parseAd(s string) (*Ad, error) {
+	if !strings.HasPrefix(s, adhdr) {
+		return nil, errors.New("not an ad")
+	}
+	toks := strings.Split(s[len(adhdr):], "\t")
+	if len(toks) != 3 || toks[0] == "" || len(strings.Split(toks[1], "!")) != 3 {
+		return nil, errors.New("bad ad")
+	}
+	a := &Ad{Name: toks[0], Addr: toks[1]}
+	if toks[2] != "" {
+		a.Trees = strings.Split(toks[2], ",")
+	}
+	return a, nil
+}
+
+// Replace a local host in the ad address with the IP it came from,
+// so it can be dialed from here.
+func (a *Ad) fillHost(src net.Addr) {
+	ua, ok := src.(*net.UDPAddr)
+	if !ok {
+		return
+	}
+	toks := strings.Split(a.Addr, "!")
+	switch toks[1] {
+	case "", "*", "local", "localhost":
+	default:
+		return
+	}
+	h := ua.IP.String()
+	if ua.IP.To4() == nil {
+		if ua.Zone != "" {
+			h += "%" + ua.Zone
+		}
+		h = "[" + h + "]"
+	}
+	if toks[0] == "*" {
+		toks[0] = "tcp"
+	}
+	a.Addr = strings.Join([]string{toks[0], h, toks[2]}, "!")
+}
+
+func group(nw string) *net.UDPAddr {
+	if nw == "udp4" {
+		return &net.UDPAddr{IP: net.ParseIP(GroupV4), Port: Port}
+	}
+	ga := &net.UDPAddr{IP: net.ParseIP(GroupV6), Port: Port}
+	if Iface != nil {
+		ga.Zone = Iface.Name
+	}
+	return ga
+}
+
+func mcast(nw string, c net.PacketConn) mcaster {
+	if nw == "udp4" {
+		return ipv4.NewPacketConn(c)
+	}
+	return ipv6.NewPacketConn(c)
+}
+
+// Listen for datagrams sent to the group for nw (udp4 or udp6)
+func listen(nw string) (net.PacketConn, error) {
+	ga := group(nw)
+	// binding to the group address permits other listeners in the same host.
+	c, err := net.ListenPacket(nw, ga.String())
+	if err != nil {
+		return nil, err
+	}
+	mc := mcast(nw, c)
+	if err := mc.JoinGroup(Iface, ga); err != nil {
+		c.Close()
+		return nil, err
+	}
+	if Iface != nil {
+		mc.SetMulticastInterface(Iface)
+	}
+	mc.SetMulticastLoopback(true)
+	return c, nil
+}
+
+// Make a conn to send to the group for nw (udp4 or udp6)
+func dial(nw string) (net.PacketConn, error) {
+	c, err := net.ListenPacket(nw, ":0")
+	if err != nil {
+		return nil, err
+	}
+	mc := mcast(nw, c)
+	if Iface != nil {
+		if err := mc.SetMulticastInterface(Iface); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	mc.SetMulticastLoopback(true)
+	return c, nil
+}
+
+// Start answering queries for the given ad.
+// It's an error if neither IPv4 nor IPv6 multicast can be used.
+// Unix addresses can't be dialed from other hosts and are not announced.
+func Announce(ad *Ad) (*Announcer, error) {
+	if strings.HasPrefix(ad.Addr, "unix!") {
+		return nil, ErrUnix
+	}
+	a := &Announcer{
+		Flag: &dbg.Flag{Tag: "disc"},
+		ad:   *ad,
+	}
+	a.SetTrees(ad.Trees...)
+	var err error
+	for _, nw := range []string{"udp4", "udp6"} {
+		c, e := listen(nw)
+		if e != nil {
+			if err == nil {
+				err = e
+			}
+			continue
+		}
+		a.cs = append(a.cs, c)
+		go a.loop(c)
+	}
+	if len(a.cs) == 0 {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *Announcer) loop(c net.PacketConn) {
+	buf := make([]byte, 1024)
+	for {
+		n, src, err := c.ReadFrom(buf)
+		if err != nil {
+			a.Dprintf("%s: %s\n", c.LocalAddr(), err)
+			return
+		}
+		q := string(buf[:n])
+		if !strings.HasPrefix(q, qhdr) {
+			continue
+		}
+		name := q[len(qhdr):]
+		a.lk.Lock()
+		ad := a.ad
+		a.lk.Unlock()
+		if name != "" && name != ad.Name {
+			continue
+		}
+		a.Dprintf("%s: query %q: %s\n", src, name, &ad)
+		if _, err := c.WriteTo([]byte(adhdr+ad.String()), src); err != nil {
+			a.Dprintf("%s: %s\n", src, err)
+		}
+	}
+}
+
+// Return a copy of the ad announced.
+func (a *Announcer) Ad() Ad {
+	a.lk.Lock()
+	defer a.lk.Unlock()
+	ad := a.ad
+	ad.Trees = append([]string{}, a.ad.Trees...)
+	return ad
+}
+
+// Change the name announced.
+func (a *Announcer) Rename(name string) {
+	a.lk.Lock()
+	a.ad.Name = name
+	a.lk.Unlock()
+}
+
+// Change the trees announced.
+func (a *Announcer) SetTrees(trees ...string) {
+	ts := append([]string{}, trees...)
+	sort.Strings(ts)
+	a.lk.Lock()
+	a.ad.Trees = ts
+	a.lk.Unlock()
+}
+
+// Stop announcing.
+func (a *Announcer) Close() error {
+	for _, c := range a.cs {
+		c.Close()
+	}
+	return nil
+}
+
+// Send a query to the group for nw (udp4 or udp6) and
+// send the ads received to rc, and the error (if any) to ec.
+func query(nw, name string, rc chan<- *Ad, ec chan<- error) {
+	c, err := dial(nw)
+	if err != nil {
+		ec <- err
+		return
+	}
+	defer c.Close()
+	if _, err := c.WriteTo([]byte(qhdr+name), group(nw)); err != nil {
+		ec <- err
+		return
+	}
+	c.SetReadDeadline(time.Now().Add(Timeout))
+	buf := make([]byte, 8*1024)
+	for {
+		n, src, err := c.ReadFrom(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				err = nil
+			}
+			ec <- err
+			return
+		}
+		ad, err := parseAd(string(buf[:n]))
+		if err != nil || (name != "" && ad.Name != name) {
+			continue
+		}
+		ad.fillHost(src)
+		rc <- ad
+	}
+}
+
+// Query for the ads with the given name, or for all ads if name is "",
+// waiting Timeout for replies, and return those found, sorted by name.
+// ErrNotFound is returned if none are found.
+func Lookup(name string) ([]*Ad, error) {
+	nws := []string{"udp4", "udp6"}
+	rc := make(chan *Ad)
+	ec := make(chan error, len(nws))
+	for _, nw := range nws {
+		go query(nw, name, rc, ec)
+	}
+	ads := []*Ad{}
+	seen := map[string]bool{}
+	var err error
+	nerrs := 0
+	for ndone := 0; ndone < len(nws); {
+		select {
+		case ad := <-rc:
+			if s := ad.String(); !seen[s] {
+				seen[s] = true
+				ads = append(ads, ad)
+			}
+		case e := <-ec:
+			if e != nil {
+				err = e
+				nerrs++
+			}
+			ndone++
+		}
+	}
+	if len(ads) == 0 {
+		// report errors only if we couldn't query at all
+		if nerrs < len(nws) {
+			err = ErrNotFound
+		}
+		return nil, err
+	}
+	sort.Sort(byName(ads))
+	return ads, nil
+}
+
+type byName []*Ad
+
+func (b byName) Less(i, j int) bool {
+	if b[i].Name != b[j].Name {
+		return b[i].Name < b[j].Name
+	}
+	return b[i].Addr < b[j].Addr
+}
+
+func (b byName) Swap(i, j int) {
+	b[i], b[j] = b[j], b[i]
+}
+
+func (b byName) Len() int {
+	return len(b)
+}
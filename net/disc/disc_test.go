@@ -0,0 +1,116 @@
+package disc
+
+import (
+	"clive/dbg"
+	"net"
+	"testing"
+)
+
+var (
+	verb   = false
+	printf = dbg.FlagPrintf(&verb)
+)
+
+func useLoopback(t *testing.T) {
+	ifs, err := net.Interfaces()
+	if err != nil {
+		t.Skip("no interfaces: ", err)
+	}
+	for i := range ifs {
+		if ifs[i].Flags&net.FlagLoopback != 0 && ifs[i].Flags&net.FlagUp != 0 {
+			Iface = &ifs[i]
+			Port = 8093
+			return
+		}
+	}
+	t.Skip("no loopback interface")
+}
+
+func TestAds(t *testing.T) {
+	verb = testing.Verbose()
+	ad := &Ad{Name: "x", Addr: "tcp!*!8002", Trees: []string{"main", "dump"}}
+	a, err := parseAd(adhdr + ad.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.String() != ad.String() || !a.Has("dump") || a.Has("other") {
+		t.Fatalf("bad ad %s", a)
+	}
+	a.fillHost(&net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 8003})
+	if a.Addr != "tcp!10.0.0.1!8002" {
+		t.Fatalf("bad addr %s", a.Addr)
+	}
+	a.fillHost(&net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: 8003})
+	if a.Addr != "tcp!10.0.0.1!8002" {
+		t.Fatalf("host replaced in %s", a.Addr)
+	}
+	for _, s := range []string{"", "clive ad\tx", "clive ad\tx\tbad\t", "clive q\tx"} {
+		if _, err := parseAd(s); err == nil {
+			t.Fatalf("could parse %q", s)
+		}
+	}
+}
+
+func TestLookup(t *testing.T) {
+	verb = testing.Verbose()
+	useLoopback(t)
+	a1, err := Announce(&Ad{Name: "disc1", Addr: "tcp!*!8002", Trees: []string{"main"}})
+	if err != nil {
+		t.Skip("no multicast: ", err)
+	}
+	defer a1.Close()
+	a1.Debug = testing.Verbose()
+	if _, err := Announce(&Ad{Name: "disc2", Addr: "unix!*!8002"}); err != ErrUnix {
+		t.Fatalf("unix ad: %v", err)
+	}
+	a2, err := Announce(&Ad{Name: "disc2", Addr: "tcp!*!8004", Trees: []string{"b", "a"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a2.Close()
+
+	ads, err := Lookup("disc1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, a := range ads {
+		printf("ad %s\n", a)
+	}
+	if ads[0].Name != "disc1" || !ads[0].Has("main") || ads[0].Addr == "tcp!*!8002" {
+		t.Fatalf("bad ad %s", ads[0])
+	}
+
+	ads, err = Lookup("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for _, a := range ads {
+		printf("ad %s\n", a)
+		if a.Name == "disc1" || a.Name == "disc2" {
+			n++
+		}
+	}
+	if n < 2 {
+		t.Fatalf("found %d ads", n)
+	}
+
+	a2.Rename("disc3")
+	a2.SetTrees("main")
+	ads, err = Lookup("disc3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, a := range ads {
+		if a.Name != "disc3" || !a.Has("main") || a.Has("a") {
+			t.Fatalf("bad ad %s", a)
+		}
+	}
+	if _, err := Lookup("disc2"); err != ErrNotFound {
+		t.Fatalf("old name: %v", err)
+	}
+	a1.Close()
+	if _, err := Lookup("disc1"); err != ErrNotFound {
+		t.Fatalf("closed announcer: %v", err)
+	}
+}
@@ -71,9 +71,17 @@ func AuthWebSocketHandler(h websocket.Handler) http.HandlerFunc {
 // Authenticate before calling the handler.
 // When TLS is disabled, or there's no key file, auth is considered ok.
 func AuthHandler(fn http.HandlerFunc) http.HandlerFunc {
+	return AuthUidHandler(func(w http.ResponseWriter, r *http.Request, uid string) {
+		fn(w, r)
+	})
+}
+
+// Like AuthHandler, but the handler is also given the user who did auth,
+// or "" if auth is disabled.
+func AuthUidHandler(fn func(w http.ResponseWriter, r *http.Request, uid string)) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if auth.TLSserver == nil || !auth.Enabled {
-			fn(w, r)
+			fn(w, r, "")
 			return
 		}
 		clive, err := r.Cookie("clive")
@@ -95,10 +103,7 @@ func AuthHandler(fn http.HandlerFunc) http.HandlerFunc {
 			authFailed(w, r)
 			return
 		}
-		// TODO: We should decorate r adding the user id to
-		// the url as a query, so fn can inspect the query and
-		// know which user did auth.
-		fn(w, r)
+		fn(w, r, u)
 	}
 }
 
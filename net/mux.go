@@ -13,24 +13,49 @@ import (
 	"time"
 )
 
+// []byte messages of at least this size are compressed in muxes
+// dialed or served through non-unix networks, if the peer is able
+// to decompress them (see ch.Mux.Compress).
+// Set to 0 to disable compression.
+var MuxZSz = 1024
+
+func muxCompress(m *ch.Mux, nw string) {
+	if MuxZSz > 0 && nw != "unix" {
+		m.Compress(MuxZSz)
+	}
+}
+
 // Dial the given address and return a muxed connection
 // The connection is secured if tlscfg is not nil.
+// Large messages are compressed if the network is not unix and
+// the server can decompress them (see MuxZSz).
+// Connections started by the server are discarded.
 func MuxDial(addr string, tlscfg ...*tls.Config) (m *ch.Mux, err error) {
-	var cfg *tls.Config
-	if len(tlscfg) > 0 {
-		cfg = tlscfg[0]
-	}
-	nc, err := dial(addr, cfg)
+	m, err = MuxDialIn(addr, tlscfg...)
 	if err == nil {
-		m = ch.NewMux(nc, true)
-		m.Tag = addr
 		go func() {
 			for _ = range m.In {
 			}
 		}()
-		return m, nil
 	}
-	return nil, err
+	return m, err
+}
+
+// Like MuxDial, but the caller must receive from m.In the
+// connections started by the server.
+func MuxDialIn(addr string, tlscfg ...*tls.Config) (m *ch.Mux, err error) {
+	var cfg *tls.Config
+	if len(tlscfg) > 0 {
+		cfg = tlscfg[0]
+	}
+	nc, err := dial(addr, cfg)
+	if err != nil {
+		return nil, err
+	}
+	m = ch.NewMux(nc, true)
+	m.Tag = addr
+	muxCompress(m, nc.RemoteAddr().Network())
+	return m, nil
 }
 
 func serveMuxLoop(l net.Listener, rc chan *ch.Mux, ec chan bool,
@@ -80,6 +105,8 @@ func serveMuxLoop(l net.Listener, rc chan *ch.Mux, ec chan bool,
 		}
 		mux := ch.NewMux(fd, false)
 		mux.Tag = raddr
+		// don't block accepting while talking to this client
+		go muxCompress(mux, l.Addr().Network())
 		if ok := rc <- mux; !ok {
 			close(mux.In, cerror(rc))
 			close(ec, cerror(rc))
@@ -101,7 +128,7 @@ func serveMux1(nw, host, port string, tlscfg *tls.Config) (c <-chan *ch.Mux, ec
 			}
 		}
 	}
-	if nw == "tcp" && (host == "local" || host == "*" || host == "localhost") {
+	if (nw == "tcp" || nw == "ws") && (host == "local" || host == "*" || host == "localhost") {
 		host = ""
 	}
 	addr := host + ":" + port
@@ -111,7 +138,14 @@ func serveMux1(nw, host, port string, tlscfg *tls.Config) (c <-chan *ch.Mux, ec
 		os.Remove(port)
 	}
 	dbg.Warn("listen at %s (%s:%s)", tag, nw, addr)
-	fd, err := net.Listen(nw, addr)
+	var fd net.Listener
+	if nw == "ws" {
+		// TLS, if any, is handled by the ws listener
+		fd, err = listenWS(addr, tlscfg)
+		tlscfg = nil
+	} else {
+		fd, err = net.Listen(nw, addr)
+	}
 	if err != nil {
 		return nil, nil, err
 	}
@@ -172,8 +206,11 @@ func serveMuxBoth(c1 <-chan *ch.Mux, ec1 chan<- bool,
 // transport fails and the service can't continue.
 // If the requested service name is already being served or any
 // other error happens, the error is returned (along with two nil channels).
-// If the network is "*", the service will be started on all networks.
+// If the network is "*", the service will be started on all networks
+// but ws, which must be requested explicitly.
 // The connections are secured if tlscfg is not nil.
+// Large messages are compressed if the network is not unix and
+// the client can decompress them (see MuxZSz).
 func MuxServe(addr string, tlscfg ...*tls.Config) (c <-chan *ch.Mux, ec chan bool, err error) {
 	var cfg *tls.Config
 	if len(tlscfg) > 0 {
@@ -199,6 +236,9 @@ func MuxServe(addr string, tlscfg ...*tls.Config) (c <-chan *ch.Mux, ec chan boo
 	case "unix", "tcp", "tls":
 		port := Port(nw, svc)
 		return serveMux1(nw, host, port, cfg)
+	case "ws":
+		port := Port("tcp", svc)
+		return serveMux1(nw, host, port, cfg)
 	default:
 		return nil, nil, ErrBadAddr
 	}
@@ -79,7 +79,7 @@ func Port(netw, svc string) string {
 // 	network!address!service
 //
 // The network/address may be "*" to use any available.
-// Known networks are unix, tcp, and tls; the default is tcp.
+// Known networks are unix, tcp, tls, and ws (WebSocket); the default is tcp.
 // The service defaults to "zx".
 func ParseAddr(addr string) (net, mach, svc string) {
 	args := strings.Split(addr, "!")
@@ -183,6 +183,9 @@ func dial(addr string, tlscfg *tls.Config) (c net.Conn, err error) {
 			return c, nil
 		}
 	}
+	if nw == "ws" {
+		return dialWS(host, port, tlscfg)
+	}
 	return nil, err
 }
 
@@ -270,7 +273,7 @@ func serve1(nw, host, port string, tlscfg *tls.Config) (c <-chan ch.Conn, ec cha
 			}
 		}
 	}
-	if nw == "tcp" && (host == "local" || host == "*" || host == "localhost") {
+	if (nw == "tcp" || nw == "ws") && (host == "local" || host == "*" || host == "localhost") {
 		host = ""
 	}
 	addr := host + ":" + port
@@ -280,7 +283,14 @@ func serve1(nw, host, port string, tlscfg *tls.Config) (c <-chan ch.Conn, ec cha
 		os.Remove(port)
 	}
 	dbg.Warn("listen at %s (%s:%s)", tag, nw, addr)
-	fd, err := net.Listen(nw, addr)
+	var fd net.Listener
+	if nw == "ws" {
+		// TLS, if any, is handled by the ws listener
+		fd, err = listenWS(addr, tlscfg)
+		tlscfg = nil
+	} else {
+		fd, err = net.Listen(nw, addr)
+	}
 	if err != nil {
 		return nil, nil, err
 	}
@@ -341,7 +351,8 @@ func serveBoth(c1 <-chan ch.Conn, ec1 chan<- bool,
 // transport fails and the service can't continue.
 // If the requested service name is already being served or any
 // other error happens, the error is returned (along with two nil channels).
-// If the network is "*", the service will be started on all networks.
+// If the network is "*", the service will be started on all networks
+// but ws, which must be requested explicitly.
 // The connections are secured if tlscfg is not nil.
 func Serve(addr string, tlscfg ...*tls.Config) (c <-chan ch.Conn, ec chan bool, err error) {
 	var cfg *tls.Config
@@ -368,6 +379,9 @@ func Serve(addr string, tlscfg ...*tls.Config) (c <-chan ch.Conn, ec chan bool,
 	case "unix", "tcp", "tls":
 		port := Port("unix", svc)
 		return serve1(nw, host, port, cfg)
+	case "ws":
+		port := Port("tcp", svc)
+		return serve1(nw, host, port, cfg)
 	default:
 		return nil, nil, ErrBadAddr
 	}
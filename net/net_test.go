@@ -122,6 +122,11 @@ func TestTCPConn(t *testing.T) {
 	testConn(t, "tcp!local!6667", nil, nil)
 }
 
+func TestWSConn(t *testing.T) {
+	os.Args[0] = "net.test"
+	testConn(t, "ws!local!6668", nil, nil)
+}
+
 func TestGoTLS(t *testing.T) {
 	os.Args[0] = "net.test"
 	ccfg, err := TLSCfg("/Users/nemo/.ssh/client")
@@ -251,6 +256,11 @@ func TestTCPMux(t *testing.T) {
 	testMux(t, "tcp!local!6667", nil, nil)
 }
 
+func TestWSMux(t *testing.T) {
+	os.Args[0] = "net.test"
+	testMux(t, "ws!local!6668", nil, nil)
+}
+
 func TestTLSMux(t *testing.T) {
 	verb := testing.Verbose()
 	printf := dbg.FlagPrintf(&verb)
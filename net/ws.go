@@ -0,0 +1,173 @@
+package net
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"golang.org/x/net/websocket"
+	"net"
+	"net/http"
+	"sync"
+)
+
+/*
+	The ws network carries the ch framing over WebSocket
+	binary frames, using the path WSPath at the HTTP server.
+	Addresses are ws!host!port, and the connection uses wss if a TLS
+	config is given, so that services may sit behind HTTP(S) reverse proxies
+	and be reached from browsers.
+*/
+
+// Path used for WebSocket connections.
+var WSPath = "/clive"
+
+// A WebSocket connection with writes buffered until flushed,
+// so each ch message goes in a single frame.
+struct wsConn {
+	*websocket.Conn
+	bw    *bufio.Writer
+	raddr net.Addr
+	donec chan bool // closed when done, for server conns
+	once  sync.Once
+}
+
+// A net.Addr for the remote end of server conns
+struct wsAddr {
+	addr string
+}
+
+func (a wsAddr) Network() string {
+	return "ws"
+}
+
+func (a wsAddr) String() string {
+	return a.addr
+}
+
+func newWSConn(ws *websocket.Conn, raddr net.Addr) *wsConn {
+	ws.PayloadType = websocket.BinaryFrame
+	return &wsConn{
+		Conn:  ws,
+		bw:    bufio.NewWriter(ws),
+		raddr: raddr,
+		donec: make(chan bool),
+	}
+}
+
+func (c *wsConn) Write(dat []byte) (int, error) {
+	return c.bw.Write(dat)
+}
+
+func (c *wsConn) Flush() error {
+	return c.bw.Flush()
+}
+
+func (c *wsConn) RemoteAddr() net.Addr {
+	if c.raddr != nil {
+		return c.raddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *wsConn) Close() error {
+	var err error
+	c.once.Do(func() {
+		c.bw.Flush()
+		err = c.Conn.Close()
+		close(c.donec)
+	})
+	return err
+}
+
+func dialWS(host, port string, tlscfg *tls.Config) (net.Conn, error) {
+	if host == "local" || host == "localhost" || host == "*" {
+		host = "127.0.0.1"
+	}
+	scheme := "ws"
+	if tlscfg != nil {
+		scheme = "wss"
+	}
+	cfg, err := websocket.NewConfig(fmt.Sprintf("%s://%s:%s%s", scheme, host, port, WSPath),
+		fmt.Sprintf("http://%s/", host))
+	if err != nil {
+		return nil, err
+	}
+	c, err := dialTCP(host, port, tlscfg)
+	if err != nil {
+		return nil, err
+	}
+	ws, err := websocket.NewClient(cfg, c)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return newWSConn(ws, nil), nil
+}
+
+// A net.Listener accepting WebSocket connections.
+struct wsListener {
+	l  net.Listener
+	c  chan net.Conn
+	ec chan bool
+}
+
+func (l *wsListener) Accept() (net.Conn, error) {
+	c, ok := <-l.c
+	if !ok {
+		err := cerror(l.c)
+		if err == nil {
+			err = errors.New("listener closed")
+		}
+		return nil, err
+	}
+	return c, nil
+}
+
+func (l *wsListener) Close() error {
+	close(l.ec)
+	return l.l.Close()
+}
+
+func (l *wsListener) Addr() net.Addr {
+	return wsAddr{l.l.Addr().String()}
+}
+
+func (l *wsListener) handle(ws *websocket.Conn) {
+	c := newWSConn(ws, wsAddr{ws.Request().RemoteAddr})
+	select {
+	case l.c <- c:
+	case <-l.ec:
+		c.Close()
+		return
+	}
+	// the conn is closed when the handler returns.
+	select {
+	case <-c.donec:
+	case <-l.ec:
+	}
+}
+
+// Listen for WebSocket connections at addr (host:port), using TLS if
+// tlscfg is not nil.
+func listenWS(addr string, tlscfg *tls.Config) (net.Listener, error) {
+	fd, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if tlscfg != nil {
+		fd = tls.NewListener(fd, tlscfg)
+	}
+	l := &wsListener{
+		l:  fd,
+		c:  make(chan net.Conn),
+		ec: make(chan bool),
+	}
+	mux := http.NewServeMux()
+	mux.Handle(WSPath, websocket.Server{Handler: l.handle})
+	go func() {
+		err := http.Serve(fd, mux)
+		close(l.c, err)
+	}()
+	return l, nil
+}
@@ -3,6 +3,7 @@ package ns
 import (
 	"clive/net/auth"
 	"clive/zx"
+	"clive/zx/p9"
 	"clive/zx/rzx"
 	"clive/zx/zux"
 	"fmt"
@@ -19,6 +20,7 @@ var (
 	_fs  zx.RWFs       = &NS{}
 	_fs2 zx.Finder     = &NS{}
 	_fs3 zx.FindGetter = &NS{}
+	_fs4 zx.Watcher    = &NS{}
 )
 
 // For testing
@@ -108,11 +110,44 @@ func DirFs(d zx.Dir) (zx.Fs, error) {
 		addr = addr[3:] // remove zx!
 		// rzx does cache dials, no need to do it again here.
 		return rzx.Dial(addr, auth.TLSclient)
+	case "disc":
+		// the addr is kept as is, to resolve it again if the server moves.
+		saddr := d.SAddr()
+		addr, err := discAddr(saddr)
+		if err != nil {
+			return nil, err
+		}
+		fs, err := rzx.Dial(addr[3:], auth.TLSclient)
+		if err != nil {
+			forgetDisc(saddr)
+		}
+		return fs, err
+	case "9p":
+		addr := d.SAddr()
+		if len(addr) < 3 {
+			panic("DirFs bug")
+		}
+		addr = addr[3:] // remove 9p!
+		// p9 does cache dials too.
+		return p9.Dial(addr)
 	default:
 		return nil, fmt.Errorf("ns: no tree for addr %q", d["addr"])
 	}
 }
 
+// Return the tree for a mount point, authenticated for ns.ai if set.
+func (ns *NS) dirFs(d zx.Dir) (zx.Fs, error) {
+	fs, err := DirFs(d)
+	if err != nil || ns.ai == nil {
+		return fs, err
+	}
+	afs, ok := fs.(zx.Auther)
+	if !ok {
+		return nil, fmt.Errorf("ns: %s: %s", d["addr"], zx.ErrPerm)
+	}
+	return afs.Auth(ns.ai)
+}
+
 func cerr(err error) <-chan []byte {
 	c := make(chan []byte)
 	close(c, err)
@@ -132,20 +167,34 @@ func rerr(err error) <-chan error {
 	return c
 }
 
+// On unions, the first entry where the file exists is used.
 func (ns *NS) Stat(path string) <-chan zx.Dir {
-	pname, ds, err := ns.Resolve(path)
+	_, ds, err := ns.Resolve(path)
 	if err != nil {
 		return derr(err)
 	}
+	path, _ = zx.UseAbsPath(path)
 	d := ds[0]
 	if d["addr"] == "" {
 		c := make(chan zx.Dir, 1)
-		d["path"] = fpath.Join(pname, d.SPath())
+		d["path"] = path
 		c <- d
 		close(c)
 		return c
 	}
-	fs, err := DirFs(d)
+	if len(ds) > 1 {
+		rc := make(chan zx.Dir, 1)
+		go func() {
+			_, _, rd, err := ns.found(ds)
+			if err == nil {
+				rd["path"] = path
+				rc <- rd
+			}
+			close(rc, err)
+		}()
+		return rc
+	}
+	fs, err := ns.dirFs(d)
 	if err != nil {
 		return derr(err)
 	}
@@ -154,7 +203,7 @@ func (ns *NS) Stat(path string) <-chan zx.Dir {
 		dc := fs.Stat(d.SPath())
 		rd := <-dc
 		if rd != nil {
-			rd["path"] = fpath.Join(pname, d.SPath())
+			rd["path"] = path
 			rc <- rd
 		}
 		close(rc, cerror(dc))
@@ -162,13 +211,43 @@ func (ns *NS) Stat(path string) <-chan zx.Dir {
 	return rc
 }
 
+// On unions, directories have the entries for all the mounts (see ns/union.go),
+// and the first entry where the file exists is used for files.
 func (ns *NS) Get(path string, off, count int64) <-chan []byte {
 	_, ds, err := ns.Resolve(path)
 	if err != nil {
 		return cerr(err)
 	}
+	if len(ds) > 1 {
+		c := make(chan []byte)
+		go func() {
+			d, fs, sd, err := ns.found(ds)
+			if err == nil && sd["type"] == "d" {
+				err = ns.getUnion(ds, off, count, c)
+				close(c, err)
+				return
+			}
+			xfs, ok := fs.(zx.Getter)
+			if err == nil && !ok {
+				err = fmt.Errorf("%s: tree is not a getter", path)
+			}
+			if err != nil {
+				close(c, err)
+				return
+			}
+			gc := xfs.Get(d.SPath(), off, count)
+			for b := range gc {
+				if ok := c <- b; !ok {
+					close(gc, cerror(c))
+					return
+				}
+			}
+			close(c, cerror(gc))
+		}()
+		return c
+	}
 	d := ds[0]
-	fs, err := DirFs(d)
+	fs, err := ns.dirFs(d)
 	if err != nil {
 		return cerr(err)
 	}
@@ -179,15 +258,16 @@ func (ns *NS) Get(path string, off, count int64) <-chan []byte {
 	return xfs.Get(d.SPath(), off, count)
 }
 
-// On unions, the first entry is always used.
+// On unions, the first entry where the file exists is used, or the
+// one for creates if it does not exist.
 func (ns *NS) Put(path string, ud zx.Dir, off int64, dc <-chan []byte) <-chan zx.Dir {
-	pname, ds, err := ns.Resolve(path)
+	_, ds, err := ns.Resolve(path)
 	if err != nil {
 		close(dc, err)
 		return derr(err)
 	}
-	d := ds[0]
-	fs, err := DirFs(d)
+	path, _ = zx.UseAbsPath(path)
+	d, fs, err := ns.putMount(ds)
 	if err != nil {
 		close(dc, err)
 		return derr(err)
@@ -202,7 +282,7 @@ func (ns *NS) Put(path string, ud zx.Dir, off int64, dc <-chan []byte) <-chan zx
 		pc := xfs.Put(d.SPath(), ud, off, dc)
 		rd := <-pc
 		if rd != nil {
-			rd["path"] = fpath.Join(pname, d.SPath())
+			rd["path"] = path
 			rc <- rd
 		}
 		close(rc, cerror(pc))
@@ -210,13 +290,14 @@ func (ns *NS) Put(path string, ud zx.Dir, off int64, dc <-chan []byte) <-chan zx
 	return rc
 }
 
+// On unions, the first entry where the file exists is used.
 func (ns *NS) Wstat(path string, ud zx.Dir) <-chan zx.Dir {
-	pname, ds, err := ns.Resolve(path)
+	_, ds, err := ns.Resolve(path)
 	if err != nil {
 		return derr(err)
 	}
-	d := ds[0]
-	fs, err := DirFs(d)
+	path, _ = zx.UseAbsPath(path)
+	d, fs, _, err := ns.found(ds)
 	if err != nil {
 		return derr(err)
 	}
@@ -229,7 +310,7 @@ func (ns *NS) Wstat(path string, ud zx.Dir) <-chan zx.Dir {
 		wc := xfs.Wstat(d.SPath(), ud)
 		rd := <-wc
 		if rd != nil {
-			rd["path"] = fpath.Join(pname, d.SPath())
+			rd["path"] = path
 			rc <- rd
 		}
 		close(rc, cerror(wc))
@@ -237,13 +318,13 @@ func (ns *NS) Wstat(path string, ud zx.Dir) <-chan zx.Dir {
 	return rc
 }
 
+// On unions, the first entry where the file exists is used.
 func (ns *NS) Remove(path string) <-chan error {
 	_, ds, err := ns.Resolve(path)
 	if err != nil {
 		return rerr(err)
 	}
-	d := ds[0]
-	fs, err := DirFs(d)
+	d, fs, _, err := ns.found(ds)
 	if err != nil {
 		return rerr(err)
 	}
@@ -254,13 +335,13 @@ func (ns *NS) Remove(path string) <-chan error {
 	return xfs.Remove(d.SPath())
 }
 
+// On unions, the first entry where the file exists is used.
 func (ns *NS) RemoveAll(path string) <-chan error {
 	_, ds, err := ns.Resolve(path)
 	if err != nil {
 		return rerr(err)
 	}
-	d := ds[0]
-	fs, err := DirFs(d)
+	d, fs, _, err := ns.found(ds)
 	if err != nil {
 		return rerr(err)
 	}
@@ -271,13 +352,14 @@ func (ns *NS) RemoveAll(path string) <-chan error {
 	return xfs.RemoveAll(d.SPath())
 }
 
+// On unions, the first entry where from exists is used, and
+// to must be in a mount for the same tree.
 func (ns *NS) Move(from, to string) <-chan error {
 	_, fromds, err := ns.Resolve(from)
 	if err != nil {
 		return rerr(err)
 	}
-	fromd := fromds[0]
-	fromfs, err := DirFs(fromd)
+	fromd, fromfs, _, err := ns.found(fromds)
 	if err != nil {
 		return rerr(err)
 	}
@@ -285,8 +367,14 @@ func (ns *NS) Move(from, to string) <-chan error {
 	if err != nil {
 		return rerr(err)
 	}
-	tod := tods[0]
-	if fromd.SAddr() != tod.SAddr() {
+	var tod zx.Dir
+	for _, d := range tods {
+		if _, err := ns.dirFs(d); err == nil && d.SAddr() == fromd.SAddr() {
+			tod = d
+			break
+		}
+	}
+	if tod == nil {
 		return rerr(fmt.Errorf("%s: cross device move", from))
 	}
 	xfs, ok := fromfs.(zx.Mover)
@@ -49,6 +49,20 @@ struct finder {
 
 	suffs  map[string]*prefix
 	spreds map[string]*pred.Pred
+	seen   map[string]bool // paths found, if there are unions
+}
+
+// Is rd a duplicate of an entry already found in a union?
+// The first one found wins.
+func (f *finder) dup(rd zx.Dir) bool {
+	if f.seen == nil {
+		return false
+	}
+	if f.seen[rd["path"]] {
+		return true
+	}
+	f.seen[rd["path"]] = true
+	return false
 }
 
 func (p *prefix) dupDirs() []zx.Dir {
@@ -61,20 +75,28 @@ func (p *prefix) dupDirs() []zx.Dir {
 	return dirs
 }
 
+// Return the tree for a mount point; binds are found in our ns.
+func (f *finder) dirFs(d zx.Dir) (zx.Fs, error) {
+	if isBind(d) {
+		return f.ns, nil
+	}
+	return f.ns.dirFs(d)
+}
+
 // f.findget for one mount point
 func (f *finder) find1get(d zx.Dir) error {
 	pname := fpath.Base(f.walked)
 	searching := zx.HasPrefix(f.name, f.walked)
 	f.ns.vprintf("fnd:\t\tfind name %s walked %s sp %s dp %s depth %d searching %v\n",
 		f.name, f.walked, f.spref, f.dpref, f.depth, searching)
-	if !d.IsFinder() {
+	if !d.IsFinder() && !isBind(d) {
 		f.ns.vprintf("fnd:\t\tnot a finder\n")
 		// it's ok to find it if it's just the name where we are finding.
 		if f.name == f.walked || !searching {
 			d["name"] = pname
 			d["path"] = f.walked
 			v, _, _ := f.pred.EvalAt(d, f.depth)
-			if v {
+			if v && !f.dup(d) {
 				if ok := f.gc <- d; !ok {
 					return cerror(f.gc)
 				}
@@ -83,7 +105,7 @@ func (f *finder) find1get(d zx.Dir) error {
 		return nil
 	}
 
-	rf, err := DirFs(d)
+	rf, err := f.dirFs(d)
 	if err != nil {
 		f.ns.vprintf("fnd:\t\tdir fs: %s\n", err)
 		return err
@@ -104,9 +126,13 @@ func (f *finder) find1get(d zx.Dir) error {
 	f.ns.vprintf("fnd:\t\tfind(%s %q %s %s %d)\n",
 		sname, f.pred, spath, f.walked, f.depth)
 	rgc := r.FindGet(sname, f.pred.String(), spath, f.walked, f.depth)
+	skip := false // data for a duplicate entry
 	for rg := range rgc {
 		rd, ok := rg.(zx.Dir)
 		if !ok {
+			if skip {
+				continue
+			}
 			f.ns.vprintf("fnd: fwd msg type %T\n", rg)
 			if ok := f.gc <- rg; !ok {
 				close(rgc, cerror(f.gc))
@@ -114,7 +140,7 @@ func (f *finder) find1get(d zx.Dir) error {
 			}
 			continue
 		}
-		if rd["name"] == "/" {
+		if rd["name"] == "/" || rd["path"] == f.walked {
 			rd["name"] = pname
 		}
 
@@ -133,9 +159,11 @@ func (f *finder) find1get(d zx.Dir) error {
 				els := zx.Elems(zx.Suffix(nf.walked, nf.name))
 				nf.depth = len(els)
 			}
-			for _, nd := range np.dupDirs() {
+			nds := np.dupDirs()
+			for _, nd := range nds {
 				f.ns.vprintf("fnd:\t\trecur at %s\n", nd)
-				if err := nf.find1get(nd); err != nil {
+				err := nf.find1get(nd)
+				if err != nil && (len(nds) == 1 || !zx.IsNotExist(err)) {
 					nd["err"] = err.Error()
 					if ok := f.gc <- nd; !ok {
 						close(rgc, cerror(f.gc))
@@ -151,6 +179,9 @@ func (f *finder) find1get(d zx.Dir) error {
 			suff := zx.Suffix(cpath, f.spref)
 			rd["path"] = fpath.Join(f.dpref, suff)
 		}
+		if skip = f.dup(rd); skip {
+			continue
+		}
 		if ok := f.gc <- rd; !ok {
 			close(rgc, cerror(f.gc))
 			break
@@ -165,21 +196,21 @@ func (f *finder) find1(d zx.Dir) error {
 	searching := zx.HasPrefix(f.name, f.walked)
 	f.ns.vprintf("fnd:\t\tfind1 name %s walked %s sp %s dp %s depth %d searching %v\n",
 		f.name, f.walked, f.spref, f.dpref, f.depth, searching)
-	if !d.IsFinder() {
+	if !d.IsFinder() && !isBind(d) {
 		f.ns.vprintf("fnd:\t\tnot a finder: %s\n", d)
 		// it's ok to find it if it's just the name where we are finding.
 		if f.name == f.walked || !searching {
 			d["name"] = pname
 			d["path"] = f.walked
 			v, _, _ := f.pred.EvalAt(d, f.depth)
-			if v {
+			if v && !f.dup(d) {
 				f.c <- d
 			}
 		}
 		return nil
 	}
 
-	rf, err := DirFs(d)
+	rf, err := f.dirFs(d)
 	if err != nil {
 		f.ns.vprintf("fnd:\t\tdir fs: %s\n", err)
 		return err
@@ -200,7 +231,7 @@ func (f *finder) find1(d zx.Dir) error {
 		sname, f.pred, spath, f.walked, f.depth)
 	rc := r.Find(sname, f.pred.String(), spath, f.walked, f.depth)
 	for rd := range rc {
-		if rd["name"] == "/" {
+		if rd["name"] == "/" || rd["path"] == f.walked {
 			rd["name"] = pname
 		}
 
@@ -219,9 +250,11 @@ func (f *finder) find1(d zx.Dir) error {
 				els := zx.Elems(zx.Suffix(nf.walked, nf.name))
 				nf.depth = len(els)
 			}
-			for _, nd := range np.dupDirs() {
+			nds := np.dupDirs()
+			for _, nd := range nds {
 				f.ns.vprintf("fnd:\t\trecur at %s\n", nd)
-				if err := nf.find1(nd); err != nil {
+				err := nf.find1(nd)
+				if err != nil && (len(nds) == 1 || !zx.IsNotExist(err)) {
 					nd["err"] = err.Error()
 					if ok := f.c <- nd; !ok {
 						close(rc, cerror(f.c))
@@ -237,6 +270,9 @@ func (f *finder) find1(d zx.Dir) error {
 			suff := zx.Suffix(cpath, f.spref)
 			rd["path"] = fpath.Join(f.dpref, suff)
 		}
+		if f.dup(rd) {
+			continue
+		}
 		if ok := f.c <- rd; !ok {
 			close(rc, cerror(f.c))
 			break
@@ -274,18 +310,24 @@ func (f *finder) find() error {
 	// and record their adjusted predicates to exclude their suffixes on their finds.
 	f.suffs = map[string]*prefix{}
 	f.spreds = map[string]*pred.Pred{}
+	union := len(f.p.mnt) > 1
 	for _, xp := range ns.pref {
 		if f.p != xp && zx.HasPrefix(xp.name, f.name) {
 			f.suffs[xp.name] = xp
 			f.spreds[xp.name] = ns.exclSuffixes(xp.name, f.upred)
+			union = union || len(xp.mnt) > 1
 		}
 	}
 	ns.lk.RUnlock()
+	if union {
+		f.seen = map[string]bool{}
+	}
 
 	// Start one find at a time starting with p, considering that we walked
 	// already p's name.
 	f.walked = f.p.name
 	ds := f.p.dupDirs()
+	nerrs := 0
 	for _, d := range ds {
 		ns.vprintf("fnd:\t\tmnt %s: %s\n", f.p.name, d.LongFmt())
 		var err error
@@ -301,6 +343,11 @@ func (f *finder) find() error {
 		if len(ds) == 1 {
 			return err
 		}
+		// In unions, files may be just in some of the mounts.
+		if zx.IsNotExist(err) {
+			nerrs++
+			continue
+		}
 		if err != nil {
 			d["err"] = err.Error()
 			if f.gc != nil {
@@ -314,6 +361,9 @@ func (f *finder) find() error {
 			}
 		}
 	}
+	if nerrs == len(ds) {
+		return fmt.Errorf("%s: %s", f.name, zx.ErrNotExist)
+	}
 	return nil
 }
 
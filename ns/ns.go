@@ -6,15 +6,23 @@
 	to a finder interface.
 
 	It's a prefix table where the longest prefix wins.
-	There are no binds and no unions.
+	Mounting several trees at the same prefix makes union directories
+	(see union.go).
+
+	A prefix may be also bound to another path in the name space (see Bind),
+	using the address ns!path for the mounted entry.
 */
 package ns
 
 import (
 	"bytes"
 	"clive/dbg"
+	"clive/net/auth"
+	"clive/net/disc"
 	"clive/zx"
+	"clive/zx/p9"
 	"clive/zx/rzx"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"path"
@@ -31,6 +39,15 @@ const (
 	Repl   Flag = iota // replace previous mounted dirs.
 	Before             // mount before previous mounted dirs.
 	After              // mount after previous mounted dirs.
+
+	Create Flag = 4 // or'ed to the above: create new files in this mount.
+)
+
+var (
+	// Max number of binds followed to resolve a name.
+	MaxBinds = 16
+
+	ErrBindLoop = errors.New("bind loop")
 )
 
 // A binder is a name space that binds prefixes to directory entries.
@@ -40,6 +57,7 @@ interface Binder {
 	// Add an entry at the given d["path"] prefix for the given directory entry.
 	// If flag is Before or After, previous contents of the path are preserved and
 	// the new entry is added before or after them.
+	// If flag includes Create, new files in the union are created in this entry.
 	// Despite Repl mounts, other mounts that are suffixes of the given prefix
 	// remain mounted.
 	Mount(d zx.Dir, flag Flag) error
@@ -65,6 +83,7 @@ struct NS {
 
 	lk   sync.RWMutex
 	pref []*prefix
+	ai   *auth.Info // if set, trees are used authenticated for ai
 }
 
 // Create a new empty name space. It has a single entry for an empty
@@ -89,6 +108,9 @@ func (ns *NS) vprintf(f string, args ...face{}) (n int, err error) {
 }
 
 func (f Flag) String() string {
+	if f&Create != 0 {
+		return (f&^Create).String() + "|Create"
+	}
 	switch f {
 	case Before:
 		return "Before"
@@ -148,7 +170,7 @@ func (ns *NS) String() string {
 			continue
 		}
 		path := p["path"]
-		if a := p["addr"]; strings.HasPrefix(a, "lfs!") {
+		if a := p["addr"]; strings.HasPrefix(a, "lfs!") && p["create"] == "" {
 			toks := strings.Split(a, "!")
 			if len(toks) == 3 && path == toks[1] && toks[2] == "/" {
 				fmt.Fprintf(&buf, "%s\n", path)
@@ -180,33 +202,54 @@ func (ns *NS) String() string {
 // or
 // /one/path
 // then return a Dir for that entry
-func specialForm(ln string) zx.Dir {
+func specialForm(ln string) (zx.Dir, error) {
 	if len(ln) == 0 || ln[0] != '/' {
-		return nil
+		return nil, nil
 	}
 	n := strings.IndexRune(ln, ':')
 	if n > 0 {
-		return nil
+		return nil, nil
 	}
 	toks := strings.Fields(ln)
 	if len(toks) > 2 {
-		return nil
+		return nil, nil
 	}
 	addr := toks[len(toks)-1]
 	if n = strings.IndexRune(addr, '!'); n < 0 {
 		addr = fmt.Sprintf("lfs!%s!/", addr)
 	} else {
 		els := strings.Split(addr, "!")
-		if els[0] != "zx" && els[0] != "lfs" {
+		if els[0] != "zx" && els[0] != "lfs" && els[0] != "ns" && els[0] != "disc" &&
+			els[0] != "9p" {
 			els = append([]string{"zx"}, els...)
 			addr = "zx!" + addr
 		}
-		if els[0] == "lfs" {
+		switch els[0] {
+		case "ns": // ns!/target/path
+		case "disc": // disc!name!tree!path, resolved by DirFs
+			if len(els) < 2 || len(els) > 4 || els[1] == "" {
+				return nil, fmt.Errorf("bad disc address %q", addr)
+			}
+			switch len(els) {
+			case 3: // disc!name!tree
+				addr += "!/"
+			case 2: // disc!name
+				addr += "!main!/"
+			}
+		case "lfs":
 			switch len(els) {
 			case 2:
 				addr += "!/"
 			}
-		} else {
+		case "9p":
+			switch len(els) {
+			case 6: // 9p!tcp!host!9fs!main!/
+			case 5: // 9p!tcp!host!9fs!main
+				addr += "!/"
+			default: // 9p!host, 9p!host!9fs, 9p!tcp!host!9fs
+				addr = "9p!" + p9.FillAddr(strings.Join(els[1:], "!")) + "!/"
+			}
+		default:
 			switch len(els) {
 			case 6: // zx!unix!localhost!zx!main!/
 			case 5: // zx!unix!localhost!zx!main
@@ -224,18 +267,71 @@ func specialForm(ln string) zx.Dir {
 		"path": toks[0],
 		"addr": addr,
 		"name": fpath.Base(toks[0]),
+	}, nil
+}
+
+var (
+	discs   = map[string]string{} // disc!name!tree -> zx address
+	discslk sync.Mutex
+)
+
+// Resolve the disc!name!tree address using LAN discovery (see clive/net/disc)
+// and return the zx address for it (without the path).
+// The first server found with the tree is used, and kept until forgotten.
+// Anyone in the local network may announce any name, and the auth
+// handshake when dialing the server is the only protection against spoofed ads.
+func discAddr(saddr string) (string, error) {
+	discslk.Lock()
+	addr, ok := discs[saddr]
+	discslk.Unlock()
+	if ok {
+		return addr, nil
+	}
+	els := strings.Split(saddr, "!")
+	if len(els) != 3 || els[1] == "" {
+		return "", fmt.Errorf("bad disc address %q", saddr)
+	}
+	name, tree := els[1], els[2]
+	ads, err := disc.Lookup(name)
+	if err != nil {
+		return "", fmt.Errorf("%s: %s", name, err)
+	}
+	for _, a := range ads {
+		if a.Has(tree) {
+			addr = fmt.Sprintf("zx!%s!%s", a.Addr, tree)
+			discslk.Lock()
+			discs[saddr] = addr
+			discslk.Unlock()
+			return addr, nil
+		}
 	}
+	return "", fmt.Errorf("%s: no tree %s", name, tree)
+}
+
+// Forget the resolution for saddr, e.g., after failing to dial it.
+func forgetDisc(saddr string) {
+	discslk.Lock()
+	defer discslk.Unlock()
+	delete(discs, saddr)
 }
 
 // Recreate a name space provided its printed representation.
 // It accepts the special line formats
 // 	path addr
 // 	path filepath
-// to dial the given addr or use the given lfs filepath and mount it at path.
+// to dial the given addr or use the given lfs filepath and mount it at path,
+// and
+// 	path ns!target
+// to bind path to target (see Bind), and
+// 	path disc!name!tree!path
+// to mount the tree from the server announced in the local network with
+// the given name (see clive/net/disc); tree and path may be absent.
+// Such names are resolved when the tree is first used, and printed as given.
 //
 // A full addr is proto!net!host!port!tree!path,
-// where proto can be zx|lfs.
+// where proto can be zx|lfs|9p.
 // For lfs, the addr is of the form lfs!lfsroot!path
+// For 9p, tree is the attach name and the port is 9fs (564) by default.
 // zx is implied it no proto is given.
 // Any suffix components may be absent so we accept
 //	localhost!zx	-> zx!tcp!localhost!zx!main!/
@@ -259,14 +355,9 @@ func Parse(s string) (*NS, error) {
 		if len(ln) == 0 || ln[0] == '#' {
 			continue
 		}
-		d := specialForm(ln)
-		p := d["path"]
-		if d == nil {
-			d, _ = zx.ParseDir(ln)
-			p = d["path"]
-		}
-		if len(d) == 0 || p == "" {
-			return nil, fmt.Errorf("bad ns entry for dir <%s>", d)
+		d, err := ParseEntry(ln)
+		if err != nil {
+			return nil, err
 		}
 		if err := ns.Mount(d, After); err != nil {
 			return nil, err
@@ -275,6 +366,40 @@ func Parse(s string) (*NS, error) {
 	return ns, nil
 }
 
+// Parse a single line in the printed representation of a name space
+// (see Parse) and return the dir entry for it.
+func ParseEntry(ln string) (zx.Dir, error) {
+	d, err := specialForm(ln)
+	if err != nil {
+		return nil, err
+	}
+	if d == nil {
+		d, _ = zx.ParseDir(ln)
+	}
+	if len(d) == 0 || d["path"] == "" {
+		return nil, fmt.Errorf("bad ns entry for dir <%s>", d)
+	}
+	return d, nil
+}
+
+// Bind name to the target path in the name space, so that resolving
+// name (or paths under it) resolves target (or the paths under it) instead.
+// The flag is used as in Mount, and name may be a union of binds and mounts.
+// It's an error if this would make a loop.
+func (ns *NS) Bind(name, target string, flag Flag) error {
+	t, err := zx.UseAbsPath(target)
+	if err != nil {
+		return fmt.Errorf("bind: %s", err)
+	}
+	return ns.Mount(zx.Dir{"path": name, "addr": "ns!" + t}, flag)
+}
+
+// Use the trees mounted authenticated for ai.
+// Trees that can't authenticate users (zx.Auther) are not used.
+func (ns *NS) AuthFor(ai *auth.Info) {
+	ns.ai = ai
+}
+
 // Create a copy of the ns.
 func (ns *NS) Dup() *NS {
 	var b bytes.Buffer
@@ -313,9 +438,56 @@ func (b byName) Len() int {
 	return len(b)
 }
 
+func isBind(d zx.Dir) bool {
+	return d.Proto() == "ns"
+}
+
+// Are a and b the same path or is one under the other?
+func related(a, b string) bool {
+	return zx.HasPrefix(a, b) || zx.HasPrefix(b, a)
+}
+
+// Does binding name to target make a loop? (ns is locked)
+// Binds can't refer to paths under or over them, and neither can
+// the binds for the paths they refer to.
+func (ns *NS) bindLoops(name, target string) bool {
+	seen := map[string]bool{}
+	var loops func(string) bool
+	loops = func(t string) bool {
+		if related(t, name) {
+			return true
+		}
+		if seen[t] {
+			return false
+		}
+		seen[t] = true
+		for _, p := range ns.pref {
+			if !related(p.name, t) {
+				continue
+			}
+			for _, d := range p.mnt {
+				if isBind(d) && loops(d.SPath()) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	return loops(target)
+}
+
 func (ns *NS) mount(d zx.Dir, flag Flag) error {
 	name := d["path"]
 	ns.Dprintf("mount %s %s %s\n", name, d, flag)
+	if isBind(d) {
+		t := d.SPath()
+		if len(t) == 0 || t[0] != '/' {
+			return fmt.Errorf("bind: %s: bad target path '%s'", name, t)
+		}
+		if ns.bindLoops(name, t) {
+			return fmt.Errorf("bind: %s: %s: %s", name, t, ErrBindLoop)
+		}
+	}
 	for _, p := range ns.pref {
 		if p.name == name {
 			return p.mount(d, flag)
@@ -340,6 +512,10 @@ func (ns *NS) Mount(d zx.Dir, flag Flag) error {
 	d = d.Dup()
 	d["path"] = name
 	d["name"] = path.Base(name)
+	if flag&Create != 0 {
+		d["create"] = "y"
+		flag &^= Create
+	}
 	ns.lk.Lock()
 	defer ns.lk.Unlock()
 	return ns.mount(d, flag)
@@ -401,6 +577,8 @@ func (ns *NS) Unmount(fname string, d zx.Dir) error {
 // in the server for the resource resolved.
 // However, the path is left pointing to the mount point.
 // The path must be absolute.
+// Binds are resolved recursively, and the mount points for their targets are
+// returned in their place.
 func (ns *NS) Resolve(name string) (pref string, mnts []zx.Dir, err error) {
 	path, err := zx.UseAbsPath(name)
 	if err != nil {
@@ -409,6 +587,16 @@ func (ns *NS) Resolve(name string) (pref string, mnts []zx.Dir, err error) {
 	ns.Dprintf("resolve %s\n", path)
 	ns.lk.RLock()
 	defer ns.lk.RUnlock()
+	return ns.resolve(name, path, map[string]bool{})
+}
+
+// ns is rlocked; walked has the paths resolved through binds, to detect loops.
+func (ns *NS) resolve(name, path string, walked map[string]bool) (string, []zx.Dir, error) {
+	if walked[path] || len(walked) > MaxBinds {
+		return "", nil, fmt.Errorf("resolve: %s: %s", name, ErrBindLoop)
+	}
+	walked[path] = true
+	defer delete(walked, path)
 	var p *prefix
 	for _, np := range ns.pref {
 		if zx.HasPrefix(path, np.name) {
@@ -423,8 +611,18 @@ func (ns *NS) Resolve(name string) (pref string, mnts []zx.Dir, err error) {
 		return "", nil, fmt.Errorf("resolve: %s: %s", name, zx.ErrNotExist)
 	}
 	suff := zx.Suffix(path, p.name)
-	mnts = make([]zx.Dir, 0, len(p.mnt))
+	mnts := make([]zx.Dir, 0, len(p.mnt))
 	for _, d := range p.mnt {
+		if isBind(d) {
+			tpath := fpath.Join(d.SPath(), suff)
+			ns.Dprintf("\tbind %s -> %s\n", path, tpath)
+			_, tmnts, err := ns.resolve(name, tpath, walked)
+			if err != nil && !zx.IsNotExist(err) {
+				return "", nil, err
+			}
+			mnts = append(mnts, tmnts...)
+			continue
+		}
 		if d.IsFinder() || suff == "" || suff == "/" {
 			d = d.Dup()
 			if suff != "/" && suff != "" {
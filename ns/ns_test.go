@@ -4,16 +4,21 @@ import (
 	"bytes"
 	"clive/dbg"
 	"clive/net"
+	"clive/net/auth"
+	"clive/net/disc"
 	"clive/zx"
 	"clive/zx/fstest"
 	"clive/zx/rzx"
 	"clive/zx/zux"
 	"clive/zx/zxc"
 	"fmt"
+	"io/ioutil"
+	gonet "net"
 	"os"
 	fpath "path"
 	"strings"
 	"testing"
+	"time"
 )
 
 const tdir = "/tmp/ns_test"
@@ -29,9 +34,11 @@ var (
 /usr
 /usr/nemo	zx!unix!8089!/tmp
 path:"/x"	io:"0"	addr:"zx!unix!8089!/tmp"
+/n/plan9	9p!tcp!plan9!564
 `
 
 	ns1out = `/
+/n/plan9	9p!tcp!plan9!564!main!/
 /tmp
 /tmp	lfs!/!/tmp
 /tmp
@@ -556,6 +563,72 @@ func TestFindGets(t *testing.T) {
 	runTest(t, fstest.FindGets)
 }
 
+func TestWatches(t *testing.T) {
+	runTest(t, fstest.Watches)
+}
+
+// A tree whose watches report the changes sent through c.
+struct chgFs {
+	zx.Fs
+	c chan zx.Dir
+}
+
+func (fs *chgFs) Watch(p, pred string) <-chan zx.Dir {
+	return fs.c
+}
+
+func TestWatchIdleEnd(t *testing.T) {
+	os.RemoveAll(tdir)
+	fstest.MkTree(t, tdir)
+	defer os.RemoveAll(tdir)
+	zfs, err := zux.NewZX(tdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := &chgFs{Fs: zfs, c: make(chan zx.Dir, 1)}
+	AddLfsPath(tdir, fs)
+	defer AddLfsPath(tdir, nil)
+	ns := mkns(t, fmt.Sprintf("/\t%s\n", tdir))
+	old := watchPoll
+	watchPoll = 10 * time.Millisecond
+	defer func() { watchPoll = old }()
+	wc := ns.Watch("/a", "")
+	close(wc)
+	// no changes arrive; the tree watch must be closed anyway
+	time.Sleep(10 * watchPoll)
+	if ok := fs.c <- zx.Dir{"path": "/a/x", "Chg": zx.Created}; ok {
+		t.Fatalf("tree watch not closed")
+	}
+}
+
+func TestAuthFor(t *testing.T) {
+	os.RemoveAll(tdir)
+	fstest.MkTree(t, tdir)
+	defer os.RemoveAll(tdir)
+	zfs, err := zux.NewZX(tdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	AddLfsPath(tdir, zfs)
+	defer AddLfsPath(tdir, nil)
+	ns := mkns(t, fmt.Sprintf("/\t%s\n", tdir))
+	ns.AuthFor(&auth.Info{Uid: "nemo", Gids: map[string]bool{}, Ok: true})
+	if _, err := zx.Stat(ns, "/1"); err != nil {
+		t.Fatal(err)
+	}
+	// trees that can't authenticate users must not be used
+	AddLfsPath(tdir, &chgFs{Fs: zfs})
+	if _, err := zx.Stat(ns, "/1"); !zx.IsPerm(err) {
+		t.Fatalf("stat through a tree without auth: %v", err)
+	}
+	dc := ns.Find("/", "", "/", "/", 0)
+	for d := range dc {
+		if d["err"] == "" {
+			t.Fatalf("find through a tree without auth: %s", d)
+		}
+	}
+}
+
 func runRfsTest(t *testing.T, fn fstest.TestFunc) {
 	delLfsPath("/")
 	os.Args[0] = "ns.test"
@@ -621,6 +694,70 @@ func TestRfsFinds(t *testing.T) {
 	runRfsTest(t, fstest.Finds)
 }
 
+func TestDiscEntry(t *testing.T) {
+	os.Args[0] = "ns.test"
+	ifs, err := gonet.Interfaces()
+	if err != nil {
+		t.Skip("no interfaces: ", err)
+	}
+	for i := range ifs {
+		if ifs[i].Flags&gonet.FlagLoopback != 0 {
+			disc.Iface = &ifs[i]
+			disc.Port = 8094
+		}
+	}
+	if disc.Iface == nil {
+		t.Skip("no loopback interface")
+	}
+	defer func() { disc.Iface = nil }()
+	os.RemoveAll(tdir)
+	fstest.MkTree(t, tdir)
+	defer os.RemoveAll(tdir)
+	fs, err := zux.NewZX(tdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, err := rzx.NewServer("tcp!localhost!9899")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	srv.NoAuth()
+	if err := srv.Announce("nstest"); err != nil {
+		t.Skip("no multicast: ", err)
+	}
+	if err := srv.Serve("main", fs); err != nil {
+		t.Fatal(err)
+	}
+	d, err := ParseEntry("/x\tdisc!nstest!main!/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	printf("entry %s\n", d)
+	if d["addr"] != "disc!nstest!main!/a" {
+		t.Fatalf("bad entry %s", d)
+	}
+	if _, err := DirFs(d); err != nil {
+		t.Fatal(err)
+	}
+	addr, err := discAddr(d.SAddr())
+	if err != nil || !strings.HasPrefix(addr, "zx!tcp!") || !strings.HasSuffix(addr, "!9899!main") {
+		t.Fatalf("bad disc addr %s %v", addr, err)
+	}
+	for _, a := range []string{"disc!nstest!other", "disc!nonexistent"} {
+		d, err := ParseEntry("/x\t" + a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := DirFs(d); err == nil {
+			t.Fatalf("could resolve %s", a)
+		}
+	}
+	if _, err := ParseEntry("/x\tdisc!"); err == nil {
+		t.Fatalf("could parse a bad disc address")
+	}
+}
+
 func TestPaths(t *testing.T) {
 	verb = testing.Verbose()
 	os.RemoveAll(tdir + "empty")
@@ -683,3 +820,143 @@ func TestPaths(t *testing.T) {
 		t.Fatalf("bad nb of dirs in find")
 	}
 }
+
+func TestUnion(t *testing.T) {
+	verb = testing.Verbose()
+	mine, shared := tdir+"mine", tdir+"shared"
+	os.RemoveAll(mine)
+	os.RemoveAll(shared)
+	defer os.RemoveAll(mine)
+	defer os.RemoveAll(shared)
+	for _, f := range []string{mine + "/x", mine + "/y", shared + "/y",
+		shared + "/z", shared + "/sub/w"} {
+		os.MkdirAll(fpath.Dir(f), 0755)
+		if err := ioutil.WriteFile(f, []byte(f), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	AddLfsPath(mine, nil)
+	AddLfsPath(shared, nil)
+	defer delLfsPath(mine)
+	defer delLfsPath(shared)
+	ns := mkns(t, "/bin\t"+shared)
+	d := zx.Dir{"path": "/bin", "addr": "lfs!" + mine + "!/"}
+	if err := ns.Mount(d, Before|Create); err != nil {
+		t.Fatal(err)
+	}
+	printf("ns is `%s`\n", ns)
+	ns2, err := Parse(ns.String())
+	if err != nil || ns2.String() != ns.String() {
+		t.Fatalf("bad ns round trip: %v", err)
+	}
+
+	ds, err := zx.GetDir(ns, "/bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, d := range ds {
+		names = append(names, d["name"])
+	}
+	printf("getdir %v\n", names)
+	if strings.Join(names, " ") != "x y sub z" {
+		t.Fatalf("bad union dir %v", names)
+	}
+	dat, err := zx.GetAll(ns, "/bin/y")
+	if err != nil || string(dat) != mine+"/y" {
+		t.Fatalf("bad union get %q %v", dat, err)
+	}
+	if dat, err = zx.GetAll(ns, "/bin/sub/w"); err != nil || string(dat) != shared+"/sub/w" {
+		t.Fatalf("bad union get %q %v", dat, err)
+	}
+	if err := zx.PutAll(ns, "/bin/n", []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(mine + "/n"); err != nil {
+		t.Fatalf("create not in the create mount: %s", err)
+	}
+	if err := zx.PutAll(ns, "/bin/z", []byte("new z")); err != nil {
+		t.Fatal(err)
+	}
+	if dat, _ := ioutil.ReadFile(shared + "/z"); string(dat) != "new z" {
+		t.Fatalf("put not in the mount with the file")
+	}
+
+	n := 0
+	dc := ns.Find("/bin", "", "/", "/", 0)
+	for d := range dc {
+		printf("found %s\n", d["path"])
+		n++
+	}
+	if err := cerror(dc); err != nil || n != 7 {
+		t.Fatalf("bad union find: %d %v", n, err)
+	}
+	n = 0
+	gc := ns.FindGet("/bin", "type=-", "/", "/", 0)
+	for m := range gc {
+		if d, ok := m.(zx.Dir); ok {
+			printf("found %s\n", d["path"])
+			n++
+		}
+	}
+	if err := cerror(gc); err != nil || n != 5 {
+		t.Fatalf("bad union findget: %d %v", n, err)
+	}
+}
+
+func TestBind(t *testing.T) {
+	verb = testing.Verbose()
+	os.RemoveAll(tdir)
+	fstest.MkTree(t, tdir)
+	defer os.RemoveAll(tdir)
+	AddLfsPath(tdir, nil)
+	ns := mkns(t, "/zx\t"+tdir)
+	if err := ns.Bind("/src/mine", "/zx/a", Repl); err != nil {
+		t.Fatal(err)
+	}
+	if err := ns.Bind("/other", "/src/mine/b", Repl); err != nil {
+		t.Fatal(err)
+	}
+	printf("ns is `%s`\n", ns)
+	out := ns.String()
+	if !strings.Contains(out, "/src/mine\tns!/zx/a\n") {
+		t.Fatalf("bad bind entry")
+	}
+	ns2, err := Parse(out)
+	if err != nil || ns2.String() != out {
+		t.Fatalf("bad ns round trip: %v", err)
+	}
+
+	d, err := zx.Stat(ns, "/src/mine/a1")
+	if err != nil || d["path"] != "/src/mine/a1" {
+		t.Fatalf("bad stat %s %v", d, err)
+	}
+	dat, err := zx.GetAll(ns, "/other/c/c3")
+	if err != nil || !strings.HasPrefix(string(dat), "/a/b/c/c3 ") {
+		t.Fatalf("bad get thru binds %q %v", dat, err)
+	}
+	n := 0
+	dc := ns.Find("/src/mine", "", "/", "/", 0)
+	for d := range dc {
+		printf("found %s\n", d.TestFmt())
+		if !zx.HasPrefix(d["path"], "/src/mine") {
+			t.Fatalf("bad find path %s", d["path"])
+		}
+		n++
+	}
+	if err := cerror(dc); err != nil || n != 6 {
+		t.Fatalf("bad find thru binds: %d %v", n, err)
+	}
+
+	loops := [][2]string{
+		{"/x", "/x/y"},
+		{"/x/y", "/x"},
+		{"/zx/a/b", "/src/mine"},
+		{"/zx/a/b/c", "/other"},
+	}
+	for _, l := range loops {
+		if err := ns.Bind(l[0], l[1], Repl); err == nil {
+			t.Fatalf("bind %s %s didn't fail", l[0], l[1])
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package rns
+
+import (
+	"clive/ch"
+	"clive/dbg"
+	"clive/net"
+	"clive/net/auth"
+	"clive/ns"
+	"clive/zx"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Remote ns client
+struct NS {
+	*dbg.Flag
+	addr string
+	ai   *auth.Info
+	m    *ch.Mux
+}
+
+var (
+	ErrBadReply = errors.New("bad reply message")
+
+	_ns  ns.Binder     = &NS{}
+	_ns2 zx.Finder     = &NS{}
+	_ns3 zx.FindGetter = &NS{}
+)
+
+func (x *NS) String() string {
+	return x.addr
+}
+
+// return network!host!port from addr.
+// 	host -> tcp!host!ns
+//	host!port -> tcp!host!port
+func FillAddr(addr string) string {
+	toks := strings.Split(addr, "!")
+	switch len(toks) {
+	case 1:
+		return fmt.Sprintf("tcp!%s!ns", toks[0])
+	case 2:
+		return fmt.Sprintf("tcp!%s!%s", toks[0], toks[1])
+	default:
+		return addr
+	}
+}
+
+// Dial the ns (or sns) service at addr, completed if needed using FillAddr().
+func Dial(addr string, tlscfg ...*tls.Config) (*NS, error) {
+	var tc *tls.Config
+	if len(tlscfg) > 0 {
+		tc = tlscfg[0]
+	}
+	addr = FillAddr(addr)
+	m, err := net.MuxDial(addr, tc)
+	if err != nil {
+		return nil, err
+	}
+	ai, err := auth.AtClient(m.Rpc(), "", "ns")
+	if err != nil {
+		if !strings.Contains(err.Error(), "auth disabled") {
+			m.Close()
+			return nil, fmt.Errorf("%s: %s", addr, err)
+		}
+		dbg.Warn("%s: %s", addr, err)
+	}
+	x := &NS{
+		Flag: &dbg.Flag{},
+		addr: addr,
+		ai:   ai,
+		m:    m,
+	}
+	x.Tag = "rns"
+	return x, nil
+}
+
+// Return the auth info for the connection, if any.
+func (x *NS) Ai() *auth.Info {
+	return x.ai
+}
+
+func (x *NS) Close() error {
+	x.m.Close()
+	return nil
+}
+
+// Issue the request and return the reply chan.
+func (x *NS) rpc(m *Msg) <-chan face{} {
+	c := x.m.Rpc()
+	x.Dprintf("->%s\n", m)
+	if ok := c.Out <- m; !ok {
+		close(c.In, cerror(c.Out))
+	} else {
+		close(c.Out)
+	}
+	return c.In
+}
+
+// Issue a request replying just the error status.
+func (x *NS) call(m *Msg) error {
+	c := x.rpc(m)
+	for range c {
+		close(c, ErrBadReply)
+		return ErrBadReply
+	}
+	err := cerror(c)
+	if err != nil {
+		x.Dprintf("<-%s\n", err)
+	}
+	return err
+}
+
+// See ns.Binder.
+func (x *NS) Mount(d zx.Dir, flag ns.Flag) error {
+	return x.call(&Msg{Op: Tmount, Path: d["path"], D: d, Flag: flag})
+}
+
+// See ns.Binder.
+// Only the first dir given, if any, is used to match the mounts removed.
+func (x *NS) Unmount(name string, d ...zx.Dir) error {
+	m := &Msg{Op: Tunmount, Path: name}
+	if len(d) > 0 {
+		m.D = d[0]
+	}
+	return x.call(m)
+}
+
+// See ns.NS.Resolve.
+func (x *NS) Resolve(name string) (pref string, mnts []zx.Dir, err error) {
+	c := x.rpc(&Msg{Op: Tresolve, Path: name})
+	first := true
+	for r := range c {
+		switch r := r.(type) {
+		case string:
+			if !first {
+				close(c, ErrBadReply)
+				return "", nil, ErrBadReply
+			}
+			pref = r
+		case zx.Dir:
+			if first {
+				close(c, ErrBadReply)
+				return "", nil, ErrBadReply
+			}
+			mnts = append(mnts, r)
+		default:
+			close(c, ErrBadReply)
+			return "", nil, ErrBadReply
+		}
+		first = false
+	}
+	if err := cerror(c); err != nil {
+		x.Dprintf("<-%s\n", err)
+		return "", nil, err
+	}
+	if first {
+		return "", nil, ErrBadReply
+	}
+	return pref, mnts, nil
+}
+
+// See zx.Finder.
+func (x *NS) Find(name, fpred, spref, dpref string, depth0 int) <-chan zx.Dir {
+	rc := make(chan zx.Dir)
+	go func() {
+		c := x.m.Rpc()
+		m := &Msg{Op: Tfind, Path: name,
+			Pred: fpred, Spref: spref, Dpref: dpref, Depth: depth0,
+		}
+		x.Dprintf("->%s\n", m)
+		if ok := c.Out <- m; !ok {
+			err := cerror(c.Out)
+			close(c.In, err)
+			close(rc, err)
+			return
+		}
+		close(c.Out)
+		for r := range c.In {
+			d, ok := r.(zx.Dir)
+			if !ok {
+				close(c.In, ErrBadReply)
+				close(rc, ErrBadReply)
+				return
+			}
+			if ok := rc <- d; !ok {
+				x.m.Cancel(c, cerror(rc))
+				return
+			}
+		}
+		close(rc, cerror(c.In))
+	}()
+	return rc
+}
+
+// See zx.FindGetter.
+func (x *NS) FindGet(name, fpred, spref, dpref string, depth0 int) <-chan face{} {
+	rc := make(chan face{})
+	go func() {
+		c := x.m.Rpc()
+		m := &Msg{Op: Tfindget, Path: name,
+			Pred: fpred, Spref: spref, Dpref: dpref, Depth: depth0,
+		}
+		x.Dprintf("->%s\n", m)
+		if ok := c.Out <- m; !ok {
+			err := cerror(c.Out)
+			close(c.In, err)
+			close(rc, err)
+			return
+		}
+		close(c.Out)
+		for r := range c.In {
+			if ok := rc <- r; !ok {
+				x.m.Cancel(c, cerror(rc))
+				return
+			}
+		}
+		close(rc, cerror(c.In))
+	}()
+	return rc
+}
+
+// Return the textual representation of the remote name space,
+// as printed by ns.NS.String, which may be given to ns.Parse.
+func (x *NS) Text() (string, error) {
+	c := x.rpc(&Msg{Op: Tns})
+	s := ""
+	for r := range c {
+		rs, ok := r.(string)
+		if !ok {
+			close(c, ErrBadReply)
+			return "", ErrBadReply
+		}
+		s += rs
+	}
+	return s, cerror(c)
+}
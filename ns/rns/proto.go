@@ -0,0 +1,203 @@
+package rns
+
+import (
+	"bytes"
+	"clive/ch"
+	"clive/dbg"
+	"clive/ns"
+	"clive/zx"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+type MsgId byte
+
+const (
+	Tns MsgId = iota + 66
+	Tmount
+	Tunmount
+	Tresolve
+	Tfind
+	Tfindget
+	Tend
+	Tmin = Tns
+)
+
+struct Msg {
+	Op    MsgId
+	Path  string  // All requests but Tns
+	D     zx.Dir  // Mount, Unmount (nil to unmount all)
+	Flag  ns.Flag // Mount
+	Pred  string  // Find, Findget
+	Spref string  // Find, Findget
+	Dpref string  // Find, Findget
+	Depth int     // Find, Findget
+}
+
+var ErrBadMsg = errors.New("bad message type")
+
+func init() {
+	ch.DefType(&Msg{})
+}
+
+func (o MsgId) String() string {
+	switch o {
+	case Tns:
+		return "Tns"
+	case Tmount:
+		return "Tmount"
+	case Tunmount:
+		return "Tunmount"
+	case Tresolve:
+		return "Tresolve"
+	case Tfind:
+		return "Tfind"
+	case Tfindget:
+		return "Tfindget"
+	default:
+		return fmt.Sprintf("Tunknown<%d>", o)
+	}
+}
+
+func (m *Msg) WriteTo(w io.Writer) (n int64, err error) {
+	if m.Op < Tmin || m.Op >= Tend {
+		err = fmt.Errorf("%s %d", ErrBadMsg, m.Op)
+		dbg.Warn("Msg.WriteTo: %s", err)
+		return 0, err
+	}
+	var op [1]byte
+	op[0] = byte(m.Op)
+	if _, err := w.Write(op[:]); err != nil {
+		return 0, err
+	}
+	n = 1
+	if m.Op == Tns {
+		return n, nil
+	}
+	nw, err := ch.WriteStringTo(w, m.Path)
+	n += nw
+	if err != nil {
+		return n, err
+	}
+	if m.Op == Tmount || m.Op == Tunmount {
+		d := m.D
+		if d == nil {
+			d = zx.Dir{}
+		}
+		nw, err = d.WriteTo(w)
+		n += nw
+		if err != nil {
+			return n, err
+		}
+	}
+	if m.Op == Tmount {
+		if err = binary.Write(w, binary.LittleEndian, uint64(m.Flag)); err != nil {
+			return n, err
+		}
+		n += 8
+	}
+	if m.Op == Tfind || m.Op == Tfindget {
+		for _, s := range []string{m.Pred, m.Spref, m.Dpref} {
+			nw, err = ch.WriteStringTo(w, s)
+			n += nw
+			if err != nil {
+				return n, err
+			}
+		}
+		if err = binary.Write(w, binary.LittleEndian, uint64(m.Depth)); err != nil {
+			return n, err
+		}
+		n += 8
+	}
+	return n, nil
+}
+
+func (m *Msg) String() string {
+	var buf bytes.Buffer
+	if m == nil {
+		return "<nil msg>"
+	}
+	if m.Op == Tns {
+		fmt.Fprintf(&buf, "%s", m.Op)
+	} else {
+		fmt.Fprintf(&buf, "%s '%s'", m.Op, m.Path)
+	}
+	if m.Op == Tmount || m.Op == Tunmount {
+		fmt.Fprintf(&buf, " d <%s>", m.D)
+	}
+	if m.Op == Tmount {
+		fmt.Fprintf(&buf, " %s", m.Flag)
+	}
+	if m.Op == Tfind || m.Op == Tfindget {
+		fmt.Fprintf(&buf, " pred '%s' spref '%s' dpref '%s' depth %d",
+			m.Pred, m.Spref, m.Dpref, m.Depth)
+	}
+	return buf.String()
+}
+
+func UnpackMsg(buf []byte) ([]byte, *Msg, error) {
+	m := &Msg{}
+	if len(buf) < 1 {
+		return buf, nil, ch.ErrTooSmall
+	}
+	m.Op = MsgId(buf[0])
+	if m.Op < Tmin || m.Op >= Tend {
+		return buf, nil, fmt.Errorf("unknown msg type %d", buf[0])
+	}
+	buf = buf[1:]
+	if m.Op == Tns {
+		return buf, m, nil
+	}
+	var err error
+	buf, m.Path, err = ch.UnpackString(buf)
+	if err != nil {
+		return buf, nil, err
+	}
+	if m.Op == Tmount || m.Op == Tunmount {
+		buf, m.D, err = zx.UnpackDir(buf)
+		if err != nil {
+			return buf, nil, err
+		}
+		if len(m.D) == 0 {
+			m.D = nil
+		}
+	}
+	if m.Op == Tmount {
+		if len(buf) < 8 {
+			return buf, nil, ch.ErrTooSmall
+		}
+		m.Flag = ns.Flag(binary.LittleEndian.Uint64(buf[0:]))
+		buf = buf[8:]
+	}
+	if m.Op == Tfind || m.Op == Tfindget {
+		buf, m.Pred, err = ch.UnpackString(buf)
+		if err != nil {
+			return buf, nil, err
+		}
+		buf, m.Spref, err = ch.UnpackString(buf)
+		if err != nil {
+			return buf, nil, err
+		}
+		buf, m.Dpref, err = ch.UnpackString(buf)
+		if err != nil {
+			return buf, nil, err
+		}
+		if len(buf) < 8 {
+			return buf, nil, ch.ErrTooSmall
+		}
+		m.Depth = int(binary.LittleEndian.Uint64(buf[0:]))
+		buf = buf[8:]
+	}
+	return buf, m, nil
+}
+
+func (m *Msg) Unpack(b []byte) (face{}, error) {
+	_, m, err := UnpackMsg(b)
+	return m, err
+}
+
+func (m *Msg) TypeId() uint16 {
+	return ch.Tns
+}
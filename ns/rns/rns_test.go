@@ -0,0 +1,161 @@
+package rns
+
+import (
+	"bytes"
+	"clive/dbg"
+	"clive/ns"
+	"clive/zx"
+	"clive/zx/fstest"
+	"os"
+	"testing"
+)
+
+const tdir = "/tmp/rns_test"
+
+var (
+	verb   = false
+	printf = dbg.FlagPrintf(&verb)
+
+	msgs = [...]*Msg{
+		&Msg{Op: Tns},
+		&Msg{Op: Tmount, Path: "/a", D: zx.Dir{"path": "/a", "addr": "lfs!/tmp"},
+			Flag: ns.Before},
+		&Msg{Op: Tunmount, Path: "/a"},
+		&Msg{Op: Tresolve, Path: "/a/b"},
+		&Msg{Op: Tfind, Path: "/a",
+			Pred: "name=x", Spref: "/", Dpref: "/", Depth: 1},
+		&Msg{Op: Tfindget, Path: "/a",
+			Pred: "name=x", Spref: "/", Dpref: "/", Depth: 1},
+	}
+)
+
+func TestMsgs(t *testing.T) {
+	verb = testing.Verbose()
+	for _, m := range msgs {
+		var b bytes.Buffer
+		if _, err := m.WriteTo(&b); err != nil {
+			t.Fatalf("write: %s", err)
+		}
+		_, um, err := UnpackMsg(b.Bytes())
+		if err != nil {
+			t.Fatalf("unpack: %s", err)
+		}
+		printf("msg %s\n", um)
+		if um.String() != m.String() {
+			t.Fatalf("bad msg %q", um)
+		}
+	}
+}
+
+func count(t *testing.T, f zx.Finder, name string) int {
+	n := 0
+	dc := f.Find(name, "", "/", "/", 0)
+	for d := range dc {
+		printf("\t%s\n", d)
+		n++
+	}
+	if err := cerror(dc); err != nil {
+		t.Fatalf("find: %s", err)
+	}
+	return n
+}
+
+func testNS(t *testing.T, addr string, shared bool) {
+	fstest.MkTree(t, tdir)
+	defer os.RemoveAll(tdir)
+	ns.AddLfsPath(tdir, nil)
+	base := ns.New()
+	var srv *Server
+	var err error
+	if shared {
+		srv, err = NewSharedServer(addr, base)
+	} else {
+		srv, err = NewServer(addr, base)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	c1, err := Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c1.Close()
+	c2, err := Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+
+	d := zx.Dir{"path": "/x", "addr": "lfs!" + tdir + "!/"}
+	if err := c1.Mount(d, ns.Repl); !zx.IsPerm(err) {
+		t.Fatalf("mount not allowed: %v", err)
+	}
+	srv.AllowMount("lfs!" + tdir)
+	bad := zx.Dir{"path": "/y", "addr": "lfs!" + tdir + "!/../.."}
+	if err := c1.Mount(bad, ns.Repl); !zx.IsPerm(err) {
+		t.Fatalf("mount outside allowed: %v", err)
+	}
+	if err := c1.Mount(d, ns.Repl); err != nil {
+		t.Fatal(err)
+	}
+	txt, err := c2.Text()
+	if err != nil {
+		t.Fatal(err)
+	}
+	printf("ns is `%s`\n", txt)
+	pref, mnts, err := c2.Resolve("/x/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pref != "/x" || len(mnts) != 1 || mnts[0]["addr"] != "lfs!"+tdir+"!/a" {
+		t.Fatalf("bad resolve %s %v", pref, mnts)
+	}
+
+	// the same user gets the same name space, but the initial one is kept.
+	if _, _, err := base.Resolve("/x/a"); shared != (err == nil) {
+		t.Fatalf("base ns: shared %v resolve: %v", shared, err)
+	}
+
+	printf("find:\n")
+	lns := ns.New()
+	lns.Mount(d, ns.Repl)
+	if n, ln := count(t, c2, "/x"), count(t, lns, "/x"); n != ln || n == 0 {
+		t.Fatalf("find: got %d entries; expected %d", n, ln)
+	}
+	nd, nb := 0, 0
+	gc := c2.FindGet("/x/a", "", "/", "/", 0)
+	for x := range gc {
+		switch x := x.(type) {
+		case zx.Dir:
+			nd++
+		case []byte:
+			nb += len(x)
+		}
+	}
+	if err := cerror(gc); err != nil || nd == 0 || nb == 0 {
+		t.Fatalf("findget: %d dirs %d bytes: %v", nd, nb, err)
+	}
+
+	if err := c2.Unmount("/x"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c1.Unmount("/x"); err == nil {
+		t.Fatalf("could unmount twice")
+	}
+	if _, _, err := c1.Resolve("/x/a"); err == nil {
+		t.Fatalf("could resolve after unmount")
+	}
+}
+
+func TestNS(t *testing.T) {
+	os.Remove("/tmp/clive.9870")
+	defer os.Remove("/tmp/clive.9870")
+	testNS(t, "unix!local!9870", false)
+}
+
+func TestSNS(t *testing.T) {
+	os.Remove("/tmp/clive.9871")
+	defer os.Remove("/tmp/clive.9871")
+	testNS(t, "unix!local!9871", true)
+}
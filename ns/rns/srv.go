@@ -0,0 +1,306 @@
+/*
+	Remote name spaces.
+
+	The ns service (port "ns") keeps a name space for each user,
+	initialized as a copy of the one given to the server the first time
+	the user is seen, and the sns service (port "sns") keeps a single
+	name space shared by all users.
+	In the ns service, the trees are used authenticated for the user
+	(see zx.Auther), so users may only read what they could read
+	by themselves; the server user is not restricted.
+
+	Clients dial the service using Dial and get a Binder and Finder
+	for the remote name space.
+	The server dials the trees mounted on behalf of its users, thus
+	remote mounts are restricted to the addresses given to AllowMount,
+	and, in the sns service, only the server user may change the
+	name space.
+	The protocol is that of ch.Mux, using Msg requests.
+	Mount and unmount replies are just the error status,
+	resolve sends the prefix string and then the mounted dirs,
+	find sends dirs, find-get sends dirs and file data,
+	and Tns sends the name space text.
+*/
+package rns
+
+import (
+	"clive/ch"
+	"clive/dbg"
+	"clive/net"
+	"clive/net/auth"
+	"clive/ns"
+	"clive/u"
+	"clive/zx"
+	"crypto/tls"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+struct Server {
+	*dbg.Flag
+	*sync.Mutex
+	ns     *ns.NS            // name space served, or initial one for users
+	nss    map[string]*ns.NS // per-user name spaces if not shared
+	shared bool
+	addr   string   // where served
+	mntok  []string // addresses users may mount
+	noauth bool
+	inc    <-chan *ch.Mux
+	endc   chan bool
+}
+
+func (s *Server) String() string {
+	return s.addr
+}
+
+func newServer(addr string, tc *tls.Config, n *ns.NS, shared bool) (*Server, error) {
+	inc, endc, err := net.MuxServe(addr, tc)
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		Flag:   &dbg.Flag{},
+		Mutex:  &sync.Mutex{},
+		ns:     n,
+		nss:    map[string]*ns.NS{},
+		shared: shared,
+		inc:    inc,
+		endc:   endc,
+		addr:   addr,
+	}
+	s.Tag = addr
+	go s.loop()
+	return s, nil
+}
+
+// Start a ns server at the given address.
+// Each user gets its own copy of the given name space.
+func NewServer(addr string, ns *ns.NS, tlscfg ...*tls.Config) (*Server, error) {
+	var tc *tls.Config
+	if len(tlscfg) > 0 {
+		tc = tlscfg[0]
+	}
+	return newServer(addr, tc, ns, false)
+}
+
+// Start a sns server at the given address.
+// All users share the given name space.
+func NewSharedServer(addr string, ns *ns.NS, tlscfg ...*tls.Config) (*Server, error) {
+	var tc *tls.Config
+	if len(tlscfg) > 0 {
+		tc = tlscfg[0]
+	}
+	return newServer(addr, tc, ns, true)
+}
+
+// Disable auth in server
+func (s *Server) NoAuth() {
+	s.noauth = true
+}
+
+// Let users mount the trees at the given addresses, or under them.
+// An address may be a full address, e.g. zx!tcp!host!zx!main!/dir, or
+// a prefix of one ending at a "!", e.g. zx!tcp!host!zx.
+// Binds to paths in the name space need no permission.
+func (s *Server) AllowMount(addrs ...string) {
+	s.Lock()
+	defer s.Unlock()
+	s.mntok = append(s.mntok, addrs...)
+}
+
+// Can users mount d?
+func (s *Server) canMount(d zx.Dir) bool {
+	if d.Proto() == "ns" {
+		return true
+	}
+	addr := d["addr"]
+	if strings.Contains(addr, "..") {
+		return false
+	}
+	s.Lock()
+	defer s.Unlock()
+	for _, a := range s.mntok {
+		if addr == a || strings.HasPrefix(addr, a+"!") {
+			return true
+		}
+	}
+	return false
+}
+
+// Can the user change the name space?
+func (s *Server) canChange(ai *auth.Info) bool {
+	return !s.shared || ai.Ok && ai.Uid == u.Uid
+}
+
+// Return the name space for the user.
+// The trees in the name spaces of users other than the server user
+// are used authenticated for them, and those that can't authenticate
+// users are not used.
+func (s *Server) userNS(ai *auth.Info) *ns.NS {
+	if s.shared {
+		return s.ns
+	}
+	s.Lock()
+	defer s.Unlock()
+	x := s.nss[ai.Uid]
+	if x == nil {
+		x = s.ns.Dup()
+		x.Debug = s.ns.Debug
+		if !s.noauth && ai.Uid != u.Uid {
+			x.AuthFor(ai)
+		}
+		s.nss[ai.Uid] = x
+	}
+	return x
+}
+
+func (s *Server) resolve(c ch.Conn, m *Msg, ns *ns.NS) error {
+	pref, mnts, err := ns.Resolve(m.Path)
+	if err != nil {
+		return err
+	}
+	if ok := c.Out <- pref; !ok {
+		return cerror(c.Out)
+	}
+	for _, d := range mnts {
+		if ok := c.Out <- d; !ok {
+			return cerror(c.Out)
+		}
+	}
+	return nil
+}
+
+func (s *Server) find(c ch.Conn, m *Msg, ns *ns.NS) error {
+	rc := ns.Find(m.Path, m.Pred, m.Spref, m.Dpref, m.Depth)
+	for d := range rc {
+		if ok := c.Out <- d; !ok {
+			err := cerror(c.Out)
+			close(rc, err)
+			return err
+		}
+	}
+	return cerror(rc)
+}
+
+func (s *Server) findget(c ch.Conn, m *Msg, ns *ns.NS) error {
+	rc := ns.FindGet(m.Path, m.Pred, m.Spref, m.Dpref, m.Depth)
+	for x := range rc {
+		if ok := c.Out <- x; !ok {
+			err := cerror(c.Out)
+			close(rc, err)
+			return err
+		}
+	}
+	return cerror(rc)
+}
+
+func (s *Server) req(c ch.Conn, ai *auth.Info, ns *ns.NS) {
+	var rerr error
+	dat, ok := <-c.In
+	if !ok {
+		rerr = cerror(c.In)
+		close(c.In, rerr)
+		close(c.Out, rerr)
+		return
+	}
+	switch m := dat.(type) {
+	case *Msg:
+		s.Dprintf("%s: <- %s\n", c.Tag, m)
+		switch m.Op {
+		case Tns:
+			if ok := c.Out <- ns.String(); !ok {
+				rerr = cerror(c.Out)
+			}
+		case Tmount:
+			if !s.canChange(ai) || !s.canMount(m.D) {
+				rerr = fmt.Errorf("mount %s: %s", m.D["addr"], zx.ErrPerm)
+			} else {
+				rerr = ns.Mount(m.D, m.Flag)
+			}
+		case Tunmount:
+			if !s.canChange(ai) {
+				rerr = fmt.Errorf("unmount %s: %s", m.Path, zx.ErrPerm)
+			} else {
+				rerr = ns.Unmount(m.Path, m.D)
+			}
+		case Tresolve:
+			rerr = s.resolve(c, m, ns)
+		case Tfind:
+			rerr = s.find(c, m, ns)
+		case Tfindget:
+			rerr = s.findget(c, m, ns)
+		default:
+			rerr = fmt.Errorf("unknown msg op %v", m.Op)
+		}
+	default:
+		rerr = fmt.Errorf("unknown msg type %T", m)
+	}
+	if rerr != nil {
+		s.Dprintf("%s: %s\n", c.Tag, rerr)
+	}
+	close(c.In, rerr)
+	close(c.Out, rerr)
+}
+
+func (s *Server) client(mx *ch.Mux) {
+	s.Dprintf("new client %s\n", mx.Tag)
+	defer s.Dprintf("gone client %s\n", mx.Tag)
+	var ai *auth.Info
+	var err error
+	for c := range mx.In {
+		if c.Out == nil {
+			close(c.In, "must issue auth rpc")
+			continue
+		}
+		if s.noauth {
+			ai, err = auth.NoneAtServer(c, "", "ns")
+			if ai != nil && err != nil && err.Error() == "auth disabled" {
+				err = nil
+			}
+		} else {
+			ai, err = auth.AtServer(c, "", "ns")
+		}
+		if err != nil {
+			dbg.Warn("%s: %s: %s", s.addr, mx.Tag, err)
+			continue
+		}
+		break
+	}
+	if ai == nil {
+		dbg.Warn("no client auth info for %s", mx.Tag)
+		close(mx.In)
+		return
+	}
+	s.Dprintf("%s auth as %s\n", mx.Tag, ai.Uid)
+	ns := s.userNS(ai)
+	for c := range mx.In {
+		go s.req(c, ai, ns)
+	}
+}
+
+func (s *Server) loop() {
+	doselect {
+	case mx, ok := <-s.inc:
+		if !ok {
+			close(s.endc, cerror(s.inc))
+			continue
+		}
+		go s.client(mx)
+	case <-s.endc:
+		dbg.Warn("%s: server exiting", s)
+		close(s.inc, "exiting")
+		break
+	}
+}
+
+// Terminate the server.
+func (s *Server) Close() {
+	close(s.endc)
+}
+
+// Wait until the server is done
+func (s *Server) Wait() error {
+	<-s.endc
+	return cerror(s.endc)
+}
@@ -0,0 +1,135 @@
+package ns
+
+import (
+	"clive/zx"
+	"fmt"
+)
+
+/*
+	Union directories.
+
+	When several trees are mounted at the same prefix (using Before and After),
+	the prefix and the directories under it are unions:
+	the files in them are the first ones found in the mounted trees, in order,
+	and getting the directory merges the entries from all the trees,
+	with the first one winning if there are duplicate names.
+
+	New files are created at the first mount flagged as Create (or at the
+	first mount if none is flagged as such); other requests
+	go to the first mount where the file exists.
+*/
+
+// Return the first mount in ds, as resolved for a path, where the path exists,
+// its tree, and the dir entry for the path (nil for single mounts, which
+// are not checked).
+func (ns *NS) found(ds []zx.Dir) (zx.Dir, zx.Fs, zx.Dir, error) {
+	var err error
+	for _, d := range ds {
+		fs, ferr := ns.dirFs(d)
+		if ferr != nil {
+			if err == nil || zx.IsNotExist(err) {
+				err = ferr
+			}
+			continue
+		}
+		if len(ds) == 1 {
+			return d, fs, nil, nil
+		}
+		sd, serr := zx.Stat(fs, d.SPath())
+		if serr == nil {
+			return d, fs, sd, nil
+		}
+		if err == nil {
+			err = serr
+		}
+	}
+	if err == nil {
+		err = zx.ErrNotExist
+	}
+	return nil, nil, nil, err
+}
+
+// Return the mount in ds where new files are created.
+func createMount(ds []zx.Dir) zx.Dir {
+	for _, d := range ds {
+		if d["create"] == "y" {
+			return d
+		}
+	}
+	return ds[0]
+}
+
+// Return the mount in ds for a put, the one where the file exists, or
+// the one for creates if it does not exist.
+func (ns *NS) putMount(ds []zx.Dir) (zx.Dir, zx.Fs, error) {
+	if len(ds) > 1 {
+		d, fs, _, err := ns.found(ds)
+		if err == nil {
+			return d, fs, nil
+		}
+		if !zx.IsNotExist(err) {
+			return nil, nil, err
+		}
+	}
+	d := createMount(ds)
+	fs, err := ns.dirFs(d)
+	return d, fs, err
+}
+
+// Get the merged entries for the union directory at ds,
+// sending those in [off,off+count) to c.
+func (ns *NS) getUnion(ds []zx.Dir, off, count int64, c chan<- []byte) error {
+	seen := map[string]bool{}
+	n := int64(0)
+	some := false
+	var err error
+	for _, d := range ds {
+		fs, ferr := ns.dirFs(d)
+		if ferr != nil {
+			err = ferr
+			continue
+		}
+		xfs, ok := fs.(zx.Getter)
+		if !ok {
+			err = fmt.Errorf("%s: tree is not a getter", d["path"])
+			continue
+		}
+		sd, serr := zx.Stat(fs, d.SPath())
+		if serr != nil || sd["type"] != "d" {
+			if serr != nil && !zx.IsNotExist(serr) {
+				err = serr
+			}
+			continue
+		}
+		some = true
+		gc := xfs.Get(d.SPath(), 0, zx.All)
+		for b := range gc {
+			_, ed, uerr := zx.UnpackDir(b)
+			if uerr != nil {
+				close(gc, uerr)
+				return uerr
+			}
+			if seen[ed["name"]] {
+				continue
+			}
+			seen[ed["name"]] = true
+			if n >= off && (count == zx.All || n < off+count) {
+				if ok := c <- b; !ok {
+					close(gc, cerror(c))
+					return cerror(c)
+				}
+			}
+			n++
+		}
+		if gerr := cerror(gc); gerr != nil {
+			return gerr
+		}
+	}
+	if some {
+		return nil
+	}
+	if err == nil {
+		err = zx.ErrNotExist
+	}
+	return err
+}
@@ -0,0 +1,163 @@
+package ns
+
+import (
+	"clive/zx"
+	"clive/zx/pred"
+	"fmt"
+	fpath "path"
+	"sync"
+	"time"
+)
+
+// Interval to check if the reader of a watch is gone while there are no changes
+var watchPoll = time.Second
+
+// A watch issued to a mounted tree.
+// Paths at spath in the tree are at path in the name space.
+struct mntWatch {
+	path  string
+	spath string
+	c     <-chan zx.Dir
+}
+
+// Rewrite a path reported by the tree to be a path in the name space.
+func (w *mntWatch) nsPath(p string) string {
+	return fpath.Join(w.path, zx.Suffix(p, w.spath))
+}
+
+// Issue a watch for the tree mounted at d, if it's a watcher.
+func (ns *NS) watchMnt(path string, d zx.Dir) *mntWatch {
+	if d["addr"] == "" || !d.IsFinder() {
+		return nil
+	}
+	fs, err := ns.dirFs(d)
+	if err != nil {
+		return nil
+	}
+	wfs, ok := fs.(zx.Watcher)
+	if !ok {
+		return nil
+	}
+	spath := d.SPath()
+	return &mntWatch{path: path, spath: spath, c: wfs.Watch(spath, "")}
+}
+
+// Implementation of the Watcher.Watch operation.
+// Watches are issued to all the trees mounted at the longest prefix of name
+// and to those mounted at suffixes of name; their changes are merged.
+// Trees that are not watchers are ignored.
+// The paths reported (and the "From" attribute for moves) refer to the name space.
+// The watches issued are closed when the reader closes the returned chan,
+// even if no changes arrive.
+func (ns *NS) Watch(name, fpred string) <-chan zx.Dir {
+	c := make(chan zx.Dir)
+	name, err := zx.UseAbsPath(name)
+	if err != nil {
+		close(c, err)
+		return c
+	}
+	x, err := pred.New(fpred)
+	if err != nil {
+		close(c, err)
+		return c
+	}
+	pname, ds, err := ns.Resolve(name)
+	if err != nil {
+		close(c, err)
+		return c
+	}
+	var ws []*mntWatch
+	for _, d := range ds {
+		if w := ns.watchMnt(name, d); w != nil {
+			ws = append(ws, w)
+		}
+	}
+	ns.lk.RLock()
+	for _, p := range ns.pref {
+		if p.name == pname || !zx.HasPrefix(p.name, name) {
+			continue
+		}
+		for _, d := range p.mnt {
+			if w := ns.watchMnt(p.name, d.Dup()); w != nil {
+				ws = append(ws, w)
+			}
+		}
+	}
+	ns.lk.RUnlock()
+	if len(ws) == 0 {
+		close(c, fmt.Errorf("%s: not a watcher", name))
+		return c
+	}
+	var wg sync.WaitGroup
+	var errs []error
+	var errslk sync.Mutex
+	var clk sync.Mutex // sends to c and checks for its reader being gone
+	send := func(d zx.Dir) bool {
+		clk.Lock()
+		defer clk.Unlock()
+		ok := c <- d
+		return ok
+	}
+	donec := make(chan bool)
+	go func() {
+		for {
+			select {
+			case <-donec:
+				return
+			case <-time.After(watchPoll):
+			}
+			// c is not buffered and sends hold clk, so
+			// there's nothing to receive unless c is closed.
+			gone := false
+			clk.Lock()
+			select {
+			case _, ok := <-c:
+				gone = !ok
+			default:
+			}
+			clk.Unlock()
+			if gone {
+				for _, w := range ws {
+					close(w.c, cerror(c))
+				}
+				return
+			}
+		}
+	}()
+	for _, w := range ws {
+		wg.Add(1)
+		go func(w *mntWatch) {
+			defer wg.Done()
+			for d := range w.c {
+				d["path"] = w.nsPath(d["path"])
+				d["name"] = fpath.Base(d["path"])
+				if from := d["From"]; from != "" && zx.HasPrefix(from, w.spath) {
+					d["From"] = w.nsPath(from)
+				}
+				depth := len(zx.Elems(zx.Suffix(d["path"], name)))
+				if d["Chg"] != zx.Overflow && !x.Match(d, depth) {
+					continue
+				}
+				if ok := send(d); !ok {
+					close(w.c, cerror(c))
+					return
+				}
+			}
+			if err := cerror(w.c); err != nil {
+				errslk.Lock()
+				errs = append(errs, err)
+				errslk.Unlock()
+			}
+		}(w)
+	}
+	go func() {
+		wg.Wait()
+		close(donec)
+		if len(errs) > 0 {
+			close(c, errs[0])
+		} else {
+			close(c)
+		}
+	}()
+	return c
+}
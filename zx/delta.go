@@ -0,0 +1,230 @@
+package zx
+
+import (
+	"bytes"
+	"clive/ch"
+	"encoding/binary"
+	"fmt"
+)
+
+// Block size used by default for delta transfers (see Deltaer).
+const DeltaBlkSz = 16 * 1024
+
+// Data for a file at the given offset, as sent in delta transfers.
+struct Delta {
+	Off  int64
+	Data []byte
+}
+
+// Pack the delta as a byte array (offset and data).
+func (dl Delta) Bytes() []byte {
+	b := make([]byte, 8+len(dl.Data))
+	binary.LittleEndian.PutUint64(b, uint64(dl.Off))
+	copy(b[8:], dl.Data)
+	return b
+}
+
+// Unpack a delta packed by Delta.Bytes
+func UnpackDelta(b []byte) (Delta, error) {
+	if len(b) < 8 {
+		return Delta{}, ch.ErrTooSmall
+	}
+	off := int64(binary.LittleEndian.Uint64(b))
+	return Delta{Off: off, Data: b[8:]}, nil
+}
+
+func (dl Delta) String() string {
+	return fmt.Sprintf("delta off %d [%d]bytes", dl.Off, len(dl.Data))
+}
+
+// Return the hashes for the blocks of blksz bytes of the data sent through c.
+func BlockSums(c <-chan []byte, blksz int64) ([][]byte, error) {
+	if blksz <= 0 {
+		err := fmt.Errorf("bad block size %d", blksz)
+		close(c, err)
+		return nil, err
+	}
+	var sums [][]byte
+	h := NewSum()
+	n := int64(0)
+	for b := range c {
+		for len(b) > 0 {
+			nw := int64(len(b))
+			if nw > blksz-n {
+				nw = blksz - n
+			}
+			h.Write(b[:nw])
+			b = b[nw:]
+			if n += nw; n == blksz {
+				sums = append(sums, h.Sum(nil))
+				h.Reset()
+				n = 0
+			}
+		}
+	}
+	if err := cerror(c); err != nil {
+		return nil, err
+	}
+	if n > 0 {
+		sums = append(sums, h.Sum(nil))
+	}
+	return sums, nil
+}
+
+// Send through dc a Delta for each block of blksz bytes of the data
+// sent through c that does not match the hash for the block in sums.
+func Deltas(c <-chan []byte, blksz int64, sums [][]byte, dc chan<- Delta) error {
+	if blksz <= 0 {
+		err := fmt.Errorf("bad block size %d", blksz)
+		close(c, err)
+		return err
+	}
+	h := NewSum()
+	off := int64(0)
+	i := 0
+	blk := make([]byte, 0, blksz)
+	flush := func() bool {
+		h.Reset()
+		h.Write(blk)
+		n := int64(len(blk))
+		if i >= len(sums) || !bytes.Equal(h.Sum(nil), sums[i]) {
+			if ok := dc <- Delta{Off: off, Data: blk}; !ok {
+				return false
+			}
+			blk = make([]byte, 0, blksz)
+		}
+		off += n
+		i++
+		blk = blk[:0]
+		return true
+	}
+	for b := range c {
+		for len(b) > 0 {
+			n := int(blksz) - len(blk)
+			if n > len(b) {
+				n = len(b)
+			}
+			blk = append(blk, b[:n]...)
+			b = b[n:]
+			if int64(len(blk)) == blksz && !flush() {
+				err := cerror(dc)
+				close(c, err)
+				return err
+			}
+		}
+	}
+	if err := cerror(c); err != nil {
+		return err
+	}
+	if len(blk) > 0 && !flush() {
+		return cerror(dc)
+	}
+	return nil
+}
+
+// Send through c the Dir for the file at p in fs and then the Deltas
+// for the blocks that differ from those with the given hashes.
+// This can be used to implement DeltaGet for any Getter.
+func GetDeltas(fs Getter, p string, blksz int64, sums [][]byte, c chan<- face{}) error {
+	if blksz <= 0 {
+		return fmt.Errorf("%s: bad block size", p)
+	}
+	d, err := Stat(fs, p)
+	if err != nil {
+		return err
+	}
+	if d["type"] == "d" {
+		return fmt.Errorf("%s: %s", p, ErrIsDir)
+	}
+	if ok := c <- d; !ok {
+		return cerror(c)
+	}
+	dc := make(chan Delta)
+	go func() {
+		close(dc, Deltas(fs.Get(p, 0, All), blksz, sums, dc))
+	}()
+	for dl := range dc {
+		if ok := c <- dl; !ok {
+			err := cerror(c)
+			close(dc, err)
+			return err
+		}
+	}
+	return cerror(dc)
+}
+
+// Return an error if the delta is not within a file of the given size.
+func (dl Delta) Check(p string, size int64) error {
+	if dl.Off < 0 || dl.Off+int64(len(dl.Data)) > size {
+		return fmt.Errorf("%s: delta at %d+%d beyond size %d", p, dl.Off, len(dl.Data), size)
+	}
+	return nil
+}
+
+// Update the existing file at p in fs with the Deltas sent through dc.
+// Contiguous deltas are written using a single Put.
+// d is used as in Put, and d["size"] must be the new size for the file.
+// Deltas not within the new size are an error.
+// This can be used to implement DeltaPut for any Putter.
+func PutDeltas(fs Putter, p string, d Dir, dc <-chan Delta) (Dir, error) {
+	if d["size"] == "" {
+		err := fmt.Errorf("%s: no size", p)
+		close(dc, err)
+		return nil, err
+	}
+	size := d.Size()
+	var dlerr error // for a bad delta
+	recv := func() (Delta, bool) {
+		dl, more := <-dc
+		if more {
+			if dlerr = dl.Check(p, size); dlerr != nil {
+				close(dc, dlerr)
+				return dl, false
+			}
+		}
+		return dl, more
+	}
+	d = d.Dup()
+	delete(d, "type") // the file must exist
+	mt := d["mtime"]
+	var rd Dir
+	dl, more := recv()
+	if dlerr != nil {
+		return nil, dlerr
+	}
+	for first := true; first || more; first = false {
+		off := dl.Off
+		bc := make(chan []byte)
+		rc := fs.Put(p, d, off, bc)
+		for more && dl.Off == off {
+			if ok := bc <- dl.Data; !ok {
+				err := cerror(bc)
+				close(dc, err)
+				return nil, err
+			}
+			off += int64(len(dl.Data))
+			dl, more = recv()
+		}
+		err := dlerr
+		if err == nil {
+			err = cerror(dc)
+		}
+		if !more && err != nil {
+			close(bc, err)
+			<-rc
+			return nil, err
+		}
+		close(bc)
+		rd = <-rc
+		if err := cerror(rc); err != nil {
+			close(dc, err)
+			return nil, err
+		}
+		// only the first put truncates; all keep the mtime
+		d = Dir{}
+		if mt != "" {
+			d["mtime"] = mt
+		}
+	}
+	return rd, nil
+}
@@ -648,7 +648,7 @@ func (d Dir) Proto() string {
 func (d Dir) IsFinder() bool {
 	p := d.Proto()
 	switch p {
-	case "lfs", "zxc", "zx", "finder":
+	case "lfs", "zxc", "zx", "9p", "disc", "finder":
 		return true
 	default:
 		return false
@@ -19,6 +19,7 @@ var (
 	ErrBadCtl    = errors.New("bad ctl request")
 	ErrNotSuffix = errors.New("not an inner path")
 	ErrBadType   = errors.New("bad file type")
+	ErrQuota     = errors.New("quota exceeded")
 	ErrIO        = ch.ErrIO
 )
 
@@ -78,3 +79,14 @@ func IsPerm(e error) bool {
 	s := e.Error()
 	return strings.Contains(s, "permission denied")
 }
+
+func IsQuota(e error) bool {
+	if e == nil {
+		return false
+	}
+	if e == ErrQuota {
+		return true
+	}
+	s := e.Error()
+	return strings.Contains(s, "quota exceeded")
+}
@@ -14,6 +14,35 @@ interface Fs {
 
 const All = -1
 
+// Getters able to report hashes for file contents.
+// They might also report the hash for the whole file in the "sum"
+// attribute (see Sum), once it is known and while the file does not change.
+interface Summer {
+	Getter
+	// Send the hashes for the data of the file at path, one per message.
+	// If blksz is 0, a single hash is sent for the whole file;
+	// otherwise, a hash is sent for each block of blksz bytes
+	// (the last one might be shorter).
+	Sums(path string, blksz int64) <-chan []byte
+}
+
+// Trees able to transfer just the data that differs from an old
+// copy of a file kept by the caller (see Delta).
+interface Deltaer {
+	Getter
+	// Get the file at path given the hashes for the blocks of blksz
+	// bytes of the caller's copy (see Summer).
+	// The Dir for the file is sent first, and then a Delta for
+	// each block that differs; the caller must truncate its copy to
+	// the size reported.
+	DeltaGet(path string, blksz int64, sums [][]byte) <-chan face{}
+	// Update the file at path with the data sent through dc, like
+	// Put(path, d, 0, dc) would do for an existing file, but sending
+	// only the blocks of blksz bytes that differ.
+	// d["size"] must be the size of the data sent.
+	DeltaPut(path string, d Dir, blksz int64, dc <-chan []byte) <-chan Dir
+}
+
 // File systems able to find directory entries
 interface Finder {
 	// Navigate the tree starting at path to find files matching the predicate
@@ -73,6 +102,9 @@ interface Putter {
 	// created if they do not exist.
 	// If d["type"] is "D", it means "d" but parent directories are created
 	// if they do not exist.
+	// If d["type"] is "l", a symbolic link to the target sent through dc
+	// is created, for trees supporting them. Symbolic links report their
+	// target in the temporary "Link" attribute.
 	Put(path string, d Dir, off int64, dc <-chan []byte) <-chan Dir
 }
 
@@ -106,6 +138,32 @@ interface Linker {
 	Link(oldp, newp string) <-chan error
 }
 
+// Kinds of changes reported by Watchers in the "Chg" attribute.
+const (
+	Created = "created"
+	Updated = "updated"
+	Removed = "removed"
+	Moved   = "moved"
+
+	// Changes were lost because the watcher did not keep up.
+	Overflow = "overflow"
+)
+
+// File systems able to notify changes made to files
+interface Watcher {
+	// Report changes made to files at or under path that match pred.
+	// Each change is reported by sending the Dir for the file after the
+	// change, with the temporary attribute "Chg" set to the kind of change
+	// (Created, Updated, Removed, or Moved).
+	// Removed files might report just their name, path, type, and addr.
+	// Moved files report the new path and the old one in the "From" attribute.
+	// Changes are dropped if the caller does not keep up with them, and
+	// a Dir for path with "Chg" set to Overflow reports that.
+	// The depth used to evaluate pred is relative to path.
+	// The watch ceases when the caller closes the returned channel.
+	Watch(path, pred string) <-chan Dir
+}
+
 // File systems that can authenticate a user
 interface Auther {
 	// returns a new view of the Fs authenticated for ai
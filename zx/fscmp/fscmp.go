@@ -69,6 +69,8 @@ func (c Chg) String() string {
 
 // Compute changes for fs1 to become like fs2 and send them to the
 // returned chan.
+// Files are considered to have different data if their mtimes or sizes
+// differ, or if both report a "sum" attribute (see zx.Sum) and the sums differ.
 // If no path is given, "/" is used.
 func Diff(fs1, fs2 zx.Getter, path ...string) <-chan Chg {
 	p := "/"
@@ -124,6 +126,18 @@ func diffrec(k ChgType, d zx.Dir, fs zx.Getter, c chan<- Chg) error {
 	return nil
 }
 
+// Like zx.EqualDirs, but ignores "sum", which trees might report
+// only once they have computed it.
+func equalMeta(d1, d2 zx.Dir) bool {
+	if d1["sum"] == "" && d2["sum"] == "" {
+		return zx.EqualDirs(d1, d2)
+	}
+	d1, d2 = d1.Dup(), d2.Dup()
+	delete(d1, "sum")
+	delete(d2, "sum")
+	return zx.EqualDirs(d1, d2)
+}
+
 func diff(d1, d2 zx.Dir, fs1, fs2 zx.Getter, c chan<- Chg) error {
 	if d1["path"] != d2["path"] {
 		panic("diff bug, paths differ")
@@ -135,10 +149,15 @@ func diff(d1, d2 zx.Dir, fs1, fs2 zx.Getter, c chan<- Chg) error {
 		}
 		return nil
 	}
-	metachanged := !zx.EqualDirs(d1, d2)
+	metachanged := !equalMeta(d1, d2)
 	datachanged := metachanged &&
 		(d1["mtime"] != d2["mtime"] || d1["size"] != d2["size"])
 	typ := d1["type"]
+	if typ != "d" && d1["sum"] != "" && d2["sum"] != "" {
+		// the hashes tell for sure
+		datachanged = d1["sum"] != d2["sum"]
+		metachanged = metachanged || datachanged
+	}
 	if typ != "d" {
 		var chg Chg
 		if datachanged {
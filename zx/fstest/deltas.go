@@ -0,0 +1,135 @@
+package fstest
+
+import (
+	"bytes"
+	"clive/zx"
+)
+
+// Apply the dir and deltas from c to old and return the result.
+func applyDeltas(t Fataler, old []byte, c <-chan face{}) ([]byte, int) {
+	x := <-c
+	d, ok := x.(zx.Dir)
+	if !ok {
+		t.Fatalf("delta get: no dir: %v", cerror(c))
+	}
+	dat := make([]byte, d.Size())
+	copy(dat, old)
+	n := 0
+	for x := range c {
+		dl, ok := x.(zx.Delta)
+		if !ok {
+			t.Fatalf("delta get: got %T", x)
+		}
+		Printf("%s\n", dl)
+		copy(dat[dl.Off:], dl.Data)
+		n++
+	}
+	if err := cerror(c); err != nil {
+		t.Fatalf("delta get: %s", err)
+	}
+	return dat, n
+}
+
+func deltaPut(t Fataler, fs zx.Deltaer, p string, dat []byte, blksz int64) {
+	c := make(chan []byte, 1)
+	c <- dat
+	close(c)
+	d := zx.Dir{}
+	d.SetSize(int64(len(dat)))
+	rc := fs.DeltaPut(p, d, blksz, c)
+	rd := <-rc
+	if err := cerror(rc); err != nil {
+		t.Fatalf("delta put: %s", err)
+	}
+	if rd.Size() != int64(len(dat)) {
+		t.Fatalf("delta put: size is %d", rd.Size())
+	}
+	ndat, err := zx.GetAll(fs, p)
+	if err != nil {
+		t.Fatalf("get: %s", err)
+	}
+	if !bytes.Equal(dat, ndat) {
+		t.Fatalf("delta put: bad data")
+	}
+}
+
+func Deltas(t Fataler, xfs zx.Fs) {
+	fs, ok := xfs.(zx.Deltaer)
+	if !ok {
+		t.Fatalf("not a Deltaer")
+	}
+	blksz := int64(1024)
+	dat, err := zx.GetAll(fs, "/a/a2")
+	if err != nil {
+		t.Fatalf("get: %s", err)
+	}
+
+	// an old copy with a change and missing the tail
+	old := append([]byte{}, dat[:len(dat)-100]...)
+	old[3000]++
+	c := make(chan []byte, 1)
+	c <- old
+	close(c)
+	sums, err := zx.BlockSums(c, blksz)
+	if err != nil {
+		t.Fatalf("sums: %s", err)
+	}
+	ndat, n := applyDeltas(t, old, fs.DeltaGet("/a/a2", blksz, sums))
+	if !bytes.Equal(dat, ndat) {
+		t.Fatalf("delta get: bad data")
+	}
+	if n != 2 {
+		t.Fatalf("delta get: got %d deltas", n)
+	}
+
+	// an old copy with more data
+	old = append(append([]byte{}, dat...), []byte("more data\n")...)
+	c = make(chan []byte, 1)
+	c <- old
+	close(c)
+	if sums, err = zx.BlockSums(c, blksz); err != nil {
+		t.Fatalf("sums: %s", err)
+	}
+	ndat, n = applyDeltas(t, old, fs.DeltaGet("/a/a2", blksz, sums))
+	if !bytes.Equal(dat, ndat) {
+		t.Fatalf("delta get: bad data")
+	}
+	if n != 1 {
+		t.Fatalf("delta get: got %d deltas", n)
+	}
+
+	if _, n = applyDeltas(t, dat, fs.DeltaGet("/a/a2", blksz, nil)); n == 0 {
+		t.Fatalf("delta get: no deltas for no sums")
+	}
+
+	// change, grow, and shrink the file
+	ndat = append([]byte{}, dat...)
+	ndat[5000]++
+	deltaPut(t, fs, "/a/a2", ndat, blksz)
+	ndat = append(ndat, dat...)
+	deltaPut(t, fs, "/a/a2", ndat, blksz)
+	deltaPut(t, fs, "/a/a2", ndat[:1500], blksz)
+	deltaPut(t, fs, "/a/a2", nil, blksz)
+
+	// deltas beyond the new size are refused
+	if pfs, ok := xfs.(zx.Putter); ok {
+		for _, off := range []int64{-1, 10} {
+			dc := make(chan zx.Delta, 1)
+			dc <- zx.Delta{Off: off, Data: make([]byte, 100)}
+			close(dc)
+			if _, err := zx.PutDeltas(pfs, "/a/a2", zx.Dir{"size": "50"}, dc); err == nil {
+				t.Fatalf("put deltas: delta at %d accepted", off)
+			}
+		}
+		d, err := zx.Stat(fs, "/a/a2")
+		if err != nil || d.Size() != 0 {
+			t.Fatalf("put deltas: stat %v %v", d, err)
+		}
+	}
+
+	rc := fs.DeltaPut("/a/xxx", zx.Dir{"size": "0"}, blksz, nil)
+	<-rc
+	if err := cerror(rc); !zx.IsNotExist(err) {
+		t.Fatalf("delta put: non existing file: %v", err)
+	}
+}
@@ -3,6 +3,7 @@ package fstest
 import (
 	"bytes"
 	"clive/zx"
+	"errors"
 )
 
 struct findTest {
@@ -195,3 +196,34 @@ func FindGets(t Fataler, xfs zx.Fs) {
 		}
 	}
 }
+
+// Stop reading early and check that the fs is still ok.
+func Cancels(t Fataler, xfs zx.Fs) {
+	fs, ok := xfs.(zx.FullFs)
+	if !ok {
+		t.Fatalf("not a full fs")
+	}
+	cerr := errors.New("cancel test")
+	dc := fs.Find("/", "", "", "", 0)
+	<-dc
+	close(dc, cerr)
+	fc := fs.FindGet("/", "", "", "", 0)
+	for i := 0; i < 5; i++ {
+		<-fc
+	}
+	close(fc, cerr)
+	bc := fs.Get("/2", 0, -1)
+	<-bc
+	close(bc, cerr)
+	for i := 0; i < 3; i++ {
+		Finds(t, fs)
+		FindGets(t, fs)
+	}
+	dat, err := zx.GetAll(fs, "/2")
+	if err != nil {
+		t.Fatalf("get: %s", err)
+	}
+	if !bytes.Equal(dat, FileData["/2"]) {
+		t.Fatalf("bad data for /2")
+	}
+}
@@ -0,0 +1,98 @@
+package fstest
+
+import (
+	"bytes"
+	"clive/zx"
+)
+
+func Sums(t Fataler, xfs zx.Fs) {
+	fs, ok := xfs.(zx.Summer)
+	if !ok {
+		t.Fatalf("not a Summer")
+	}
+	dat, err := zx.GetAll(fs, "/a/a2")
+	if err != nil {
+		t.Fatalf("get: %s", err)
+	}
+	h := zx.NewSum()
+	h.Write(dat)
+	xsum := zx.SumString(h.Sum(nil))
+
+	d, err := zx.Stat(xfs, "/a/a2")
+	if err != nil {
+		t.Fatalf("stat: %s", err)
+	}
+	sum, err := zx.Sum(fs, d)
+	if err != nil {
+		t.Fatalf("sum: %s", err)
+	}
+	Printf("sum %s\n", sum)
+	if sum != xsum {
+		t.Fatalf("bad sum %s", sum)
+	}
+	d, err = zx.Stat(xfs, "/a/a2")
+	if err != nil {
+		t.Fatalf("stat: %s", err)
+	}
+	if d["sum"] != "" && d["sum"] != xsum {
+		t.Fatalf("bad sum attr %s", d["sum"])
+	}
+
+	blksz := int64(1024)
+	sums, err := zx.Sums(fs, "/a/a2", blksz)
+	if err != nil {
+		t.Fatalf("sums: %s", err)
+	}
+	if n := (int64(len(dat)) + blksz - 1) / blksz; int64(len(sums)) != n {
+		t.Fatalf("got %d sums; expected %d", len(sums), n)
+	}
+	for i, s := range sums {
+		b := dat[int64(i)*blksz:]
+		if int64(len(b)) > blksz {
+			b = b[:blksz]
+		}
+		h.Reset()
+		h.Write(b)
+		if !bytes.Equal(s, h.Sum(nil)) {
+			t.Fatalf("bad sum for block %d", i)
+		}
+	}
+	if _, err := zx.Sums(fs, "/a", blksz); err == nil {
+		t.Fatalf("sums for a dir worked")
+	}
+
+	if ffs, ok := xfs.(zx.Finder); ok {
+		dc := ffs.Find("/", "sum="+xsum, "", "", 0)
+		var got []string
+		for d := range dc {
+			Printf("found %s\n", d.Fmt())
+			got = append(got, d["path"])
+		}
+		if err := cerror(dc); err != nil {
+			t.Fatalf("find: %s", err)
+		}
+		if len(got) != 1 || got[0] != "/a/a2" {
+			t.Fatalf("find by sum: got %v", got)
+		}
+	}
+
+	if err := zx.PutAll(fs.(zx.Putter), "/a/a2", []byte("hi there\n")); err != nil {
+		t.Fatalf("put: %s", err)
+	}
+	d, err = zx.Stat(xfs, "/a/a2")
+	if err != nil {
+		t.Fatalf("stat: %s", err)
+	}
+	if d["sum"] == xsum {
+		t.Fatalf("stale sum after put")
+	}
+	sum, err = zx.Sum(fs, d)
+	if err != nil {
+		t.Fatalf("sum: %s", err)
+	}
+	h.Reset()
+	h.Write([]byte("hi there\n"))
+	if sum != zx.SumString(h.Sum(nil)) {
+		t.Fatalf("bad sum after put")
+	}
+}
@@ -0,0 +1,68 @@
+package fstest
+
+import (
+	"clive/zx"
+	"time"
+)
+
+struct watchChg {
+	Path, Chg, From string
+}
+
+// Changes expected when watching /a during Watches
+var watchChgs = []watchChg{
+	{"/a/n1", zx.Created, ""},
+	{"/a/a1", zx.Updated, ""},
+	{"/a/a2", zx.Removed, ""},
+	{"/a/m1", zx.Moved, "/a/a1"},
+}
+
+func Watches(t Fataler, xfs zx.Fs) {
+	fs, ok := xfs.(zx.Watcher)
+	if !ok {
+		t.Fatalf("not a Watcher")
+	}
+	wc := fs.Watch("/a", "")
+	if err := zx.PutAll(xfs.(zx.Putter), "/a/n1", []byte("hi there\n")); err != nil {
+		t.Fatalf("put: %s", err)
+	}
+	rc := xfs.(zx.Wstater).Wstat("/a/a1", zx.Dir{"foo": "bar"})
+	<-rc
+	if err := cerror(rc); err != nil {
+		t.Fatalf("wstat: %s", err)
+	}
+	if err := <-xfs.(zx.Remover).Remove("/a/a2"); err != nil {
+		t.Fatalf("rm: %s", err)
+	}
+	if err := <-xfs.(zx.Mover).Move("/a/a1", "/a/m1"); err != nil {
+		t.Fatalf("mv: %s", err)
+	}
+	// not under /a; must not be seen
+	if err := zx.PutAll(xfs.(zx.Putter), "/d/n2", []byte("hi there\n")); err != nil {
+		t.Fatalf("put: %s", err)
+	}
+
+	// The OS may report more changes than those we made (eg. an
+	// update after a create), but we must see those we made in order.
+	n := 0
+	tmout := time.After(5 * time.Second)
+	for n < len(watchChgs) {
+		select {
+		case d, ok := <-wc:
+			if !ok {
+				t.Fatalf("watch: %v", cerror(wc))
+			}
+			Printf("watch %s %s %s\n", d["Chg"], d["path"], d["From"])
+			if !zx.HasPrefix(d["path"], "/a") {
+				t.Fatalf("watch: %s not under /a", d["path"])
+			}
+			x := watchChgs[n]
+			if d["path"] == x.Path && d["Chg"] == x.Chg && d["From"] == x.From {
+				n++
+			}
+		case <-tmout:
+			t.Fatalf("watch: missing %v", watchChgs[n])
+		}
+	}
+	close(wc)
+}
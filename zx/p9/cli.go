@@ -0,0 +1,918 @@
+package p9
+
+import (
+	"bufio"
+	"clive/dbg"
+	cnet "clive/net"
+	"clive/u"
+	"clive/zx"
+	"clive/zx/pred"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	fpath "path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A zx tree for the files served by a 9P2000 server.
+// Requests are multiplexed on a single connection, using a tag per request.
+struct Fs {
+	*dbg.Flag
+	addr       string // net!host!port!aname
+	nc         net.Conn
+	msize      uint32
+	sync.Mutex        // for the fields below
+	err        error  // set when the connection is gone
+	tags       map[uint16]chan *Fcall
+	ntag       uint16
+	fids       []uint32 // free fids
+	nfid       uint32
+}
+
+const rootFid = 0
+
+var (
+	ErrNotSup = errors.New("not supported by 9P2000")
+
+	dials   = map[string]*Fs{}
+	dialslk sync.Mutex
+	_fs     zx.FullFs = &Fs{}
+)
+
+// Return network!host!port!aname from addr.
+// 	host -> tcp!host!9fs!main
+//	host!port -> tcp!host!port!main
+//	net!host!port -> net!host!port!main
+func FillAddr(addr string) string {
+	toks := strings.Split(addr, "!")
+	switch len(toks) {
+	case 1:
+		return fmt.Sprintf("tcp!%s!9fs!main", toks[0])
+	case 2:
+		return fmt.Sprintf("tcp!%s!%s!main", toks[0], toks[1])
+	case 3:
+		return fmt.Sprintf("%s!main", addr)
+	default:
+		return addr
+	}
+}
+
+// Dial the network address for a raw 9P connection.
+// If the network is "*", unix is tried before tcp.
+func dial(addr string) (net.Conn, error) {
+	nw, host, svc := cnet.ParseAddr(addr)
+	if nw != "*" && nw != "unix" && nw != "tcp" {
+		return nil, cnet.ErrBadAddr
+	}
+	var err error
+	if nw == "*" || nw == "unix" {
+		nc, uerr := net.Dial("unix", cnet.Port("unix", svc))
+		if uerr == nil {
+			return nc, nil
+		}
+		err = uerr
+	}
+	if nw == "*" || nw == "tcp" {
+		if host == "local" || host == "localhost" || host == "*" {
+			host = "127.0.0.1"
+		}
+		return net.Dial("tcp", host+":"+cnet.Port("tcp", svc))
+	}
+	return nil, err
+}
+
+// Dial a 9P2000 server and attach to the tree with the given name.
+// addr is completed if needed using FillAddr(), and the last
+// element is the attach name.
+// The previously dialed addresses are cached and the
+// old connections are returned while they are alive.
+// The local user name is used to attach, and no authentication
+// is performed.
+func Dial(addr string) (*Fs, error) {
+	addr = FillAddr(addr)
+	dialslk.Lock()
+	fs, ok := dials[addr]
+	dialslk.Unlock()
+	if ok {
+		return fs, nil
+	}
+	n := strings.LastIndexByte(addr, '!')
+	nc, err := dial(addr[:n])
+	if err != nil {
+		return nil, err
+	}
+	fs = &Fs{
+		Flag: &dbg.Flag{Tag: "p9 " + addr},
+		addr: addr,
+		nc:   nc,
+		tags: map[uint16]chan *Fcall{},
+		nfid: rootFid,
+	}
+	if err := fs.attach(addr[n+1:]); err != nil {
+		nc.Close()
+		return nil, fmt.Errorf("%s: %s", addr, err)
+	}
+	dialslk.Lock()
+	ofs, ok := dials[addr]
+	if !ok {
+		dials[addr] = fs
+	}
+	dialslk.Unlock()
+	if ok {
+		// dialed by someone else meanwhile
+		fs.Close()
+		return ofs, nil
+	}
+	return fs, nil
+}
+
+func (fs *Fs) String() string {
+	return fs.Tag
+}
+
+func (fs *Fs) attach(aname string) error {
+	r := bufio.NewReader(fs.nc)
+	f := &Fcall{Type: Tversion, Tag: NoTag, Msize: MaxMsize, Version: Version}
+	fs.Dprintf("-> %s\n", f)
+	if err := WriteFcall(fs.nc, f); err != nil {
+		return err
+	}
+	rf, err := ReadFcall(r, MaxMsize)
+	if err != nil {
+		return err
+	}
+	fs.Dprintf("<- %s\n", rf)
+	if rf.Type == Rerror {
+		return errors.New(rf.Ename)
+	}
+	if rf.Type != Rversion || rf.Version != Version || rf.Msize < IOHdrSz+128 {
+		return fmt.Errorf("bad version %s", rf)
+	}
+	fs.msize = rf.Msize
+	if fs.msize > MaxMsize {
+		fs.msize = MaxMsize
+	}
+	go fs.reader(r)
+	f = &Fcall{Type: Tattach, Fid: rootFid, Afid: NoFid, Uname: u.Uid, Aname: aname}
+	if _, err := fs.rpc(f); err != nil {
+		fs.hangup(err)
+		return err
+	}
+	return nil
+}
+
+// Hang up the connection to the server.
+func (fs *Fs) Close() error {
+	fs.hangup(errors.New("closed"))
+	return nil
+}
+
+// The connection is gone, fail all pending and further requests.
+func (fs *Fs) hangup(err error) {
+	fs.Lock()
+	if fs.err == nil {
+		fs.Dprintf("hangup: %s\n", err)
+		fs.err = fmt.Errorf("%s: %s: %s", fs.addr, zx.ErrIO, err)
+		for _, rc := range fs.tags {
+			close(rc)
+		}
+		fs.tags = map[uint16]chan *Fcall{}
+		fs.nc.Close()
+	}
+	fs.Unlock()
+	dialslk.Lock()
+	if dials[fs.addr] == fs {
+		delete(dials, fs.addr)
+	}
+	dialslk.Unlock()
+}
+
+// Read replies and hand them to the requests waiting for them.
+func (fs *Fs) reader(r *bufio.Reader) {
+	for {
+		f, err := ReadFcall(r, fs.msize)
+		if err != nil {
+			fs.hangup(err)
+			return
+		}
+		fs.Dprintf("<- %s\n", f)
+		fs.Lock()
+		rc := fs.tags[f.Tag]
+		delete(fs.tags, f.Tag)
+		fs.Unlock()
+		if rc != nil {
+			rc <- f
+		}
+	}
+}
+
+// Issue a request and wait for its reply.
+// Rerror replies are returned as errors.
+func (fs *Fs) rpc(f *Fcall) (*Fcall, error) {
+	rc := make(chan *Fcall, 1)
+	fs.Lock()
+	if fs.err != nil {
+		err := fs.err
+		fs.Unlock()
+		return nil, err
+	}
+	for fs.ntag == NoTag || fs.tags[fs.ntag] != nil {
+		fs.ntag++
+	}
+	f.Tag = fs.ntag
+	fs.ntag++
+	fs.tags[f.Tag] = rc
+	fs.Dprintf("-> %s\n", f)
+	err := WriteFcall(fs.nc, f)
+	fs.Unlock()
+	if err != nil {
+		fs.hangup(err)
+	}
+	r, ok := <-rc
+	if !ok {
+		fs.Lock()
+		err := fs.err
+		fs.Unlock()
+		return nil, err
+	}
+	if r.Type == Rerror {
+		return nil, errors.New(r.Ename)
+	}
+	if r.Type != f.Type+1 {
+		return nil, fmt.Errorf("%s: %s", ErrBadMsg, r.Type)
+	}
+	return r, nil
+}
+
+func (fs *Fs) newfid() uint32 {
+	fs.Lock()
+	defer fs.Unlock()
+	if n := len(fs.fids); n > 0 {
+		fid := fs.fids[n-1]
+		fs.fids = fs.fids[:n-1]
+		return fid
+	}
+	fs.nfid++
+	return fs.nfid
+}
+
+func (fs *Fs) putfid(fid uint32) {
+	fs.Lock()
+	fs.fids = append(fs.fids, fid)
+	fs.Unlock()
+}
+
+func (fs *Fs) clunk(fid uint32) {
+	fs.rpc(&Fcall{Type: Tclunk, Fid: fid})
+	fs.putfid(fid)
+}
+
+// Walk to p and return a new fid for it.
+func (fs *Fs) walk(p string) (uint32, error) {
+	els := zx.Elems(p)
+	fid := fs.newfid()
+	from := uint32(rootFid)
+	for {
+		n := len(els)
+		if n > MaxWElem {
+			n = MaxWElem
+		}
+		r, err := fs.rpc(&Fcall{Type: Twalk, Fid: from, Newfid: fid, Wname: els[:n]})
+		if err == nil && len(r.Wqid) < n {
+			err = fmt.Errorf("%s: %s", p, zx.ErrNotExist)
+		}
+		if err != nil {
+			if from == fid {
+				fs.clunk(fid)
+			} else {
+				fs.putfid(fid)
+			}
+			return 0, err
+		}
+		from = fid
+		if els = els[n:]; len(els) == 0 {
+			return fid, nil
+		}
+	}
+}
+
+func (fs *Fs) iounit(r *Fcall) uint32 {
+	if r.Iounit == 0 || r.Iounit > fs.msize-IOHdrSz {
+		return fs.msize - IOHdrSz
+	}
+	return r.Iounit
+}
+
+// Return the zx dir for the 9P stat of the file at p.
+func (fs *Fs) dir(p string, st *Stat) zx.Dir {
+	d := zx.Dir{
+		"name": st.Name,
+		"path": p,
+		"type": "-",
+		"uid":  st.Uid,
+		"gid":  st.Gid,
+		"wuid": st.Muid,
+		"addr": "9p!" + fs.addr + "!" + p,
+	}
+	if p == "/" {
+		d["name"] = "/"
+	}
+	d.SetMode(uint64(st.Mode))
+	if st.Mode&DMDIR != 0 {
+		d["type"] = "d"
+		d.SetSize(0)
+	} else {
+		d.SetSize(int64(st.Length))
+	}
+	d.SetTime("mtime", time.Unix(int64(st.Mtime), 0))
+	return d
+}
+
+func (fs *Fs) fstat(fid uint32, p string) (zx.Dir, error) {
+	r, err := fs.rpc(&Fcall{Type: Tstat, Fid: fid})
+	if err != nil {
+		return nil, err
+	}
+	_, st, err := UnpackStat(r.Stat)
+	if err != nil {
+		return nil, err
+	}
+	return fs.dir(p, st), nil
+}
+
+func (fs *Fs) stat(p string) (zx.Dir, error) {
+	p, err := zx.UseAbsPath(p)
+	if err != nil {
+		return nil, err
+	}
+	fid, err := fs.walk(p)
+	if err != nil {
+		return nil, err
+	}
+	defer fs.clunk(fid)
+	return fs.fstat(fid, p)
+}
+
+func (fs *Fs) Stat(p string) <-chan zx.Dir {
+	c := make(chan zx.Dir, 1)
+	go func() {
+		d, err := fs.stat(p)
+		if err == nil {
+			c <- d
+		}
+		close(c, err)
+	}()
+	return c
+}
+
+// Return a 9P stat with all fields set to "don't touch".
+func nullStat() *Stat {
+	return &Stat{
+		Type:   ^uint16(0),
+		Dev:    ^uint32(0),
+		Qid:    Qid{^byte(0), ^uint32(0), ^uint64(0)},
+		Mode:   ^uint32(0),
+		Atime:  ^uint32(0),
+		Mtime:  ^uint32(0),
+		Length: ^uint64(0),
+	}
+}
+
+// Update the attributes in d that 9P can represent (mode, size, mtime,
+// uid, and gid) for the file open as fid; others are ignored.
+func (fs *Fs) wstat(fid uint32, od, d zx.Dir) error {
+	st := nullStat()
+	some := false
+	if d["mode"] != "" && d.Mode() != od.Mode() {
+		st.Mode = uint32(d.Mode())
+		if od["type"] == "d" {
+			st.Mode |= DMDIR
+		}
+		some = true
+	}
+	if d["size"] != "" {
+		if od["type"] == "d" {
+			return fmt.Errorf("%s: %s", od["path"], zx.ErrIsDir)
+		}
+		st.Length = uint64(d.Size())
+		some = true
+	}
+	if d["mtime"] != "" {
+		st.Mtime = uint32(d.Time("mtime").Unix())
+		some = true
+	}
+	if d["uid"] != "" && d["uid"] != od["uid"] {
+		st.Uid = d["uid"]
+		some = true
+	}
+	if d["gid"] != "" && d["gid"] != od["gid"] {
+		st.Gid = d["gid"]
+		some = true
+	}
+	if !some {
+		return nil
+	}
+	_, err := fs.rpc(&Fcall{Type: Twstat, Fid: fid, Stat: st.Bytes()})
+	return err
+}
+
+func (fs *Fs) Wstat(p string, d zx.Dir) <-chan zx.Dir {
+	c := make(chan zx.Dir, 1)
+	go func() {
+		p, err := zx.UseAbsPath(p)
+		if err != nil {
+			close(c, err)
+			return
+		}
+		fid, err := fs.walk(p)
+		if err != nil {
+			close(c, err)
+			return
+		}
+		defer fs.clunk(fid)
+		od, err := fs.fstat(fid, p)
+		if err == nil {
+			err = fs.wstat(fid, od, d)
+		}
+		if err == nil {
+			od, err = fs.fstat(fid, p)
+		}
+		if err == nil {
+			c <- od
+		}
+		close(c, err)
+	}()
+	return c
+}
+
+func (fs *Fs) Get(p string, off, count int64) <-chan []byte {
+	c := make(chan []byte)
+	go func() {
+		close(c, fs.get(p, off, count, c))
+	}()
+	return c
+}
+
+func (fs *Fs) get(p string, off, count int64, c chan<- []byte) error {
+	p, err := zx.UseAbsPath(p)
+	if err != nil {
+		return err
+	}
+	fid, err := fs.walk(p)
+	if err != nil {
+		return err
+	}
+	defer fs.clunk(fid)
+	r, err := fs.rpc(&Fcall{Type: Topen, Fid: fid, Mode: OREAD})
+	if err != nil {
+		return err
+	}
+	iounit := fs.iounit(r)
+	if r.Qid.Type&QTDIR != 0 {
+		return fs.getdir(fid, p, off, count, iounit, c)
+	}
+	if off < 0 {
+		off = 0
+	}
+	for count != 0 {
+		n := iounit
+		if count > 0 && count < int64(n) {
+			n = uint32(count)
+		}
+		r, err := fs.rpc(&Fcall{Type: Tread, Fid: fid, Offset: uint64(off), Count: n})
+		if err != nil {
+			return err
+		}
+		if len(r.Data) == 0 {
+			break
+		}
+		if ok := c <- r.Data; !ok {
+			return cerror(c)
+		}
+		off += int64(len(r.Data))
+		if count > 0 {
+			count -= int64(len(r.Data))
+		}
+	}
+	return nil
+}
+
+// Read the directory open as fid and send the entries
+// in the format of zx.Dir.Bytes().
+// off and count refer to directory entries.
+func (fs *Fs) getdir(fid uint32, p string, off, count int64, iounit uint32, c chan<- []byte) error {
+	var doff uint64
+	for count != 0 {
+		r, err := fs.rpc(&Fcall{Type: Tread, Fid: fid, Offset: doff, Count: iounit})
+		if err != nil {
+			return err
+		}
+		if len(r.Data) == 0 {
+			break
+		}
+		doff += uint64(len(r.Data))
+		for b := r.Data; len(b) > 0 && count != 0; {
+			var st *Stat
+			if b, st, err = UnpackStat(b); err != nil {
+				return err
+			}
+			if off > 0 {
+				off--
+				continue
+			}
+			d := fs.dir(fpath.Join(p, st.Name), st)
+			if ok := c <- d.Bytes(); !ok {
+				return cerror(c)
+			}
+			if count > 0 {
+				count--
+			}
+		}
+	}
+	return nil
+}
+
+func (fs *Fs) Put(p string, d zx.Dir, off int64, dc <-chan []byte) <-chan zx.Dir {
+	c := make(chan zx.Dir, 1)
+	go func() {
+		rd, err := fs.put(p, d, off, dc)
+		if err != nil {
+			if dc != nil {
+				close(dc, err)
+			}
+			close(c, err)
+			return
+		}
+		c <- rd
+		close(c)
+	}()
+	return c
+}
+
+func (fs *Fs) put(p string, d zx.Dir, off int64, dc <-chan []byte) (zx.Dir, error) {
+	p, err := zx.UseAbsPath(p)
+	if err != nil {
+		return nil, err
+	}
+	if d == nil {
+		d = zx.Dir{}
+	}
+	typ := d["type"]
+	switch typ {
+	case "d", "D":
+		return fs.mkdir(p, d, typ == "D")
+	case "", "-", "F":
+	case "l":
+		return nil, fmt.Errorf("%s: symlinks %s", p, ErrNotSup)
+	default:
+		return nil, fmt.Errorf("%s: %s", p, zx.ErrBadType)
+	}
+	if p == "/" {
+		return nil, fmt.Errorf("%s: %s", p, zx.ErrIsDir)
+	}
+	created := false
+	mode := uint8(OWRITE)
+	if d["size"] == "0" {
+		mode |= OTRUNC
+	}
+	fid, err := fs.walk(p)
+	var r *Fcall
+	if err == nil {
+		r, err = fs.rpc(&Fcall{Type: Topen, Fid: fid, Mode: mode})
+		if err != nil {
+			fs.clunk(fid)
+			return nil, err
+		}
+	} else {
+		if typ == "" || !zx.IsNotExist(err) {
+			return nil, err
+		}
+		if typ == "F" {
+			if _, err := fs.mkdir(fpath.Dir(p), zx.Dir{"mode": "0755"}, true); err != nil {
+				return nil, err
+			}
+		}
+		if fid, err = fs.walk(fpath.Dir(p)); err != nil {
+			return nil, err
+		}
+		perm := uint32(0644)
+		if d["mode"] != "" {
+			perm = uint32(d.Mode())
+		}
+		r, err = fs.rpc(&Fcall{Type: Tcreate, Fid: fid, Name: fpath.Base(p), Perm: perm, Mode: mode})
+		if err != nil {
+			fs.clunk(fid)
+			return nil, err
+		}
+		created = true
+	}
+	defer fs.clunk(fid)
+	iounit := fs.iounit(r)
+	od, err := fs.fstat(fid, p)
+	if err != nil {
+		return nil, err
+	}
+	wd := zx.Dir{}
+	if d["size"] != "" && d.Size() != od.Size() {
+		wd["size"] = d["size"]
+	}
+	if d["mode"] != "" && !created {
+		wd["mode"] = d["mode"]
+	}
+	if err := fs.wstat(fid, od, wd); err != nil {
+		return nil, err
+	}
+	if off < 0 {
+		off = od.Size()
+		if wd["size"] != "" {
+			off = wd.Size()
+		}
+	}
+	if dc == nil {
+		dc = make(chan []byte)
+		close(dc)
+	}
+	for data := range dc {
+		for len(data) > 0 {
+			n := len(data)
+			if n > int(iounit) {
+				n = int(iounit)
+			}
+			r, err := fs.rpc(&Fcall{Type: Twrite, Fid: fid, Offset: uint64(off), Data: data[:n]})
+			if err != nil {
+				return nil, err
+			}
+			if r.Count == 0 {
+				return nil, io.ErrShortWrite
+			}
+			off += int64(r.Count)
+			data = data[r.Count:]
+		}
+	}
+	if err := cerror(dc); err != nil {
+		return nil, err
+	}
+	// update other attributes after writing, or the mtime would change.
+	wd = zx.Dir{}
+	for _, k := range []string{"mtime", "uid", "gid"} {
+		if d[k] != "" {
+			wd[k] = d[k]
+		}
+	}
+	if err := fs.wstat(fid, od, wd); err != nil {
+		return nil, err
+	}
+	return fs.fstat(fid, p)
+}
+
+// Create a directory at p, with parents if needed; it's ok if it exists.
+func (fs *Fs) mkdir(p string, d zx.Dir, parents bool) (zx.Dir, error) {
+	od, err := fs.stat(p)
+	if err == nil {
+		if od["type"] != "d" {
+			return nil, fmt.Errorf("%s: %s", p, zx.ErrExists)
+		}
+		return od, nil
+	}
+	if !zx.IsNotExist(err) {
+		return nil, err
+	}
+	if parents {
+		if _, err := fs.mkdir(fpath.Dir(p), zx.Dir{"mode": "0755"}, true); err != nil {
+			return nil, err
+		}
+	}
+	fid, err := fs.walk(fpath.Dir(p))
+	if err != nil {
+		return nil, err
+	}
+	defer fs.clunk(fid)
+	perm := uint32(DMDIR | 0755)
+	if d["mode"] != "" {
+		perm = DMDIR | uint32(d.Mode())
+	}
+	_, err = fs.rpc(&Fcall{Type: Tcreate, Fid: fid, Name: fpath.Base(p), Perm: perm, Mode: OREAD})
+	if err != nil {
+		return nil, err
+	}
+	return fs.fstat(fid, p)
+}
+
+func (fs *Fs) remove(p string) error {
+	p, err := zx.UseAbsPath(p)
+	if err != nil {
+		return err
+	}
+	if p == "/" {
+		return fmt.Errorf("%s: %s", p, zx.ErrPerm)
+	}
+	fid, err := fs.walk(p)
+	if err != nil {
+		return err
+	}
+	// the fid is clunked even if the remove fails
+	_, err = fs.rpc(&Fcall{Type: Tremove, Fid: fid})
+	fs.putfid(fid)
+	return err
+}
+
+func (fs *Fs) removeAll(p string) error {
+	d, err := fs.stat(p)
+	if err != nil {
+		return err
+	}
+	if d["type"] == "d" {
+		ds, err := zx.GetDir(fs, d["path"])
+		if err != nil {
+			return err
+		}
+		for _, cd := range ds {
+			if err := fs.removeAll(cd["path"]); err != nil {
+				return err
+			}
+		}
+	}
+	return fs.remove(d["path"])
+}
+
+// Run fn and report its error through the returned chan.
+func errcall(fn func() error) <-chan error {
+	c := make(chan error, 1)
+	go func() {
+		err := fn()
+		c <- err
+		close(c, err)
+	}()
+	return c
+}
+
+func (fs *Fs) Remove(p string) <-chan error {
+	return errcall(func() error {
+		return fs.remove(p)
+	})
+}
+
+func (fs *Fs) RemoveAll(p string) <-chan error {
+	return errcall(func() error {
+		return fs.removeAll(p)
+	})
+}
+
+// 9P can only rename files within their directory, and other moves fail.
+func (fs *Fs) Move(from, to string) <-chan error {
+	return errcall(func() error {
+		return fs.move(from, to)
+	})
+}
+
+func (fs *Fs) move(from, to string) error {
+	from, err := zx.UseAbsPath(from)
+	if err != nil {
+		return err
+	}
+	to, err = zx.UseAbsPath(to)
+	if err != nil {
+		return err
+	}
+	if from == to {
+		return nil
+	}
+	if from == "/" || to == "/" {
+		return fmt.Errorf("move %s: %s", from, zx.ErrPerm)
+	}
+	if fpath.Dir(from) != fpath.Dir(to) {
+		return fmt.Errorf("move %s %s: moves across directories %s", from, to, ErrNotSup)
+	}
+	fid, err := fs.walk(from)
+	if err != nil {
+		return err
+	}
+	defer fs.clunk(fid)
+	st := nullStat()
+	st.Name = fpath.Base(to)
+	_, err = fs.rpc(&Fcall{Type: Twstat, Fid: fid, Stat: st.Bytes()})
+	return err
+}
+
+// 9P has no links and this always fails.
+func (fs *Fs) Link(oldp, newp string) <-chan error {
+	return errcall(func() error {
+		return fmt.Errorf("link %s: %s", newp, ErrNotSup)
+	})
+}
+
+func (fs *Fs) findr(d zx.Dir, fp *pred.Pred, p, spref, dpref string, lvl int, c chan<- zx.Dir) error {
+	match, pruned, err := fp.EvalAt(d, lvl)
+	if pruned {
+		if !match {
+			d["proto"] = "9p"
+			d["err"] = "pruned"
+		}
+		if ok := c <- d; !ok {
+			return cerror(c)
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var ds []zx.Dir
+	if d["type"] == "d" {
+		ds, err = zx.GetDir(fs, p)
+		if err != nil {
+			d["err"] = err.Error()
+		}
+	}
+	if match || err != nil {
+		if ok := c <- d; !ok {
+			return cerror(c)
+		}
+	}
+	for _, cd := range ds {
+		cp := cd["path"]
+		if spref != dpref {
+			suff := zx.Suffix(cp, spref)
+			if suff == "" {
+				return fmt.Errorf("%s: %s: %s", spref, cp, zx.ErrNotSuffix)
+			}
+			cd["path"] = fpath.Join(dpref, suff)
+		}
+		if err := fs.findr(cd, fp, cp, spref, dpref, lvl+1, c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (fs *Fs) find(p, fpred, spref, dpref string, depth int, c chan<- zx.Dir) error {
+	d, err := fs.stat(p)
+	if err != nil {
+		return err
+	}
+	p = d["path"]
+	if spref != "" || dpref != "" {
+		spref, err = zx.UseAbsPath(spref)
+		if err != nil {
+			return err
+		}
+		dpref, err = zx.UseAbsPath(dpref)
+		if err != nil {
+			return err
+		}
+	}
+	fp, err := pred.New(fpred)
+	if err != nil {
+		return err
+	}
+	if spref != dpref {
+		suff := zx.Suffix(p, spref)
+		if suff == "" {
+			return fmt.Errorf("suffix %s %s: %s", spref, p, zx.ErrNotSuffix)
+		}
+		d["path"] = fpath.Join(dpref, suff)
+	}
+	return fs.findr(d, fp, p, spref, dpref, depth, c)
+}
+
+// 9P has no find request; the tree is walked by the client
+// and the predicate evaluated here.
+func (fs *Fs) Find(p, fpred, spref, dpref string, depth0 int) <-chan zx.Dir {
+	c := make(chan zx.Dir)
+	go func() {
+		close(c, fs.find(p, fpred, spref, dpref, depth0, c))
+	}()
+	return c
+}
+
+// Like Find, but the data for each file found follows its dir.
+func (fs *Fs) FindGet(p, fpred, spref, dpref string, depth0 int) <-chan face{} {
+	c := make(chan face{})
+	go func() {
+		dc := fs.Find(p, fpred, spref, dpref, depth0)
+		for d := range dc {
+			if ok := c <- d.Dup(); !ok {
+				close(dc, cerror(c))
+				return
+			}
+			if d["err"] != "" || d["type"] == "d" {
+				continue
+			}
+			bc := fs.Get(d.SPath(), 0, zx.All)
+			for b := range bc {
+				if ok := c <- b; !ok {
+					close(bc, cerror(c))
+					close(dc, cerror(c))
+					return
+				}
+			}
+			if err := cerror(bc); err != nil {
+				c <- err
+			}
+		}
+		close(c, cerror(dc))
+	}()
+	return c
+}
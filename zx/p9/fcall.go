@@ -0,0 +1,557 @@
+package p9
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+type MsgType byte
+
+const (
+	Tversion MsgType = iota + 100
+	Rversion
+	Tauth
+	Rauth
+	Tattach
+	Rattach
+	Terror // illegal
+	Rerror
+	Tflush
+	Rflush
+	Twalk
+	Rwalk
+	Topen
+	Ropen
+	Tcreate
+	Rcreate
+	Tread
+	Rread
+	Twrite
+	Rwrite
+	Tclunk
+	Rclunk
+	Tremove
+	Rremove
+	Tstat
+	Rstat
+	Twstat
+	Rwstat
+	Tmax
+)
+
+const (
+	Version = "9P2000"
+
+	NoTag uint16 = 0xFFFF
+	NoFid uint32 = 0xFFFFFFFF
+
+	// size of the header for read/write messages
+	IOHdrSz = 24
+
+	// Max message size used
+	MaxMsize = 64*1024 + IOHdrSz
+
+	MaxWElem = 16
+
+	// Qid types
+	QTDIR    = 0x80
+	QTAPPEND = 0x40
+	QTEXCL   = 0x20
+	QTAUTH   = 0x08
+	QTFILE   = 0x00
+
+	// Mode bits
+	DMDIR    = 0x80000000
+	DMAPPEND = 0x40000000
+	DMEXCL   = 0x20000000
+	DMAUTH   = 0x08000000
+	DMTMP    = 0x04000000
+
+	// Open modes
+	OREAD   = 0
+	OWRITE  = 1
+	ORDWR   = 2
+	OEXEC   = 3
+	OTRUNC  = 0x10
+	ORCLOSE = 0x40
+)
+
+// A 9P qid
+struct Qid {
+	Type byte
+	Vers uint32
+	Path uint64
+}
+
+// A 9P directory entry.
+// Integer fields set to all ones and empty strings mean "don't touch" in
+// Twstat requests.
+struct Stat {
+	Type   uint16
+	Dev    uint32
+	Qid    Qid
+	Mode   uint32
+	Atime  uint32
+	Mtime  uint32
+	Length uint64
+	Name   string
+	Uid    string
+	Gid    string
+	Muid   string
+}
+
+// A 9P message. Only those fields used by its type are meaningful.
+struct Fcall {
+	Type    MsgType
+	Tag     uint16
+	Fid     uint32
+	Msize   uint32   // Tversion, Rversion
+	Version string   // Tversion, Rversion
+	Oldtag  uint16   // Tflush
+	Ename   string   // Rerror
+	Qid     Qid      // Rattach, Ropen, Rcreate
+	Iounit  uint32   // Ropen, Rcreate
+	Aqid    Qid      // Rauth
+	Afid    uint32   // Tauth, Tattach
+	Uname   string   // Tauth, Tattach
+	Aname   string   // Tauth, Tattach
+	Perm    uint32   // Tcreate
+	Name    string   // Tcreate
+	Mode    byte     // Tcreate, Topen
+	Newfid  uint32   // Twalk
+	Wname   []string // Twalk
+	Wqid    []Qid    // Rwalk
+	Offset  uint64   // Tread, Twrite
+	Count   uint32   // Tread, Twrite, Rwrite
+	Data    []byte   // Twrite, Rread
+	Stat    []byte   // Twstat, Rstat
+}
+
+var (
+	ErrBadMsg  = errors.New("bad 9P message")
+	ErrTooLong = errors.New("9P message too long")
+
+	le = binary.LittleEndian
+)
+
+func (t MsgType) String() string {
+	names := [...]string{
+		"Tversion", "Rversion", "Tauth", "Rauth", "Tattach", "Rattach",
+		"Terror", "Rerror", "Tflush", "Rflush", "Twalk", "Rwalk",
+		"Topen", "Ropen", "Tcreate", "Rcreate", "Tread", "Rread",
+		"Twrite", "Rwrite", "Tclunk", "Rclunk", "Tremove", "Rremove",
+		"Tstat", "Rstat", "Twstat", "Rwstat",
+	}
+	if t < Tversion || t >= Tmax {
+		return fmt.Sprintf("Tunknown<%d>", t)
+	}
+	return names[t-Tversion]
+}
+
+func (q Qid) String() string {
+	return fmt.Sprintf("(%x %d %x)", q.Path, q.Vers, q.Type)
+}
+
+func (f *Fcall) String() string {
+	s := fmt.Sprintf("%s tag %d", f.Type, f.Tag)
+	switch f.Type {
+	case Tversion, Rversion:
+		s += fmt.Sprintf(" msize %d version '%s'", f.Msize, f.Version)
+	case Tauth:
+		s += fmt.Sprintf(" afid %d uname '%s' aname '%s'", f.Afid, f.Uname, f.Aname)
+	case Rauth:
+		s += fmt.Sprintf(" aqid %s", f.Aqid)
+	case Tattach:
+		s += fmt.Sprintf(" fid %d afid %d uname '%s' aname '%s'",
+			f.Fid, f.Afid, f.Uname, f.Aname)
+	case Rattach:
+		s += fmt.Sprintf(" qid %s", f.Qid)
+	case Rerror:
+		s += fmt.Sprintf(" ename '%s'", f.Ename)
+	case Tflush:
+		s += fmt.Sprintf(" oldtag %d", f.Oldtag)
+	case Twalk:
+		s += fmt.Sprintf(" fid %d newfid %d wname %q", f.Fid, f.Newfid, f.Wname)
+	case Rwalk:
+		s += fmt.Sprintf(" wqid %v", f.Wqid)
+	case Topen:
+		s += fmt.Sprintf(" fid %d mode %d", f.Fid, f.Mode)
+	case Ropen, Rcreate:
+		s += fmt.Sprintf(" qid %s iounit %d", f.Qid, f.Iounit)
+	case Tcreate:
+		s += fmt.Sprintf(" fid %d name '%s' perm %o mode %d",
+			f.Fid, f.Name, f.Perm, f.Mode)
+	case Tread:
+		s += fmt.Sprintf(" fid %d offset %d count %d", f.Fid, f.Offset, f.Count)
+	case Rread:
+		s += fmt.Sprintf(" count %d", len(f.Data))
+	case Twrite:
+		s += fmt.Sprintf(" fid %d offset %d count %d", f.Fid, f.Offset, len(f.Data))
+	case Rwrite:
+		s += fmt.Sprintf(" count %d", f.Count)
+	case Tclunk, Tremove, Tstat:
+		s += fmt.Sprintf(" fid %d", f.Fid)
+	case Rstat:
+		s += fmt.Sprintf(" stat %d bytes", len(f.Stat))
+	case Twstat:
+		s += fmt.Sprintf(" fid %d stat %d bytes", f.Fid, len(f.Stat))
+	}
+	return s
+}
+
+struct buf {
+	b   []byte
+	err error
+}
+
+func (b *buf) p8(v byte) {
+	b.b = append(b.b, v)
+}
+
+func (b *buf) p16(v uint16) {
+	b.b = append(b.b, byte(v), byte(v>>8))
+}
+
+func (b *buf) p32(v uint32) {
+	b.b = append(b.b, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+}
+
+func (b *buf) p64(v uint64) {
+	b.p32(uint32(v))
+	b.p32(uint32(v >> 32))
+}
+
+func (b *buf) pstr(s string) {
+	b.p16(uint16(len(s)))
+	b.b = append(b.b, s...)
+}
+
+func (b *buf) pqid(q Qid) {
+	b.p8(q.Type)
+	b.p32(q.Vers)
+	b.p64(q.Path)
+}
+
+func (b *buf) need(n int) bool {
+	if b.err != nil {
+		return false
+	}
+	if len(b.b) < n {
+		b.err = ErrBadMsg
+		return false
+	}
+	return true
+}
+
+func (b *buf) g8() byte {
+	if !b.need(1) {
+		return 0
+	}
+	v := b.b[0]
+	b.b = b.b[1:]
+	return v
+}
+
+func (b *buf) g16() uint16 {
+	if !b.need(2) {
+		return 0
+	}
+	v := le.Uint16(b.b)
+	b.b = b.b[2:]
+	return v
+}
+
+func (b *buf) g32() uint32 {
+	if !b.need(4) {
+		return 0
+	}
+	v := le.Uint32(b.b)
+	b.b = b.b[4:]
+	return v
+}
+
+func (b *buf) g64() uint64 {
+	if !b.need(8) {
+		return 0
+	}
+	v := le.Uint64(b.b)
+	b.b = b.b[8:]
+	return v
+}
+
+func (b *buf) gbytes(n int) []byte {
+	if !b.need(n) {
+		return nil
+	}
+	v := b.b[:n:n]
+	b.b = b.b[n:]
+	return v
+}
+
+func (b *buf) gstr() string {
+	n := int(b.g16())
+	return string(b.gbytes(n))
+}
+
+func (b *buf) gqid() Qid {
+	return Qid{Type: b.g8(), Vers: b.g32(), Path: b.g64()}
+}
+
+// Return the packed stat.
+func (s *Stat) Bytes() []byte {
+	b := &buf{}
+	b.p16(0)
+	b.p16(s.Type)
+	b.p32(s.Dev)
+	b.pqid(s.Qid)
+	b.p32(s.Mode)
+	b.p32(s.Atime)
+	b.p32(s.Mtime)
+	b.p64(s.Length)
+	b.pstr(s.Name)
+	b.pstr(s.Uid)
+	b.pstr(s.Gid)
+	b.pstr(s.Muid)
+	le.PutUint16(b.b, uint16(len(b.b)-2))
+	return b.b
+}
+
+// Unpack a stat from b and return the rest of b.
+func UnpackStat(b []byte) ([]byte, *Stat, error) {
+	if len(b) < 2 {
+		return nil, nil, ErrBadMsg
+	}
+	n := int(le.Uint16(b)) + 2
+	if len(b) < n {
+		return nil, nil, ErrBadMsg
+	}
+	sb := &buf{b: b[2:n]}
+	s := &Stat{}
+	s.Type = sb.g16()
+	s.Dev = sb.g32()
+	s.Qid = sb.gqid()
+	s.Mode = sb.g32()
+	s.Atime = sb.g32()
+	s.Mtime = sb.g32()
+	s.Length = sb.g64()
+	s.Name = sb.gstr()
+	s.Uid = sb.gstr()
+	s.Gid = sb.gstr()
+	s.Muid = sb.gstr()
+	if sb.err != nil {
+		return nil, nil, sb.err
+	}
+	return b[n:], s, nil
+}
+
+// Return the packed message, including its size.
+func (f *Fcall) Bytes() ([]byte, error) {
+	b := &buf{b: make([]byte, 0, 64+len(f.Data)+len(f.Stat))}
+	b.p32(0)
+	b.p8(byte(f.Type))
+	b.p16(f.Tag)
+	switch f.Type {
+	case Tversion, Rversion:
+		b.p32(f.Msize)
+		b.pstr(f.Version)
+	case Tauth:
+		b.p32(f.Afid)
+		b.pstr(f.Uname)
+		b.pstr(f.Aname)
+	case Rauth:
+		b.pqid(f.Aqid)
+	case Tattach:
+		b.p32(f.Fid)
+		b.p32(f.Afid)
+		b.pstr(f.Uname)
+		b.pstr(f.Aname)
+	case Rattach:
+		b.pqid(f.Qid)
+	case Rerror:
+		b.pstr(f.Ename)
+	case Tflush:
+		b.p16(f.Oldtag)
+	case Twalk:
+		if len(f.Wname) > MaxWElem {
+			return nil, ErrTooLong
+		}
+		b.p32(f.Fid)
+		b.p32(f.Newfid)
+		b.p16(uint16(len(f.Wname)))
+		for _, n := range f.Wname {
+			b.pstr(n)
+		}
+	case Rwalk:
+		b.p16(uint16(len(f.Wqid)))
+		for _, q := range f.Wqid {
+			b.pqid(q)
+		}
+	case Topen:
+		b.p32(f.Fid)
+		b.p8(f.Mode)
+	case Ropen, Rcreate:
+		b.pqid(f.Qid)
+		b.p32(f.Iounit)
+	case Tcreate:
+		b.p32(f.Fid)
+		b.pstr(f.Name)
+		b.p32(f.Perm)
+		b.p8(f.Mode)
+	case Tread:
+		b.p32(f.Fid)
+		b.p64(f.Offset)
+		b.p32(f.Count)
+	case Rread:
+		b.p32(uint32(len(f.Data)))
+		b.b = append(b.b, f.Data...)
+	case Twrite:
+		b.p32(f.Fid)
+		b.p64(f.Offset)
+		b.p32(uint32(len(f.Data)))
+		b.b = append(b.b, f.Data...)
+	case Rwrite:
+		b.p32(f.Count)
+	case Tclunk, Tremove, Tstat:
+		b.p32(f.Fid)
+	case Rstat:
+		b.p16(uint16(len(f.Stat)))
+		b.b = append(b.b, f.Stat...)
+	case Twstat:
+		b.p32(f.Fid)
+		b.p16(uint16(len(f.Stat)))
+		b.b = append(b.b, f.Stat...)
+	case Rflush, Rclunk, Rremove, Rwstat:
+	default:
+		return nil, fmt.Errorf("%s: %s", ErrBadMsg, f.Type)
+	}
+	le.PutUint32(b.b, uint32(len(b.b)))
+	return b.b, nil
+}
+
+// Unpack a message (including its size).
+func UnpackFcall(m []byte) (*Fcall, error) {
+	b := &buf{b: m}
+	if n := b.g32(); b.err == nil && int(n) != len(m) {
+		return nil, ErrBadMsg
+	}
+	f := &Fcall{}
+	f.Type = MsgType(b.g8())
+	f.Tag = b.g16()
+	switch f.Type {
+	case Tversion, Rversion:
+		f.Msize = b.g32()
+		f.Version = b.gstr()
+	case Tauth:
+		f.Afid = b.g32()
+		f.Uname = b.gstr()
+		f.Aname = b.gstr()
+	case Rauth:
+		f.Aqid = b.gqid()
+	case Tattach:
+		f.Fid = b.g32()
+		f.Afid = b.g32()
+		f.Uname = b.gstr()
+		f.Aname = b.gstr()
+	case Rattach:
+		f.Qid = b.gqid()
+	case Rerror:
+		f.Ename = b.gstr()
+	case Tflush:
+		f.Oldtag = b.g16()
+	case Twalk:
+		f.Fid = b.g32()
+		f.Newfid = b.g32()
+		n := int(b.g16())
+		if n > MaxWElem {
+			return nil, ErrTooLong
+		}
+		for i := 0; i < n && b.err == nil; i++ {
+			f.Wname = append(f.Wname, b.gstr())
+		}
+	case Rwalk:
+		n := int(b.g16())
+		if n > MaxWElem {
+			return nil, ErrTooLong
+		}
+		for i := 0; i < n && b.err == nil; i++ {
+			f.Wqid = append(f.Wqid, b.gqid())
+		}
+	case Topen:
+		f.Fid = b.g32()
+		f.Mode = b.g8()
+	case Ropen, Rcreate:
+		f.Qid = b.gqid()
+		f.Iounit = b.g32()
+	case Tcreate:
+		f.Fid = b.g32()
+		f.Name = b.gstr()
+		f.Perm = b.g32()
+		f.Mode = b.g8()
+	case Tread:
+		f.Fid = b.g32()
+		f.Offset = b.g64()
+		f.Count = b.g32()
+	case Rread:
+		n := int(b.g32())
+		f.Data = b.gbytes(n)
+	case Twrite:
+		f.Fid = b.g32()
+		f.Offset = b.g64()
+		n := int(b.g32())
+		f.Data = b.gbytes(n)
+	case Rwrite:
+		f.Count = b.g32()
+	case Tclunk, Tremove, Tstat:
+		f.Fid = b.g32()
+	case Rstat:
+		n := int(b.g16())
+		f.Stat = b.gbytes(n)
+	case Twstat:
+		f.Fid = b.g32()
+		n := int(b.g16())
+		f.Stat = b.gbytes(n)
+	case Rflush, Rclunk, Rremove, Rwstat:
+	default:
+		return nil, fmt.Errorf("%s: %s", ErrBadMsg, f.Type)
+	}
+	if b.err != nil {
+		return nil, b.err
+	}
+	if len(b.b) != 0 {
+		return nil, ErrBadMsg
+	}
+	return f, nil
+}
+
+// Read a message from r, which must be at most msize bytes long.
+func ReadFcall(r io.Reader, msize uint32) (*Fcall, error) {
+	var sz [4]byte
+	if _, err := io.ReadFull(r, sz[:]); err != nil {
+		return nil, err
+	}
+	n := le.Uint32(sz[:])
+	if n < 7 {
+		return nil, ErrBadMsg
+	}
+	if n > msize {
+		return nil, ErrTooLong
+	}
+	m := make([]byte, n)
+	copy(m, sz[:])
+	if _, err := io.ReadFull(r, m[4:]); err != nil {
+		return nil, err
+	}
+	return UnpackFcall(m)
+}
+
+// Write a message to w.
+func WriteFcall(w io.Writer, f *Fcall) error {
+	m, err := f.Bytes()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(m)
+	return err
+}
@@ -0,0 +1,375 @@
+package p9
+
+import (
+	"bufio"
+	"clive/zx"
+	"clive/zx/fstest"
+	"clive/zx/zux"
+	"net"
+	"os"
+	"strings"
+	"testing"
+)
+
+struct tclient {
+	t   *testing.T
+	nc  net.Conn
+	r   *bufio.Reader
+	tag uint16
+}
+
+const (
+	tdir  = "/tmp/p9test"
+	taddr = "unix!local!9872"
+	caddr = "unix!local!9873"
+)
+
+var fcalls = [...]*Fcall{
+	&Fcall{Type: Tversion, Msize: 8192, Version: "9P2000"},
+	&Fcall{Type: Tattach, Fid: 1, Afid: NoFid, Uname: "nemo", Aname: "main"},
+	&Fcall{Type: Rerror, Ename: "oops"},
+	&Fcall{Type: Twalk, Fid: 1, Newfid: 2, Wname: []string{"a", "b"}},
+	&Fcall{Type: Rwalk, Wqid: []Qid{{QTDIR, 1, 2}, {QTFILE, 3, 4}}},
+	&Fcall{Type: Tcreate, Fid: 2, Name: "x", Perm: 0644, Mode: ORDWR},
+	&Fcall{Type: Tread, Fid: 2, Offset: 10, Count: 100},
+	&Fcall{Type: Rread, Data: []byte("hi")},
+	&Fcall{Type: Twrite, Fid: 2, Offset: 3, Data: []byte("there")},
+	&Fcall{Type: Rclunk},
+}
+
+var ofcalls = [...]string{
+	`Tversion tag 0 msize 8192 version '9P2000'`,
+	`Tattach tag 0 fid 1 afid 4294967295 uname 'nemo' aname 'main'`,
+	`Rerror tag 0 ename 'oops'`,
+	`Twalk tag 0 fid 1 newfid 2 wname ["a" "b"]`,
+	`Rwalk tag 0 wqid [(2 1 80) (4 3 0)]`,
+	`Tcreate tag 0 fid 2 name 'x' perm 644 mode 2`,
+	`Tread tag 0 fid 2 offset 10 count 100`,
+	`Rread tag 0 count 2`,
+	`Twrite tag 0 fid 2 offset 3 count 5`,
+	`Rclunk tag 0`,
+}
+
+func TestFcalls(t *testing.T) {
+	for i, f := range fcalls {
+		b, err := f.Bytes()
+		if err != nil {
+			t.Fatalf("%s: %s", f, err)
+		}
+		nf, err := UnpackFcall(b)
+		if err != nil {
+			t.Fatalf("%s: %s", f, err)
+		}
+		t.Logf("fcall %s", nf)
+		if nf.String() != ofcalls[i] {
+			t.Fatalf("bad fcall %s", nf)
+		}
+		if _, err := UnpackFcall(b[:len(b)-1]); err == nil {
+			t.Fatalf("%s: could unpack a short message", f)
+		}
+	}
+	st := &Stat{Qid: Qid{QTDIR, 1, 2}, Mode: DMDIR | 0755, Length: 3,
+		Name: "a", Uid: "nemo", Gid: "sys", Muid: "none"}
+	b := append(st.Bytes(), 1, 2)
+	rest, nst, err := UnpackStat(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *nst != *st || len(rest) != 2 {
+		t.Fatalf("bad stat %v", nst)
+	}
+}
+
+func (c *tclient) rpc(f *Fcall, rtype MsgType) *Fcall {
+	c.tag++
+	f.Tag = c.tag
+	if err := WriteFcall(c.nc, f); err != nil {
+		c.t.Fatal(err)
+	}
+	r, err := ReadFcall(c.r, MaxMsize)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	c.t.Logf("%s -> %s", f, r)
+	if r.Tag != f.Tag {
+		c.t.Fatalf("bad tag in %s", r)
+	}
+	if r.Type != rtype {
+		c.t.Fatalf("%s: got %s", f, r)
+	}
+	return r
+}
+
+func (c *tclient) read(fid uint32) []byte {
+	var data []byte
+	for {
+		r := c.rpc(&Fcall{Type: Tread, Fid: fid, Offset: uint64(len(data)), Count: 1000}, Rread)
+		if len(r.Data) == 0 {
+			return data
+		}
+		data = append(data, r.Data...)
+	}
+}
+
+func TestSrv(t *testing.T) {
+	os.Remove("/tmp/clive.9872")
+	defer os.Remove("/tmp/clive.9872")
+	fstest.MkTree(t, tdir)
+	defer os.RemoveAll(tdir)
+	fs, err := zux.NewZX(tdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, err := NewServer(taddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	srv.Debug = testing.Verbose()
+	srv.NoAuth()
+	if err := srv.Serve("main", fs); err != nil {
+		t.Fatal(err)
+	}
+	nc, err := net.Dial("unix", "/tmp/clive.9872")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+	c := &tclient{t: t, nc: nc, r: bufio.NewReader(nc)}
+
+	r := c.rpc(&Fcall{Type: Tversion, Msize: 8192, Version: "9P2000.L"}, Rversion)
+	if r.Version != "9P2000" || r.Msize != 8192 {
+		t.Fatalf("bad version %s", r)
+	}
+	c.rpc(&Fcall{Type: Tattach, Fid: 1, Afid: NoFid, Uname: "none", Aname: "other"}, Rerror)
+	r = c.rpc(&Fcall{Type: Tattach, Fid: 1, Afid: NoFid, Uname: "none"}, Rattach)
+	if r.Qid.Type != QTDIR {
+		t.Fatalf("bad root qid")
+	}
+
+	// read a file
+	r = c.rpc(&Fcall{Type: Twalk, Fid: 1, Newfid: 2, Wname: []string{"a", "a1"}}, Rwalk)
+	if len(r.Wqid) != 2 || r.Wqid[0].Type != QTDIR || r.Wqid[1].Type != QTFILE {
+		t.Fatalf("bad walk")
+	}
+	r = c.rpc(&Fcall{Type: Twalk, Fid: 1, Newfid: 3, Wname: []string{"a", "x", "y"}}, Rwalk)
+	if len(r.Wqid) != 1 {
+		t.Fatalf("bad partial walk")
+	}
+	c.rpc(&Fcall{Type: Tclunk, Fid: 3}, Rerror)
+	c.rpc(&Fcall{Type: Topen, Fid: 2, Mode: OREAD}, Ropen)
+	if dat := c.read(2); string(dat) != string(fstest.FileData["/a/a1"]) {
+		t.Fatalf("bad data")
+	}
+	c.rpc(&Fcall{Type: Tclunk, Fid: 2}, Rclunk)
+
+	// read a dir
+	c.rpc(&Fcall{Type: Twalk, Fid: 1, Newfid: 2, Wname: []string{"a"}}, Rwalk)
+	c.rpc(&Fcall{Type: Topen, Fid: 2, Mode: OWRITE}, Rerror)
+	c.rpc(&Fcall{Type: Topen, Fid: 2, Mode: OREAD}, Ropen)
+	dat := c.read(2)
+	names := []string{}
+	for len(dat) > 0 {
+		var st *Stat
+		if dat, st, err = UnpackStat(dat); err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, st.Name)
+	}
+	if strings.Join(names, " ") != "a1 a2 b" {
+		t.Fatalf("bad dir %v", names)
+	}
+	c.rpc(&Fcall{Type: Tclunk, Fid: 2}, Rclunk)
+
+	// create, write, rename, and remove
+	c.rpc(&Fcall{Type: Twalk, Fid: 1, Newfid: 2, Wname: []string{"a"}}, Rwalk)
+	r = c.rpc(&Fcall{Type: Tcreate, Fid: 2, Name: "n", Perm: 0640, Mode: ORDWR}, Rcreate)
+	if r.Qid.Type != QTFILE {
+		t.Fatalf("bad create qid")
+	}
+	c.rpc(&Fcall{Type: Twrite, Fid: 2, Data: []byte("hello world")}, Rwrite)
+	c.rpc(&Fcall{Type: Twrite, Fid: 2, Offset: 6, Data: []byte("there")}, Rwrite)
+	if dat := c.read(2); string(dat) != "hello there" {
+		t.Fatalf("bad data %q", dat)
+	}
+	st := &Stat{Type: ^uint16(0), Dev: ^uint32(0), Qid: Qid{^byte(0), ^uint32(0), ^uint64(0)},
+		Mode: ^uint32(0), Atime: ^uint32(0), Mtime: ^uint32(0), Length: 5, Name: "m"}
+	c.rpc(&Fcall{Type: Twstat, Fid: 2, Stat: st.Bytes()}, Rwstat)
+	d, err := zx.Stat(fs, "/a/m")
+	if err != nil || d.Size() != 5 || d.Mode() != 0640 {
+		t.Fatalf("bad wstat %s %v", d, err)
+	}
+	r = c.rpc(&Fcall{Type: Tstat, Fid: 2}, Rstat)
+	if _, st, err = UnpackStat(r.Stat); err != nil || st.Name != "m" || st.Length != 5 {
+		t.Fatalf("bad stat %v %v", st, err)
+	}
+	c.rpc(&Fcall{Type: Tremove, Fid: 2}, Rremove)
+	if _, err := zx.Stat(fs, "/a/m"); err == nil {
+		t.Fatalf("file not removed")
+	}
+	c.rpc(&Fcall{Type: Tstat, Fid: 2}, Rerror)
+
+	// mkdir and remove on close
+	c.rpc(&Fcall{Type: Twalk, Fid: 1, Newfid: 2}, Rwalk)
+	c.rpc(&Fcall{Type: Tcreate, Fid: 2, Name: "dd", Perm: DMDIR | 0755, Mode: OREAD | ORCLOSE}, Rcreate)
+	if d, err := zx.Stat(fs, "/dd"); err != nil || d["type"] != "d" {
+		t.Fatalf("dir not created")
+	}
+	c.rpc(&Fcall{Type: Tclunk, Fid: 2}, Rclunk)
+	if _, err := zx.Stat(fs, "/dd"); err == nil {
+		t.Fatalf("dir not removed")
+	}
+}
+
+// Serve a test tree and run fn on a client for it.
+func runCli(t *testing.T, fn fstest.TestFunc) {
+	os.Args[0] = "p9.test"
+	fstest.Verb = testing.Verbose()
+	os.Remove("/tmp/clive.9873")
+	defer os.Remove("/tmp/clive.9873")
+	fstest.MkTree(t, tdir)
+	defer os.RemoveAll(tdir)
+	fs, err := zux.NewZX(tdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, err := NewServer(caddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	srv.NoAuth()
+	if err := srv.Serve("main", fs); err != nil {
+		t.Fatal(err)
+	}
+	cfs, err := Dial(caddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cfs.Close()
+	cfs.Debug = testing.Verbose()
+	fn(t, cfs)
+}
+
+func TestCliStats(t *testing.T) {
+	runCli(t, fstest.Stats)
+}
+
+func TestCliPuts(t *testing.T) {
+	runCli(t, fstest.Puts)
+}
+
+func TestCliMkdirs(t *testing.T) {
+	runCli(t, fstest.Mkdirs)
+}
+
+func TestCliRemoves(t *testing.T) {
+	runCli(t, fstest.Removes)
+}
+
+func TestCliWstats(t *testing.T) {
+	runCli(t, fstest.Wstats)
+}
+
+// fstest.Gets and Finds expect /Ctl to be a "c" file, which 9P can't tell.
+func cliGets(t fstest.Fataler, xfs zx.Fs) {
+	fs := xfs.(*Fs)
+	for _, p := range fstest.Files {
+		dat, err := zx.GetAll(fs, p)
+		if err != nil || string(dat) != string(fstest.FileData[p]) {
+			t.Fatalf("get %s: bad data %v", p, err)
+		}
+	}
+	dat, err := get(fs, "/a/a2", 1024, 10*1024)
+	if err != nil || string(dat) != string(fstest.FileData["/a/a2"][1024:11*1024]) {
+		t.Fatalf("get /a/a2 1k 10k: bad data %v", err)
+	}
+	out := ""
+	gc := fs.Get("/a", 1, 2)
+	for b := range gc {
+		_, d, err := zx.UnpackDir(b)
+		if err != nil {
+			t.Fatalf("get /a: %s", err)
+		}
+		out += d.Fmt() + "\n"
+	}
+	if err := cerror(gc); err != nil {
+		t.Fatalf("get /a: %s", err)
+	}
+	if out != "- rw-r--r--  20.9k /a/a2\nd rwxr-xr-x      0 /a/b\n" {
+		t.Fatalf("get /a: bad dir <%s>", out)
+	}
+	if _, err := zx.GetAll(fs, "/n"); !zx.IsNotExist(err) {
+		t.Fatalf("get /n: %v", err)
+	}
+}
+
+func TestCliGets(t *testing.T) {
+	runCli(t, cliGets)
+}
+
+func cliFinds(t fstest.Fataler, xfs zx.Fs) {
+	fs := xfs.(*Fs)
+	out := ""
+	dc := fs.Find("/a/b", "depth<=1", "/a", "/x/y", 0)
+	for d := range dc {
+		out += d.Fmt() + "\n"
+	}
+	if err := cerror(dc); err != nil {
+		t.Fatalf("find: %s", err)
+	}
+	if out != "d rwxr-xr-x      0 /x/y/b\nd rwxr-xr-x      0 /x/y/b/c\n" {
+		t.Fatalf("bad find <%s>", out)
+	}
+	var data []byte
+	names := []string{}
+	gc := fs.FindGet("/a", "type=-", "", "", 0)
+	for x := range gc {
+		switch x := x.(type) {
+		case zx.Dir:
+			names = append(names, x["path"])
+		case []byte:
+			data = append(data, x...)
+		case error:
+			t.Fatalf("findget: %s", x)
+		}
+	}
+	if err := cerror(gc); err != nil {
+		t.Fatalf("findget: %s", err)
+	}
+	if strings.Join(names, " ") != "/a/a1 /a/a2 /a/b/c/c3" {
+		t.Fatalf("bad findget %v", names)
+	}
+	all := string(fstest.FileData["/a/a1"]) + string(fstest.FileData["/a/a2"]) +
+		string(fstest.FileData["/a/b/c/c3"])
+	if string(data) != all {
+		t.Fatalf("bad findget data")
+	}
+}
+
+func TestCliFinds(t *testing.T) {
+	runCli(t, cliFinds)
+}
+
+func cliMoves(t fstest.Fataler, xfs zx.Fs) {
+	fs := xfs.(*Fs)
+	if err := <-fs.Move("/a/a1", "/a/n1"); err != nil {
+		t.Fatalf("move: %s", err)
+	}
+	if d, err := zx.Stat(fs, "/a/n1"); err != nil || d["name"] != "n1" {
+		t.Fatalf("moved file not there: %v", err)
+	}
+	if err := <-fs.Move("/a/n1", "/d/n1"); err == nil {
+		t.Fatalf("could move across dirs")
+	}
+	if err := <-fs.RemoveAll("/a"); err != nil {
+		t.Fatalf("removeall: %s", err)
+	}
+	if _, err := zx.Stat(fs, "/a"); !zx.IsNotExist(err) {
+		t.Fatalf("removeall: /a still there")
+	}
+}
+
+func TestCliMoves(t *testing.T) {
+	runCli(t, cliMoves)
+}
@@ -0,0 +1,764 @@
+/*
+	9P2000 access to zx trees.
+
+	A Server exports zx trees to 9P2000 clients, like Plan 9, plan9port,
+	or the Linux v9fs client, eg.
+		mount -t 9p -o trans=tcp,port=564,version=9p2000,aname=main host /n/zx
+	The attach name selects the tree served (main by default).
+	Clients asking for 9P2000.L or 9P2000.u are offered plain 9P2000.
+
+	zx dirs are mapped to 9P stats using the mode, size, mtime, uid, gid,
+	and wuid attributes, and qids are made from their paths and mtimes.
+	Reads and writes become Gets and Puts; wstats become Wstats and
+	Moves (to rename files).
+
+	9P carries no clive authentication. The user name given when attaching
+	is trusted and its groups are taken from the key file for the default
+	auth domain (see auth.UserInfo); users without keys can't attach.
+	Thus, servers should be used just in trusted networks, or
+	listen on unix sockets, and serve trees checking zx permissions.
+
+	Dial does the converse and returns a zx tree for the files served
+	by a 9P2000 server, eg. Plan 9 file servers. Find and FindGet are
+	evaluated at the client, and moves are limited to renames within a
+	directory. Name spaces mount these trees using 9p! addresses (see ns).
+*/
+package p9
+
+import (
+	"bufio"
+	"clive/dbg"
+	cnet "clive/net"
+	"clive/net/auth"
+	"clive/zx"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net"
+	"os"
+	fpath "path"
+	"strings"
+	"sync"
+	"time"
+)
+
+struct Server {
+	*dbg.Flag
+	sync.Mutex
+	fs     map[string]zx.Fs // trees served
+	addr   string           // where served
+	noauth bool
+	ls     []net.Listener
+	conns  map[net.Conn]bool
+	endc   chan bool
+	once   sync.Once
+}
+
+// A client connection.
+// Requests are served one at a time, in the order they arrive.
+struct conn {
+	*Server
+	nc    net.Conn
+	tag   string
+	msize uint32
+	fids  map[uint32]*fid
+	fss   map[string]zx.Fs // trees authenticated for each user!tree
+}
+
+struct fid {
+	fs     zx.Fs
+	path   string
+	d      zx.Dir
+	omode  int // -1 if not open
+	rclose bool
+	dbuf   []byte // packed stats for dir reads
+	doff   uint64 // offset expected for the next dir read
+}
+
+var (
+	ErrNoFid     = errors.New("unknown fid")
+	ErrFidInUse  = errors.New("fid already in use")
+	ErrOpen      = errors.New("fid already open")
+	ErrNotOpen   = errors.New("fid not open for I/O")
+	ErrBadOffset = errors.New("bad offset in directory read")
+	ErrNoAuth    = errors.New("authentication not required")
+	ErrBadName   = errors.New("bad file name")
+)
+
+func init() {
+	cnet.DefSvc("9fs", "564")
+}
+
+// Listen at the given address for raw 9P connections.
+// If the network is "*", both unix and tcp are used.
+func listen(addr string) ([]net.Listener, error) {
+	nw, host, svc := cnet.ParseAddr(addr)
+	if nw == "" {
+		return nil, cnet.ErrBadAddr
+	}
+	if host == "local" || host == "*" || host == "localhost" {
+		host = ""
+	}
+	var ls []net.Listener
+	var err error
+	if nw == "*" || nw == "unix" {
+		p := cnet.Port("unix", svc)
+		os.Remove(p)
+		l, uerr := net.Listen("unix", p)
+		if uerr == nil {
+			ls = append(ls, l)
+		}
+		err = uerr
+	}
+	if nw == "*" || nw == "tcp" {
+		l, terr := net.Listen("tcp", host+":"+cnet.Port("tcp", svc))
+		if terr == nil {
+			ls = append(ls, l)
+		}
+		if err == nil {
+			err = terr
+		}
+	}
+	if nw != "*" && nw != "unix" && nw != "tcp" {
+		err = cnet.ErrBadAddr
+	}
+	if len(ls) == 0 {
+		return nil, err
+	}
+	return ls, nil
+}
+
+// Start a 9P server at the given address (tcp!*!9fs, by default port 564).
+func NewServer(addr string) (*Server, error) {
+	ls, err := listen(addr)
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		Flag:  &dbg.Flag{Tag: "p9 " + addr},
+		fs:    map[string]zx.Fs{},
+		addr:  addr,
+		ls:    ls,
+		conns: map[net.Conn]bool{},
+		endc:  make(chan bool),
+	}
+	for _, l := range ls {
+		go s.loop(l)
+	}
+	return s, nil
+}
+
+func (s *Server) String() string {
+	return s.addr
+}
+
+// Trust the user names given by clients and use the trees as they are,
+// without authenticating them for the users.
+func (s *Server) NoAuth() {
+	s.noauth = true
+}
+
+// Serve fs with the given tree name, used as the 9P attach name.
+// Trees implementing zx.FullFs support all 9P requests; others
+// fail those requests they can't handle.
+func (s *Server) Serve(name string, fs zx.Fs) error {
+	s.Lock()
+	defer s.Unlock()
+	if s.fs[name] != nil {
+		return fmt.Errorf("%s: %s already served", s.addr, name)
+	}
+	s.fs[name] = fs
+	return nil
+}
+
+// Stop the server and hang up all clients.
+func (s *Server) Close() {
+	s.once.Do(func() {
+		s.Lock()
+		for _, l := range s.ls {
+			l.Close()
+			if ua, ok := l.Addr().(*net.UnixAddr); ok {
+				os.Remove(ua.Name)
+			}
+		}
+		for nc := range s.conns {
+			nc.Close()
+		}
+		s.Unlock()
+		close(s.endc)
+	})
+}
+
+// Wait until the server is done
+func (s *Server) Wait() error {
+	<-s.endc
+	return cerror(s.endc)
+}
+
+func (s *Server) loop(l net.Listener) {
+	for {
+		nc, err := l.Accept()
+		if err != nil {
+			s.Dprintf("accept: %s\n", err)
+			return
+		}
+		s.Lock()
+		s.conns[nc] = true
+		s.Unlock()
+		go s.serve(nc)
+	}
+}
+
+func (s *Server) serve(nc net.Conn) {
+	c := &conn{
+		Server: s,
+		nc:     nc,
+		tag:    nc.RemoteAddr().String(),
+		msize:  MaxMsize,
+		fids:   map[uint32]*fid{},
+		fss:    map[string]zx.Fs{},
+	}
+	if c.tag == "" || c.tag == "@" {
+		// unix sockets do not provide raddr
+		c.tag = "local"
+	}
+	s.Dprintf("new client %s\n", c.tag)
+	r := bufio.NewReader(nc)
+	for {
+		f, err := ReadFcall(r, c.msize)
+		if err != nil {
+			if err != io.EOF {
+				s.Dprintf("%s: %s\n", c.tag, err)
+			}
+			break
+		}
+		s.Dprintf("%s <- %s\n", c.tag, f)
+		rf := c.rpc(f)
+		rf.Tag = f.Tag
+		s.Dprintf("%s -> %s\n", c.tag, rf)
+		if err := WriteFcall(nc, rf); err != nil {
+			s.Dprintf("%s: %s\n", c.tag, err)
+			break
+		}
+	}
+	c.clunkAll()
+	nc.Close()
+	s.Lock()
+	delete(s.conns, nc)
+	s.Unlock()
+	s.Dprintf("gone client %s\n", c.tag)
+}
+
+func (c *conn) rpc(f *Fcall) *Fcall {
+	var r *Fcall
+	var err error
+	switch f.Type {
+	case Tversion:
+		r, err = c.version(f)
+	case Tauth:
+		err = ErrNoAuth
+	case Tattach:
+		r, err = c.attach(f)
+	case Tflush:
+		// requests are served in order; nothing to flush
+		r = &Fcall{Type: Rflush}
+	case Twalk:
+		r, err = c.walk(f)
+	case Topen:
+		r, err = c.open(f)
+	case Tcreate:
+		r, err = c.create(f)
+	case Tread:
+		r, err = c.read(f)
+	case Twrite:
+		r, err = c.write(f)
+	case Tclunk:
+		r, err = c.clunk(f)
+	case Tremove:
+		r, err = c.remove(f)
+	case Tstat:
+		r, err = c.stat(f)
+	case Twstat:
+		r, err = c.wstat(f)
+	default:
+		err = fmt.Errorf("%s: %s", ErrBadMsg, f.Type)
+	}
+	if err != nil {
+		return &Fcall{Type: Rerror, Ename: err.Error()}
+	}
+	return r
+}
+
+func (c *conn) iounit() uint32 {
+	return c.msize - IOHdrSz
+}
+
+func (c *conn) lookup(n uint32) (*fid, error) {
+	fp := c.fids[n]
+	if fp == nil {
+		return nil, ErrNoFid
+	}
+	return fp, nil
+}
+
+func (c *conn) clunkAll() {
+	for n, fp := range c.fids {
+		if fp.rclose {
+			c.rm(fp)
+		}
+		delete(c.fids, n)
+	}
+}
+
+// Return the qid for the file described by d.
+func qid(d zx.Dir) Qid {
+	h := fnv.New64a()
+	h.Write([]byte(d["path"]))
+	q := Qid{Path: h.Sum64(), Vers: uint32(d.Uint("mtime") / 1000)}
+	if d["type"] == "d" {
+		q.Type = QTDIR
+	}
+	return q
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "none"
+	}
+	return s
+}
+
+// Return the 9P stat for d.
+func dirStat(d zx.Dir) *Stat {
+	mode := uint32(d.Mode())
+	sz := uint64(d.Size())
+	if d["type"] == "d" {
+		mode |= DMDIR
+		sz = 0
+	}
+	nm := d["name"]
+	if d["path"] == "/" {
+		nm = "/"
+	}
+	mt := uint32(d.Time("mtime").Unix())
+	return &Stat{
+		Qid:    qid(d),
+		Mode:   mode,
+		Atime:  mt,
+		Mtime:  mt,
+		Length: sz,
+		Name:   nm,
+		Uid:    orNone(d["uid"]),
+		Gid:    orNone(d["gid"]),
+		Muid:   orNone(d["wuid"]),
+	}
+}
+
+func (c *conn) version(f *Fcall) (*Fcall, error) {
+	if f.Msize < IOHdrSz+128 {
+		return nil, errors.New("msize too small")
+	}
+	c.clunkAll()
+	c.msize = f.Msize
+	if c.msize > MaxMsize {
+		c.msize = MaxMsize
+	}
+	v := "unknown"
+	if strings.HasPrefix(f.Version, Version) {
+		v = Version
+	}
+	return &Fcall{Type: Rversion, Msize: c.msize, Version: v}, nil
+}
+
+// Return the tree with the given name as seen by the user.
+func (c *conn) tree(uname, name string) (zx.Fs, error) {
+	c.Lock()
+	fs := c.fs[name]
+	noauth := c.noauth
+	c.Unlock()
+	if fs == nil {
+		return nil, fmt.Errorf("%s: %s", name, zx.ErrNotExist)
+	}
+	if noauth {
+		return fs, nil
+	}
+	k := uname + "!" + name
+	if afs := c.fss[k]; afs != nil {
+		return afs, nil
+	}
+	ai, err := auth.UserInfo("", uname)
+	if err != nil {
+		dbg.Warn("%s: %s: %s", c.addr, c.tag, err)
+		return nil, err
+	}
+	if afs, ok := fs.(zx.Auther); ok {
+		if fs, err = afs.Auth(ai); err != nil {
+			return nil, err
+		}
+	}
+	c.Dprintf("%s attach as %s\n", c.tag, ai.Uid)
+	c.fss[k] = fs
+	return fs, nil
+}
+
+func (c *conn) attach(f *Fcall) (*Fcall, error) {
+	if c.fids[f.Fid] != nil {
+		return nil, ErrFidInUse
+	}
+	name := strings.Trim(f.Aname, "/")
+	if name == "" {
+		name = "main"
+	}
+	fs, err := c.tree(f.Uname, name)
+	if err != nil {
+		return nil, err
+	}
+	d, err := zx.Stat(fs, "/")
+	if err != nil {
+		return nil, err
+	}
+	c.fids[f.Fid] = &fid{fs: fs, path: "/", d: d, omode: -1}
+	return &Fcall{Type: Rattach, Qid: qid(d)}, nil
+}
+
+func (c *conn) walk(f *Fcall) (*Fcall, error) {
+	fp, err := c.lookup(f.Fid)
+	if err != nil {
+		return nil, err
+	}
+	if fp.omode >= 0 {
+		return nil, ErrOpen
+	}
+	if f.Newfid != f.Fid && c.fids[f.Newfid] != nil {
+		return nil, ErrFidInUse
+	}
+	p, d := fp.path, fp.d
+	qids := []Qid{}
+	for i, n := range f.Wname {
+		var nd zx.Dir
+		np := fpath.Join(p, n)
+		switch {
+		case d["type"] != "d":
+			err = fmt.Errorf("%s: %s", p, zx.ErrNotDir)
+		case n == "" || n == "." || strings.Contains(n, "/"):
+			err = fmt.Errorf("%s: %s", n, ErrBadName)
+		default:
+			nd, err = zx.Stat(fp.fs, np)
+		}
+		if err != nil {
+			if i == 0 {
+				return nil, err
+			}
+			break
+		}
+		p, d = np, nd
+		qids = append(qids, qid(d))
+	}
+	if len(qids) == len(f.Wname) {
+		c.fids[f.Newfid] = &fid{fs: fp.fs, path: p, d: d, omode: -1}
+	}
+	return &Fcall{Type: Rwalk, Wqid: qids}, nil
+}
+
+func (c *conn) open(f *Fcall) (*Fcall, error) {
+	fp, err := c.lookup(f.Fid)
+	if err != nil {
+		return nil, err
+	}
+	if fp.omode >= 0 {
+		return nil, ErrOpen
+	}
+	d, err := zx.Stat(fp.fs, fp.path)
+	if err != nil {
+		return nil, err
+	}
+	mode := int(f.Mode & 3)
+	wr := mode == OWRITE || mode == ORDWR || f.Mode&OTRUNC != 0
+	if d["type"] == "d" && wr {
+		return nil, fmt.Errorf("%s: %s", fp.path, zx.ErrIsDir)
+	}
+	if _, ok := fp.fs.(zx.Putter); wr && !ok {
+		return nil, fmt.Errorf("%s: %s", fp.path, zx.ErrRO)
+	}
+	if f.Mode&OTRUNC != 0 && d.Size() != 0 {
+		wfs, ok := fp.fs.(zx.Wstater)
+		if !ok {
+			return nil, fmt.Errorf("%s: %s", fp.path, zx.ErrRO)
+		}
+		rc := wfs.Wstat(fp.path, zx.Dir{"size": "0"})
+		if nd := <-rc; nd != nil {
+			d = nd
+		} else if err := cerror(rc); err != nil {
+			return nil, err
+		}
+	}
+	fp.d = d
+	fp.omode = mode
+	fp.rclose = f.Mode&ORCLOSE != 0
+	fp.dbuf = nil
+	fp.doff = 0
+	return &Fcall{Type: Ropen, Qid: qid(d), Iounit: c.iounit()}, nil
+}
+
+func (c *conn) create(f *Fcall) (*Fcall, error) {
+	fp, err := c.lookup(f.Fid)
+	if err != nil {
+		return nil, err
+	}
+	if fp.omode >= 0 {
+		return nil, ErrOpen
+	}
+	if fp.d["type"] != "d" {
+		return nil, fmt.Errorf("%s: %s", fp.path, zx.ErrNotDir)
+	}
+	if f.Name == "" || f.Name == "." || f.Name == ".." || strings.Contains(f.Name, "/") {
+		return nil, fmt.Errorf("%s: %s", f.Name, ErrBadName)
+	}
+	pfs, ok := fp.fs.(zx.Putter)
+	if !ok {
+		return nil, fmt.Errorf("%s: %s", fp.path, zx.ErrRO)
+	}
+	np := fpath.Join(fp.path, f.Name)
+	pmode := uint32(fp.d.Mode())
+	nd := zx.Dir{}
+	var dc chan []byte
+	if f.Perm&DMDIR != 0 {
+		if _, err := zx.Stat(fp.fs, np); err == nil {
+			return nil, fmt.Errorf("%s: %s", np, zx.ErrExists)
+		}
+		nd["type"] = "d"
+		nd.SetMode(uint64(f.Perm & (^uint32(0777) | pmode&0777)))
+	} else {
+		nd["type"] = "-"
+		nd["size"] = "0"
+		nd.SetMode(uint64(f.Perm & (^uint32(0666) | pmode&0666)))
+		dc = make(chan []byte)
+		close(dc)
+	}
+	rc := pfs.Put(np, nd, 0, dc)
+	<-rc
+	if err := cerror(rc); err != nil {
+		return nil, err
+	}
+	d, err := zx.Stat(fp.fs, np)
+	if err != nil {
+		return nil, err
+	}
+	fp.path = np
+	fp.d = d
+	fp.omode = int(f.Mode & 3)
+	fp.rclose = f.Mode&ORCLOSE != 0
+	return &Fcall{Type: Rcreate, Qid: qid(d), Iounit: c.iounit()}, nil
+}
+
+func get(fs zx.Getter, p string, off, count int64) ([]byte, error) {
+	rc := fs.Get(p, off, count)
+	var data []byte
+	for b := range rc {
+		data = append(data, b...)
+	}
+	return data, cerror(rc)
+}
+
+func (c *conn) read(f *Fcall) (*Fcall, error) {
+	fp, err := c.lookup(f.Fid)
+	if err != nil {
+		return nil, err
+	}
+	if fp.omode < 0 || fp.omode == OWRITE {
+		return nil, ErrNotOpen
+	}
+	gfs, ok := fp.fs.(zx.Getter)
+	if !ok {
+		return nil, fmt.Errorf("%s: %s", fp.path, zx.ErrBug)
+	}
+	count := f.Count
+	if count > c.iounit() {
+		count = c.iounit()
+	}
+	if fp.d["type"] != "d" {
+		data, err := get(gfs, fp.path, int64(f.Offset), int64(count))
+		if err != nil {
+			return nil, err
+		}
+		return &Fcall{Type: Rread, Data: data}, nil
+	}
+	if f.Offset == 0 {
+		ds, err := zx.GetDir(gfs, fp.path)
+		if err != nil {
+			return nil, err
+		}
+		fp.dbuf = nil
+		for _, d := range ds {
+			fp.dbuf = append(fp.dbuf, dirStat(d).Bytes()...)
+		}
+		fp.doff = 0
+	} else if f.Offset != fp.doff {
+		return nil, ErrBadOffset
+	}
+	// send whole entries only
+	b := fp.dbuf[fp.doff:]
+	n := 0
+	for n < len(b) {
+		sz := int(le.Uint16(b[n:])) + 2
+		if n+sz > int(count) {
+			break
+		}
+		n += sz
+	}
+	if n == 0 && len(b) > 0 {
+		return nil, errors.New("read count too small for a directory entry")
+	}
+	fp.doff += uint64(n)
+	return &Fcall{Type: Rread, Data: b[:n]}, nil
+}
+
+func (c *conn) write(f *Fcall) (*Fcall, error) {
+	fp, err := c.lookup(f.Fid)
+	if err != nil {
+		return nil, err
+	}
+	if fp.omode != OWRITE && fp.omode != ORDWR {
+		return nil, ErrNotOpen
+	}
+	pfs, ok := fp.fs.(zx.Putter)
+	if !ok {
+		return nil, fmt.Errorf("%s: %s", fp.path, zx.ErrRO)
+	}
+	dc := make(chan []byte, 1)
+	dc <- f.Data
+	close(dc)
+	rc := pfs.Put(fp.path, nil, int64(f.Offset), dc)
+	<-rc
+	if err := cerror(rc); err != nil {
+		return nil, err
+	}
+	return &Fcall{Type: Rwrite, Count: uint32(len(f.Data))}, nil
+}
+
+func (c *conn) clunk(f *Fcall) (*Fcall, error) {
+	fp, err := c.lookup(f.Fid)
+	if err != nil {
+		return nil, err
+	}
+	delete(c.fids, f.Fid)
+	if fp.rclose {
+		c.rm(fp)
+	}
+	return &Fcall{Type: Rclunk}, nil
+}
+
+func (c *conn) rm(fp *fid) error {
+	rfs, ok := fp.fs.(zx.Remover)
+	if !ok {
+		return fmt.Errorf("%s: %s", fp.path, zx.ErrRO)
+	}
+	rc := rfs.Remove(fp.path)
+	<-rc
+	return cerror(rc)
+}
+
+func (c *conn) remove(f *Fcall) (*Fcall, error) {
+	fp, err := c.lookup(f.Fid)
+	if err != nil {
+		return nil, err
+	}
+	// the fid is clunked even if the remove fails
+	delete(c.fids, f.Fid)
+	if err := c.rm(fp); err != nil {
+		return nil, err
+	}
+	return &Fcall{Type: Rremove}, nil
+}
+
+func (c *conn) stat(f *Fcall) (*Fcall, error) {
+	fp, err := c.lookup(f.Fid)
+	if err != nil {
+		return nil, err
+	}
+	d, err := zx.Stat(fp.fs, fp.path)
+	if err != nil {
+		return nil, err
+	}
+	fp.d = d
+	return &Fcall{Type: Rstat, Stat: dirStat(d).Bytes()}, nil
+}
+
+func (c *conn) wstat(f *Fcall) (*Fcall, error) {
+	fp, err := c.lookup(f.Fid)
+	if err != nil {
+		return nil, err
+	}
+	_, st, err := UnpackStat(f.Stat)
+	if err != nil {
+		return nil, err
+	}
+	d, err := zx.Stat(fp.fs, fp.path)
+	if err != nil {
+		return nil, err
+	}
+	isdir := d["type"] == "d"
+	nd := zx.Dir{}
+	if st.Mode != ^uint32(0) {
+		if (st.Mode&DMDIR != 0) != isdir {
+			return nil, fmt.Errorf("%s: can't change directory bit", fp.path)
+		}
+		if uint32(d.Mode()) != st.Mode&0777 {
+			nd.SetMode(uint64(st.Mode))
+		}
+	}
+	if st.Mtime != ^uint32(0) {
+		nd.SetTime("mtime", time.Unix(int64(st.Mtime), 0))
+	}
+	if st.Length != ^uint64(0) && (isdir || st.Length != uint64(d.Size())) {
+		if isdir {
+			return nil, fmt.Errorf("%s: %s", fp.path, zx.ErrIsDir)
+		}
+		nd.SetSize(int64(st.Length))
+	}
+	if st.Uid != "" && st.Uid != d["uid"] {
+		nd["uid"] = st.Uid
+	}
+	if st.Gid != "" && st.Gid != d["gid"] {
+		nd["gid"] = st.Gid
+	}
+	mv := st.Name != "" && st.Name != d["name"]
+	if mv && (fp.path == "/" || st.Name == "." || st.Name == ".." || strings.Contains(st.Name, "/")) {
+		return nil, fmt.Errorf("%s: %s", st.Name, ErrBadName)
+	}
+	if len(nd) == 0 && !mv {
+		// all don't touch: a request to sync the file.
+		if sfs, ok := fp.fs.(zx.Syncer); ok {
+			if err := sfs.Sync(); err != nil {
+				return nil, err
+			}
+		}
+		return &Fcall{Type: Rwstat}, nil
+	}
+	if len(nd) > 0 {
+		wfs, ok := fp.fs.(zx.Wstater)
+		if !ok {
+			return nil, fmt.Errorf("%s: %s", fp.path, zx.ErrRO)
+		}
+		rc := wfs.Wstat(fp.path, nd)
+		<-rc
+		if err := cerror(rc); err != nil {
+			return nil, err
+		}
+	}
+	if mv {
+		mfs, ok := fp.fs.(zx.Mover)
+		if !ok {
+			return nil, fmt.Errorf("%s: %s", fp.path, zx.ErrRO)
+		}
+		np := fpath.Join(fpath.Dir(fp.path), st.Name)
+		rc := mfs.Move(fp.path, np)
+		<-rc
+		if err := cerror(rc); err != nil {
+			return nil, err
+		}
+		fp.path = np
+	}
+	return &Fcall{Type: Rwstat}, nil
+}
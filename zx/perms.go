@@ -5,11 +5,36 @@ import (
 	"fmt"
 )
 
+// Set by clive/zx/pred to evaluate the predicates in capabilities, at
+// the given depth in the capability subtree.
+// If it's not set, capabilities with predicates grant no access to their subtrees.
+var CapPred func(pred string, d Dir, lvl int) bool
+
+// Does the capability in ai, if any, allow this access to this file?
+func (d Dir) capAllows(ai *auth.Info, what int) bool {
+	if ai == nil || ai.Cap == nil {
+		return true
+	}
+	c := ai.Cap
+	if !c.Allows("", d["path"], what) {
+		return false
+	}
+	lvl := c.Depth(d["path"])
+	if c.Pred == "" || lvl < 0 || (what == 0111 && d["type"] == "d") {
+		return true
+	}
+	return CapPred != nil && CapPred(c.Pred, d, lvl)
+}
+
 // To check with 0111 | 0222 | 0444.
+// If ai has a capability, it must allow the access as well.
 func (d Dir) Can(ai *auth.Info, what int) bool {
 	if d == nil {
 		return true
 	}
+	if !d.capAllows(ai, what) {
+		return false
+	}
 	mode := int(d.Mode())
 	if ai.InGroup(d["Uid"]) {
 		return mode&what != 0
@@ -62,6 +87,9 @@ func (d Dir) CanWstat(ai *auth.Info, nd Dir) error {
 	if len(d) == 0 || len(nd) == 0 || ai == nil {
 		return nil
 	}
+	if !d.capAllows(ai, 0222) {
+		return fmt.Errorf("%s: %s", d["path"], ErrPerm)
+	}
 	isowner := ai.InGroup(d["uid"])
 	for k, v := range nd {
 		if d[k] == v {
@@ -26,6 +26,8 @@
 		`prune`		false, and indicates that the tree can be pruned
 	The predefined attribute "depth" may be used to indicate the depth of the
 	Dir evaluted.
+	The "sum" attribute (the hash of the file contents) may be used as well;
+	trees supporting it compute it for files when a predicate uses it.
 
 		n	(where n is an int) is understood as `depth<=n`
 		d	is understood as `type=d`
@@ -102,6 +104,20 @@ var (
 	debug bool
 )
 
+func init() {
+	zx.CapPred = capPred
+}
+
+// Used by zx.Dir.Can to check predicates in capabilities.
+func capPred(s string, d zx.Dir, lvl int) bool {
+	p, err := New(s)
+	if err != nil || p == nil {
+		return err == nil
+	}
+	match, _, err := p.EvalAt(d, lvl)
+	return err == nil && match
+}
+
 // A compiled predicate.
 struct Pred {
 	op    op // operation
@@ -144,6 +160,23 @@ func Not(arg *Pred) *Pred {
 	}
 }
 
+// Return true if the predicate refers to the given attribute.
+// Used by trees that compute some attributes only when needed (e.g., "sum").
+func (p *Pred) Uses(attr string) bool {
+	if p == nil {
+		return false
+	}
+	if p.name == attr {
+		return true
+	}
+	for _, a := range p.args {
+		if a.Uses(attr) {
+			return true
+		}
+	}
+	return false
+}
+
 //	exp	p	->
 //	/a/b	/x	-> false, true
 //	/a/b	/a	-> false, false
@@ -177,6 +210,14 @@ func EvalStr(e zx.Dir, p string, depth int) (value, pruned bool, err error) {
 	return x.EvalAt(e, depth)
 }
 
+// Return true if the predicate is true for e at the given depth
+// and it can be evaluated.
+// This is the match function used for zx.Watch.
+func (p *Pred) Match(e zx.Dir, lvl int) bool {
+	v, _, err := p.EvalAt(e, lvl)
+	return v && err == nil
+}
+
 // Evaluate the predicate at the given directory
 // entry (considering that its depth is the given one).
 // Returns true or false as the value of the predicate, a prune indication
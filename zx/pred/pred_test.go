@@ -2,9 +2,11 @@ package pred
 
 import (
 	"clive/dbg"
+	"clive/net/auth"
 	"clive/zx"
 	"path"
 	"testing"
+	"time"
 )
 
 /*
@@ -198,3 +200,51 @@ func BenchmarkPredString(b *testing.B) {
 	}
 
 }
+
+struct tcap {
+	d    zx.Dir
+	what int
+	ok   bool
+}
+
+func TestCapPerms(t *testing.T) {
+	c := &auth.Cap{
+		Uid:     "nemo",
+		Path:    "/a/b",
+		Pred:    "name~*.c",
+		Expires: time.Now().Add(time.Hour),
+	}
+	ai := &auth.Info{Uid: "nemo", Gids: map[string]bool{}, Cap: c}
+	mk := func(p, typ string) zx.Dir {
+		return zx.Dir{"path": p, "name": path.Base(p), "type": typ,
+			"mode": "0777", "Uid": "nemo", "Gid": "nemo"}
+	}
+	outs := []tcap{
+		{mk("/", "d"), 0111, true},
+		{mk("/a", "d"), 0111, true},
+		{mk("/a", "d"), 0444, false},
+		{mk("/a/c.c", "-"), 0444, false},
+		{mk("/a/b", "d"), 0111, true},
+		{mk("/a/b/x", "d"), 0111, true},
+		{mk("/a/b/x", "d"), 0444, false},
+		{mk("/a/b/x/f.c", "-"), 0444, true},
+		{mk("/a/b/x/f.h", "-"), 0444, false},
+		{mk("/a/b/x/f.c", "-"), 0222, false},
+	}
+	for _, o := range outs {
+		if ok := o.d.Can(ai, o.what); ok != o.ok {
+			t.Fatalf("%s %o: got %v", o.d["path"], o.what, ok)
+		}
+	}
+	c.RW = true
+	if !mk("/a/b/f.c", "-").CanPut(ai) {
+		t.Fatalf("rw cap can't put")
+	}
+	if err := mk("/a/f.c", "-").CanWstat(ai, zx.Dir{"mtime": "0"}); err == nil {
+		t.Fatalf("wstat outside the cap didn't fail")
+	}
+	c.Expires = time.Now().Add(-time.Second)
+	if mk("/a/b/f.c", "-").CanGet(ai) {
+		t.Fatalf("expired cap can get")
+	}
+}
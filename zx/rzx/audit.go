@@ -0,0 +1,521 @@
+package rzx
+
+import (
+	"bufio"
+	"clive/dbg"
+	"clive/net/auth"
+	"clive/u"
+	"clive/zx"
+	"clive/zx/pred"
+	"fmt"
+	"io"
+	"os"
+	fpath "path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The audit log records a line for each mutating request, in the
+// format used by zx.Dir.String, with the attributes
+//	seq mtime uid client tree op file to result
+// The log is rotated to file.1, file.2, ... when it reaches AuditSz bytes,
+// and only AuditKeep old logs are kept.
+// It is also served as a read-only tree named "audit" (see Server.Audit),
+// with a file /<seq> for each record, carrying the record attributes, and
+// the log line as its data.
+// Only an index of the records is kept in memory; records are read
+// from the logs and parsed as the tree is used.
+struct audit {
+	sync.Mutex
+	file  string
+	fd    *os.File
+	sz    int64
+	seq   uint64
+	mtime string     // of the last record
+	logs  [][]logRec // index for file, file.1, ...
+}
+
+// Where a record is found in its log.
+struct logRec {
+	seq uint64
+	off int64
+	sz  int
+}
+
+// Logs opened to read records from, and their index.
+struct logSnap {
+	file string
+	fds  []*os.File // nil if the log is gone
+	logs [][]logRec
+}
+
+// Read-only zx tree for an audit log
+struct auditFs {
+	*dbg.Flag
+	a *audit
+}
+
+var (
+	AuditSz   int64 = 16 * 1024 * 1024
+	AuditKeep       = 4
+
+	_afs  zx.Getter     = &auditFs{}
+	_afs2 zx.Finder     = &auditFs{}
+	_afs3 zx.FindGetter = &auditFs{}
+	_afs4 zx.Auther     = &auditFs{}
+)
+
+// Record mutating requests made by clients in the audit log at file,
+// and serve the log as the read-only tree "audit" (see audit).
+// Only the server user may use the audit tree.
+func (s *Server) Audit(file string) error {
+	if err := s.audit.open(file); err != nil {
+		return err
+	}
+	return s.Serve("audit", &auditFs{Flag: &dbg.Flag{Tag: "audit"}, a: s.audit})
+}
+
+func mutates(op MsgId) bool {
+	switch op {
+	case Tput, Tdput, Twstat, Tremove, Tremoveall, Tmove, Tlink:
+		return true
+	}
+	return false
+}
+
+func (a *audit) open(file string) error {
+	a.Lock()
+	defer a.Unlock()
+	if a.fd != nil {
+		return fmt.Errorf("audit: already logging to %s", a.file)
+	}
+	a.file = file
+	a.logs = make([][]logRec, AuditKeep+1)
+	a.seq = 0
+	a.mtime = ""
+	for i := range a.logs {
+		f := a.logName(i)
+		recs, mtime, err := index(f)
+		if err != nil && !os.IsNotExist(err) {
+			dbg.Warn("audit: %s: %s", f, err)
+		}
+		a.logs[i] = recs
+		// the current log may be empty after a rotation
+		if n := len(recs); n > 0 && recs[n-1].seq > a.seq {
+			a.seq = recs[n-1].seq
+			a.mtime = mtime
+		}
+	}
+	return a.reopen()
+}
+
+// Name of the i-th old log, or of the log if i is 0.
+func (a *audit) logName(i int) string {
+	if i == 0 {
+		return a.file
+	}
+	return fmt.Sprintf("%s.%d", a.file, i)
+}
+
+// a is locked
+func (a *audit) reopen() error {
+	fd, err := os.OpenFile(a.file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	st, err := fd.Stat()
+	if err != nil {
+		fd.Close()
+		return err
+	}
+	a.fd = fd
+	a.sz = st.Size()
+	return nil
+}
+
+// a is locked
+func (a *audit) rotate() error {
+	a.fd.Close()
+	a.fd = nil
+	for i := AuditKeep; i > 0; i-- {
+		os.Rename(a.logName(i-1), a.logName(i))
+	}
+	if AuditKeep <= 0 {
+		os.Remove(a.file)
+	}
+	copy(a.logs[1:], a.logs)
+	a.logs[0] = nil
+	return a.reopen()
+}
+
+// Record the request m made by uid from client, with result err.
+func (a *audit) log(uid, client string, m *Msg, err error) {
+	a.Lock()
+	defer a.Unlock()
+	if a.fd == nil {
+		return
+	}
+	a.seq++
+	d := zx.Dir{
+		"uid":    uid,
+		"client": client,
+		"tree":   m.Fsys,
+		"op":     strings.ToLower(m.Op.String()[1:]),
+		"file":   m.Path,
+		"result": "ok",
+	}
+	d.SetUint("seq", a.seq)
+	d.SetTime("mtime", time.Now())
+	if m.To != "" {
+		d["to"] = m.To
+	}
+	if err != nil {
+		d["result"] = err.Error()
+	}
+	ln := d.String() + "\n"
+	if a.sz > 0 && a.sz+int64(len(ln)) > AuditSz {
+		if err := a.rotate(); err != nil {
+			dbg.Warn("audit: %s: %s", a.file, err)
+			return
+		}
+	}
+	off := a.sz
+	n, err := a.fd.WriteString(ln)
+	a.sz += int64(n)
+	if err != nil {
+		dbg.Warn("audit: %s: %s", a.file, err)
+		return
+	}
+	a.logs[0] = append(a.logs[0], logRec{seq: a.seq, off: off, sz: len(ln)})
+	a.mtime = d["mtime"]
+}
+
+// Return the index for the log file given and the mtime of its last record.
+func index(file string) ([]logRec, string, error) {
+	fd, err := os.Open(file)
+	if err != nil {
+		return nil, "", err
+	}
+	defer fd.Close()
+	var recs []logRec
+	mtime := ""
+	off := int64(0)
+	scn := bufio.NewScanner(fd)
+	for scn.Scan() {
+		ln := scn.Text()
+		sz := len(ln) + 1
+		d, err := zx.ParseDir(ln)
+		if err == nil && d["seq"] != "" {
+			recs = append(recs, logRec{seq: d.Uint("seq"), off: off, sz: sz})
+			mtime = d["mtime"]
+		}
+		off += int64(sz)
+	}
+	return recs, mtime, scn.Err()
+}
+
+// Parse the record for the log line ln.
+func recDir(file, ln string) (zx.Dir, error) {
+	d, err := zx.ParseDir(strings.TrimSuffix(ln, "\n"))
+	if err != nil {
+		return nil, err
+	}
+	seq := d["seq"]
+	d["name"] = seq
+	d["path"] = "/" + seq
+	d["addr"] = fmt.Sprintf("audit!%s!/%s", file, seq)
+	d["type"] = "-"
+	d["mode"] = "0444"
+	d["gid"] = d["uid"]
+	d.SetSize(int64(len(ln)))
+	return d, nil
+}
+
+// Return the root dir for the logs.
+func (a *audit) root() zx.Dir {
+	a.Lock()
+	defer a.Unlock()
+	n := 0
+	for _, recs := range a.logs {
+		n += len(recs)
+	}
+	root := zx.Dir{
+		"name":  "/",
+		"path":  "/",
+		"addr":  fmt.Sprintf("audit!%s!/", a.file),
+		"type":  "d",
+		"mode":  "0555",
+		"uid":   u.Uid,
+		"gid":   u.Uid,
+		"mtime": a.mtime,
+	}
+	if n == 0 {
+		root["mtime"] = "0"
+	}
+	root.SetSize(int64(n))
+	return root
+}
+
+// Return the record with the given seq.
+func (a *audit) rec(seq uint64) (zx.Dir, error) {
+	a.Lock()
+	defer a.Unlock()
+	for i, recs := range a.logs {
+		j := sort.Search(len(recs), func(j int) bool { return recs[j].seq >= seq })
+		if j == len(recs) || recs[j].seq != seq {
+			continue
+		}
+		fd, err := os.Open(a.logName(i))
+		if err != nil {
+			return nil, err
+		}
+		defer fd.Close()
+		buf := make([]byte, recs[j].sz)
+		if _, err := fd.ReadAt(buf, recs[j].off); err != nil {
+			return nil, err
+		}
+		return recDir(a.file, string(buf))
+	}
+	return nil, fmt.Errorf("/%d: %s", seq, zx.ErrNotExist)
+}
+
+// Open the logs to read the records indexed so far.
+// The fds keep the logs even if they are rotated meanwhile.
+func (a *audit) snap() *logSnap {
+	a.Lock()
+	defer a.Unlock()
+	ls := &logSnap{file: a.file}
+	for i, recs := range a.logs {
+		if len(recs) == 0 {
+			continue
+		}
+		fd, err := os.Open(a.logName(i))
+		if err != nil {
+			continue
+		}
+		ls.fds = append(ls.fds, fd)
+		ls.logs = append(ls.logs, recs)
+	}
+	return ls
+}
+
+func (ls *logSnap) close() {
+	for _, fd := range ls.fds {
+		fd.Close()
+	}
+}
+
+// Call fn for each record, oldest first, while it returns true.
+func (ls *logSnap) each(fn func(d zx.Dir) bool) error {
+	for i := len(ls.fds) - 1; i >= 0; i-- {
+		recs := ls.logs[i]
+		last := recs[len(recs)-1]
+		r := bufio.NewReader(io.NewSectionReader(ls.fds[i], 0, last.off+int64(last.sz)))
+		for {
+			ln, err := r.ReadString('\n')
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			d, err := recDir(ls.file, ln)
+			if err != nil || d["seq"] == "" {
+				continue
+			}
+			if !fn(d) {
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+func (fs *auditFs) String() string {
+	return fs.Tag
+}
+
+// Only the server user may see the audit log.
+func (fs *auditFs) Auth(ai *auth.Info) (zx.Fs, error) {
+	if ai == nil || ai.Uid != u.Uid {
+		return nil, fmt.Errorf("audit: %s", zx.ErrPerm)
+	}
+	return fs, nil
+}
+
+func (fs *auditFs) dir(p string) (zx.Dir, error) {
+	p, err := zx.UseAbsPath(p)
+	if err != nil {
+		return nil, err
+	}
+	if p == "/" {
+		return fs.a.root(), nil
+	}
+	seq, err := strconv.ParseUint(p[1:], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", p, zx.ErrNotExist)
+	}
+	return fs.a.rec(seq)
+}
+
+func (fs *auditFs) Stat(p string) <-chan zx.Dir {
+	c := make(chan zx.Dir, 1)
+	d, err := fs.dir(p)
+	if err == nil {
+		c <- d
+	}
+	close(c, err)
+	return c
+}
+
+// Data for the record d: its log line.
+func recData(d zx.Dir) []byte {
+	nd := zx.Dir{}
+	for _, k := range []string{"seq", "mtime", "uid", "client", "tree",
+		"op", "file", "to", "result"} {
+		if v, ok := d[k]; ok {
+			nd[k] = v
+		}
+	}
+	return []byte(nd.String() + "\n")
+}
+
+func (fs *auditFs) Get(p string, off, count int64) <-chan []byte {
+	c := make(chan []byte)
+	go func() {
+		p, err := zx.UseAbsPath(p)
+		if err != nil {
+			close(c, err)
+			return
+		}
+		if p == "/" {
+			ls := fs.a.snap()
+			defer ls.close()
+			i := int64(0)
+			err := ls.each(func(d zx.Dir) bool {
+				if count != zx.All && i >= off+count {
+					return false
+				}
+				i++
+				if i <= off {
+					return true
+				}
+				ok := c <- d.Bytes()
+				return ok
+			})
+			close(c, err)
+			return
+		}
+		d, err := fs.dir(p)
+		if err != nil {
+			close(c, err)
+			return
+		}
+		dat := recData(d)
+		if off > int64(len(dat)) {
+			off = int64(len(dat))
+		}
+		dat = dat[off:]
+		if count != zx.All && count < int64(len(dat)) {
+			dat = dat[:count]
+		}
+		if len(dat) > 0 {
+			c <- dat
+		}
+		close(c)
+	}()
+	return c
+}
+
+func (fs *auditFs) find(p, fpred, spref, dpref string, depth0 int, c chan<- zx.Dir) error {
+	p, err := zx.UseAbsPath(p)
+	if err != nil {
+		return err
+	}
+	fp, err := pred.New(fpred)
+	if err != nil {
+		return err
+	}
+	if spref != "" || dpref != "" {
+		if spref, err = zx.UseAbsPath(spref); err != nil {
+			return err
+		}
+		if dpref, err = zx.UseAbsPath(dpref); err != nil {
+			return err
+		}
+	}
+	d, err := fs.dir(p)
+	if err != nil {
+		return err
+	}
+	// send d at the given level; return false to stop
+	send := func(d zx.Dir, lvl int) (bool, error) {
+		if spref != dpref {
+			suff := zx.Suffix(d["path"], spref)
+			if suff == "" {
+				return false, fmt.Errorf("suffix %s %s: %s", spref, d["path"], zx.ErrNotSuffix)
+			}
+			d["path"] = fpath.Join(dpref, suff)
+		}
+		match, pruned, err := fp.EvalAt(d, lvl)
+		if err != nil {
+			return false, err
+		}
+		if pruned && !match {
+			d["err"] = "pruned"
+		}
+		if pruned || match {
+			if ok := c <- d; !ok {
+				return false, cerror(c)
+			}
+		}
+		return !pruned || lvl > depth0, nil
+	}
+	more, err := send(d, depth0)
+	if err != nil || !more || p != "/" {
+		return err
+	}
+	ls := fs.a.snap()
+	defer ls.close()
+	xerr := ls.each(func(d zx.Dir) bool {
+		_, err = send(d, depth0+1)
+		return err == nil
+	})
+	if err == nil {
+		err = xerr
+	}
+	return err
+}
+
+func (fs *auditFs) Find(p, fpred, spref, dpref string, depth0 int) <-chan zx.Dir {
+	c := make(chan zx.Dir)
+	go func() {
+		close(c, fs.find(p, fpred, spref, dpref, depth0, c))
+	}()
+	return c
+}
+
+func (fs *auditFs) FindGet(p, fpred, spref, dpref string, depth0 int) <-chan face{} {
+	c := make(chan face{})
+	go func() {
+		dc := fs.Find(p, fpred, spref, dpref, depth0)
+		for d := range dc {
+			if ok := c <- d; !ok {
+				close(dc, cerror(c))
+				return
+			}
+			if d["err"] != "" || d["type"] != "-" {
+				continue
+			}
+			if ok := c <- recData(d); !ok {
+				close(dc, cerror(c))
+				return
+			}
+		}
+		close(c, cerror(dc))
+	}()
+	return c
+}
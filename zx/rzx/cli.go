@@ -11,6 +11,7 @@ import (
 	"sort"
 	"strings"
 	"sync"
+	"time"
 )
 
 // Remote zx client
@@ -21,12 +22,15 @@ struct Fs {
 	addr       string
 	raddr      string // addr used to cache dials
 	tc         *tls.Config
+	token      string // capability token used to auth, if any
 	ai         *auth.Info
 	trees      map[string]bool
 	fsys       string
 	m          *ch.Mux
 	closed     bool // mux is gone, can redial
+	shut       bool // closed by the user, don't redial
 	closewc    chan bool
+	invals     *invals
 	sync.Mutex // for redials
 }
 
@@ -37,9 +41,23 @@ func (d ddir) String() string {
 }
 
 var (
+	// Keep alive interval and timeout for connections to servers
+	// (see ch.Mux.KeepAlive); no keep alives are used if the interval is 0.
+	KeepAliveIval    = 30 * time.Second
+	KeepAliveTimeout = 90 * time.Second
+
+	// Number of times idempotent requests (stat, get, find) are retried
+	// when the connection is gone, and the delay before the first retry,
+	// doubled for each further one.
+	Retries    = 3
+	RetryDelay = 500 * time.Millisecond
+
 	dials   = map[string]*Fs{}
 	dialslk sync.Mutex
-	_fs     zx.FullFs = &Fs{}
+	_fs     zx.FullFs  = &Fs{}
+	_fs2    zx.Watcher = &Fs{}
+	_fs3    zx.Summer  = &Fs{}
+	_fs4    zx.Deltaer = &Fs{}
 )
 
 func (fs *Fs) String() string {
@@ -87,15 +105,32 @@ func splitaddr(addr string) (string, string) {
 // the caller might call Redial() to re-create the FS or
 // Close() to cease its operation.
 func Dial(addr string, tlscfg ...*tls.Config) (*Fs, error) {
+	return dial(addr, "", tlscfg...)
+}
+
+// Like Dial, but authenticates using the capability token given
+// (see auth.Cap) instead of the user keys.
+// Dials with different tokens are considered different dials.
+func DialCap(addr, token string, tlscfg ...*tls.Config) (*Fs, error) {
+	if token == "" {
+		return nil, fmt.Errorf("%s: no capability token", addr)
+	}
+	return dial(addr, token, tlscfg...)
+}
+
+func dial(addr, token string, tlscfg ...*tls.Config) (*Fs, error) {
 	var tc *tls.Config
 	if len(tlscfg) > 0 {
 		tc = tlscfg[0]
 	}
 	addr = FillAddr(addr)
-	if fs, ok := dialed(addr); ok {
+	raddr := addr
+	if token != "" {
+		raddr += "!" + token
+	}
+	if fs, ok := dialed(raddr); ok {
 		return fs, nil
 	}
-	raddr := addr
 	addr, fsys := splitaddr(addr)
 	fs := &Fs{
 		Flag:    &dbg.Flag{},
@@ -103,10 +138,12 @@ func Dial(addr string, tlscfg ...*tls.Config) (*Fs, error) {
 		addr:    addr,
 		raddr:   raddr,
 		tc:      tc,
+		token:   token,
 		trees:   map[string]bool{},
 		fsys:    fsys,
 		closed:  true, // not yet dialed
 		closewc: make(chan bool),
+		invals:  &invals{cs: map[chan string]string{}},
 	}
 	fs.Tag = "rfs"
 	fs.Flags.Add("debug", &fs.Debug)
@@ -120,27 +157,105 @@ func Dial(addr string, tlscfg ...*tls.Config) (*Fs, error) {
 // Dial again a previously dialed remote ZX FS.
 // If the file system is still dialed, the old connection is closed
 // and a new one created.
-// Upon network errors, the error strings contain "i/o errror" and
+// Requests redial on their own when the connection is gone (eg., when
+// the server does not answer keep alives), and idempotent ones are
+// retried (see Retries), but
+// upon network errors, the error strings contain "i/o errror" and
 // the caller might just redial the file system to try to continue
 // its operation, or Close() might be called instead.
 func (fs *Fs) Redial() error {
 	fs.Lock()
 	defer fs.Unlock()
-	if !fs.closed {
-		if fs.m != nil {
-			fs.m.Close()
-			<-fs.closewc
-		}
-		fs.ai = nil
-		fs.closed = true
-		fs.closewc = make(chan bool)
+	fs.shut = false
+	return fs.redial()
+}
+
+// Is the mux gone?
+func hungup(m *ch.Mux) bool {
+	if m == nil {
+		return true
+	}
+	select {
+	case <-m.Hup:
+		return true
+	default:
+		return false
+	}
+}
+
+// Return the mux to issue requests, redialing first if the connection
+// is gone and the fs was not closed by the user.
+func (fs *Fs) mux() (*ch.Mux, error) {
+	fs.Lock()
+	defer fs.Unlock()
+	if fs.shut || (!fs.closed && !hungup(fs.m)) {
+		return fs.m, nil
+	}
+	fs.Dprintf("redial %s\n", fs.addr)
+	if err := fs.redial(); err != nil {
+		return nil, err
+	}
+	return fs.m, nil
+}
+
+// Start a rpc, redialing first if needed.
+// If we can't redial, the conn returned is closed with the error.
+func (fs *Fs) rpc() (*ch.Mux, ch.Conn) {
+	m, err := fs.mux()
+	if err != nil {
+		in := make(chan face{})
+		out := make(chan face{})
+		close(in, err)
+		close(out, err)
+		return nil, ch.Conn{Tag: fs.Tag, In: in, Out: out}
+	}
+	return m, m.Rpc()
+}
+
+// A request using m failed with err for the ntry-th time.
+// Report if it should be retried, waiting before doing so.
+// Only requests failing because the connection is gone are retried.
+func (fs *Fs) retry(m *ch.Mux, ntry int, err error) bool {
+	if err == nil || ntry >= Retries {
+		return false
+	}
+	fs.Lock()
+	shut := fs.shut
+	fs.Unlock()
+	s := err.Error()
+	if shut || (!hungup(m) && !strings.Contains(s, ch.ErrIO.Error()) &&
+		!strings.Contains(s, "mux closed")) {
+		return false
+	}
+	fs.Dprintf("retry: %s\n", err)
+	time.Sleep(RetryDelay << uint(ntry))
+	return true
+}
+
+// fs is locked.
+func (fs *Fs) redial() error {
+	if !fs.closed && fs.m != nil {
+		closewc := fs.closewc
+		fs.m.Close()
+		<-closewc
 	}
-	m, err := net.MuxDial(fs.addr, fs.tc)
+	fs.ai = nil
+	fs.closed = true
+	fs.closewc = make(chan bool)
+	m, err := net.MuxDialIn(fs.addr, fs.tc)
 	if err != nil {
 		return err
 	}
+	if KeepAliveIval > 0 {
+		m.KeepAlive(KeepAliveIval, KeepAliveTimeout)
+	}
 	call := m.Rpc()
-	ai, err := auth.AtClient(call, "", "zx")
+	var ai *auth.Info
+	if fs.token != "" {
+		ai, err = auth.CapAtClient(call, "", fs.token, "zx")
+	} else {
+		ai, err = auth.AtClient(call, "", "zx")
+	}
 	if err != nil {
 		if !strings.Contains(err.Error(), "auth disabled") {
 			m.Close()
@@ -164,25 +279,44 @@ func (fs *Fs) Redial() error {
 	fs.ai = ai
 	fs.m = m
 	fs.closed = false
+	go fs.srvreqs(m)
 	dialslk.Lock()
 	dials[fs.raddr] = fs
 	dialslk.Unlock()
 	closewc := fs.closewc
 	go func() {
 		<-m.Hup
+		close(closewc)
 		fs.Lock()
-		fs.closed = true
+		if fs.m == m {
+			fs.closed = true
+		}
+		shut := fs.shut
 		fs.Unlock()
-		dialslk.Lock()
-		delete(dials, fs.raddr)
-		dialslk.Unlock()
-		close(closewc)
+		if shut {
+			dialslk.Lock()
+			if dials[fs.raddr] == fs {
+				delete(dials, fs.raddr)
+			}
+			dialslk.Unlock()
+		}
 	}()
 	return nil
 }
 
 func (fs *Fs) Close() error {
-	fs.m.Close()
+	fs.Lock()
+	fs.shut = true
+	m := fs.m
+	fs.Unlock()
+	if m != nil {
+		m.Close()
+	}
+	dialslk.Lock()
+	if dials[fs.raddr] == fs {
+		delete(dials, fs.raddr)
+	}
+	dialslk.Unlock()
 	return nil
 }
 
@@ -229,53 +363,72 @@ func (fs *Fs) Fsys(name string) (*Fs, error) {
 	return nil, fmt.Errorf("no fsys '%s'", name)
 }
 
-func (fs *Fs) dircall(p string, m *Msg) chan zx.Dir {
+// Issue a request replying with a dir.
+// If idem, the request is retried if the connection is gone.
+func (fs *Fs) dircall(m *Msg, idem bool) chan zx.Dir {
 	rc := make(chan zx.Dir, 1)
 	go func() {
-		c := fs.m.Rpc()
-		fs.Dprintf("->%s\n", m)
-		if ok := c.Out <- m; !ok {
-			err := cerror(c.Out)
-			close(c.In, err)
-			return
-		}
-		close(c.Out)
-		m := <-c.In
-		err := cerror(c.In)
-		if err == nil {
-			if d, ok := m.(zx.Dir); ok {
-				fs.Dprintf("<-%s\n", ddir(d))
+		for ntry := 0; ; ntry++ {
+			mx, d, err := fs.dircall1(m)
+			if idem && fs.retry(mx, ntry, err) {
+				continue
+			}
+			if d != nil {
 				rc <- d
-			} else {
-				err = ErrBadMsg
 			}
-		} else {
-			fs.Dprintf("<-%v\n", err)
+			close(rc, err)
+			break
 		}
-		close(rc, err)
-		close(c.In, err)
 	}()
 	return rc
 }
 
+func (fs *Fs) dircall1(m *Msg) (*ch.Mux, zx.Dir, error) {
+	mx, c := fs.rpc()
+	fs.Dprintf("->%s\n", m)
+	if ok := c.Out <- m; !ok {
+		err := cerror(c.Out)
+		close(c.In, err)
+		return mx, nil, err
+	}
+	close(c.Out)
+	x := <-c.In
+	err := cerror(c.In)
+	var d zx.Dir
+	if err == nil {
+		var ok bool
+		if d, ok = x.(zx.Dir); ok {
+			fs.Dprintf("<-%s\n", ddir(d))
+		} else {
+			err = ErrBadMsg
+		}
+	} else {
+		fs.Dprintf("<-%v\n", err)
+	}
+	close(c.In, err)
+	return mx, d, err
+}
+
 func (fs *Fs) Stat(p string) <-chan zx.Dir {
 	m := &Msg{Op: Tstat, Fsys: fs.fsys, Path: p}
-	return fs.dircall(p, m)
+	return fs.dircall(m, true)
 }
 
 func (fs *Fs) Wstat(p string, d zx.Dir) <-chan zx.Dir {
 	m := &Msg{Op: Twstat, Fsys: fs.fsys, Path: p, D: d.Dup()}
-	return fs.dircall(p, m)
+	return fs.dircall(m, false)
 }
 
 func (fs *Fs) errcall(m *Msg) chan error {
 	rc := make(chan error, 1)
 	go func() {
-		c := fs.m.Rpc()
+		_, c := fs.rpc()
 		fs.Dprintf("->%s\n", m)
 		if ok := c.Out <- m; !ok {
 			err := cerror(c.Out)
 			close(c.In, err)
+			rc <- err
+			close(rc, err)
 			return
 		}
 		close(c.Out)
@@ -313,50 +466,129 @@ func (fs *Fs) Link(oldp, newp string) <-chan error {
 	return fs.errcall(m)
 }
 
+// If the connection is gone, the get is retried for the data not
+// yet received.
+// Directory gets are restarted and the entries already received skipped;
+// file gets are resumed only if the file did not change, and fail otherwise.
+// The server sends the dir for the file before its data, which is compared
+// with a new stat of the file when resuming.
 func (fs *Fs) Get(p string, off, count int64) <-chan []byte {
+	m := &Msg{Op: Tget, Fsys: fs.fsys, Path: p, Off: off, Count: count}
+	return fs.bytescall(m, true)
+}
+
+// See zx.Summer.
+// If the server's tree is not a zx.Summer, the server computes the sums.
+func (fs *Fs) Sums(p string, blksz int64) <-chan []byte {
+	m := &Msg{Op: Tsums, Fsys: fs.fsys, Path: p, Count: blksz}
+	return fs.bytescall(m, false)
+}
+
+// Issue a request replying with []bytes
+// If isget and the connection is gone, the request is retried
+// for the data not yet received (see Get).
+func (fs *Fs) bytescall(m *Msg, isget bool) <-chan []byte {
 	rc := make(chan []byte, 1)
 	go func() {
-		c := fs.m.Rpc()
-		m := &Msg{Op: Tget, Fsys: fs.fsys, Path: p, Off: off, Count: count}
-		fs.Dprintf("->%s\n", m)
-		if ok := c.Out <- m; !ok {
-			err := cerror(c.Out)
-			close(c.In, err)
-			return
+		m := *m
+		var d zx.Dir // as first seen by the get
+		var dp *zx.Dir
+		if isget {
+			dp = &d
 		}
-		close(c.Out)
-		for m := range c.In {
-			m, ok := m.([]byte)
-			if !ok {
-				fs.Dprintf("<- %v\n", m)
-				err := ErrBadMsg
-				close(c.In, err)
-				close(rc, err)
+		skip := 0 // dir entries already sent
+		for ntry := 0; ; ntry++ {
+			mx, n, nmsgs, gone, err := fs.bytescall1(&m, dp, skip, rc)
+			if gone {
 				break
-			} else {
-				if fs.Verb {
-					fs.Dprintf("<- [%d]bytes\n", len(m))
+			}
+			if isget && (n == 0 || m.Off >= 0) && fs.retry(mx, ntry, err) {
+				if n == 0 {
+					continue
 				}
-				if ok := rc <- m; !ok {
-					close(c.In, cerror(rc))
-					break
+				if d["type"] == "d" {
+					// offsets and counts are entries
+					skip += nmsgs
+					continue
+				}
+				nd, serr := zx.Stat(fs, m.Path)
+				if d != nil && serr == nil && d["type"] == nd["type"] &&
+					d["mtime"] == nd["mtime"] && d["size"] == nd["size"] {
+					m.Off += n
+					if m.Count != zx.All {
+						m.Count -= n
+					}
+					continue
 				}
+				err = fmt.Errorf("%s: changed or gone while getting: %s", m.Path, err)
 			}
+			close(rc, err)
+			break
 		}
-		err := cerror(c.In)
-		if err != nil {
-			fs.Dprintf("<-%s\n", err)
-		}
-		close(rc, err)
 	}()
 	return rc
 }
 
+// Issue the request sending the reply to rc, but for the first skip messages,
+// and return the number of bytes and messages sent.
+// If dp is not nil, the reply starts with the dir for the file, kept
+// at dp unless it has one already.
+// gone is set if rc was closed by the receiver.
+func (fs *Fs) bytescall1(m *Msg, dp *zx.Dir, skip int, rc chan []byte) (mx *ch.Mux, n int64, nmsgs int, gone bool, err error) {
+	mx, c := fs.rpc()
+	fs.Dprintf("->%s\n", m)
+	if ok := c.Out <- m; !ok {
+		err := cerror(c.Out)
+		close(c.In, err)
+		return mx, 0, 0, false, err
+	}
+	close(c.Out)
+	for m := range c.In {
+		m, ok := m.([]byte)
+		if !ok {
+			fs.Dprintf("<- %v\n", m)
+			err := ErrBadMsg
+			close(c.In, err)
+			return mx, n, nmsgs, false, err
+		}
+		if fs.Verb {
+			fs.Dprintf("<- [%d]bytes\n", len(m))
+		}
+		if dp != nil {
+			_, d, err := zx.UnpackDir(m)
+			if err != nil {
+				close(c.In, err)
+				return mx, n, nmsgs, false, err
+			}
+			if *dp == nil {
+				*dp = d
+			}
+			dp = nil
+			continue
+		}
+		if skip > 0 {
+			skip--
+			continue
+		}
+		if ok := rc <- m; !ok {
+			mx.Cancel(c, cerror(rc))
+			return mx, n, nmsgs, true, nil
+		}
+		n += int64(len(m))
+		nmsgs++
+	}
+	err = cerror(c.In)
+	if err != nil {
+		fs.Dprintf("<-%s\n", err)
+	}
+	return mx, n, nmsgs, false, err
+}
+
 func (fs *Fs) Put(p string, d zx.Dir, off int64, dc <-chan []byte) <-chan zx.Dir {
 	rc := make(chan zx.Dir, 1)
 	d = d.Dup()
 	go func() {
-		c := fs.m.Rpc()
+		_, c := fs.rpc()
 		if dc == nil || d["type"] == "d" {
 			dc = make(chan []byte)
 			close(dc)
@@ -365,7 +597,9 @@ func (fs *Fs) Put(p string, d zx.Dir, off int64, dc <-chan []byte) <-chan zx.Dir
 		fs.Dprintf("->%s\n", m)
 		if ok := c.Out <- m; !ok {
 			err := cerror(c.Out)
+			close(dc, err)
 			close(c.In, err)
+			close(rc, err)
 			return
 		}
 		if d["type"] == "d" {
@@ -412,17 +646,221 @@ func (fs *Fs) Put(p string, d zx.Dir, off int64, dc <-chan []byte) <-chan zx.Dir
 	return rc
 }
 
+// See zx.Deltaer.
+// If the server's tree is not a zx.Deltaer, the server computes the deltas.
+func (fs *Fs) DeltaGet(p string, blksz int64, sums [][]byte) <-chan face{} {
+	rc := make(chan face{})
+	go func() {
+		m := &Msg{Op: Tdget, Fsys: fs.fsys, Path: p, Count: blksz}
+		mx, c := fs.rpc()
+		fs.Dprintf("->%s\n", m)
+		if ok := c.Out <- m; !ok {
+			err := cerror(c.Out)
+			close(c.In, err)
+			close(rc, err)
+			return
+		}
+		for _, sum := range sums {
+			if ok := c.Out <- sum; !ok {
+				err := cerror(c.Out)
+				close(c.In, err)
+				close(rc, err)
+				return
+			}
+		}
+		close(c.Out)
+		for x := range c.In {
+			ok := false
+			switch x := x.(type) {
+			case zx.Dir:
+				fs.Dprintf("<-%s\n", ddir(x))
+				ok = rc <- x
+			case []byte:
+				dl, err := zx.UnpackDelta(x)
+				if err != nil {
+					close(c.In, err)
+					close(rc, err)
+					return
+				}
+				if fs.Verb {
+					fs.Dprintf("<-%s\n", dl)
+				}
+				ok = rc <- dl
+			default:
+				err := ErrBadMsg
+				close(c.In, err)
+				close(rc, err)
+				return
+			}
+			if !ok {
+				mx.Cancel(c, cerror(rc))
+				break
+			}
+		}
+		err := cerror(c.In)
+		if err != nil {
+			fs.Dprintf("<-%s\n", err)
+		}
+		close(rc, err)
+	}()
+	return rc
+}
+
+// See zx.Deltaer.
+// The server sends the sums for its blocks, ending with an empty
+// message, and we send the deltas and wait for the resulting dir.
+func (fs *Fs) DeltaPut(p string, d zx.Dir, blksz int64, dc <-chan []byte) <-chan zx.Dir {
+	rc := make(chan zx.Dir, 1)
+	d = d.Dup()
+	go func() {
+		if dc == nil {
+			dc = make(chan []byte)
+			close(dc)
+		}
+		rd, err := fs.deltaPut(p, d, blksz, dc)
+		if err != nil {
+			fs.Dprintf("<-%s\n", err)
+			close(dc, err)
+		} else {
+			fs.Dprintf("<-%s\n", ddir(rd))
+			rc <- rd
+		}
+		close(rc, err)
+	}()
+	return rc
+}
+
+func (fs *Fs) deltaPut(p string, d zx.Dir, blksz int64, dc <-chan []byte) (zx.Dir, error) {
+	_, c := fs.rpc()
+	m := &Msg{Op: Tdput, Fsys: fs.fsys, Path: p, D: d, Count: blksz}
+	fs.Dprintf("->%s\n", m)
+	if ok := c.Out <- m; !ok {
+		err := cerror(c.Out)
+		close(c.In, err)
+		return nil, err
+	}
+	var sums [][]byte
+	insums := true
+	for insums {
+		x, ok := <-c.In
+		if !ok {
+			err := cerror(c.In)
+			if err == nil {
+				err = ErrBadMsg
+			}
+			close(c.Out, err)
+			return nil, err
+		}
+		sum, ok := x.([]byte)
+		if !ok {
+			err := ErrBadMsg
+			close(c.In, err)
+			close(c.Out, err)
+			return nil, err
+		}
+		if insums = len(sum) > 0; insums {
+			sums = append(sums, sum)
+		}
+	}
+	fs.Dprintf("<- %d sums\n", len(sums))
+	xc := make(chan zx.Delta)
+	go func() {
+		close(xc, zx.Deltas(dc, blksz, sums, xc))
+	}()
+	for dl := range xc {
+		if fs.Verb {
+			fs.Dprintf("->%s\n", dl)
+		}
+		if ok := c.Out <- dl.Bytes(); !ok {
+			err := cerror(c.Out)
+			close(xc, err)
+			close(c.In, err)
+			return nil, err
+		}
+	}
+	err := cerror(xc)
+	close(c.Out, err)
+	if err != nil {
+		close(c.In, err)
+		return nil, err
+	}
+	x := <-c.In
+	if err := cerror(c.In); err != nil {
+		return nil, err
+	}
+	rd, ok := x.(zx.Dir)
+	if !ok {
+		err := ErrBadMsg
+		close(c.In, err)
+		return nil, err
+	}
+	close(c.In)
+	return rd, nil
+}
+
+// If the connection is gone before any dir is received, the find is retried.
 func (fs *Fs) Find(p, fpred, spref, dpref string, depth0 int) <-chan zx.Dir {
 	rc := make(chan zx.Dir)
 	go func() {
 		m := &Msg{Op: Tfind, Fsys: fs.fsys, Path: p,
 			Pred: fpred, Spref: spref, Dpref: dpref, Depth: depth0,
 		}
-		c := fs.m.Rpc()
+		for ntry := 0; ; ntry++ {
+			mx, n, err := fs.find(m, rc)
+			if n == 0 && fs.retry(mx, ntry, err) {
+				continue
+			}
+			close(rc, err)
+			break
+		}
+	}()
+	return rc
+}
+
+// Issue a find sending the reply to rc and return the number of dirs sent.
+func (fs *Fs) find(m *Msg, rc chan zx.Dir) (*ch.Mux, int, error) {
+	mx, c := fs.rpc()
+	fs.Dprintf("->%s\n", m)
+	if ok := c.Out <- m; !ok {
+		err := cerror(c.Out)
+		close(c.In, err)
+		return mx, 0, err
+	}
+	close(c.Out)
+	n := 0
+	for m := range c.In {
+		d, ok := m.(zx.Dir)
+		if !ok {
+			err := ErrBadMsg
+			close(c.In, err)
+			return mx, n, err
+		}
+		fs.Dprintf("<-%s\n", ddir(d))
+		if ok := rc <- d; !ok {
+			mx.Cancel(c, cerror(rc))
+			return mx, n + 1, nil
+		}
+		n++
+	}
+	err := cerror(c.In)
+	if err != nil {
+		fs.Dprintf("<-%s\n", err)
+	}
+	return mx, n, err
+}
+
+// See zx.Watcher.
+// The server must be serving a tree that is a zx.Watcher.
+func (fs *Fs) Watch(p, fpred string) <-chan zx.Dir {
+	rc := make(chan zx.Dir)
+	go func() {
+		m := &Msg{Op: Twatch, Fsys: fs.fsys, Path: p, Pred: fpred}
+		mx, c := fs.rpc()
 		fs.Dprintf("->%s\n", m)
 		if ok := c.Out <- m; !ok {
 			err := cerror(c.Out)
 			close(c.In, err)
+			close(rc, err)
 			return
 		}
 		close(c.Out)
@@ -435,7 +873,7 @@ func (fs *Fs) Find(p, fpred, spref, dpref string, depth0 int) <-chan zx.Dir {
 			} else {
 				fs.Dprintf("<-%s\n", ddir(m))
 				if ok := rc <- m; !ok {
-					close(c.In, cerror(rc))
+					mx.Cancel(c, cerror(rc))
 					break
 				}
 			}
@@ -455,7 +893,7 @@ func (fs *Fs) FindGet(p, fpred, spref, dpref string, depth0 int) <-chan face{} {
 		m := &Msg{Op: Tfindget, Fsys: fs.fsys, Path: p,
 			Pred: fpred, Spref: spref, Dpref: dpref, Depth: depth0,
 		}
-		c := fs.m.Rpc()
+		mx, c := fs.rpc()
 		fs.Dprintf("->%s\n", m)
 		if ok := c.Out <- m; !ok {
 			err := cerror(c.Out)
@@ -465,7 +903,7 @@ func (fs *Fs) FindGet(p, fpred, spref, dpref string, depth0 int) <-chan face{} {
 		close(c.Out)
 		for m := range c.In {
 			if ok := rc <- m; !ok {
-				close(c.In, cerror(rc))
+				mx.Cancel(c, cerror(rc))
 				break
 			}
 		}
@@ -0,0 +1,154 @@
+package rzx
+
+import (
+	"clive/ch"
+	"clive/zx"
+	fpath "path"
+	"sync"
+)
+
+// Files each client mux has statted or fetched.
+// When a client changes a file, Tinval messages are sent to other
+// clients interested in the file (or its parent directory), and
+// their interest is dropped until they stat or fetch the file again.
+struct cbacks {
+	sync.Mutex
+	muxes map[*ch.Mux]map[string]bool // fsys!path
+}
+
+// Invalidation subscribers for a client (shared by all its fsys views)
+struct invals {
+	sync.Mutex
+	cs map[chan string]string // chan to fsys
+}
+
+// Nb. of buffered invalidations for each subscriber
+var nbufInval = 64
+
+func cbkey(fsys, p string) string {
+	return fsys + "!" + fpath.Clean(p)
+}
+
+func (cb *cbacks) want(mx *ch.Mux, fsys, p string) {
+	if mx == nil {
+		return
+	}
+	cb.Lock()
+	defer cb.Unlock()
+	ps := cb.muxes[mx]
+	if ps == nil {
+		ps = map[string]bool{}
+		cb.muxes[mx] = ps
+	}
+	ps[cbkey(fsys, p)] = true
+}
+
+func (cb *cbacks) del(mx *ch.Mux) {
+	cb.Lock()
+	delete(cb.muxes, mx)
+	cb.Unlock()
+}
+
+// The files at paths were changed through mx; tell other clients.
+func (cb *cbacks) changed(mx *ch.Mux, fsys string, paths ...string) {
+	var ks []string
+	for _, p := range paths {
+		if p == "" {
+			continue
+		}
+		ks = append(ks, cbkey(fsys, p), cbkey(fsys, fpath.Dir(p)))
+	}
+	cb.Lock()
+	defer cb.Unlock()
+	for omx, ps := range cb.muxes {
+		if omx == mx {
+			continue
+		}
+		var ims []*Msg
+		for _, k := range ks {
+			if ps[k] {
+				delete(ps, k)
+				ims = append(ims, &Msg{Op: Tinval, Fsys: fsys, Path: k[len(fsys)+1:]})
+			}
+		}
+		if len(ims) > 0 {
+			go sendInvals(omx, ims)
+		}
+	}
+}
+
+func sendInvals(mx *ch.Mux, ims []*Msg) {
+	c := mx.Out()
+	for _, m := range ims {
+		if ok := c.Out <- m; !ok {
+			return
+		}
+	}
+	close(c.Out)
+}
+
+// Record the interest of the client in the file or
+// report changes made by the client after a request.
+func (s *Server) callbacks(m *Msg) {
+	switch m.Op {
+	case Tstat, Tget, Tdget:
+		s.cbs.want(s.mx, m.Fsys, m.Path)
+	case Tput, Tdput, Twstat, Tremove, Tremoveall:
+		s.cbs.changed(s.mx, m.Fsys, m.Path)
+	case Tmove, Tlink:
+		s.cbs.changed(s.mx, m.Fsys, m.Path, m.To)
+	}
+}
+
+// Return a chan to receive the paths for files in this tree
+// changed by other clients of the server after we statted or fetched them.
+// The chan is kept across redials, and ceases when the caller closes it.
+// Invalidations are never waited for: if the reader falls behind they are
+// dropped and an empty path is sent instead, meaning any file may have changed.
+func (fs *Fs) Invals() <-chan string {
+	c := make(chan string, nbufInval)
+	fs.invals.Lock()
+	fs.invals.cs[c] = fs.fsys
+	fs.invals.Unlock()
+	return c
+}
+
+// Send the invalidation to the subscribers.
+// It never blocks, so requests from the server are not held by a slow reader.
+func (iv *invals) post(m *Msg) {
+	iv.Lock()
+	defer iv.Unlock()
+	for c, fsys := range iv.cs {
+		if fsys != m.Fsys {
+			continue
+		}
+		// The last slot is kept to report lost invalidations.
+		// We hold the lock, so a free slot can't go away.
+		p := m.Path
+		if len(c) >= cap(c)-1 {
+			if len(c) == cap(c) {
+				continue
+			}
+			p = ""
+		}
+		if ok := c <- p; !ok {
+			delete(iv.cs, c)
+		}
+	}
+}
+
+// Process requests sent by the server to the client.
+// Only invalidations are expected.
+func (fs *Fs) srvreqs(mx *ch.Mux) {
+	for c := range mx.In {
+		for x := range c.In {
+			if m, ok := x.(*Msg); ok && m.Op == Tinval {
+				fs.Dprintf("<-%s\n", m)
+				fs.invals.post(m)
+			}
+		}
+		if c.Out != nil {
+			close(c.Out, zx.ErrBug)
+		}
+	}
+}
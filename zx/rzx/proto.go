@@ -25,6 +25,11 @@ const (
 	Twstat
 	Tfind
 	Tfindget
+	Twatch
+	Tinval // sent by the server to clients
+	Tsums
+	Tdget
+	Tdput
 	Tend
 	Tmin = Ttrees
 )
@@ -34,10 +39,10 @@ struct Msg {
 	Fsys  string // All requests
 	Path  string // All requests
 	Off   int64  // Get, Put
-	Count int64  // Get
-	D     zx.Dir // Put, Wstat
+	Count int64  // Get, Sums, Dget, Dput (block size)
+	D     zx.Dir // Put, Wstat, Dput
 	To    string // Move, Liink
-	Pred  string // Find, Findget
+	Pred  string // Find, Findget, Watch
 	Spref string // Find, Findget
 	Dpref string // Find, Findget
 	Depth int    // Find, Findget
@@ -73,6 +78,16 @@ func (o MsgId) String() string {
 		return "Tfindget"
 	case Twstat:
 		return "Twstat"
+	case Twatch:
+		return "Twatch"
+	case Tinval:
+		return "Tinval"
+	case Tsums:
+		return "Tsums"
+	case Tdget:
+		return "Tdget"
+	case Tdput:
+		return "Tdput"
 	default:
 		return fmt.Sprintf("Tunknown<%d>", o)
 	}
@@ -109,13 +124,13 @@ func (m *Msg) WriteTo(w io.Writer) (n int64, err error) {
 		}
 		n += 8
 	}
-	if m.Op == Tget {
+	if m.Op == Tget || m.Op == Tsums || m.Op == Tdget || m.Op == Tdput {
 		if err = binary.Write(w, binary.LittleEndian, uint64(m.Count)); err != nil {
 			return n, err
 		}
 		n += 8
 	}
-	if m.Op == Tput || m.Op == Twstat {
+	if m.Op == Tput || m.Op == Twstat || m.Op == Tdput {
 		nw, err = m.D.WriteTo(w)
 		n += nw
 		if err != nil {
@@ -129,7 +144,7 @@ func (m *Msg) WriteTo(w io.Writer) (n int64, err error) {
 			return n, err
 		}
 	}
-	if m.Op == Tfind || m.Op == Tfindget {
+	if m.Op == Tfind || m.Op == Tfindget || m.Op == Twatch {
 		nw, err = ch.WriteStringTo(w, m.Pred)
 		n += nw
 		if err != nil {
@@ -168,16 +183,16 @@ func (m *Msg) String() string {
 	if m.Op == Tget || m.Op == Tput {
 		fmt.Fprintf(&buf, " off %d", m.Off)
 	}
-	if m.Op == Tget {
+	if m.Op == Tget || m.Op == Tsums || m.Op == Tdget || m.Op == Tdput {
 		fmt.Fprintf(&buf, " count %d", m.Count)
 	}
-	if m.Op == Tput || m.Op == Twstat {
+	if m.Op == Tput || m.Op == Twstat || m.Op == Tdput {
 		fmt.Fprintf(&buf, " d <%s> ", m.D)
 	}
 	if m.Op == Tmove || m.Op == Tlink {
 		fmt.Fprintf(&buf, " to '%s'", m.To)
 	}
-	if m.Op == Tfind || m.Op == Tfindget {
+	if m.Op == Tfind || m.Op == Tfindget || m.Op == Twatch {
 		fmt.Fprintf(&buf, " pred '%s'", m.Pred)
 	}
 	if m.Op == Tfind || m.Op == Tfindget {
@@ -217,14 +232,14 @@ func UnpackMsg(buf []byte) ([]byte, *Msg, error) {
 		m.Off = int64(binary.LittleEndian.Uint64(buf[0:]))
 		buf = buf[8:]
 	}
-	if m.Op == Tget {
+	if m.Op == Tget || m.Op == Tsums || m.Op == Tdget || m.Op == Tdput {
 		if len(buf) < 8 {
 			return buf, nil, ch.ErrTooSmall
 		}
 		m.Count = int64(binary.LittleEndian.Uint64(buf[0:]))
 		buf = buf[8:]
 	}
-	if m.Op == Tput || m.Op == Twstat {
+	if m.Op == Tput || m.Op == Twstat || m.Op == Tdput {
 		buf, m.D, err = zx.UnpackDir(buf)
 		if err != nil {
 			return buf, nil, err
@@ -236,7 +251,7 @@ func UnpackMsg(buf []byte) ([]byte, *Msg, error) {
 			return buf, nil, err
 		}
 	}
-	if m.Op == Tfind || m.Op == Tfindget {
+	if m.Op == Tfind || m.Op == Tfindget || m.Op == Twatch {
 		buf, m.Pred, err = ch.UnpackString(buf)
 		if err != nil {
 			return buf, nil, err
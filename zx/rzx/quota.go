@@ -0,0 +1,414 @@
+package rzx
+
+import (
+	"bytes"
+	"clive/ch"
+	"clive/u"
+	"clive/zx"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limits for a tree or for a user of a tree.
+// A limit of 0 means there is no limit.
+struct limits {
+	storage int64 // bytes stored
+	rpcs    int64 // in-flight requests
+	bw      int64 // bytes per second
+}
+
+struct quota {
+	limits
+	set  bool      // limits set by a ctl, not inherited from "*"
+	nrpc int64     // in-flight requests
+	next time.Time // when the bandwidth allows more transfers
+}
+
+// Quotas for a served tree and its users, set using ctl requests
+//	quota tree storage|rpcs|bw value
+//	quota user uid storage|rpcs|bw value
+// where a uid "*" sets the limits for users without their own ones,
+// a value 0 removes the limit, and values may have k, m or g suffixes.
+// Storage is the size of files owned by the user (or the tree) when the
+// first storage limit is set, updated as users write and remove files.
+// Files are always charged to their owner, and new files to their creator.
+// The server user can set quotas; other users get permission errors.
+struct quotas {
+	sync.Mutex
+	name  string
+	fs    zx.Fs
+	tree  quota
+	users map[string]*quota // "*" has the limits for other users
+	du    map[string]int64  // storage by uid, if we track it
+	total int64             // storage for the tree, if we track it
+}
+
+var units = map[byte]int64{
+	'k': 1024,
+	'K': 1024,
+	'm': 1024 * 1024,
+	'M': 1024 * 1024,
+	'g': 1024 * 1024 * 1024,
+	'G': 1024 * 1024 * 1024,
+}
+
+func newQuotas(name string, fs zx.Fs) *quotas {
+	return &quotas{
+		name:  name,
+		fs:    fs,
+		users: map[string]*quota{"*": &quota{set: true}},
+	}
+}
+
+func qerror(who, what string) error {
+	return fmt.Errorf("%s: %s: %s", who, what, zx.ErrQuota)
+}
+
+func qvalue(s string) (int64, error) {
+	x := int64(1)
+	v := s
+	if n := len(v); n > 1 && units[v[n-1]] != 0 {
+		x = units[v[n-1]]
+		v = v[:n-1]
+	}
+	n, err := strconv.ParseInt(v, 0, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("bad quota value '%s'", s)
+	}
+	return n * x, nil
+}
+
+// uid's quota; q is locked.
+func (q *quotas) user(uid string) *quota {
+	if uq := q.users[uid]; uq != nil {
+		return uq
+	}
+	uq := &quota{limits: q.users["*"].limits}
+	q.users[uid] = uq
+	return uq
+}
+
+// Ctl flag handler; args are "quota" and the ctl arguments.
+func (q *quotas) ctl(args ...string) error {
+	mustscan, err := q.set(args...)
+	if err != nil || !mustscan {
+		return err
+	}
+	return q.scan()
+}
+
+// Set the quota for the ctl and return true if storage must be scanned.
+func (q *quotas) set(args ...string) (bool, error) {
+	usage := errors.New("usage: quota tree|user uid storage|rpcs|bw value")
+	if len(args) > 0 && args[0] == "quota" {
+		args = args[1:]
+	}
+	if len(args) < 3 {
+		return false, usage
+	}
+	q.Lock()
+	defer q.Unlock()
+	var qt *quota
+	switch args[0] {
+	case "tree":
+		qt = &q.tree
+		args = args[1:]
+	case "user":
+		if len(args) != 4 {
+			return false, usage
+		}
+		qt = q.user(args[1])
+		qt.set = true
+		args = args[2:]
+	default:
+		return false, usage
+	}
+	if len(args) != 2 {
+		return false, usage
+	}
+	v, err := qvalue(args[1])
+	if err != nil {
+		return false, err
+	}
+	mustscan := false
+	switch args[0] {
+	case "storage":
+		qt.storage = v
+		mustscan = v > 0 && q.du == nil
+	case "rpcs":
+		qt.rpcs = v
+	case "bw":
+		qt.bw = v
+	default:
+		return false, usage
+	}
+	if qt == q.users["*"] {
+		for _, uq := range q.users {
+			if !uq.set {
+				uq.limits = qt.limits
+			}
+		}
+	}
+	return mustscan, nil
+}
+
+// Compute the storage used by each uid in the tree, unless known.
+// Requests are not held while the tree is scanned.
+func (q *quotas) scan() error {
+	du, total, err := diskUsage(q.fs, "/")
+	if err != nil {
+		return fmt.Errorf("%s: quota: %s", q.name, err)
+	}
+	q.Lock()
+	defer q.Unlock()
+	if q.du == nil {
+		q.du, q.total = du, total
+	}
+	return nil
+}
+
+// Storage used by files at p, by uid and in total.
+func diskUsage(fs zx.Fs, p string) (map[string]int64, int64, error) {
+	du := map[string]int64{}
+	total := int64(0)
+	xfs, ok := fs.(zx.Finder)
+	if !ok {
+		return du, 0, nil
+	}
+	dc := xfs.Find(p, "", "", "", 0)
+	for d := range dc {
+		if d["type"] != "-" || d["err"] != "" {
+			continue
+		}
+		sz := d.Size()
+		du[d["uid"]] += sz
+		total += sz
+	}
+	return du, total, cerror(dc)
+}
+
+func (qt *quota) String() string {
+	var buf bytes.Buffer
+	names := []string{"storage", "rpcs", "bw"}
+	for i, v := range []int64{qt.storage, qt.rpcs, qt.bw} {
+		if v > 0 {
+			fmt.Fprintf(&buf, " %s %d", names[i], v)
+		}
+	}
+	if buf.Len() == 0 {
+		return " none"
+	}
+	return buf.String()
+}
+
+func (q *quotas) String() string {
+	q.Lock()
+	defer q.Unlock()
+	out := []string{}
+	s := fmt.Sprintf("tree%s rpcs %d", &q.tree, q.tree.nrpc)
+	if q.du != nil {
+		s += fmt.Sprintf(" used %d", q.total)
+	}
+	out = append(out, s)
+	uids := []string{}
+	for uid := range q.users {
+		uids = append(uids, uid)
+	}
+	sort.Sort(sort.StringSlice(uids))
+	for _, uid := range uids {
+		uq := q.users[uid]
+		if !uq.set && uq.nrpc == 0 {
+			continue
+		}
+		s := fmt.Sprintf("user %s%s", uid, uq)
+		if uid != "*" {
+			s += fmt.Sprintf(" rpcs %d", uq.nrpc)
+			if q.du != nil {
+				s += fmt.Sprintf(" used %d", q.du[uid])
+			}
+		}
+		out = append(out, s)
+	}
+	return strings.Join(out, "\nquotas ")
+}
+
+// Start a request for uid, or fail if there are too many.
+func (q *quotas) start(uid string) error {
+	q.Lock()
+	defer q.Unlock()
+	uq := q.user(uid)
+	if uq.rpcs > 0 && uq.nrpc >= uq.rpcs {
+		return qerror("user "+uid, "rpcs")
+	}
+	if q.tree.rpcs > 0 && q.tree.nrpc >= q.tree.rpcs {
+		return qerror("tree "+q.name, "rpcs")
+	}
+	uq.nrpc++
+	q.tree.nrpc++
+	return nil
+}
+
+func (q *quotas) end(uid string) {
+	q.Lock()
+	defer q.Unlock()
+	q.user(uid).nrpc--
+	q.tree.nrpc--
+}
+
+// Is storage being accounted?
+func (q *quotas) counts() bool {
+	q.Lock()
+	defer q.Unlock()
+	return q.du != nil
+}
+
+// Can uid store n more bytes?
+func (q *quotas) chkStorage(uid string, n int64) error {
+	q.Lock()
+	defer q.Unlock()
+	if q.du == nil || n <= 0 {
+		return nil
+	}
+	if uq := q.user(uid); uq.storage > 0 && q.du[uid]+n > uq.storage {
+		return qerror("user "+uid, "storage")
+	}
+	if q.tree.storage > 0 && q.total+n > q.tree.storage {
+		return qerror("tree "+q.name, "storage")
+	}
+	return nil
+}
+
+// uid stored n more bytes (or less, if n < 0).
+// Changes made behind our back may make the usage drift; it's never negative.
+func (q *quotas) stored(uid string, n int64) {
+	q.Lock()
+	defer q.Unlock()
+	if q.du != nil {
+		q.add(uid, n)
+	}
+}
+
+// q is locked
+func (q *quotas) add(uid string, n int64) {
+	if q.du[uid] += n; q.du[uid] < 0 {
+		q.du[uid] = 0
+	}
+	if q.total += n; q.total < 0 {
+		q.total = 0
+	}
+}
+
+// The file at p, owned by uid with the given old size, was updated;
+// its new owner and size are charged.
+func (q *quotas) updated(fs zx.Fs, p, uid string, oldsz int64) {
+	nuid, sz := fowner(fs, p, uid)
+	q.stored(uid, -oldsz)
+	q.stored(nuid, sz)
+}
+
+// How long to wait before transferring n bytes, for a limit of bw
+// bytes per second with bursts of up to one second.
+func (qt *quota) delay(now time.Time, n int64) time.Duration {
+	if qt.bw <= 0 {
+		return 0
+	}
+	if qt.next.Before(now) {
+		qt.next = now
+	}
+	qt.next = qt.next.Add(time.Duration(n) * time.Second / time.Duration(qt.bw))
+	return qt.next.Sub(now) - time.Second
+}
+
+// Is the bandwidth limited for uid?
+func (q *quotas) limitsBW(uid string) bool {
+	q.Lock()
+	defer q.Unlock()
+	return q.user(uid).bw > 0 || q.tree.bw > 0
+}
+
+// Wait until uid may transfer n bytes.
+func (q *quotas) wait(uid string, n int) {
+	q.Lock()
+	now := time.Now()
+	d := q.user(uid).delay(now, int64(n))
+	if td := q.tree.delay(now, int64(n)); td > d {
+		d = td
+	}
+	q.Unlock()
+	if d > 0 {
+		time.Sleep(d)
+	}
+}
+
+func msgsz(m face{}) int {
+	switch m := m.(type) {
+	case []byte:
+		return len(m)
+	case zx.Dir:
+		return len(m.Bytes())
+	}
+	return 0
+}
+
+// Return a conn that passes the data through c at the
+// bandwidth permitted for uid.
+func (q *quotas) throttle(uid string, c ch.Conn) ch.Conn {
+	in := make(chan face{})
+	out := make(chan face{})
+	go func() {
+		for m := range c.In {
+			q.wait(uid, msgsz(m))
+			if ok := in <- m; !ok {
+				close(c.In, cerror(in))
+				return
+			}
+		}
+		close(in, cerror(c.In))
+	}()
+	go func() {
+		for m := range out {
+			q.wait(uid, msgsz(m))
+			if ok := c.Out <- m; !ok {
+				close(out, cerror(c.Out))
+				return
+			}
+		}
+		close(c.Out, cerror(out))
+	}()
+	return ch.Conn{Tag: c.Tag, In: in, Out: out}
+}
+
+// Only the server user may set quotas.
+func (q *quotas) chkCtl(uid string, ctl []byte) error {
+	if uid != u.Uid && bytes.HasPrefix(bytes.TrimSpace(ctl), []byte("quota")) {
+		return fmt.Errorf("%s: quota: %s", q.name, zx.ErrPerm)
+	}
+	return nil
+}
+
+// The files accounted in du were removed; their owners are credited.
+func (q *quotas) freed(du map[string]int64) {
+	q.Lock()
+	defer q.Unlock()
+	if q.du == nil {
+		return
+	}
+	for o, n := range du {
+		q.add(o, -n)
+	}
+}
+
+// Owner and size of the file at p, as accounted by diskUsage.
+// If it's not a file, the owner is uid (who would create it) and the size 0.
+func fowner(fs zx.Fs, p, uid string) (string, int64) {
+	d, err := zx.Stat(fs, p)
+	if err != nil || d["type"] != "-" {
+		return uid, 0
+	}
+	return d["uid"], d.Size()
+}
@@ -8,9 +8,12 @@ import (
 	"clive/dbg"
 	"clive/net"
 	"clive/net/auth"
+	"clive/net/disc"
 	"clive/zx"
 	"crypto/tls"
+	"encoding/hex"
 	"fmt"
+	fpath "path"
 	"sort"
 	"strings"
 	"sync"
@@ -31,12 +34,19 @@ struct Server {
 	*dbg.Flag
 	*sync.Mutex
 	fs      map[string]zx.Fs // file trees served
+	qs      map[string]*quotas
 	addr    string           // where served
 	rdonly  bool
 	noauth  bool
 	inc     <-chan *ch.Mux
 	endc    chan bool
 	clients *clients
+	cbs     *cbacks
+	audit   *audit
+	ann     *disc.Announcer // nil if not announced
+	mx      *ch.Mux   // client mux, in per-client copies
+	uid     string    // client user, in per-client copies
+	cap     *auth.Cap // client capability, in per-client copies
 	// when we auth a user, we make a new copy of the Server
 	// struct, with local copies of everything that's not a pointer,
 	// and a new ai for the user.
@@ -104,13 +114,60 @@ func newServer(addr string, tc *tls.Config, ro bool) (*Server, error) {
 		addr:    addr,
 		rdonly:  ro,
 		fs:      map[string]zx.Fs{},
+		qs:      map[string]*quotas{},
 		clients: &clients{set: map[string]client{}},
+		cbs:     &cbacks{muxes: map[*ch.Mux]map[string]bool{}},
+		audit:   &audit{},
 	}
 	s.Tag = addr
 	go s.loop()
 	return s, nil
 }
 
+// Names for the trees served, called with the lock held.
+func (s *Server) treeNames() []string {
+	ts := []string{}
+	for t := range s.fs {
+		ts = append(ts, t)
+	}
+	return ts
+}
+
+// Return the address to announce for the server.
+// The host is left as * when the server is local, so that
+// clients use the address they get the ad from.
+func (s *Server) adAddr() string {
+	nw, host, svc := net.ParseAddr(s.addr)
+	if nw == "*" {
+		nw = "tcp"
+	}
+	port := net.Port(nw, svc)
+	if host == "local" || host == "localhost" {
+		host = "*"
+	}
+	return fmt.Sprintf("%s!%s!%s", nw, host, port)
+}
+
+// Announce the server and its trees in the local network with the
+// given name, so it can be found using disc.Lookup.
+// Servers are not announced unless this is called, and
+// those listening only on unix sockets can't be announced.
+func (s *Server) Announce(name string) error {
+	s.Lock()
+	defer s.Unlock()
+	if s.ann != nil {
+		s.ann.Rename(name)
+		return nil
+	}
+	ad := &disc.Ad{Name: name, Addr: s.adAddr(), Trees: s.treeNames()}
+	ann, err := disc.Announce(ad)
+	if err != nil {
+		return fmt.Errorf("%s: announce: %s", s, err)
+	}
+	s.ann = ann
+	return nil
+}
+
 // Start a read-write server at the given address.
 func NewServer(addr string, tlscfg ...*tls.Config) (*Server, error) {
 	var tc *tls.Config
@@ -147,20 +204,27 @@ func (s *Server) Serve(name string, fs zx.Fs) error {
 		return fmt.Errorf("%s: %s already served", s.addr, name)
 	}
 	s.fs[name] = fs
+	q := newQuotas(name, fs)
+	s.qs[name] = q
+	if s.ann != nil {
+		s.ann.SetTrees(s.treeNames()...)
+	}
 	if ffs, ok := fs.(flagAdder); ok {
 		ffs.AddRO("server rdonly", &s.rdonly)
 		ffs.AddRO("server noauth", &s.noauth)
 		ffs.AddRO("server addr", &s.addr)
 		ffs.AddRO("user", s.clients)
+		ffs.Add("quota", q.ctl)
+		ffs.AddRO("quotas", q)
 	}
 	dbg.Warn("%s: serving %s...", s, fs)
 	return nil
 }
 
-func (s *Server) tree(name string) zx.Fs {
+func (s *Server) tree(name string) (zx.Fs, *quotas) {
 	s.Lock()
 	defer s.Unlock()
-	return s.fs[name]
+	return s.fs[name], s.qs[name]
 }
 
 func (s *Server) trees(c ch.Conn, m *Msg, fs zx.Fs) error {
@@ -197,6 +261,11 @@ func (s *Server) get(c ch.Conn, m *Msg, fs zx.Fs) error {
 		return err
 	}
 	isdir := d["type"] == "d"
+	// the dir goes first, so the client knows what it gets
+	// should it have to resume the get.
+	if ok := c.Out <- d.Bytes(); !ok {
+		return cerror(c.Out)
+	}
 	rc := xfs.Get(m.Path, m.Off, m.Count)
 	for x := range rc {
 		if isdir {
@@ -215,6 +284,171 @@ func (s *Server) get(c ch.Conn, m *Msg, fs zx.Fs) error {
 	return cerror(rc)
 }
 
+func (s *Server) sums(c ch.Conn, m *Msg, fs zx.Fs) error {
+	if xfs, ok := fs.(zx.Summer); ok {
+		rc := xfs.Sums(m.Path, m.Count)
+		for x := range rc {
+			if ok := c.Out <- x; !ok {
+				err := cerror(c.Out)
+				close(rc, err)
+				return err
+			}
+		}
+		return cerror(rc)
+	}
+	xfs, ok := fs.(zx.Getter)
+	if !ok {
+		return zx.ErrBug
+	}
+	var sums [][]byte
+	if m.Count > 0 {
+		var err error
+		if sums, err = zx.Sums(xfs, m.Path, m.Count); err != nil {
+			return err
+		}
+	} else {
+		d, err := zx.Stat(fs, m.Path)
+		if err != nil {
+			return err
+		}
+		str, err := zx.Sum(xfs, d)
+		if err != nil {
+			return err
+		}
+		sum, err := hex.DecodeString(str)
+		if err != nil {
+			return err
+		}
+		sums = append(sums, sum)
+	}
+	for _, x := range sums {
+		if ok := c.Out <- x; !ok {
+			return cerror(c.Out)
+		}
+	}
+	return nil
+}
+
+// The client sends the sums for the blocks of its copy after the request.
+func (s *Server) dget(c ch.Conn, m *Msg, fs zx.Fs) error {
+	xfs, ok := fs.(zx.Getter)
+	if !ok {
+		return zx.ErrBug
+	}
+	var sums [][]byte
+	for x := range c.In {
+		sum, ok := x.([]byte)
+		if !ok {
+			err := ErrBadMsg
+			close(c.In, err)
+			return err
+		}
+		sums = append(sums, sum)
+	}
+	if err := cerror(c.In); err != nil {
+		return err
+	}
+	var rc <-chan face{}
+	if dfs, ok := fs.(zx.Deltaer); ok {
+		rc = dfs.DeltaGet(m.Path, m.Count, sums)
+	} else {
+		xc := make(chan face{})
+		go func() {
+			close(xc, zx.GetDeltas(xfs, m.Path, m.Count, sums, xc))
+		}()
+		rc = xc
+	}
+	for x := range rc {
+		switch x := x.(type) {
+		case zx.Dir:
+			s.mkaddr(x, m.Fsys)
+			ok = c.Out <- x
+		case zx.Delta:
+			ok = c.Out <- x.Bytes()
+		default:
+			err := zx.ErrBug
+			close(rc, err)
+			return err
+		}
+		if !ok {
+			err := cerror(c.Out)
+			close(rc, err)
+			return err
+		}
+	}
+	return cerror(rc)
+}
+
+// We send the sums for the blocks of the file, ending with an
+// empty message, and the client sends the deltas.
+func (s *Server) dput(c ch.Conn, m *Msg, fs zx.Fs) error {
+	if s.rdonly {
+		return fmt.Errorf("%s: %s", s.addr, zx.ErrRO)
+	}
+	xfs, ok := fs.(zx.RWFs)
+	if !ok {
+		return zx.ErrBug
+	}
+	_, q := s.tree(m.Fsys)
+	who, oldsz := s.uid, int64(0)
+	if q.counts() {
+		who, oldsz = fowner(fs, m.Path, s.uid)
+		if err := q.chkStorage(who, m.D.Size()-oldsz); err != nil {
+			return err
+		}
+	}
+	sums, err := zx.Sums(xfs, m.Path, m.Count)
+	if err != nil {
+		return err
+	}
+	for _, sum := range sums {
+		if ok := c.Out <- sum; !ok {
+			return cerror(c.Out)
+		}
+	}
+	if ok := c.Out <- []byte{}; !ok {
+		return cerror(c.Out)
+	}
+	dc := make(chan zx.Delta)
+	go func() {
+		for x := range c.In {
+			b, ok := x.([]byte)
+			if !ok {
+				err := ErrBadMsg
+				close(c.In, err)
+				close(dc, err)
+				return
+			}
+			dl, err := zx.UnpackDelta(b)
+			if err == nil {
+				err = dl.Check(m.Path, m.D.Size())
+			}
+			if err != nil {
+				close(c.In, err)
+				close(dc, err)
+				return
+			}
+			if ok := dc <- dl; !ok {
+				close(c.In, cerror(dc))
+				return
+			}
+		}
+		close(dc, cerror(c.In))
+	}()
+	rd, err := zx.PutDeltas(xfs, m.Path, m.D, dc)
+	if q.counts() {
+		q.updated(fs, m.Path, who, oldsz)
+	}
+	if err != nil {
+		return err
+	}
+	s.mkaddr(rd, m.Fsys)
+	if ok := c.Out <- rd; !ok {
+		return cerror(c.Out)
+	}
+	return nil
+}
+
 func (s *Server) put(c ch.Conn, m *Msg, fs zx.Fs) error {
 	if s.rdonly {
 		return fmt.Errorf("%s: %s", s.addr, zx.ErrRO)
@@ -223,14 +457,49 @@ func (s *Server) put(c ch.Conn, m *Msg, fs zx.Fs) error {
 	if !ok {
 		return zx.ErrBug
 	}
+	_, q := s.tree(m.Fsys)
+	isdir := m.D["type"] == "d" || m.D["type"] == "D"
+	counts := !isdir && m.Path != "/Ctl" && q.counts()
+	who, oldsz := s.uid, int64(0)
+	if counts {
+		who, oldsz = fowner(fs, m.Path, s.uid)
+		// the file is truncated or extended to the size given
+		if m.D["size"] != "" {
+			if err := q.chkStorage(who, m.D.Size()-oldsz); err != nil {
+				return err
+			}
+		}
+	}
+	end := m.Off // of the data written
+	if end < 0 {
+		end = oldsz
+	}
 	ic := make(chan []byte)
 	if m.D["type"] == "d" {
 		close(ic)
 	} else {
+		isctl := m.Path == "/Ctl"
 		go func() {
+			var ctl []byte
 			for m := range c.In {
 				switch m := m.(type) {
 				case []byte:
+					if isctl {
+						// ctls may come in several chunks;
+						// check them as a whole, as the fs will.
+						ctl = append(ctl, m...)
+						continue
+					}
+					var err error
+					if counts {
+						end += int64(len(m))
+						err = q.chkStorage(who, end-oldsz)
+					}
+					if err != nil {
+						close(c.In, err)
+						close(ic, err)
+						break
+					}
 					ok := ic <- m
 					if !ok {
 						close(c.In, cerror(ic))
@@ -243,12 +512,23 @@ func (s *Server) put(c ch.Conn, m *Msg, fs zx.Fs) error {
 					break
 				}
 			}
+			if len(ctl) > 0 && cerror(c.In) == nil {
+				if err := q.chkCtl(s.uid, ctl); err != nil {
+					close(ic, err)
+					return
+				}
+				ic <- ctl
+			}
 			close(ic, cerror(c.In))
 		}()
 	}
 	rc := xfs.Put(m.Path, m.D, m.Off, ic)
 	rd := <-rc
-	if err := cerror(rc); err != nil {
+	err := cerror(rc)
+	if counts {
+		q.updated(fs, m.Path, who, oldsz)
+	}
+	if err != nil {
 		return err
 	}
 	s.mkaddr(rd, m.Fsys)
@@ -291,10 +571,21 @@ func (s *Server) remove(c ch.Conn, m *Msg, fs zx.Fs) error {
 	if m.Path == "" || m.Path == "/" {
 		return fmt.Errorf("%s: won't remove /", s.addr)
 	}
+	_, q := s.tree(m.Fsys)
+	var du map[string]int64
+	if q.counts() {
+		du, _, _ = diskUsage(fs, m.Path)
+	}
+	var err error
 	if m.Op == Tremove {
-		return <-xfs.Remove(m.Path)
+		err = <-xfs.Remove(m.Path)
+	} else {
+		err = <-xfs.RemoveAll(m.Path)
 	}
-	return <-xfs.RemoveAll(m.Path)
+	if err == nil {
+		q.freed(du)
+	}
+	return err
 }
 
 func (s *Server) find(c ch.Conn, m *Msg, fs zx.Fs) error {
@@ -304,6 +595,9 @@ func (s *Server) find(c ch.Conn, m *Msg, fs zx.Fs) error {
 	}
 	rc := xfs.Find(m.Path, m.Pred, m.Spref, m.Dpref, m.Depth)
 	for d := range rc {
+		if !s.capFound(m, d) {
+			continue
+		}
 		s.mkaddr(d, m.Fsys)
 		if ok := c.Out <- d; !ok {
 			err := cerror(c.Out)
@@ -333,6 +627,23 @@ func (s *Server) findget(c ch.Conn, m *Msg, fs zx.Fs) error {
 	return cerror(rc)
 }
 
+func (s *Server) watch(c ch.Conn, m *Msg, fs zx.Fs) error {
+	xfs, ok := fs.(zx.Watcher)
+	if !ok {
+		return zx.ErrBug
+	}
+	rc := xfs.Watch(m.Path, m.Pred)
+	for d := range rc {
+		s.mkaddr(d, m.Fsys)
+		if ok := c.Out <- d; !ok {
+			err := cerror(c.Out)
+			close(rc, err)
+			return err
+		}
+	}
+	return cerror(rc)
+}
+
 func (s *Server) wstat(c ch.Conn, m *Msg, fs zx.Fs) error {
 	if s.rdonly {
 		return fmt.Errorf("%s: %s", s.addr, zx.ErrRO)
@@ -341,8 +652,22 @@ func (s *Server) wstat(c ch.Conn, m *Msg, fs zx.Fs) error {
 	if !ok {
 		return zx.ErrBug
 	}
+	_, q := s.tree(m.Fsys)
+	counts := (m.D["size"] != "" || m.D["uid"] != "") && q.counts()
+	who, oldsz := s.uid, int64(0)
+	if counts {
+		who, oldsz = fowner(fs, m.Path, s.uid)
+		if m.D["size"] != "" {
+			if err := q.chkStorage(who, m.D.Size()-oldsz); err != nil {
+				return err
+			}
+		}
+	}
 	rc := xfs.Wstat(m.Path, m.D)
 	rd := <-rc
+	if counts {
+		q.updated(fs, m.Path, who, oldsz)
+	}
 	if err := cerror(rc); err != nil {
 		return err
 	}
@@ -369,11 +694,28 @@ func (s *Server) req(c ch.Conn) {
 			rerr = s.trees(c, m, nil)
 			break
 		}
-		fs := s.tree(m.Fsys)
+		fs, q := s.tree(m.Fsys)
 		if fs == nil {
 			rerr = fmt.Errorf("no fsys '%s'", m.Fsys)
 			break
 		}
+		if rerr = s.chkCap(m); rerr != nil {
+			break
+		}
+		// watches are not requests in flight, they just wait
+		if m.Op != Twatch {
+			if rerr = q.start(s.uid); rerr != nil {
+				break
+			}
+			defer q.end(s.uid)
+		}
+		if q.limitsBW(s.uid) {
+			// the throttled conn is closed below, and the
+			// original input must be closed as well.
+			in := c.In
+			defer func() { close(in, rerr) }()
+			c = q.throttle(s.uid, c)
+		}
 		switch m.Op {
 		case Tstat:
 			rerr = s.stat(c, m, fs)
@@ -383,6 +725,8 @@ func (s *Server) req(c ch.Conn) {
 			rerr = s.put(c, m, fs)
 		case Tmove:
 			rerr = s.move(c, m, fs)
+		case Tlink:
+			rerr = s.link(c, m, fs)
 		case Tremove, Tremoveall:
 			rerr = s.remove(c, m, fs)
 		case Tfind:
@@ -391,6 +735,14 @@ func (s *Server) req(c ch.Conn) {
 			rerr = s.findget(c, m, fs)
 		case Twstat:
 			rerr = s.wstat(c, m, fs)
+		case Twatch:
+			rerr = s.watch(c, m, fs)
+		case Tsums:
+			rerr = s.sums(c, m, fs)
+		case Tdget:
+			rerr = s.dget(c, m, fs)
+		case Tdput:
+			rerr = s.dput(c, m, fs)
 		default:
 			rerr = fmt.Errorf("unknown msg op %v", m.Op)
 		}
@@ -399,11 +751,55 @@ func (s *Server) req(c ch.Conn) {
 	}
 	if rerr != nil {
 		s.Dprintf("%s: %s\n", c.Tag, rerr)
+	} else if m, ok := dat.(*Msg); ok {
+		s.callbacks(m)
+	}
+	if m, ok := dat.(*Msg); ok && mutates(m.Op) && s.mx != nil {
+		s.audit.log(s.uid, s.mx.Tag, m, rerr)
 	}
 	close(c.In, rerr)
 	close(c.Out, rerr)
 }
 
+// Check that the client capability, if any, allows the request.
+// Stat and find requests must be within the capability subtree or walk to it,
+// other requests must be within the subtree, and
+// requests updating the tree require a read-write capability.
+// Find results outside the subtree are not sent (see capFound).
+// Permission checks in the served trees honour the capability as well.
+func (s *Server) chkCap(m *Msg) error {
+	if s.cap == nil {
+		return nil
+	}
+	what := 0111
+	switch {
+	case mutates(m.Op):
+		what = 0222
+	case m.Op == Tget, m.Op == Tfindget, m.Op == Tdget, m.Op == Tsums, m.Op == Twatch:
+		what = 0444
+	}
+	if !s.cap.Allows(m.Fsys, m.Path, what) {
+		return fmt.Errorf("%s: %s", m.Path, zx.ErrPerm)
+	}
+	if m.To != "" && !s.cap.Allows(m.Fsys, m.To, what) {
+		return fmt.Errorf("%s: %s", m.To, zx.ErrPerm)
+	}
+	return nil
+}
+
+// Is the dir d, found by the find request m, within
+// the capability subtree?
+func (s *Server) capFound(m *Msg, d zx.Dir) bool {
+	if s.cap == nil {
+		return true
+	}
+	p := d["path"]
+	if m.Spref != m.Dpref {
+		p = fpath.Join(m.Spref, zx.Suffix(p, m.Dpref))
+	}
+	return s.cap.Allows(m.Fsys, p, 0444)
+}
+
 func (s *Server) authFor(ai *auth.Info) *Server {
 	s.Lock()
 	defer s.Unlock()
@@ -411,6 +807,9 @@ func (s *Server) authFor(ai *auth.Info) *Server {
 	*ns = *s
 	ns.fs = map[string]zx.Fs{}
 	for n, fs := range s.fs {
+		if ai != nil && !ai.Cap.Allows(n, "/", 0111) {
+			continue
+		}
 		if afs, ok := fs.(zx.Auther); ok {
 			fs, err := afs.Auth(ai)
 			if err != nil {
@@ -441,7 +840,7 @@ func (s *Server) client(mx *ch.Mux) {
 				err = nil
 			}
 		} else {
-			ai, err = auth.AtServer(c, "", "zx")
+			ai, err = auth.CapAtServer(c, "", "zx")
 		}
 		if err != nil {
 			dbg.Warn("%s: %s: %s", s.addr, mx.Tag, err)
@@ -457,10 +856,14 @@ func (s *Server) client(mx *ch.Mux) {
 	s.Dprintf("%s auth as %s\n", mx.Tag, ai.Uid)
 	s.clients.add(mx.Tag, ai.Uid)
 	ns := s.authFor(ai)
+	ns.mx = mx
+	ns.uid = ai.Uid
+	ns.cap = ai.Cap
 	for c := range mx.In {
 		go ns.req(c)
 	}
 	ns.clients.del(mx.Tag)
+	ns.cbs.del(mx)
 }
 
 func (s *Server) loop() {
@@ -474,6 +877,11 @@ func (s *Server) loop() {
 	case <-s.endc:
 		dbg.Warn("%s: server exiting", s)
 		close(s.inc, "exiting")
+		s.Lock()
+		if s.ann != nil {
+			s.ann.Close()
+		}
+		s.Unlock()
 		break
 	}
 }
@@ -1,6 +1,7 @@
 package rzx
 
 import (
+	"bytes"
 	"clive/ch"
 	"clive/net"
 	"clive/net/auth"
@@ -8,9 +9,13 @@ import (
 	"clive/zx"
 	"clive/zx/fstest"
 	"clive/zx/zux"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"strings"
 	"testing"
+	"time"
 )
 
 struct tb {
@@ -41,6 +46,7 @@ func (b *tb) CloseRead() error {
 
 var (
 	md   = zx.Dir{"type": "d", "mode": "0755"}
+	sd   = zx.Dir{"size": "10"}
 	msgs = [...]*Msg{
 		&Msg{Op: Ttrees},
 		&Msg{Op: Tstat, Fsys: "main", Path: "/a"},
@@ -55,6 +61,11 @@ var (
 			Pred: "name=x", Spref: "/", Dpref: "/", Depth: 1},
 		&Msg{Op: Tfindget, Fsys: "main", Path: "/a",
 			Pred: "name=x", Spref: "/", Dpref: "/", Depth: 1},
+		&Msg{Op: Twatch, Fsys: "main", Path: "/a", Pred: "name=x"},
+		&Msg{Op: Tinval, Fsys: "main", Path: "/a"},
+		&Msg{Op: Tsums, Fsys: "main", Path: "/a", Count: 1024},
+		&Msg{Op: Tdget, Fsys: "main", Path: "/a", Count: 1024},
+		&Msg{Op: Tdput, Fsys: "main", Path: "/a", D: sd, Count: 1024},
 	}
 	omsgs = [...]string{
 		`Ttrees`,
@@ -68,6 +79,11 @@ var (
 		`Twstat 'main' '/a' d <type:"d" mode:"0755"> `,
 		`Tfind 'main' '/a' pred 'name=x' spref '/' dpref '/' depth 1`,
 		`Tfindget 'main' '/a' pred 'name=x' spref '/' dpref '/' depth 1`,
+		`Twatch 'main' '/a' pred 'name=x'`,
+		`Tinval 'main' '/a'`,
+		`Tsums 'main' '/a' count 1024`,
+		`Tdget 'main' '/a' count 1024`,
+		`Tdput 'main' '/a' count 1024 d <size:"10"> `,
 	}
 )
 
@@ -193,3 +209,472 @@ func TestMoves(t *testing.T) {
 func TestAsAFile(t *testing.T) {
 	runTest(t, fstest.AsAFile)
 }
+
+func TestWatches(t *testing.T) {
+	runTest(t, fstest.Watches)
+}
+
+func TestDeltas(t *testing.T) {
+	runTest(t, fstest.Deltas)
+}
+
+func TestCancels(t *testing.T) {
+	runTest(t, fstest.Cancels)
+}
+
+func TestQuotas(t *testing.T) {
+	q := newQuotas("tree", nil)
+	if err := q.ctl("quota", "user", "*", "rpcs", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.ctl("quota", "user", "nemo", "rpcs", "2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.ctl("quota", "tree", "rpcs", "x"); err == nil {
+		t.Fatal("bad value didn't fail")
+	}
+	for i, uid := range []string{"a", "a", "b", "nemo", "nemo", "nemo"} {
+		err := q.start(uid)
+		t.Logf("start %s: %v", uid, err)
+		if (i == 1 || i == 5) != zx.IsQuota(err) {
+			t.Fatalf("start %s: %v", uid, err)
+		}
+	}
+	q.end("a")
+	if err := q.start("a"); err != nil {
+		t.Fatal(err)
+	}
+	t.Logf("quotas %s", q)
+	if err := q.chkCtl("other", []byte("quota tree rpcs 3\n")); !zx.IsPerm(err) {
+		t.Fatalf("ctl from other user: %v", err)
+	}
+
+	if err := q.ctl("quota", "tree", "bw", "100k"); err != nil {
+		t.Fatal(err)
+	}
+	t0 := time.Now()
+	for i := 0; i < 3; i++ {
+		q.wait("a", 100*1024)
+	}
+	if tm := time.Since(t0); tm < time.Second || tm > 3*time.Second {
+		t.Fatalf("bw: took %v", tm)
+	}
+}
+
+func storageQuota(t fstest.Fataler, fs zx.Fs) {
+	ctl := func(s string) {
+		if err := zx.PutAll(fs.(zx.Putter), "/Ctl", []byte(s)); err != nil {
+			t.Fatalf("ctl: %s", err)
+		}
+	}
+	put := func(p string, sz int) error {
+		return zx.PutAll(fs.(zx.Putter), p, make([]byte, sz))
+	}
+	// files already in the tree count as well
+	du, _, err := diskUsage(fs, "/")
+	if err != nil {
+		t.Fatalf("du: %s", err)
+	}
+	ctl(fmt.Sprintf("quota user * storage %d", du[u.Uid]+4*1024))
+	if err := put("/q1", 3*1024); err != nil {
+		t.Fatalf("put: %s", err)
+	}
+	err = put("/q2", 2*1024)
+	t.Logf("put: %v", err)
+	if !zx.IsQuota(err) {
+		t.Fatalf("put: %v", err)
+	}
+	<-fs.(zx.Remover).Remove("/q2")
+	// sizes given without data count as well
+	dc := make(chan []byte)
+	close(dc)
+	rc := fs.(zx.Putter).Put("/q3", zx.Dir{"type": "-", "size": "1000000"}, 0, dc)
+	<-rc
+	if err := cerror(rc); !zx.IsQuota(err) {
+		t.Fatalf("put size: %v", err)
+	}
+	rc = fs.(zx.Wstater).Wstat("/q1", zx.Dir{"size": "1000000"})
+	<-rc
+	if err := cerror(rc); !zx.IsQuota(err) {
+		t.Fatalf("wstat size: %v", err)
+	}
+	if err := <-fs.(zx.Remover).Remove("/q1"); err != nil {
+		t.Fatalf("rm: %s", err)
+	}
+	if err := put("/q2", 2*1024); err != nil {
+		t.Fatalf("put: %s", err)
+	}
+	dat, err := zx.GetAll(fs.(zx.Getter), "/Ctl")
+	if err != nil {
+		t.Fatalf("ctl: %s", err)
+	}
+	t.Logf("ctl:\n%s", dat)
+	ctl("quota user * storage 0")
+	if err := put("/q1", 3*1024); err != nil {
+		t.Fatalf("put: %s", err)
+	}
+}
+
+func TestInvalsOverflow(t *testing.T) {
+	iv := &invals{cs: map[chan string]string{}}
+	c := make(chan string, nbufInval)
+	iv.cs[c] = "main"
+	for i := 0; i < 2*nbufInval; i++ {
+		// must not block
+		iv.post(&Msg{Op: Tinval, Fsys: "main", Path: fmt.Sprintf("/f%d", i)})
+	}
+	for i := 0; i < nbufInval-1; i++ {
+		if p := <-c; p != fmt.Sprintf("/f%d", i) {
+			t.Fatalf("got %q", p)
+		}
+	}
+	if p := <-c; p != "" {
+		t.Fatalf("no overflow: got %q", p)
+	}
+	close(c)
+	iv.post(&Msg{Op: Tinval, Fsys: "main", Path: "/x"})
+	if len(iv.cs) != 0 {
+		t.Fatalf("closed chan not gone")
+	}
+}
+
+func TestStorageQuota(t *testing.T) {
+	runTest(t, storageQuota)
+}
+
+func TestAudit(t *testing.T) {
+	os.Remove("/tmp/clive.9897")
+	defer os.Remove("/tmp/clive.9897")
+	log := "/tmp/rzxaudit.log"
+	for i := 0; i <= AuditKeep; i++ {
+		os.Remove(fmt.Sprintf("%s.%d", log, i))
+	}
+	os.Remove(log)
+	defer os.Remove(log)
+	fstest.MkTree(t, tdir)
+	defer os.RemoveAll(tdir)
+	fs, err := zux.NewZX(tdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, err := NewServer("unix!local!9897")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	if err := srv.Serve("main", fs); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Audit(log); err != nil {
+		t.Fatal(err)
+	}
+	rfs, err := Dial("unix!local!9897")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rfs.Close()
+	if err := zx.PutAll(rfs, "/n1", []byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-rfs.Move("/n1", "/n2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-rfs.Remove("/n1"); err == nil {
+		t.Fatal("remove didn't fail")
+	}
+	if err := <-rfs.Remove("/n2"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := zx.GetAll(rfs, "/1"); err != nil {
+		t.Fatal(err)
+	}
+
+	afs, err := rfs.Fsys("audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	outs := []string{
+		`op:"put" file:"/n1" result:"ok"`,
+		`op:"move" file:"/n1" to:"/n2" result:"ok"`,
+		`op:"remove" file:"/n1" result:"`,
+		`op:"remove" file:"/n2" result:"ok"`,
+	}
+	dc := afs.Find("/", "type=-", "", "", 0)
+	n := 0
+	for d := range dc {
+		s := fmt.Sprintf("op:%q file:%q", d["op"], d["file"])
+		if d["to"] != "" {
+			s += fmt.Sprintf(" to:%q", d["to"])
+		}
+		s += fmt.Sprintf(" result:%q", d["result"])
+		t.Logf("%s", s)
+		if n >= len(outs) || !strings.HasPrefix(s, outs[n]) {
+			t.Fatalf("bad record %s", d)
+		}
+		if d["uid"] != u.Uid || d["tree"] != "main" {
+			t.Fatalf("bad record %s", d)
+		}
+		n++
+	}
+	if err := cerror(dc); err != nil || n != len(outs) {
+		t.Fatalf("find: %d records: %v", n, err)
+	}
+	dc = afs.Find("/", "op=remove&result=ok", "", "", 0)
+	d := <-dc
+	if d == nil || d["file"] != "/n2" {
+		t.Fatalf("find: %v", cerror(dc))
+	}
+	dat, err := zx.GetAll(afs, d["path"])
+	if err != nil || d.Size() != int64(len(dat)) {
+		t.Fatalf("get: %v", err)
+	}
+	t.Logf("record %s", dat)
+	if err := zx.PutAll(afs, "/x", []byte("hi")); err == nil {
+		t.Fatal("audit is not ro")
+	}
+
+	// rotate
+	osz := AuditSz
+	defer func() { AuditSz = osz }()
+	AuditSz = 1024
+	for i := 0; i < 20; i++ {
+		<-rfs.Remove("/nothere")
+	}
+	if _, err := os.Stat(log + ".1"); err != nil {
+		t.Fatalf("not rotated: %s", err)
+	}
+	ds, err := zx.GetDir(afs, "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ds) < 20 {
+		t.Fatalf("only %d records", len(ds))
+	}
+	// records in rotated logs are read from them
+	if d, err := zx.Stat(afs, "/1"); err != nil || d["op"] != "put" {
+		t.Fatalf("stat: %v %v", d, err)
+	}
+
+	// seqs survive a restart, even if the log is empty after a rotation
+	last := ds[len(ds)-1].Uint("seq")
+	if err := os.Truncate(log, 0); err != nil {
+		t.Fatal(err)
+	}
+	a := &audit{}
+	if err := a.open(log); err != nil {
+		t.Fatal(err)
+	}
+	a.fd.Close()
+	if a.seq == 0 || a.seq >= last {
+		t.Fatalf("restart: seq %d last %d", a.seq, last)
+	}
+}
+
+func TestCapDial(t *testing.T) {
+	os.Remove("/tmp/clive.9898")
+	defer os.Remove("/tmp/clive.9898")
+	fstest.MkTree(t, tdir)
+	defer os.RemoveAll(tdir)
+	fs, err := zux.NewZX(tdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, err := NewServer("unix!local!9898")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	if err := srv.Serve("main", fs); err != nil {
+		t.Fatal(err)
+	}
+	var ai *auth.Info
+	c := &auth.Cap{Tree: "main", Path: "/a", Expires: time.Now().Add(time.Minute)}
+	tok, err := ai.Mint("", c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rfs, err := DialCap("unix!local!9898", tok)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rfs.Close()
+	if _, err := zx.GetAll(rfs, "/a/a1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := zx.Stat(rfs, "/"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := zx.GetAll(rfs, "/1"); !zx.IsPerm(err) {
+		t.Fatalf("get outside the cap: %v", err)
+	}
+	if _, err := zx.GetDir(rfs, "/"); !zx.IsPerm(err) {
+		t.Fatalf("get of a dir walking to the cap: %v", err)
+	}
+	for _, op := range []string{"find", "findget"} {
+		var xc <-chan face{}
+		if op == "find" {
+			dc := rfs.Find("/", "", "/", "/", 0)
+			c := make(chan face{})
+			go func() {
+				for d := range dc {
+					c <- d
+				}
+				close(c, cerror(dc))
+			}()
+			xc = c
+		} else {
+			xc = rfs.FindGet("/", "", "/", "/", 0)
+		}
+		n := 0
+		for x := range xc {
+			// data follows its dir
+			d, ok := x.(zx.Dir)
+			if !ok {
+				continue
+			}
+			if p := d["path"]; p != "/a" && !strings.HasPrefix(p, "/a/") {
+				t.Fatalf("%s: %s outside the cap", op, p)
+			}
+			n++
+		}
+		t.Logf("%s: %d dirs, sts %v", op, n, cerror(xc))
+		if op == "find" && n == 0 {
+			t.Fatalf("find: no dirs within the cap")
+		}
+	}
+	if err := zx.PutAll(rfs, "/a/n1", []byte("hi")); !zx.IsPerm(err) {
+		t.Fatalf("put with a ro cap: %v", err)
+	}
+
+	c.RW = true
+	if tok, err = ai.Mint("", c); err != nil {
+		t.Fatal(err)
+	}
+	wfs, err := DialCap("unix!local!9898", tok)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wfs.Close()
+	if err := zx.PutAll(wfs, "/a/n1", []byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-wfs.Move("/a/n1", "/n1"); !zx.IsPerm(err) {
+		t.Fatalf("move outside the cap: %v", err)
+	}
+	if err := <-wfs.Link("/a/n1", "/a/n2"); err != nil {
+		t.Fatalf("link: %s", err)
+	}
+	if err := <-wfs.Link("/a/n1", "/n2"); !zx.IsPerm(err) {
+		t.Fatalf("link outside the cap: %v", err)
+	}
+}
+
+func TestRedial(t *testing.T) {
+	os.Remove("/tmp/clive.9896")
+	defer os.Remove("/tmp/clive.9896")
+	fstest.MkTree(t, tdir)
+	defer os.RemoveAll(tdir)
+	fs, err := zux.NewZX(tdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, err := NewServer("unix!local!9896")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	if err := srv.Serve("main", fs); err != nil {
+		t.Fatal(err)
+	}
+	rfs, err := Dial("unix!local!9896")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rfs.Debug = testing.Verbose()
+	dat, err := zx.GetAll(rfs, "/a/a1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the connection goes away; requests redial
+	rfs.m.Close()
+	if _, err := zx.Stat(rfs, "/a/a1"); err != nil {
+		t.Fatalf("stat after hangup: %s", err)
+	}
+	rfs.m.Close()
+	ndat, err := zx.GetAll(rfs, "/a/a1")
+	if err != nil || string(ndat) != string(dat) {
+		t.Fatalf("get after hangup: %v", err)
+	}
+	rfs.m.Close()
+	n := 0
+	dc := rfs.Find("/", "", "/", "/", 0)
+	for range dc {
+		n++
+	}
+	if err := cerror(dc); err != nil || n == 0 {
+		t.Fatalf("find after hangup: %d dirs: %v", n, err)
+	}
+	rfs.m.Close()
+	if err := zx.PutAll(rfs, "/a/n1", []byte("hi")); err != nil {
+		t.Fatalf("put after hangup: %s", err)
+	}
+
+	// gets are resumed or restarted if some data was received
+	big := make([]byte, 4*1024*1024)
+	for i := range big {
+		big[i] = byte(i)
+	}
+	if err := ioutil.WriteFile(tdir+"/a/big", big, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(tdir+"/a/many", 0755); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1000; i++ {
+		if err := ioutil.WriteFile(fmt.Sprintf("%s/a/many/f%d", tdir, i), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hangget := func(p string, chg func()) ([][]byte, error) {
+		gc := rfs.Get(p, 0, zx.All)
+		msgs := [][]byte{<-gc}
+		rfs.m.Close()
+		if chg != nil {
+			chg()
+		}
+		for x := range gc {
+			msgs = append(msgs, x)
+		}
+		return msgs, cerror(gc)
+	}
+	msgs, err := hangget("/a/big", nil)
+	if err != nil || !bytes.Equal(bytes.Join(msgs, nil), big) {
+		t.Fatalf("get file after hangup: %v", err)
+	}
+	msgs, err = hangget("/a/many", nil)
+	names := map[string]bool{}
+	for _, m := range msgs {
+		_, d, err := zx.UnpackDir(m)
+		if err != nil || names[d["name"]] {
+			t.Fatalf("get dir after hangup: bad entry %v %v", d, err)
+		}
+		names[d["name"]] = true
+	}
+	if err != nil || len(names) != 1000 {
+		t.Fatalf("get dir after hangup: %d entries: %v", len(names), err)
+	}
+	_, err = hangget("/a/big", func() {
+		os.Truncate(tdir+"/a/big", 10)
+	})
+	t.Logf("get changed file after hangup: %v", err)
+	if err == nil {
+		t.Fatalf("get of a changed file did not fail")
+	}
+
+	// but not if closed by the user
+	rfs.Close()
+	if _, err := zx.Stat(rfs, "/a/a1"); err == nil {
+		t.Fatalf("could stat after close")
+	}
+}
@@ -0,0 +1,69 @@
+package zx
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"hash"
+)
+
+// Return a new hash as used for file contents.
+func NewSum() hash.Hash {
+	return sha1.New()
+}
+
+// Return the "sum" attribute for the file data with the given hash.
+func SumString(sum []byte) string {
+	return fmt.Sprintf("%x", sum)
+}
+
+// Return the hash for the contents of the file d at fs in the format
+// used by the "sum" attribute.
+// The one reported by d is used if it's there; otherwise it's
+// asked to fs, or computed by getting the file if fs is not a Summer.
+func Sum(fs Getter, d Dir) (string, error) {
+	if s := d["sum"]; s != "" {
+		return s, nil
+	}
+	p := d["path"]
+	if d["type"] == "d" {
+		return "", fmt.Errorf("%s: %s", p, ErrIsDir)
+	}
+	if sfs, ok := fs.(Summer); ok {
+		c := sfs.Sums(p, 0)
+		sum := <-c
+		close(c)
+		if err := cerror(c); err != nil {
+			return "", err
+		}
+		if len(sum) == 0 {
+			return "", fmt.Errorf("%s: no sum", p)
+		}
+		return SumString(sum), nil
+	}
+	h := NewSum()
+	c := fs.Get(p, 0, All)
+	for b := range c {
+		h.Write(b)
+	}
+	if err := cerror(c); err != nil {
+		return "", err
+	}
+	return SumString(h.Sum(nil)), nil
+}
+
+// Return the hashes for the blocks of blksz bytes of the file at p.
+// If fs is not a Summer, the file is retrieved to compute them.
+func Sums(fs Getter, p string, blksz int64) ([][]byte, error) {
+	if blksz <= 0 {
+		return nil, fmt.Errorf("%s: bad block size", p)
+	}
+	if sfs, ok := fs.(Summer); ok {
+		var sums [][]byte
+		c := sfs.Sums(p, blksz)
+		for sum := range c {
+			sums = append(sums, sum)
+		}
+		return sums, cerror(c)
+	}
+	return BlockSums(fs.Get(p, 0, All), blksz)
+}
@@ -0,0 +1,141 @@
+package zx
+
+import (
+	"path"
+	"sync"
+)
+
+// A watch for changes at or under Path, as kept by Watcher implementations.
+// Changes are sent through C without ever blocking the sender.
+// When the reader falls behind, changes are dropped and a Dir
+// for Path with "Chg" set to Overflow is sent instead.
+struct Watch {
+	Path  string
+	Match func(d Dir, depth int) bool // nil matches all changes
+	C     chan Dir
+
+	sync.Mutex // for the fields below
+	lost       bool
+	done       bool
+}
+
+// A set of watches for a tree.
+struct Watches {
+	sync.Mutex
+	set map[*Watch]bool
+}
+
+// Nb. of buffered changes for each watch
+var NbufWatch = 64
+
+// Create a watch for p; its channel buffers NbufWatch changes.
+func NewWatch(p string, match func(Dir, int) bool) *Watch {
+	return &Watch{Path: p, Match: match, C: make(chan Dir, NbufWatch)}
+}
+
+// Send d through the watch if it's under its path and matches.
+// Return false if the watcher is gone.
+func (w *Watch) Send(d Dir) bool {
+	p := d["path"]
+	if !HasPrefix(p, w.Path) {
+		return !w.Done()
+	}
+	depth := len(Elems(Suffix(p, w.Path)))
+	if w.Match != nil && !w.Match(d, depth) {
+		return !w.Done()
+	}
+	w.Lock()
+	defer w.Unlock()
+	if w.done {
+		return false
+	}
+	// The last slot is kept for the overflow notice.
+	// We are the only sender, so a free slot can't go away.
+	if len(w.C) >= cap(w.C)-1 {
+		if !w.lost && len(w.C) < cap(w.C) {
+			w.lost = true
+			x := Dir{
+				"name": path.Base(w.Path),
+				"path": w.Path,
+				"Chg":  Overflow,
+			}
+			if ok := w.C <- x; !ok {
+				w.done = true
+			}
+		}
+		return !w.done
+	}
+	w.lost = false
+	if ok := w.C <- d; !ok {
+		w.done = true
+	}
+	return !w.done
+}
+
+// Terminate the watch with the given error (nil means no error).
+func (w *Watch) End(err error) {
+	w.Lock()
+	defer w.Unlock()
+	if !w.done {
+		w.done = true
+		close(w.C, err)
+	}
+}
+
+// Return true if the watcher is gone or the watch has ended.
+// A reader that closed C is noticed even if there are no changes to send,
+// once it has consumed those buffered.
+func (w *Watch) Done() bool {
+	w.Lock()
+	defer w.Unlock()
+	if !w.done && len(w.C) == 0 {
+		// All sends hold the lock, so there's nothing to receive
+		// unless C has been closed by the reader.
+		select {
+		case _, ok := <-w.C:
+			if !ok {
+				w.done = true
+			}
+		default:
+		}
+	}
+	return w.done
+}
+
+func (ws *Watches) Add(w *Watch) {
+	ws.Lock()
+	if ws.set == nil {
+		ws.set = map[*Watch]bool{}
+	}
+	ws.set[w] = true
+	ws.Unlock()
+}
+
+func (ws *Watches) Del(w *Watch) {
+	ws.Lock()
+	delete(ws.set, w)
+	ws.Unlock()
+}
+
+// Are there watches?
+func (ws *Watches) Active() bool {
+	ws.Lock()
+	defer ws.Unlock()
+	return len(ws.set) > 0
+}
+
+// Send d to all the watches, forgetting those that are gone.
+// It never blocks.
+func (ws *Watches) Post(d Dir) {
+	ws.Lock()
+	wl := make([]*Watch, 0, len(ws.set))
+	for w := range ws.set {
+		wl = append(wl, w)
+	}
+	ws.Unlock()
+	for _, w := range wl {
+		if !w.Send(d.Dup()) {
+			ws.Del(w)
+		}
+	}
+}
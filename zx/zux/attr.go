@@ -129,6 +129,7 @@ func (ac *aCache) get(path string, d zx.Dir) error {
 	for k, v := range fa {
 		d[k] = v
 	}
+	chkSum(d)
 	return nil
 }
 
@@ -146,6 +147,8 @@ func (ac *aCache) set(path string, d zx.Dir) error {
 	delete(d, "size")
 	delete(d, "mtime")
 	delete(d, "type")
+	delete(d, "sum") // see setSum
+	delete(d, "sumkey")
 
 	if od := da.ents[nm]; od != nil {
 		for k, v := range d {
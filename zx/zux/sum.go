@@ -0,0 +1,162 @@
+package zux
+
+import (
+	"clive/zx"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	fpath "path"
+)
+
+var _fs3 zx.Summer = &Fs{}
+
+// The "sum" attribute is kept in the attr file along with "sumkey",
+// which tells the mtime and size of the file when it was computed.
+func sumKey(d zx.Dir) string {
+	return d["mtime"] + " " + d["size"]
+}
+
+// Drop the "sum" attribute from d if the file changed after it was computed.
+func chkSum(d zx.Dir) {
+	if d["sum"] != "" && d["sumkey"] != sumKey(d) {
+		delete(d, "sum")
+	}
+	delete(d, "sumkey")
+}
+
+// Record the sum for the file at path with dir d.
+func (ac *aCache) setSum(path string, d zx.Dir, sum string) {
+	ac.Lock()
+	defer ac.Unlock()
+	nm := fpath.Base(path)
+	da := ac.readDir(fpath.Dir(path))
+	od := da.ents[nm]
+	if od == nil {
+		od = zx.Dir{"name": nm}
+		da.ents[nm] = od
+		ac.nents++
+	}
+	od["sum"] = sum
+	od["sumkey"] = sumKey(d)
+	da.dirty = true
+}
+
+// Forget the sum for the file at path.
+func (ac *aCache) dropSum(path string) {
+	ac.Lock()
+	defer ac.Unlock()
+	da := ac.readDir(fpath.Dir(path))
+	if od := da.ents[fpath.Base(path)]; od != nil && od["sum"] != "" {
+		delete(od, "sum")
+		delete(od, "sumkey")
+		da.dirty = true
+	}
+}
+
+// Compute the sum for the file at p (its dir is d) unless it's known.
+// If attrs are handled, it's kept in the attr file.
+func (fs *Fs) sum(p string, d zx.Dir) (string, error) {
+	if d["sum"] != "" {
+		return d["sum"], nil
+	}
+	if d["type"] == "d" {
+		return "", fmt.Errorf("%s: %s", p, zx.ErrIsDir)
+	}
+	path := fpath.Join(fs.root, p)
+	if err := fs.chkLinks(p, path); err != nil {
+		return "", err
+	}
+	fd, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer fd.Close()
+	h := zx.NewSum()
+	if _, err := io.Copy(h, fd); err != nil {
+		return "", err
+	}
+	sum := zx.SumString(h.Sum(nil))
+	if fs.attrs {
+		ac.setSum(path, d, sum)
+	}
+	return sum, nil
+}
+
+func (fs *Fs) sums(p string, blksz int64, c chan<- []byte) error {
+	p, err := zx.UseAbsPath(p)
+	if err != nil {
+		return err
+	}
+	if p == "/Ctl" {
+		return fmt.Errorf("%s: %s", p, zx.ErrBadType)
+	}
+	if fs.zxperms {
+		if err := fs.chkGet(p); err != nil {
+			return err
+		}
+	}
+	if blksz <= 0 {
+		d, err := fs.stat(p, false)
+		if err != nil {
+			return err
+		}
+		s, err := fs.sum(p, d)
+		if err != nil {
+			return err
+		}
+		sum, err := hex.DecodeString(s)
+		if err != nil {
+			return err
+		}
+		if ok := c <- sum; !ok {
+			return cerror(c)
+		}
+		return nil
+	}
+	path := fpath.Join(fs.root, p)
+	if err := fs.chkLinks(p, path); err != nil {
+		return err
+	}
+	fd, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	st, err := fd.Stat()
+	if err != nil {
+		return err
+	}
+	if st.IsDir() {
+		return fmt.Errorf("%s: %s", p, zx.ErrIsDir)
+	}
+	h := zx.NewSum()
+	for {
+		h.Reset()
+		n, err := io.CopyN(h, fd, blksz)
+		if n > 0 {
+			if ok := c <- h.Sum(nil); !ok {
+				return cerror(c)
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// See zx.Summer.
+// Sums for entire files are kept in the attr file if attrs are handled,
+// and reported in the "sum" attribute while the file does not change.
+func (fs *Fs) Sums(p string, blksz int64) <-chan []byte {
+	c := make(chan []byte)
+	go func() {
+		fs.Count(zx.Sget)
+		err := fs.sums(p, blksz, c)
+		close(c, err)
+	}()
+	return c
+}
@@ -0,0 +1,55 @@
+package zux
+
+import (
+	"clive/zx"
+	"clive/zx/pred"
+	"fmt"
+)
+
+// Are there watchers that must learn from us about a change?
+// If the OS reports changes, we must report only those the OS can't
+// see (e.g., updates of zx attributes).
+func (fs *Fs) watching(osvisible bool) bool {
+	return fs.w.Active() || !osvisible && fs.ino.active()
+}
+
+// Report a change made through fs to the watchers.
+func (fs *Fs) changed(d zx.Dir, chg string) {
+	if d == nil {
+		return
+	}
+	d = d.Dup()
+	d["Chg"] = chg
+	fs.w.Post(d)
+	fs.ino.post(d)
+}
+
+// See zx.Watcher.
+// On Linux, changes are learned from inotify(7) and include those made
+// by other processes.
+// Elsewhere, only changes made through this tree are reported.
+// Changes that only affect zx attributes are always reported from
+// those made through this tree.
+func (fs *Fs) Watch(p, fpred string) <-chan zx.Dir {
+	c := make(chan zx.Dir)
+	d, err := fs.stat(p, true)
+	if err != nil {
+		close(c, err)
+		return c
+	}
+	x, err := pred.New(fpred)
+	if err != nil {
+		close(c, err)
+		return c
+	}
+	if fs.zxperms && !d.CanGet(fs.ai) {
+		close(c, fmt.Errorf("%s: %s", p, zx.ErrPerm))
+		return c
+	}
+	w := zx.NewWatch(d["path"], x.Match)
+	if err := fs.osWatch(w, d["type"] == "d"); err != nil {
+		close(c, err)
+		return c
+	}
+	return w.C
+}
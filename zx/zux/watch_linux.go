@@ -0,0 +1,388 @@
+// +build linux
+
+package zux
+
+import (
+	"clive/zx"
+	"fmt"
+	"io/ioutil"
+	fpath "path"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+const inoMask = syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_CLOSE_WRITE |
+	syscall.IN_ATTRIB | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO |
+	syscall.IN_DELETE_SELF | syscall.IN_MOVE_SELF
+
+// inotify state for a watch
+struct inotify {
+	fs    *Fs
+	w     *zx.Watch
+	fd    int
+	epfd  int    // to wait for events with a timeout
+	pfd   [2]int // to wake up the loop for changes posted by the Fs
+	top   string           // top dir watched
+	all   bool             // watch dirs under top as well
+	wds   map[int32]string // watch descriptor to zx path
+	moved map[uint32]zx.Dir
+
+	lk    sync.Mutex // for the fields below
+	posts []*fsPost
+	ended bool
+}
+
+// A change reported by the Fs
+struct fsPost {
+	d     zx.Dir
+	donec chan bool
+}
+
+// The inotify watches for a tree (shared by all its auth views)
+struct inotifies {
+	sync.Mutex
+	set map[*inotify]bool
+}
+
+// Interval to check if a watch has ended while there are no events (ms)
+const inoPoll = 1000
+
+func (is *inotifies) add(in *inotify) {
+	is.Lock()
+	if is.set == nil {
+		is.set = map[*inotify]bool{}
+	}
+	is.set[in] = true
+	is.Unlock()
+}
+
+func (is *inotifies) del(in *inotify) {
+	is.Lock()
+	delete(is.set, in)
+	is.Unlock()
+}
+
+func (is *inotifies) active() bool {
+	is.Lock()
+	defer is.Unlock()
+	return len(is.set) > 0
+}
+
+// Report a change the OS can't see through the inotify watches.
+// The changes are sent by the watch loops after the events already
+// queued by the OS, so they are seen in the order they were made.
+func (is *inotifies) post(d zx.Dir) {
+	is.Lock()
+	il := make([]*inotify, 0, len(is.set))
+	for in := range is.set {
+		il = append(il, in)
+	}
+	is.Unlock()
+	for _, in := range il {
+		in.fsPost(d.Dup())
+	}
+}
+
+// Changes are learned from the OS.
+// Those the OS can't see are sent by the Fs through the inotify loop.
+func (fs *Fs) osWatch(w *zx.Watch, isdir bool) error {
+	in := &inotify{
+		fs:    fs,
+		w:     w,
+		top:   w.Path,
+		all:   isdir,
+		wds:   map[int32]string{},
+		moved: map[uint32]zx.Dir{},
+		fd:    -1,
+		epfd:  -1,
+		pfd:   [2]int{-1, -1},
+	}
+	if !isdir {
+		in.top = fpath.Dir(w.Path)
+	}
+	if err := in.open(); err != nil {
+		in.close()
+		return err
+	}
+	if err := in.addTree(in.top); err != nil {
+		in.close()
+		return err
+	}
+	fs.ino.add(in)
+	go in.loop()
+	return nil
+}
+
+func (in *inotify) open() error {
+	var err error
+	in.fd, err = syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return err
+	}
+	if err = syscall.Pipe2(in.pfd[:], syscall.O_CLOEXEC|syscall.O_NONBLOCK); err != nil {
+		return err
+	}
+	if in.epfd, err = syscall.EpollCreate1(syscall.EPOLL_CLOEXEC); err != nil {
+		return err
+	}
+	for _, fd := range []int{in.fd, in.pfd[0]} {
+		ev := &syscall.EpollEvent{Events: syscall.EPOLLIN, Fd: int32(fd)}
+		if err := syscall.EpollCtl(in.epfd, syscall.EPOLL_CTL_ADD, fd, ev); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (in *inotify) close() {
+	for _, fd := range []int{in.epfd, in.fd, in.pfd[0], in.pfd[1]} {
+		if fd >= 0 {
+			syscall.Close(fd)
+		}
+	}
+}
+
+// Send d from the loop and wait until it's done.
+func (in *inotify) fsPost(d zx.Dir) {
+	p := &fsPost{d: d, donec: make(chan bool)}
+	in.lk.Lock()
+	if in.ended {
+		in.lk.Unlock()
+		return
+	}
+	in.posts = append(in.posts, p)
+	syscall.Write(in.pfd[1], []byte{0})
+	in.lk.Unlock()
+	<-p.donec
+}
+
+// Send the changes posted by the Fs; return false if the watch is done.
+func (in *inotify) sendPosts() bool {
+	var buf [64]byte
+	for {
+		if n, _ := syscall.Read(in.pfd[0], buf[:]); n <= 0 {
+			break
+		}
+	}
+	in.lk.Lock()
+	pl := in.posts
+	in.posts = nil
+	in.lk.Unlock()
+	ok := true
+	for _, p := range pl {
+		if ok = ok && in.w.Send(p.d); !ok {
+			in.fs.ino.del(in)
+		}
+		close(p.donec)
+	}
+	return ok
+}
+
+// The loop is done; release those waiting for posts.
+func (in *inotify) end() {
+	in.fs.ino.del(in)
+	in.lk.Lock()
+	in.ended = true
+	pl := in.posts
+	in.posts = nil
+	in.lk.Unlock()
+	for _, p := range pl {
+		close(p.donec)
+	}
+	in.close()
+}
+
+func isAttrFile(name string) bool {
+	return name == AttrFile || name == ".#zx" // .#zx was the old AttrFile
+}
+
+func (in *inotify) addTree(p string) error {
+	wd, err := syscall.InotifyAddWatch(in.fd, fpath.Join(in.fs.root, p), inoMask)
+	if err != nil {
+		return err
+	}
+	in.wds[int32(wd)] = p
+	if !in.all {
+		return nil
+	}
+	ds, err := ioutil.ReadDir(fpath.Join(in.fs.root, p))
+	if err != nil {
+		return nil // gone meanwhile
+	}
+	for _, fi := range ds {
+		if fi.IsDir() && !isAttrFile(fi.Name()) {
+			in.addTree(fpath.Join(p, fi.Name()))
+		}
+	}
+	return nil
+}
+
+// forget about dirs at or under p
+func (in *inotify) forget(p string) {
+	for wd, wp := range in.wds {
+		if zx.HasPrefix(wp, p) {
+			syscall.InotifyRmWatch(in.fd, uint32(wd))
+			delete(in.wds, wd)
+		}
+	}
+}
+
+// dirs at or under from are now at or under to
+func (in *inotify) rename(from, to string) {
+	for wd, wp := range in.wds {
+		if zx.HasPrefix(wp, from) {
+			in.wds[wd] = fpath.Join(to, zx.Suffix(wp, from))
+		}
+	}
+}
+
+// what we know of a file that is gone
+func (in *inotify) gone(p string, isdir bool) zx.Dir {
+	d := zx.Dir{
+		"name": fpath.Base(p),
+		"path": p,
+		"type": "-",
+		"addr": fmt.Sprintf("lfs!%s!%s", in.fs.root, p),
+	}
+	if isdir {
+		d["type"] = "d"
+	}
+	return d
+}
+
+func (in *inotify) post(d zx.Dir, chg string) bool {
+	d["Chg"] = chg
+	return in.w.Send(d)
+}
+
+func (in *inotify) postStat(p, chg string) bool {
+	d, err := in.fs.stat(p, false)
+	if err != nil {
+		return true // gone meanwhile; we'll hear about it
+	}
+	return in.post(d, chg)
+}
+
+// Read events until the watch ends.
+// The events queued by the OS are processed before the changes
+// posted by the Fs, to report them in order.
+// We wake up now and then to see if the watch ended while there
+// were no events.
+func (in *inotify) loop() {
+	defer in.end()
+	buf := make([]byte, 64*1024)
+	evs := make([]syscall.EpollEvent, 2)
+	for !in.w.Done() {
+		_, err := syscall.EpollWait(in.epfd, evs, inoPoll)
+		if err != nil && err != syscall.EINTR {
+			in.w.End(err)
+			return
+		}
+		if !in.readEvents(buf) || !in.sendPosts() {
+			return
+		}
+	}
+}
+
+// Process the events queued; return false if the watch is done.
+func (in *inotify) readEvents(buf []byte) bool {
+	for {
+		n, err := syscall.Read(in.fd, buf)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err == syscall.EAGAIN || n == 0 {
+			return true
+		}
+		if err != nil {
+			in.w.End(err)
+			return false
+		}
+		for off := 0; off+syscall.SizeofInotifyEvent <= n; {
+			ev := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			off += syscall.SizeofInotifyEvent
+			name := strings.TrimRight(string(buf[off:off+int(ev.Len)]), "\x00")
+			off += int(ev.Len)
+			if !in.event(ev, name) {
+				return false
+			}
+		}
+		// moves out of the tree are seen as removes
+		for k, d := range in.moved {
+			delete(in.moved, k)
+			if d["type"] == "d" {
+				in.forget(d["path"])
+			}
+			if !in.post(d, zx.Removed) {
+				return false
+			}
+		}
+	}
+}
+
+// Process an event and return false if the watch is done
+func (in *inotify) event(ev *syscall.InotifyEvent, name string) bool {
+	m := ev.Mask
+	if m&syscall.IN_Q_OVERFLOW != 0 {
+		return in.postStat(in.w.Path, zx.Updated)
+	}
+	dp, ok := in.wds[ev.Wd]
+	if !ok {
+		return true
+	}
+	if m&syscall.IN_IGNORED != 0 {
+		delete(in.wds, ev.Wd)
+		return true
+	}
+	if m&(syscall.IN_DELETE_SELF|syscall.IN_MOVE_SELF) != 0 {
+		if dp != in.top {
+			return true // reported by the parent
+		}
+		in.post(in.gone(dp, true), zx.Removed)
+		in.w.End(fmt.Errorf("%s: %s", dp, zx.ErrNotExist))
+		return false
+	}
+	if isAttrFile(name) {
+		// zx attributes are reported by the Fs
+		return true
+	}
+	p := dp
+	if name != "" {
+		p = fpath.Join(dp, name)
+	}
+	isdir := m&syscall.IN_ISDIR != 0
+	switch {
+	case m&syscall.IN_CREATE != 0:
+		if isdir && in.all {
+			in.addTree(p)
+		}
+		return in.postStat(p, zx.Created)
+	case m&(syscall.IN_CLOSE_WRITE|syscall.IN_ATTRIB) != 0:
+		return in.postStat(p, zx.Updated)
+	case m&syscall.IN_DELETE != 0:
+		return in.post(in.gone(p, isdir), zx.Removed)
+	case m&syscall.IN_MOVED_FROM != 0:
+		in.moved[ev.Cookie] = in.gone(p, isdir)
+	case m&syscall.IN_MOVED_TO != 0:
+		from, ok := in.moved[ev.Cookie]
+		if !ok {
+			if isdir && in.all {
+				in.addTree(p)
+			}
+			return in.postStat(p, zx.Created)
+		}
+		delete(in.moved, ev.Cookie)
+		if isdir {
+			in.rename(from["path"], p)
+		}
+		d, err := in.fs.stat(p, false)
+		if err != nil {
+			return true
+		}
+		d["From"] = from["path"]
+		return in.post(d, zx.Moved)
+	}
+	return true
+}
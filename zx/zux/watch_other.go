@@ -0,0 +1,22 @@
+// +build !linux
+
+package zux
+
+import (
+	"clive/zx"
+)
+
+// The OS does not report changes; we do it for those made through the Fs.
+struct inotifies {}
+
+func (fs *Fs) osWatch(w *zx.Watch, isdir bool) error {
+	fs.w.Add(w)
+	return nil
+}
+
+func (is *inotifies) active() bool {
+	return false
+}
+
+func (is *inotifies) post(d zx.Dir) {
+}
@@ -30,8 +30,11 @@ struct Fs {
 	*zx.Stats
 	ai      *auth.Info
 	root    string
+	rroot   string // root with symlinks evaluated
 	attrs   bool
 	zxperms bool
+	w       *zx.Watches // watches with changes reported by the Fs
+	ino     *inotifies  // watches with changes reported by the OS
 }
 
 var ctldir = zx.Dir{
@@ -51,8 +54,9 @@ var (
 	uids   = map[uint32]string{}
 	uidslk sync.Mutex
 
-	dontremove bool      // set during testing to prevent removes
-	_fs        zx.FullFs = &Fs{}
+	dontremove bool       // set during testing to prevent removes
+	_fs        zx.FullFs  = &Fs{}
+	_fs2       zx.Watcher = &Fs{}
 
 	paranoia = false // if true, would panic if removing outside /tmp/...
 )
@@ -91,13 +95,20 @@ func new(root string, attrs bool) (*Fs, error) {
 	if err != nil {
 		return nil, err
 	}
+	rp, err := filepath.EvalSymlinks(p)
+	if err != nil {
+		return nil, err
+	}
 	tag := fpath.Base(root)
 	fs := &Fs{
 		root:  p,
+		rroot: rp,
 		attrs: attrs,
 		Flag:  &dbg.Flag{Tag: tag},
 		Flags: &zx.Flags{},
 		Stats: &zx.Stats{},
+		w:     &zx.Watches{},
+		ino:   &inotifies{},
 	}
 	fs.Flags.Add("debug", &fs.Debug)
 	fs.Flags.AddRO("attrs", &fs.attrs)
@@ -189,10 +200,21 @@ func (fs *Fs) stat(p string, chk bool) (zx.Dir, error) {
 	}
 	path := fpath.Join(fs.root, p)
 	st, err := os.Stat(path)
+	if err == nil {
+		err = fs.chkLinks(p, path)
+	}
 	if err != nil {
-		return nil, err
+		// dangling symlinks and those leaving the tree are reported as such
+		lst, lerr := os.Lstat(path)
+		if lerr != nil || fs.chkLinks(p, fpath.Dir(path)) != nil {
+			return nil, err
+		}
+		st = lst
 	}
 	d := newDir(st)
+	if t, err := os.Readlink(path); err == nil {
+		d["Link"] = t
+	}
 	d["path"] = p
 	d["addr"] = fmt.Sprintf("lfs!%s!%s", fs.root, p)
 	if p == "/" {
@@ -275,6 +297,9 @@ func (fs *Fs) get(p string, off, count int64, dc chan<- []byte) error {
 		}
 	}
 	path := fpath.Join(fs.root, p)
+	if err := fs.chkLinks(p, path); err != nil {
+		return err
+	}
 	fd, err := os.Open(path)
 	if err != nil {
 		return err
@@ -346,6 +371,11 @@ Dloop:
 		cpath := fpath.Join(path, fi.Name())
 		d["path"] = cp
 		d["addr"] = fmt.Sprintf("lfs!%s!%s", fs.root, cp)
+		if d["type"] == "l" {
+			if t, err := os.Readlink(cpath); err == nil {
+				d["Link"] = t
+			}
+		}
 		if fs.attrs || fs.zxperms {
 			ac.get(cpath, d)
 		}
@@ -391,9 +421,15 @@ func (fs *Fs) wstat(p string, d zx.Dir, chk bool) error {
 		}
 	}
 	path := fpath.Join(fs.root, p)
+	if err := fs.chkLinks(p, path); err != nil {
+		return err
+	}
 	if _, ok := d["size"]; ok && d["type"] != "d" {
 		sz := d.Size()
 		err = os.Truncate(path, sz)
+		if fs.attrs {
+			ac.dropSum(path)
+		}
 	}
 	if _, ok := d["mode"]; ok {
 		mode := d.Mode()
@@ -424,9 +460,13 @@ func (fs *Fs) Wstat(p string, d zx.Dir) <-chan zx.Dir {
 		}
 		err := fs.wstat(p, d, true)
 		if err == nil {
+			osvisible := d["mode"] != "" || d["mtime"] != "" || d["size"] != ""
 			var d zx.Dir
 			d, err = fs.stat(p, false)
 			if err == nil {
+				if fs.watching(osvisible) {
+					fs.changed(d, zx.Updated)
+				}
 				rc <- d
 			}
 		}
@@ -453,6 +493,10 @@ func (fs *Fs) remove(p string, all bool) error {
 		}
 	}
 	path := fpath.Join(fs.root, p)
+	// links are removed, but not those in the path to them.
+	if err := fs.chkLinks(p, fpath.Dir(path)); err != nil {
+		return err
+	}
 	if dontremove {
 		dbg.Warn("%s: dontremove: rm %s", fs.Tag, path)
 		return nil
@@ -477,7 +521,14 @@ func (fs *Fs) remove(p string, all bool) error {
 
 func (fs *Fs) Remove(p string) <-chan error {
 	c := make(chan error, 1)
+	var d zx.Dir
+	if fs.watching(true) {
+		d, _ = fs.stat(p, false)
+	}
 	err := fs.remove(p, false)
+	if err == nil {
+		fs.changed(d, zx.Removed)
+	}
 	c <- err
 	close(c, err)
 	return c
@@ -485,7 +536,14 @@ func (fs *Fs) Remove(p string) <-chan error {
 
 func (fs *Fs) RemoveAll(p string) <-chan error {
 	c := make(chan error, 1)
+	var d zx.Dir
+	if fs.watching(true) {
+		d, _ = fs.stat(p, false)
+	}
 	err := fs.remove(p, true)
+	if err == nil {
+		fs.changed(d, zx.Removed)
+	}
 	c <- err
 	close(c, err)
 	return c
@@ -534,6 +592,13 @@ func (fs *Fs) move(from, to string) error {
 	}
 	pathfrom := fpath.Join(fs.root, pfrom)
 	pathto := fpath.Join(fs.root, pto)
+	// links are moved, but not those in the paths to them.
+	if err := fs.chkLinks(pfrom, fpath.Dir(pathfrom)); err != nil {
+		return err
+	}
+	if err := fs.chkLinks(pto, fpath.Dir(pathto)); err != nil {
+		return err
+	}
 
 	var d zx.Dir
 	if fs.attrs {
@@ -543,6 +608,9 @@ func (fs *Fs) move(from, to string) error {
 	err = os.Rename(pathfrom, pathto)
 	if err == nil && d != nil {
 		ac.set(pathto, d)
+		if d["sum"] != "" {
+			ac.setSum(pathto, d, d["sum"])
+		}
 	}
 	return err
 }
@@ -551,6 +619,12 @@ func (fs *Fs) Move(from, to string) <-chan error {
 	c := make(chan error, 1)
 	fs.Count(zx.Smove)
 	err := fs.move(from, to)
+	if err == nil && fs.watching(true) {
+		if d, _ := fs.stat(to, false); d != nil {
+			d["From"], _ = zx.UseAbsPath(from)
+			fs.changed(d, zx.Moved)
+		}
+	}
 	c <- err
 	close(c, err)
 	return c
@@ -593,6 +667,13 @@ func (fs *Fs) link(oldp, newp string) error {
 	}
 	pathold := fpath.Join(fs.root, oldp)
 	pathnew := fpath.Join(fs.root, newp)
+	// links are linked, but not those in the paths to them.
+	if err := fs.chkLinks(oldp, fpath.Dir(pathold)); err != nil {
+		return err
+	}
+	if err := fs.chkLinks(newp, fpath.Dir(pathnew)); err != nil {
+		return err
+	}
 	return os.Link(pathold, pathnew)
 }
 
@@ -600,6 +681,10 @@ func (fs *Fs) Link(oldp, newp string) <-chan error {
 	c := make(chan error, 1)
 	fs.Count(zx.Slink)
 	err := fs.link(oldp, newp)
+	if err == nil && fs.watching(true) {
+		d, _ := fs.stat(newp, false)
+		fs.changed(d, zx.Created)
+	}
 	c <- err
 	close(c, err)
 	return c
@@ -615,6 +700,74 @@ func writeBytes(w io.Writer, c <-chan []byte) error {
 	return cerror(c)
 }
 
+// Is the symlink target t, for a link in the dir dp of the tree,
+// within the tree?
+func inTree(dp, t string) bool {
+	if fpath.IsAbs(t) {
+		return false
+	}
+	depth := len(zx.Elems(dp))
+	for _, e := range strings.Split(t, "/") {
+		switch e {
+		case "", ".":
+		case "..":
+			if depth--; depth < 0 {
+				return false
+			}
+		default:
+			depth++
+		}
+	}
+	return true
+}
+
+// Return an error if path (the unix path for p) leaves the tree through
+// symbolic links, or would do so if created, or if it's a dangling link.
+// Trees are served to remote users, and links must not give access
+// to other files.
+func (fs *Fs) chkLinks(p, path string) error {
+	for x := path; ; x = fpath.Dir(x) {
+		rp, err := filepath.EvalSymlinks(x)
+		if err == nil {
+			if !zx.HasPrefix(rp, fs.rroot) {
+				return fmt.Errorf("%s: link leaves the tree: %s", p, zx.ErrPerm)
+			}
+			return nil
+		}
+		if !os.IsNotExist(err) {
+			return err
+		}
+		if _, lerr := os.Lstat(x); lerr == nil {
+			return fmt.Errorf("%s: dangling link: %s", p, zx.ErrPerm)
+		}
+		if x == fs.root || x == "/" {
+			return err
+		}
+	}
+}
+
+// Create a symbolic link at path to the target sent through c.
+// The target must be a relative path within the tree.
+func (fs *Fs) symlink(p, path string, c <-chan []byte) error {
+	if c == nil {
+		return fmt.Errorf("symlink: %s", zx.ErrBadType)
+	}
+	var t bytes.Buffer
+	for b := range c {
+		t.Write(b)
+	}
+	if err := cerror(c); err != nil {
+		return err
+	}
+	if t.Len() == 0 {
+		return fmt.Errorf("symlink: %s", zx.ErrBadType)
+	}
+	if !inTree(fpath.Dir(p), t.String()) {
+		return fmt.Errorf("symlink: %s: target leaves the tree: %s", p, zx.ErrPerm)
+	}
+	return os.Symlink(t.String(), path)
+}
+
 func (fs *Fs) put(p string, d zx.Dir, off int64, c <-chan []byte) error {
 	p, err := zx.UseAbsPath(p)
 	if err != nil {
@@ -625,6 +778,9 @@ func (fs *Fs) put(p string, d zx.Dir, off int64, c <-chan []byte) error {
 	}
 	mkall := false
 	path := fpath.Join(fs.root, p)
+	if err := fs.chkLinks(p, path); err != nil {
+		return err
+	}
 	flg := os.O_RDWR // in case we resize it
 	if d["type"] == "F" {
 		d["type"] = "-"
@@ -675,6 +831,9 @@ func (fs *Fs) put(p string, d zx.Dir, off int64, c <-chan []byte) error {
 			}
 			return nil
 		}
+		if d["type"] == "l" {
+			return fs.symlink(p, path, c)
+		}
 		if d["type"] != "-" {
 			return zx.ErrBadType
 		}
@@ -706,6 +865,10 @@ func (fs *Fs) put(p string, d zx.Dir, off int64, c <-chan []byte) error {
 		return fmt.Errorf("put: %s", err)
 	}
 	defer fd.Close()
+	if fs.attrs {
+		// the mtime might be kept, but the sum is no longer valid
+		ac.dropSum(path)
+	}
 	if sz != -1 {
 		if err := fd.Truncate(sz); err != nil {
 			return err
@@ -736,6 +899,12 @@ func (fs *Fs) Put(p string, d zx.Dir, off int64, c <-chan []byte) <-chan zx.Dir
 	go func() {
 		fs.Count(zx.Sput)
 		d = d.SysDup()
+		chg := zx.Updated
+		if fs.watching(true) {
+			if _, err := fs.stat(p, false); err != nil {
+				chg = zx.Created
+			}
+		}
 		err := fs.put(p, d, off, c)
 		if err != nil {
 			close(c, err)
@@ -744,6 +913,9 @@ func (fs *Fs) Put(p string, d zx.Dir, off int64, c <-chan []byte) <-chan zx.Dir
 			var d zx.Dir
 			d, err = fs.stat(p, false)
 			if err == nil {
+				if fs.watching(true) {
+					fs.changed(d, chg)
+				}
 				rc <- d
 			}
 		}
@@ -754,6 +926,12 @@ func (fs *Fs) Put(p string, d zx.Dir, off int64, c <-chan []byte) <-chan zx.Dir
 
 // d is a dup and can be changed.
 func (fs *Fs) findr(d zx.Dir, fp *pred.Pred, p, spref, dpref string, lvl int, c chan<- zx.Dir) error {
+	if d["type"] == "-" && d["sum"] == "" && fp.Uses("sum") &&
+		(!fs.zxperms || fs.chkGet(p) == nil) {
+		if sum, err := fs.sum(p, d); err == nil {
+			d["sum"] = sum
+		}
+	}
 	match, pruned, err := fp.EvalAt(d, lvl)
 	// fs.Dprintf("findr at %v\n\t%v\n\t%v %v %v\n\n",
 	//	d.LongFmt(), p, match, pruned, err)
@@ -762,7 +940,9 @@ func (fs *Fs) findr(d zx.Dir, fp *pred.Pred, p, spref, dpref string, lvl int, c
 			d["proto"] = "lfs"
 			d["err"] = "pruned"
 		}
-		c <- d
+		if ok := c <- d; !ok {
+			return cerror(c)
+		}
 		return nil
 	}
 	if err != nil {
@@ -874,7 +1054,11 @@ func (fs *Fs) FindGet(path, fpred, spref, dpref string, depth0 int) <-chan face{
 			}
 			bc := fs.Get(p, 0, -1)
 			for d := range bc {
-				c <- d
+				if ok := c <- d; !ok {
+					close(bc, cerror(c))
+					close(dc, cerror(c))
+					return
+				}
 			}
 			if err := cerror(bc); err != nil {
 				c <- err
@@ -5,8 +5,10 @@ import (
 	"clive/u"
 	"clive/zx"
 	"clive/zx/fstest"
+	"io/ioutil"
 	"os"
 	"testing"
+	"time"
 )
 
 const (
@@ -117,3 +119,148 @@ func TestMoves(t *testing.T) {
 func TestAsAFile(t *testing.T) {
 	runTest(t, fstest.AsAFile)
 }
+
+func TestWatches(t *testing.T) {
+	runTest(t, fstest.Watches)
+}
+
+func TestWatchEnd(t *testing.T) {
+	runTest(t, func(t fstest.Fataler, xfs zx.Fs) {
+		fs := xfs.(*Fs)
+		wc := fs.Watch("/a", "")
+		close(wc)
+		// an attribute update is reported by the Fs and ends the watch
+		rc := fs.Wstat("/a/a1", zx.Dir{"foo": "bar"})
+		<-rc
+		if err := cerror(rc); err != nil {
+			t.Fatalf("wstat: %s", err)
+		}
+		if fs.watching(false) {
+			t.Fatalf("watch still active")
+		}
+	})
+}
+
+func TestWatchIdleEnd(t *testing.T) {
+	runTest(t, func(t fstest.Fataler, xfs zx.Fs) {
+		fs := xfs.(*Fs)
+		wc := fs.Watch("/a", "")
+		close(wc)
+		// no changes are made; the loop must notice the close on its own
+		for i := 0; fs.watching(false); i++ {
+			if i == 30 {
+				t.Fatalf("watch still active")
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	})
+}
+
+func TestSums(t *testing.T) {
+	runTest(t, fstest.Sums)
+}
+
+func TestSymlinks(t *testing.T) {
+	runTest(t, func(t fstest.Fataler, xfs zx.Fs) {
+		fs := xfs.(zx.RWFs)
+		c := make(chan []byte, 1)
+		c <- []byte("a/a1")
+		close(c)
+		pc := fs.Put("/l1", zx.Dir{"type": "l"}, 0, c)
+		<-pc
+		if err := cerror(pc); err != nil {
+			t.Fatalf("put: %s", err)
+		}
+		d, err := zx.Stat(fs, "/l1")
+		if err != nil {
+			t.Fatalf("stat: %s", err)
+		}
+		t.Logf("stat %s", d.LongFmt())
+		if d["Link"] != "a/a1" || d["type"] != "-" {
+			t.Fatalf("bad link %s", d.LongFmt())
+		}
+		ds, err := zx.GetDir(fs, "/")
+		if err != nil {
+			t.Fatalf("getdir: %s", err)
+		}
+		n := 0
+		for _, d := range ds {
+			if d["name"] == "l1" {
+				n++
+				if d["type"] != "l" || d["Link"] != "a/a1" {
+					t.Fatalf("bad link entry %s", d.LongFmt())
+				}
+			}
+		}
+		if n != 1 {
+			t.Fatalf("link not listed")
+		}
+		if err := <-fs.Remove("/a/a1"); err != nil {
+			t.Fatalf("remove: %s", err)
+		}
+		d, err = zx.Stat(fs, "/l1")
+		if err != nil || d["type"] != "l" {
+			t.Fatalf("dangling link: %v %s", err, d.LongFmt())
+		}
+		if err := <-fs.Remove("/l1"); err != nil {
+			t.Fatalf("remove: %s", err)
+		}
+
+		// links may not leave the tree
+		for _, tg := range []string{"/etc/passwd", "../../x", "a/../../../x", "./../.."} {
+			c := make(chan []byte, 1)
+			c <- []byte(tg)
+			close(c)
+			pc := fs.Put("/a/l2", zx.Dir{"type": "l"}, 0, c)
+			<-pc
+			if err := cerror(pc); !zx.IsPerm(err) {
+				t.Fatalf("put link to %s: %v", tg, err)
+			}
+		}
+		if err := os.Symlink("/etc/passwd", tdir+"/l3"); err != nil {
+			t.Fatalf("symlink: %s", err)
+		}
+		if err := os.Symlink("/tmp", tdir+"/l4"); err != nil {
+			t.Fatalf("symlink: %s", err)
+		}
+		if _, err := zx.GetAll(fs, "/l3"); !zx.IsPerm(err) {
+			t.Fatalf("get through link: %v", err)
+		}
+		if err := zx.PutAll(fs, "/l3", []byte("x")); !zx.IsPerm(err) {
+			t.Fatalf("put through link: %v", err)
+		}
+		if err := zx.PutAll(fs, "/l4/zx_test_x", []byte("x")); !zx.IsPerm(err) {
+			t.Fatalf("put through dir link: %v", err)
+		}
+		if d, err := zx.Stat(fs, "/l3"); err != nil || d["type"] != "l" {
+			t.Fatalf("stat link out of the tree: %v %s", err, d.LongFmt())
+		}
+		out := "/tmp/zx_test_out"
+		if err := ioutil.WriteFile(out, []byte("x"), 0644); err != nil {
+			t.Fatalf("write: %s", err)
+		}
+		defer os.Remove(out)
+		ffs := xfs.(zx.FullFs)
+		if err := <-ffs.Link("/l4/zx_test_out", "/x"); !zx.IsPerm(err) {
+			t.Fatalf("link through dir link: %v", err)
+		}
+		if err := <-ffs.Link("/1", "/l4/zx_test_x"); !zx.IsPerm(err) {
+			t.Fatalf("link into dir link: %v", err)
+		}
+		if err := <-ffs.Move("/l4/zx_test_out", "/x"); !zx.IsPerm(err) {
+			t.Fatalf("move through dir link: %v", err)
+		}
+		if err := <-ffs.Move("/1", "/l4/zx_test_x"); !zx.IsPerm(err) {
+			t.Fatalf("move into dir link: %v", err)
+		}
+		if err := <-fs.Remove("/l4/zx_test_out"); !zx.IsPerm(err) {
+			t.Fatalf("remove through dir link: %v", err)
+		}
+		if _, err := os.Stat(out); err != nil {
+			t.Fatalf("file out of the tree: %s", err)
+		}
+		if err := <-fs.Remove("/l3"); err != nil {
+			t.Fatalf("remove link out of the tree: %v", err)
+		}
+	})
+}
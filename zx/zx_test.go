@@ -232,3 +232,38 @@ func TestDir(t *testing.T) {
 	}
 
 }
+
+func TestWatchOverflow(t *testing.T) {
+	var ws Watches
+	w := NewWatch("/a", nil)
+	ws.Add(w)
+	n := cap(w.C) + 10
+	for i := 0; i < n; i++ {
+		// must not block
+		ws.Post(Dir{"path": fmt.Sprintf("/a/f%d", i), "Chg": Created})
+	}
+	ws.Post(Dir{"path": "/b", "Chg": Created})
+	if len(w.C) != cap(w.C) {
+		t.Fatalf("%d changes buffered", len(w.C))
+	}
+	for i := 0; i < cap(w.C)-1; i++ {
+		d := <-w.C
+		if p := fmt.Sprintf("/a/f%d", i); d["path"] != p {
+			t.Fatalf("got %s; expected %s", d["path"], p)
+		}
+	}
+	d := <-w.C
+	printf("%s\n", d)
+	if d["Chg"] != Overflow || d["path"] != "/a" {
+		t.Fatalf("no overflow: %s", d)
+	}
+	ws.Post(Dir{"path": "/a/x", "Chg": Created})
+	if d := <-w.C; d["path"] != "/a/x" {
+		t.Fatalf("got %s", d)
+	}
+	close(w.C)
+	ws.Post(Dir{"path": "/a/y", "Chg": Created})
+	if ws.Active() || !w.Done() {
+		t.Fatalf("watch not gone")
+	}
+}
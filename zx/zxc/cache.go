@@ -9,6 +9,7 @@ import (
 	"fmt"
 	"io"
 	"os"
+	fpath "path"
 	"sync"
 	"time"
 )
@@ -60,6 +61,8 @@ interface fsFile {
 	inval()
 	gotMeta(d zx.Dir) error
 	gotData(c <-chan []byte) error
+	oldSums(blksz int64) [][]byte // nil if there's no old data worth it
+	gotDeltas(c <-chan face{}) error
 	gotDir(cds []zx.Dir) error
 	gone() // the file is gone from rfs
 	walk1(el string) (fsFile, error)
@@ -67,6 +70,7 @@ interface fsFile {
 	getDir() ([]zx.Dir, error)
 	newFile(d zx.Dir, rfs zx.Fs) (fsFile, error)
 	remove(all bool) error
+	relink(name string, to fsFile, nname string) error // both locked
 	// releases the Lock before it returns
 	getData(off, count int64, c chan<- []byte) error
 	// releases the Lock before it returns
@@ -81,17 +85,28 @@ struct cFile {
 	wd zx.Dir // attributes to be updated
 }
 
+// storage for the data of a cached file
+interface fileData {
+	Len() int
+	Reset()
+	Truncate(n int64) error
+	Write(p []byte) (int, error)
+	SendTo(off, count int64, c chan<- []byte) (int64, int, error)
+	RecvFrom(off int64, c <-chan []byte) (int64, int, error)
+}
+
 // cache file entry for a file
 struct mFile {
 	cFile
 	c     *mCache
 	sts   cStatus
 	child map[string]*mFile
-	data  *mblk.Buffer
+	data  fileData
 	t     time.Time
+	base  zx.Dir // server's mtime and vers when we got it
 }
 
-var ctlfile = &mFile{cFile: cFile{d: ctldir}}
+var ctlfile = &mFile{cFile: cFile{d: ctldir}, data: &mblk.Buffer{}}
 
 // operations for the zxc cache.
 interface fsCache {
@@ -99,17 +114,26 @@ interface fsCache {
 	root() fsFile
 	sync(rfs zx.Fs) error
 	inval()
+	invalPath(p string)
+	moved(from, to string)
+	reintegrate(rfs zx.Fs, cr *conflicts) error
 	dump()
 }
 
 // In-memory cache including both data and metadata.
 // if it's synchronous, meta never seems to be ok, so we stat the
 // underlying fs all the times, and we sync right after every update operation.
+// If store is set, file data is kept there instead of in memory.
+// Moves made while disconnected are kept in mvs until reintegrated.
 struct mCache {
 	dbg.Flag
 	Verb  bool
-	stats bool // synchronous cache
-	slash *mFile
+	stats  bool // synchronous cache
+	deltas bool // keep old data to transfer just the changes
+	slash  *mFile
+	store  *dStore
+	mvlk   sync.Mutex
+	mvs    []mvOp
 }
 
 func (c cStatus) String() string {
@@ -247,13 +271,33 @@ func (mf *mFile) inval() {
 		mf.Dprintf("inval: cNewMeta\n")
 		mf.sts = cNewMeta
 		mf.data.Reset()
-	case cNew, cNewMeta, cDel, cGone, cData:
+	case cNew, cNewMeta:
+		// drop old data kept by stale
+		mf.data.Reset()
+	case cDel, cGone, cData:
 		// as it was
 	default:
 		panic("bad state")
 	}
 }
 
+// Like inval, but old data is kept, so we can get just the changes
+// if rfs is a zx.Deltaer.
+func (mf *mFile) stale() {
+	if mf.c == nil || !mf.c.deltas {
+		mf.inval()
+		return
+	}
+	switch mf.sts {
+	case cClean:
+		mf.Dprintf("stale: cNew\n")
+		mf.sts = cNew
+	case cMeta:
+		mf.Dprintf("stale: cNewMeta\n")
+		mf.sts = cNewMeta
+	}
+}
+
 func (mf *mFile) dirtyMeta() {
 	switch mf.sts {
 	case cNew:
@@ -284,10 +328,11 @@ func (mf *mFile) gotMeta(d zx.Dir) error {
 		mf.gone()
 		mf.sts = cNew
 		mf.d = d
+		mf.setBase(d)
 		if d["type"] == "d" {
 			mf.child = map[string]*mFile{}
 		} else {
-			mf.data = &mblk.Buffer{}
+			mf.data = mf.c.newData(mf)
 		}
 		return nil
 	}
@@ -295,8 +340,11 @@ func (mf *mFile) gotMeta(d zx.Dir) error {
 		mf.sts = cNew
 	}
 	if mf.sts != cData && (!mf.d.Time("mtime").Equal(d.Time("mtime")) ||
-		mf.d.Size() != d.Size()) {
-		mf.inval()
+		mf.d.Size() != d.Size()) && !sameSum(mf.d, d) {
+		mf.stale()
+	}
+	if mf.sts == cNew || mf.sts == cClean {
+		mf.setBase(d)
 	}
 	mf.d = d.Dup()
 	for k, v := range mf.wd {
@@ -310,11 +358,29 @@ func (mf *mFile) gotMeta(d zx.Dir) error {
 	return nil
 }
 
+// Do d0 and d1 report the same contents (by their "sum" attributes)?
+func sameSum(d0, d1 zx.Dir) bool {
+	return d0["sum"] != "" && d0["sum"] == d1["sum"] && d0["size"] == d1["size"]
+}
+
+// Record the server's version of the file, to detect conflicts
+// when reintegrating changes made while disconnected.
+// If d does not say, we assume the server has what we have.
+func (mf *mFile) setBase(d zx.Dir) {
+	if d == nil || d["mtime"] == "" {
+		d = mf.d
+	}
+	mf.base = zx.Dir{"mtime": d["mtime"]}
+	if v := d["vers"]; v != "" {
+		mf.base["vers"] = v
+	}
+}
+
 func (mf *mFile) gotData(c <-chan []byte) error {
 	if mf.d["name"] == ".zx" {
 		return nil
 	}
-	ndata := &mblk.Buffer{}
+	ndata := mf.c.newData(mf)
 	if mf.wd == nil {
 		mf.wd = zx.Dir{}
 	}
@@ -335,10 +401,16 @@ func (mf *mFile) gotData(c <-chan []byte) error {
 	}
 	if err != nil {
 		mf.Dprintf("got data: failed: %s\n", err)
+		if nd, ok := ndata.(*dData); ok {
+			nd.release()
+		}
 		return err
 	}
 	mf.d.SetSize(tot)
 	delete(mf.wd, "size")
+	if od, ok := mf.data.(*dData); ok {
+		od.release()
+	}
 	mf.data = ndata
 	mf.Dprintf("got data: %d %d %d bytes\n", tot, mf.d.Size(), mf.data.Len())
 	switch mf.sts {
@@ -352,6 +424,85 @@ func (mf *mFile) gotData(c <-chan []byte) error {
 	return nil
 }
 
+// Return the sums for blocks of blksz bytes of the old data
+// kept for mf, or nil if there's not enough to get just the changes.
+func (mf *mFile) oldSums(blksz int64) [][]byte {
+	if mf.c == nil || !mf.c.deltas || mf.d["type"] == "d" ||
+		mf.d["name"] == ".zx" || int64(mf.data.Len()) < blksz {
+		return nil
+	}
+	c := make(chan []byte)
+	go func() {
+		_, _, err := mf.data.SendTo(0, -1, c)
+		close(c, err)
+	}()
+	sums, err := zx.BlockSums(c, blksz)
+	if err != nil {
+		mf.Dprintf("old sums: %s\n", err)
+		return nil
+	}
+	return sums
+}
+
+// Update the old data using the dir and deltas from c (see zx.Deltaer).
+// If it fails, the data is left as it was or partially updated, but
+// mf is not clean and the next attempt still gets just the changes.
+func (mf *mFile) gotDeltas(c <-chan face{}) error {
+	x, ok := <-c
+	d, isdir := x.(zx.Dir)
+	if !ok || !isdir {
+		err := cerror(c)
+		if err == nil {
+			err = errors.New("no dir in deltas")
+		}
+		close(c, err)
+		mf.Dprintf("got deltas: failed: %s\n", err)
+		return err
+	}
+	var tot int64
+	n := 0
+	for x := range c {
+		dl, ok := x.(zx.Delta)
+		if !ok {
+			err := errors.New("bad delta type")
+			close(c, err)
+			return err
+		}
+		bc := make(chan []byte, 1)
+		bc <- dl.Data
+		close(bc)
+		nw, _, err := mf.data.RecvFrom(dl.Off, bc)
+		if err != nil {
+			close(c, err)
+			return err
+		}
+		tot += nw
+		n++
+	}
+	if err := cerror(c); err != nil {
+		mf.Dprintf("got deltas: failed: %s\n", err)
+		return err
+	}
+	sz := d.Size()
+	if err := mf.data.Truncate(sz); err != nil {
+		return err
+	}
+	mf.d.SetSize(sz)
+	if mf.wd != nil {
+		delete(mf.wd, "size")
+	}
+	mf.Dprintf("got deltas: %d deltas %d bytes, size %d\n", n, tot, sz)
+	switch mf.sts {
+	case cNewMeta:
+		mf.sts = cMeta
+		mf.Dprintf("got deltas: cMeta\n")
+	default:
+		mf.sts = cClean
+		mf.Dprintf("got deltas: cClean\n")
+	}
+	return nil
+}
+
 func (mf *mFile) wstat(nd zx.Dir) error {
 	if mf.wd == nil {
 		mf.wd = zx.Dir{}
@@ -361,6 +512,7 @@ func (mf *mFile) wstat(nd zx.Dir) error {
 		if sz := nd.Size(); sz != int64(mf.data.Len()) {
 			mf.data.Truncate(sz)
 			mf.d.SetSize(sz)
+			delete(mf.d, "sum")
 		}
 	}
 	some := false
@@ -369,7 +521,7 @@ func (mf *mFile) wstat(nd zx.Dir) error {
 			continue
 		}
 		switch k {
-		case "path", "addr", "type", "name", "size":
+		case "path", "addr", "type", "name", "size", "sum":
 			// ignored
 		case "wuid":
 			fallthrough
@@ -412,8 +564,8 @@ func (mf *mFile) gotDir(cds []zx.Dir) error {
 			cf.gotMeta(cd)
 			cf.Unlock()
 		} else {
-			var mc *mCache
-			nf, _ := mc.newFile(cd)
+			nf, _ := mf.c.newFile(cd)
+			nf.setBase(cd)
 			mf.child[nm] = nf
 			nf.c = mf.c
 		}
@@ -488,8 +640,7 @@ func (mf *mFile) newFile(d zx.Dir, rfs zx.Fs) (fsFile, error) {
 			oc.sync(fs)
 		}
 	}
-	var mc *mCache
-	nf, err := mc.newFile(d)
+	nf, err := mf.c.newFile(d)
 	if err != nil {
 		return nil, err
 	}
@@ -525,6 +676,7 @@ func (mf *mFile) putData(off int64, c <-chan []byte, umtime string) error {
 	mf.Lock()
 	mf.dirtyData()
 	mf.d.SetSize(int64(mf.data.Len()))
+	delete(mf.d, "sum")
 	if mf.sts != cDel {
 		if umtime != "" {
 			mf.d["mtime"] = umtime
@@ -593,7 +745,56 @@ func (mf *mFile) invalAll() {
 	mf.Unlock()
 }
 
+// Put the data for mf (or create the dir) at p in rfs.
+// mf is locked.
+func (mf *mFile) put(rfs zx.RWFs, p string, d zx.Dir) (zx.Dir, error) {
+	c := make(chan []byte)
+	if mf.d["type"] == "d" {
+		close(c)
+	}
+	rc := rfs.Put(p, d, 0, c)
+	if mf.d["type"] != "d" {
+		// NB: we don't unlock to sync a single version.
+		_, _, err := mf.data.SendTo(0, -1, c)
+		close(c, err)
+		if err != nil {
+			dbg.Warn("sync: send: %s", err)
+		}
+	}
+	rd := <-rc
+	return rd, cerror(rc)
+}
+
+// Like put, but if rfs is a zx.Deltaer and it had the file,
+// send just the blocks that changed.
+// mf is locked.
+func (mf *mFile) deltaPut(rfs zx.RWFs, p string, d zx.Dir) (zx.Dir, error) {
+	dfs, ok := rfs.(zx.Deltaer)
+	if !ok || !mf.c.deltas || mf.d["type"] == "d" || mf.base == nil ||
+		int64(mf.data.Len()) < zx.DeltaBlkSz {
+		return mf.put(rfs, p, d)
+	}
+	c := make(chan []byte)
+	rc := dfs.DeltaPut(p, d, zx.DeltaBlkSz, c)
+	_, _, err := mf.data.SendTo(0, -1, c)
+	close(c, err)
+	rd := <-rc
+	if err = cerror(rc); zx.IsNotExist(err) {
+		// not there; send it all
+		mf.Dprintf("sync: delta put: %s\n", err)
+		return mf.put(rfs, p, d)
+	}
+	return rd, err
+}
+
 func (mf *mFile) sync(fs zx.Fs) error {
+	return mf.xsync(fs, nil)
+}
+
+// Sync mf and its children.
+// If cr is not nil, we are reintegrating changes made while
+// disconnected, and conflicts are checked and reported in cr.
+func (mf *mFile) xsync(fs zx.Fs, cr *conflicts) error {
 	rfs, ok := fs.(zx.RWFs)
 	if !ok {
 		return errors.New("rfs does not support put/wstat/remove")
@@ -605,10 +806,18 @@ func (mf *mFile) sync(fs zx.Fs) error {
 		mf.Unlock()
 		return nil
 	}
+	cp := "" // where to keep our copy, if in conflict
+	if cr != nil {
+		cp, err = mf.chkConflict(rfs, cr)
+		if err != nil {
+			mf.Unlock()
+			return err
+		}
+	}
 	switch mf.sts {
 	case cDel: // try to del children first
 		for _, cf := range mf.child {
-			if e := cf.sync(rfs); e != nil && !zx.IsNotExist(e) {
+			if e := cf.xsync(rfs, cr); e != nil && !zx.IsNotExist(e) {
 				if err == nil {
 					err = e
 				}
@@ -635,34 +844,30 @@ func (mf *mFile) sync(fs zx.Fs) error {
 		if err = cerror(wc); err != nil {
 			dbg.Warn("sync: wstat: %s", err)
 		} else {
-			// we could update our stat with the returned one
-			_ = rd
+			mf.setBase(rd)
 			mf.wd = nil
 			mf.sts = cNew
 			mf.Dprintf("sync: wstat, cNew\n")
 		}
 	case cData:
-		mf.vprintf("sync: put %s", mf)
-		c := make(chan []byte)
-		if mf.d["type"] == "d" {
-			close(c)
-		}
 		mf.d.SetSize(int64(mf.data.Len()))
-		rc := rfs.Put(mf.d["path"], mf.d, 0, c)
-		if mf.d["type"] != "d" {
-			// NB: we don't unlock to sync a single version.
-			_, _, err = mf.data.SendTo(0, -1, c)
-			close(c, err)
-			if err != nil {
-				dbg.Warn("sync: send: %s", err)
-			}
+		p, d := mf.d["path"], mf.d
+		if cp != "" {
+			// keep our copy as a sibling
+			p = cp
+			d = d.Dup()
+			d["path"] = p
+			d["name"] = fpath.Base(p)
+			d["addr"] = "zxc!" + p
 		}
-		rd := <-rc
-		if err = cerror(rc); err != nil {
+		mf.vprintf("sync: put %s", p)
+		var rd zx.Dir
+		if rd, err = mf.deltaPut(rfs, p, d); err != nil {
 			dbg.Warn("sync: put: %s", err)
+		} else if cp != "" {
+			mf.discard()
 		} else {
-			// we could update our stat with the returned one
-			_ = rd
+			mf.setBase(rd)
 			mf.wd = nil
 			mf.sts = cClean
 			mf.Dprintf("sync: put, cClean\n")
@@ -683,7 +888,7 @@ func (mf *mFile) sync(fs zx.Fs) error {
 		// We sync all files concurrently, perhaps
 		// this is too much; we'll see.
 		go func() {
-			errc <- c.sync(rfs)
+			errc <- c.xsync(rfs, cr)
 		}()
 	}
 	for i := 0; i < len(cs); i++ {
@@ -698,7 +903,7 @@ func (mf *mFile) sync(fs zx.Fs) error {
 	}
 	// Sequential sync for dirs
 	for _, c := range ds {
-		if e := c.sync(rfs); e != nil {
+		if e := c.xsync(rfs, cr); e != nil {
 			if zx.IsIOError(e) {
 				return e
 			}
@@ -722,17 +927,27 @@ func (mc *mCache) newFile(d zx.Dir) (*mFile, error) {
 	}
 	if d["type"] == "d" {
 		f.child = map[string]*mFile{}
-	} else {
-		f.data = &mblk.Buffer{}
 	}
+	f.data = mc.newData(f)
 	return f, nil
 }
 
+// make a new (empty) data buffer for mf
+func (mc *mCache) newData(mf *mFile) fileData {
+	if mc != nil && mc.store != nil {
+		return mc.store.newData(mf)
+	}
+	return &mblk.Buffer{}
+}
+
 func (mc *mCache) setRoot(d zx.Dir) (err error) {
 	if mc.slash != nil {
 		return errors.New("root already set")
 	}
 	mc.slash, err = mc.newFile(d)
+	if err == nil {
+		mc.slash.setBase(d)
+	}
 	return err
 }
 
@@ -773,6 +988,26 @@ func (mc *mCache) inval() {
 	mc.slash.invalAll()
 }
 
+// Invalidate the entry for p (if cached) so it's fetched again when used.
+func (mc *mCache) invalPath(p string) {
+	mf := mc.slash
+	mf.Lock()
+	for _, el := range zx.Elems(p) {
+		cf, ok := mf.child[el]
+		if !ok {
+			mf.Unlock()
+			return
+		}
+		cf.Lock()
+		mf.Unlock()
+		mf = cf
+	}
+	mf.Dprintf("remote inval\n")
+	mf.stale()
+	mf.t = time.Time{}
+	mf.Unlock()
+}
+
 func (mc *mCache) dump() {
 	fmt.Fprintf(os.Stderr, "cache dump:\n")
 	mc.slash.dump(os.Stderr, 0)
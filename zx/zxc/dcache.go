@@ -0,0 +1,600 @@
+package zxc
+
+import (
+	"bytes"
+	"clive/mblk"
+	"clive/zx"
+	"container/list"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// On-disk storage for the data of cached files.
+// Data is kept in files at dir/data; those of clean files are evicted
+// in LRU order when they take more than budget bytes.
+struct dStore {
+	sync.Mutex
+	dir    string
+	budget int        // in bytes; 0 means no limit
+	n      int64      // bytes in use
+	lru    *list.List // of *dData, most recently used first
+	gen    int64      // to make file names
+	evictc chan chan bool // eviction requests; closing the chan sent, if any, when done
+}
+
+// data for a cached file, kept on disk
+struct dData {
+	sync.Mutex
+	s    *dStore
+	mf   *mFile // owner
+	name string // file name at s.dir/data
+	sz   int64
+	el   *list.Element
+}
+
+// On-disk cache.
+// It's an mCache keeping file data in a dStore and saving its
+// metadata at dir/meta when synced, so it can be loaded again later.
+// A cache dir must be used for a single tree.
+struct dCache {
+	*mCache
+	dir    string
+	savelk sync.Mutex
+	saved  map[string]uint32 // crcs of meta files saved
+}
+
+func newStore(dir string) (*dStore, error) {
+	if err := os.MkdirAll(filepath.Join(dir, "data"), 0700); err != nil {
+		return nil, err
+	}
+	s := &dStore{
+		dir:    dir,
+		lru:    list.New(),
+		gen:    time.Now().UnixNano(),
+		evictc: make(chan chan bool, 1),
+	}
+	go s.evicter()
+	return s, nil
+}
+
+func (s *dStore) path(name string) string {
+	return filepath.Join(s.dir, "data", name)
+}
+
+func (s *dStore) newData(mf *mFile) fileData {
+	s.Lock()
+	s.gen++
+	name := strconv.FormatInt(s.gen, 36)
+	s.Unlock()
+	return &dData{s: s, mf: mf, name: name}
+}
+
+// dd is locked
+func (s *dStore) touch(dd *dData) {
+	s.Lock()
+	defer s.Unlock()
+	if dd.el != nil {
+		s.lru.MoveToFront(dd.el)
+	} else if dd.sz > 0 {
+		dd.el = s.lru.PushFront(dd)
+	}
+}
+
+// dd is locked
+func (s *dStore) resized(dd *dData, osz, nsz int64) {
+	s.Lock()
+	s.n += nsz - osz
+	if nsz == 0 && dd.el != nil {
+		s.lru.Remove(dd.el)
+		dd.el = nil
+	}
+	over := s.budget > 0 && s.n > int64(s.budget)
+	s.Unlock()
+	if nsz > 0 {
+		s.touch(dd)
+	}
+	if over {
+		select {
+		case s.evictc <- nil:
+		default:
+		}
+	}
+}
+
+func (s *dStore) over() bool {
+	s.Lock()
+	defer s.Unlock()
+	return s.budget > 0 && s.n > int64(s.budget)
+}
+
+func (s *dStore) evicter() {
+	for donec := range s.evictc {
+		s.evict()
+		if donec != nil {
+			close(donec)
+		}
+	}
+}
+
+// Evict data now if we are over budget and wait until done.
+func (s *dStore) flush() {
+	donec := make(chan bool)
+	s.evictc <- donec
+	<-donec
+}
+
+// Drop the data of clean files (and old data kept for stale ones),
+// least recently used first, until we are within budget.
+func (s *dStore) evict() {
+	s.Lock()
+	dl := make([]*dData, 0, s.lru.Len())
+	for el := s.lru.Back(); el != nil; el = el.Prev() {
+		dl = append(dl, el.Value.(*dData))
+	}
+	s.Unlock()
+	for _, dd := range dl {
+		if !s.over() {
+			return
+		}
+		mf := dd.mf
+		mf.Lock()
+		switch {
+		case mf.data != fileData(dd):
+		case mf.sts == cClean, mf.sts == cMeta, mf.sts == cNew, mf.sts == cNewMeta:
+			mf.Dprintf("evict\n")
+			mf.inval()
+		}
+		mf.Unlock()
+	}
+}
+
+func (dd *dData) path() string {
+	return dd.s.path(dd.name)
+}
+
+func (dd *dData) Len() int {
+	dd.Lock()
+	defer dd.Unlock()
+	return int(dd.sz)
+}
+
+func (dd *dData) Reset() {
+	dd.Truncate(0)
+}
+
+func (dd *dData) Truncate(n int64) error {
+	dd.Lock()
+	defer dd.Unlock()
+	if n == dd.sz {
+		return nil
+	}
+	var err error
+	if n == 0 {
+		if err = os.Remove(dd.path()); os.IsNotExist(err) {
+			err = nil
+		}
+	} else {
+		var fd *os.File
+		fd, err = os.OpenFile(dd.path(), os.O_WRONLY|os.O_CREATE, 0600)
+		if err == nil {
+			err = fd.Truncate(n)
+			fd.Close()
+		}
+	}
+	if err != nil {
+		return err
+	}
+	osz := dd.sz
+	dd.sz = n
+	dd.s.resized(dd, osz, n)
+	return nil
+}
+
+func (dd *dData) Write(p []byte) (int, error) {
+	dd.Lock()
+	defer dd.Unlock()
+	fd, err := os.OpenFile(dd.path(), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return 0, err
+	}
+	n, err := fd.Write(p)
+	if e := fd.Close(); err == nil {
+		err = e
+	}
+	if n > 0 {
+		osz := dd.sz
+		dd.sz += int64(n)
+		dd.s.resized(dd, osz, dd.sz)
+	}
+	return n, err
+}
+
+// Like mblk.Buffer.SendTo
+func (dd *dData) SendTo(off, count int64, c chan<- []byte) (int64, int, error) {
+	if count == 0 {
+		return 0, 0, nil
+	}
+	dd.Lock()
+	if off >= dd.sz {
+		dd.Unlock()
+		return 0, 0, nil
+	}
+	fd, err := os.Open(dd.path())
+	dd.s.touch(dd)
+	dd.Unlock()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer fd.Close()
+	if _, err := fd.Seek(off, 0); err != nil {
+		return 0, 0, err
+	}
+	var tot int64
+	nm := 0
+	for count < 0 || tot < count {
+		sz := int64(mblk.Size)
+		if count > 0 && count-tot < sz {
+			sz = count - tot
+		}
+		buf := make([]byte, sz)
+		nr, err := fd.Read(buf)
+		if nr == 0 {
+			break
+		}
+		tot += int64(nr)
+		if ok := c <- buf[:nr]; !ok {
+			return tot, nm, cerror(c)
+		}
+		nm++
+		if err != nil {
+			break
+		}
+	}
+	return tot, nm, nil
+}
+
+// Like mblk.Buffer.RecvFrom
+func (dd *dData) RecvFrom(off int64, c <-chan []byte) (int64, int, error) {
+	dd.Lock()
+	fd, err := os.OpenFile(dd.path(), os.O_RDWR|os.O_CREATE, 0600)
+	dd.Unlock()
+	if err != nil {
+		return 0, 0, err
+	}
+	if off < 0 {
+		fd.Seek(0, 2)
+	} else {
+		fd.Seek(off, 0)
+	}
+	var tot int64
+	nm := 0
+	for data := range c {
+		nw, werr := fd.Write(data)
+		tot += int64(nw)
+		nm++
+		if werr != nil {
+			err = werr
+			break
+		}
+	}
+	if err == nil {
+		err = cerror(c)
+	}
+	st, serr := fd.Stat()
+	fd.Close()
+	if serr == nil {
+		dd.Lock()
+		osz := dd.sz
+		dd.sz = st.Size()
+		dd.s.resized(dd, osz, dd.sz)
+		dd.Unlock()
+	}
+	return tot, nm, err
+}
+
+// The data is no longer used
+func (dd *dData) release() {
+	dd.Lock()
+	defer dd.Unlock()
+	os.Remove(dd.path())
+	osz := dd.sz
+	dd.sz = 0
+	dd.s.resized(dd, osz, 0)
+}
+
+func newDCache(mc *mCache, dir string) (*dCache, error) {
+	if err := os.MkdirAll(filepath.Join(dir, "meta"), 0700); err != nil {
+		return nil, err
+	}
+	s, err := newStore(dir)
+	if err != nil {
+		return nil, err
+	}
+	mc.store = s
+	return &dCache{mCache: mc, dir: dir, saved: map[string]uint32{}}, nil
+}
+
+func metaName(p string) string {
+	return fmt.Sprintf("%x", sha1.Sum([]byte(p)))
+}
+
+func (dc *dCache) metaPath(name string) string {
+	return filepath.Join(dc.dir, "meta", name)
+}
+
+// Use the cache saved on disk, or start with d as the root if there's none.
+func (dc *dCache) setRoot(d zx.Dir) error {
+	if dc.slash != nil {
+		return errors.New("root already set")
+	}
+	root, err := dc.load()
+	if err != nil {
+		dc.Dprintf("load: %s\n", err)
+		return dc.mCache.setRoot(d)
+	}
+	dc.slash = root
+	dc.mvs = dc.loadMoves()
+	return nil
+}
+
+func (dc *dCache) reintegrate(rfs zx.Fs, cr *conflicts) error {
+	err := dc.mCache.reintegrate(rfs, cr)
+	if e := dc.save(); e != nil && err == nil {
+		err = e
+	}
+	return err
+}
+
+func (dc *dCache) moved(from, to string) {
+	dc.mCache.moved(from, to)
+	if err := dc.save(); err != nil {
+		dc.Dprintf("save: %s\n", err)
+	}
+}
+
+// Moves not yet reintegrated are kept at dir/moves.
+func (dc *dCache) loadMoves() []mvOp {
+	dat, err := ioutil.ReadFile(filepath.Join(dc.dir, "moves"))
+	if err != nil {
+		return nil
+	}
+	var mvs []mvOp
+	for len(dat) > 0 {
+		var d zx.Dir
+		dat, d, err = zx.UnpackDir(dat)
+		if err != nil {
+			dc.Dprintf("load moves: %s\n", err)
+			break
+		}
+		mvs = append(mvs, mvOp{from: d["from"], to: d["to"]})
+	}
+	return mvs
+}
+
+func (dc *dCache) saveMoves() error {
+	fname := filepath.Join(dc.dir, "moves")
+	dc.mvlk.Lock()
+	var buf bytes.Buffer
+	for _, mv := range dc.mvs {
+		buf.Write(zx.Dir{"from": mv.from, "to": mv.to}.Bytes())
+	}
+	dc.mvlk.Unlock()
+	if buf.Len() == 0 {
+		if err := os.Remove(fname); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	if err := ioutil.WriteFile(fname+".tmp", buf.Bytes(), 0600); err != nil {
+		return err
+	}
+	return os.Rename(fname+".tmp", fname)
+}
+
+func (dc *dCache) sync(rfs zx.Fs) error {
+	err := dc.mCache.sync(rfs)
+	if e := dc.save(); e != nil && err == nil {
+		err = e
+	}
+	return err
+}
+
+// mf is locked
+func packEntry(buf *bytes.Buffer, mf *mFile) {
+	d := mf.d.Dup()
+	d["Sts"] = strconv.Itoa(int(mf.sts))
+	for k, v := range mf.base {
+		d["B"+k] = v
+	}
+	if dd, ok := mf.data.(*dData); ok && dd.Len() > 0 {
+		d["Dfile"] = dd.name
+	}
+	buf.Write(d.Bytes())
+	wd := mf.wd
+	if wd == nil {
+		wd = zx.Dir{}
+	}
+	buf.Write(wd.Bytes())
+}
+
+func (dc *dCache) unpackEntry(b []byte, used map[string]bool) ([]byte, *mFile, error) {
+	b, d, err := zx.UnpackDir(b)
+	if err != nil {
+		return nil, nil, err
+	}
+	b, wd, err := zx.UnpackDir(b)
+	if err != nil {
+		return nil, nil, err
+	}
+	sts, err := strconv.Atoi(d["Sts"])
+	if err != nil || sts < int(cNew) || sts > int(cGone) {
+		return nil, nil, fmt.Errorf("%s: bad cache status", d["path"])
+	}
+	dfile := d["Dfile"]
+	delete(d, "Sts")
+	delete(d, "Dfile")
+	var base zx.Dir
+	for _, k := range []string{"mtime", "vers"} {
+		if v, ok := d["B"+k]; ok {
+			if base == nil {
+				base = zx.Dir{}
+			}
+			base[k] = v
+			delete(d, "B"+k)
+		}
+	}
+	mf, _ := dc.newFile(d)
+	mf.base = base
+	mf.sts = cStatus(sts)
+	mf.t = time.Time{} // check with the server before using it
+	if len(wd) > 0 {
+		mf.wd = wd
+	}
+	if dd, ok := mf.data.(*dData); ok && dfile != "" {
+		dd.Lock()
+		dd.name = dfile
+		if st, err := os.Stat(dd.path()); err == nil {
+			dd.sz = st.Size()
+			dd.s.resized(dd, 0, dd.sz)
+			used[dfile] = true
+		}
+		dd.Unlock()
+	}
+	if mf.d["type"] != "d" && (mf.sts == cClean || mf.sts == cMeta) &&
+		int64(mf.data.Len()) != mf.d.Size() {
+		mf.inval()
+	}
+	return b, mf, nil
+}
+
+// Load the cache saved on disk and return its root.
+func (dc *dCache) load() (*mFile, error) {
+	used := map[string]bool{}
+	root, err := dc.loadDir("/", nil, used)
+	if err != nil {
+		return nil, err
+	}
+	// data files not used are left from data replaced before we saved.
+	fis, _ := ioutil.ReadDir(filepath.Join(dc.dir, "data"))
+	for _, fi := range fis {
+		if !used[fi.Name()] {
+			os.Remove(dc.store.path(fi.Name()))
+		}
+	}
+	return root, nil
+}
+
+// Load the entries saved for the dir at p.
+// self is the entry for the dir, already loaded from its parent,
+// and is nil for the root.
+func (dc *dCache) loadDir(p string, self *mFile, used map[string]bool) (*mFile, error) {
+	name := metaName(p)
+	dat, err := ioutil.ReadFile(dc.metaPath(name))
+	if err != nil {
+		return nil, err
+	}
+	sum := crc32.ChecksumIEEE(dat)
+	dat, mf, err := dc.unpackEntry(dat, used)
+	if err != nil {
+		return nil, err
+	}
+	if self != nil {
+		mf = self
+	}
+	for len(dat) > 0 {
+		var cf *mFile
+		dat, cf, err = dc.unpackEntry(dat, used)
+		if err != nil {
+			return nil, err
+		}
+		mf.child[cf.d["name"]] = cf
+	}
+	dc.saved[name] = sum
+	for _, cf := range mf.child {
+		if cf.d["type"] != "d" {
+			continue
+		}
+		if _, err := dc.loadDir(cf.d["path"], cf, used); err != nil {
+			// we don't know its children
+			cf.Dprintf("load: %s\n", err)
+			cf.inval()
+		}
+	}
+	return mf, nil
+}
+
+// Save the metadata for the cache on disk.
+func (dc *dCache) save() error {
+	dc.savelk.Lock()
+	defer dc.savelk.Unlock()
+	seen := map[string]bool{}
+	err := dc.saveDir(dc.slash, seen)
+	if e := dc.saveMoves(); e != nil && err == nil {
+		err = e
+	}
+	fis, _ := ioutil.ReadDir(filepath.Join(dc.dir, "meta"))
+	for _, fi := range fis {
+		if nm := fi.Name(); !seen[nm] {
+			os.Remove(dc.metaPath(nm))
+			delete(dc.saved, nm)
+		}
+	}
+	return err
+}
+
+// Save the entries for mf and its children, and then those for its child dirs.
+func (dc *dCache) saveDir(mf *mFile, seen map[string]bool) error {
+	var buf bytes.Buffer
+	mf.Lock()
+	if mf.sts == cGone {
+		mf.Unlock()
+		return nil
+	}
+	p := mf.d["path"]
+	packEntry(&buf, mf)
+	nms := make([]string, 0, len(mf.child))
+	for nm := range mf.child {
+		nms = append(nms, nm)
+	}
+	sort.Strings(nms)
+	var ds []*mFile
+	for _, nm := range nms {
+		cf := mf.child[nm]
+		cf.Lock()
+		if cf.sts != cGone {
+			packEntry(&buf, cf)
+			if cf.d["type"] == "d" {
+				ds = append(ds, cf)
+			}
+		}
+		cf.Unlock()
+	}
+	mf.Unlock()
+	name := metaName(p)
+	seen[name] = true
+	var err error
+	if sum := crc32.ChecksumIEEE(buf.Bytes()); dc.saved[name] != sum {
+		fname := dc.metaPath(name)
+		if err = ioutil.WriteFile(fname+".tmp", buf.Bytes(), 0600); err == nil {
+			err = os.Rename(fname+".tmp", fname)
+		}
+		if err == nil {
+			dc.saved[name] = sum
+		}
+	}
+	for _, cf := range ds {
+		if e := dc.saveDir(cf, seen); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
@@ -0,0 +1,356 @@
+package zxc
+
+import (
+	"bytes"
+	"clive/dbg"
+	"clive/zx"
+	"errors"
+	"fmt"
+	fpath "path"
+	"sync"
+	"time"
+)
+
+/*
+	Disconnected operation.
+
+	When the "offlineok" flag is set and the server can't be reached,
+	the cache keeps on serving what it has, and changes are kept
+	in the cache (and moves queued) until we reconnect.
+	Then moves are replayed and changes are synced, checking out
+	that the server files did not change meanwhile.
+	For conflicts, the server wins: our copy (if any) is kept
+	as a sibling file and the conflict is reported in /Ctl.
+*/
+
+// Disconnected operation state (shared by all auth views)
+struct offline {
+	sync.Mutex
+	on  bool
+	rlk sync.Mutex // to reintegrate one at a time
+}
+
+// A move made while disconnected.
+struct mvOp {
+	from, to string
+}
+
+// A conflict found while reintegrating.
+struct conflict {
+	t    time.Time
+	path string
+	what string
+}
+
+// Report of the conflicts found (shared by all auth views)
+struct conflicts {
+	sync.Mutex
+	l []conflict
+}
+
+// Path used to keep our copy of a file in conflict.
+// Earlier conflict copies found in rfs are not replaced.
+func conflictPath(rfs zx.Fs, p string) (string, error) {
+	cp := p + ".conflict"
+	for i := 1; ; i++ {
+		_, err := zx.Stat(rfs, cp)
+		if zx.IsNotExist(err) {
+			return cp, nil
+		}
+		if err != nil {
+			return "", err
+		}
+		cp = fmt.Sprintf("%s.conflict.%d", p, i)
+	}
+}
+
+func (cr *conflicts) add(p, what string) {
+	cr.Lock()
+	cr.l = append(cr.l, conflict{t: time.Now(), path: p, what: what})
+	cr.Unlock()
+	dbg.Warn("conflict: %s: %s", p, what)
+}
+
+func (cr *conflicts) count() int {
+	cr.Lock()
+	defer cr.Unlock()
+	return len(cr.l)
+}
+
+// paths for the conflicts since the first n ones
+func (cr *conflicts) since(n int) []string {
+	cr.Lock()
+	defer cr.Unlock()
+	var ps []string
+	for i := n; i < len(cr.l); i++ {
+		ps = append(ps, cr.l[i].path)
+	}
+	return ps
+}
+
+func (cr *conflicts) clear() {
+	cr.Lock()
+	cr.l = nil
+	cr.Unlock()
+}
+
+func (cr *conflicts) String() string {
+	cr.Lock()
+	defer cr.Unlock()
+	if len(cr.l) == 0 {
+		return ""
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "conflicts:\n")
+	for _, c := range cr.l {
+		fmt.Fprintf(&buf, "\t%s %s: %s\n", c.t.Format(time.Stamp), c.path, c.what)
+	}
+	return buf.String()
+}
+
+// Did the server's file (sd, nil if it's gone) change since we got it?
+func changedSince(base, sd zx.Dir) bool {
+	if base == nil {
+		return sd != nil
+	}
+	if sd == nil {
+		return true
+	}
+	return sd["mtime"] != base["mtime"] || sd["vers"] != base["vers"]
+}
+
+// Check out if the server changed mf while we changed it.
+// Changes in conflict are discarded and reported in cr;
+// for files with data we return the path where our copy
+// must be kept.
+// mf is locked.
+func (mf *mFile) chkConflict(rfs zx.Fs, cr *conflicts) (string, error) {
+	switch mf.sts {
+	case cNewMeta, cMeta, cDel:
+	case cData:
+		if mf.d["type"] == "d" {
+			return "", nil
+		}
+	default:
+		return "", nil
+	}
+	p := mf.d["path"]
+	sd, err := zx.Stat(rfs, p)
+	if err != nil {
+		if !zx.IsNotExist(err) {
+			return "", err
+		}
+		sd = nil
+	}
+	if !changedSince(mf.base, sd) {
+		return "", nil
+	}
+	what := "changed in server"
+	if sd == nil {
+		what = "removed in server"
+	}
+	switch mf.sts {
+	case cDel:
+		if sd == nil {
+			return "", nil
+		}
+		cr.add(p, what+", not removed")
+		mf.gone()
+	case cNewMeta, cMeta:
+		cr.add(p, what+", attributes discarded")
+		if sd == nil {
+			mf.gone()
+		} else {
+			mf.discard()
+		}
+	case cData:
+		cp, err := conflictPath(rfs, p)
+		if err != nil {
+			return "", err
+		}
+		cr.add(p, fmt.Sprintf("%s, ours kept at %s", what, cp))
+		return cp, nil
+	}
+	return "", nil
+}
+
+// Drop our changes for mf, so it's fetched again from the server.
+// mf is locked.
+func (mf *mFile) discard() {
+	mf.Dprintf("discard: cNew\n")
+	mf.wd = nil
+	mf.sts = cNew
+	mf.data.Reset()
+	mf.t = time.Time{}
+}
+
+// Move the child name in mf to be the child nname in to.
+// Both mf and to are locked.
+func (mf *mFile) relink(name string, to fsFile, nname string) error {
+	tf, ok := to.(*mFile)
+	if !ok {
+		return errors.New("relink: not a cached file")
+	}
+	if tf.d["type"] != "d" {
+		return fmt.Errorf("%s: %s", tf, zx.ErrNotDir)
+	}
+	cf, ok := mf.child[name]
+	if !ok {
+		return fmt.Errorf("%s: %s", fpath.Join(mf.path(), name), zx.ErrNotExist)
+	}
+	cf.Lock()
+	defer cf.Unlock()
+	if cf.isDel() {
+		return fmt.Errorf("%s: %s", fpath.Join(mf.path(), name), zx.ErrNotExist)
+	}
+	if of, ok := tf.child[nname]; ok && of != cf {
+		if of == mf {
+			return fmt.Errorf("%s: %s", fpath.Join(tf.path(), nname), zx.ErrExists)
+		}
+		of.Lock()
+		gone := of.isDel()
+		of.Unlock()
+		if !gone {
+			return fmt.Errorf("%s: %s", fpath.Join(tf.path(), nname), zx.ErrExists)
+		}
+	}
+	delete(mf.child, name)
+	tf.child[nname] = cf
+	cf.rename(fpath.Join(tf.path(), nname))
+	return nil
+}
+
+// Change the path for mf and its children after a move.
+// mf is locked.
+func (mf *mFile) rename(p string) {
+	mf.d["path"] = p
+	mf.d["name"] = fpath.Base(p)
+	mf.d["addr"] = "zxc!" + p
+	for nm, cf := range mf.child {
+		cf.Lock()
+		cf.rename(fpath.Join(p, nm))
+		cf.Unlock()
+	}
+}
+
+// Queue a move made while disconnected.
+func (mc *mCache) moved(from, to string) {
+	mc.mvlk.Lock()
+	mc.mvs = append(mc.mvs, mvOp{from: from, to: to})
+	mc.mvlk.Unlock()
+}
+
+// Replay the moves made while disconnected and sync the changes,
+// reporting in cr those in conflict with changes made in the server.
+func (mc *mCache) reintegrate(rfs zx.Fs, cr *conflicts) error {
+	fs, ok := rfs.(zx.RWFs)
+	if !ok {
+		return errors.New("rfs does not support put/wstat/remove")
+	}
+	n := cr.count()
+	mc.mvlk.Lock()
+	mvs := mc.mvs
+	mc.mvs = nil
+	mc.mvlk.Unlock()
+	for i, mv := range mvs {
+		err := errors.New("move not supported")
+		if mfs, ok := rfs.(zx.Mover); ok {
+			err = <-mfs.Move(mv.from, mv.to)
+		}
+		if zx.IsIOError(err) {
+			mc.mvlk.Lock()
+			mc.mvs = append(mvs[i:], mc.mvs...)
+			mc.mvlk.Unlock()
+			return err
+		}
+		if err != nil {
+			cr.add(mv.to, fmt.Sprintf("move from %s: %s", mv.from, err))
+			mc.invalPath(fpath.Dir(mv.from))
+		}
+	}
+	err := mc.slash.xsync(fs, cr)
+	// refresh the dirs with conflicts to see the server files
+	for _, p := range cr.since(n) {
+		mc.invalPath(fpath.Dir(p))
+	}
+	return err
+}
+
+func (fs *Fs) isOffline() bool {
+	fs.offl.Lock()
+	defer fs.offl.Unlock()
+	return fs.offl.on
+}
+
+// Called when a request to rfs failed.
+// If it's a network error and we can operate disconnected,
+// we are now offline.
+func (fs *Fs) disconnected(err error) bool {
+	if !zx.IsIOError(err) || !fs.offlineok || !fs.redialok {
+		return false
+	}
+	fs.offl.Lock()
+	if !fs.offl.on {
+		dbg.Warn("%s: disconnected", fs.Tag)
+		fs.offl.on = true
+	}
+	fs.offl.Unlock()
+	return true
+}
+
+// Replay the changes made while disconnected.
+// If that works, we are back online.
+func (fs *Fs) reintegrate() error {
+	fs.offl.rlk.Lock()
+	defer fs.offl.rlk.Unlock()
+	if !fs.isOffline() {
+		return fs.c.sync(fs.rfs)
+	}
+	err := fs.c.reintegrate(fs.rfs, fs.cr)
+	if zx.IsIOError(err) {
+		return err
+	}
+	fs.offl.Lock()
+	fs.offl.on = false
+	fs.offl.Unlock()
+	dbg.Warn("%s: reintegrated", fs.Tag)
+	return err
+}
+
+// Sync the cache, reintegrating our changes if we were disconnected.
+func (fs *Fs) syncCache() error {
+	var err error
+	if fs.isOffline() {
+		err = fs.reintegrate()
+	} else {
+		err = fs.c.sync(fs.rfs)
+	}
+	fs.disconnected(err)
+	return err
+}
+
+// Move from to to in the cache while disconnected and queue the
+// move to replay it when we reconnect.
+func (fs *Fs) moveOffline(from, to string) error {
+	fromels := zx.Elems(from)
+	toels := zx.Elems(to)
+	f, err := fs.walk(forDel, nil, fromels...)
+	if err != nil {
+		return err
+	}
+	f.Unlock()
+	pfrom, pto, err := fs.walkParents(from, to)
+	if err != nil {
+		return err
+	}
+	err = pfrom.relink(fromels[len(fromels)-1], pto, toels[len(toels)-1])
+	pfrom.Unlock()
+	if pto != pfrom {
+		pto.Unlock()
+	}
+	if err != nil {
+		return err
+	}
+	fs.c.moved(from, to)
+	return nil
+}
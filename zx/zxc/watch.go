@@ -0,0 +1,49 @@
+package zxc
+
+import (
+	"clive/zx"
+	"clive/zx/pred"
+	"fmt"
+)
+
+// Are there watchers?
+func (fs *Fs) watching() bool {
+	return fs.w.Active()
+}
+
+// Report a change made through fs to the watchers.
+func (fs *Fs) changed(d zx.Dir, chg string) {
+	if d == nil {
+		return
+	}
+	d = d.Dup()
+	d["Chg"] = chg
+	fs.w.Post(d)
+}
+
+// See zx.Watcher.
+// Only changes made through this cache are reported.
+func (fs *Fs) Watch(p, fpred string) <-chan zx.Dir {
+	c := make(chan zx.Dir)
+	d, err := fs.stat(p)
+	if err != nil {
+		close(c, err)
+		return c
+	}
+	x, err := pred.New(fpred)
+	if err != nil {
+		close(c, err)
+		return c
+	}
+	ai := fs.ai
+	if !fs.perms {
+		ai = nil
+	}
+	if !d.CanGet(ai) {
+		close(c, fmt.Errorf("%s: %s", p, zx.ErrPerm))
+		return c
+	}
+	w := zx.NewWatch(d["path"], x.Match)
+	fs.w.Add(w)
+	return w.C
+}
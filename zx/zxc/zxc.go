@@ -37,14 +37,19 @@ struct Fs {
 	*dbg.Flag
 	*zx.Flags
 	*zx.Stats
-	ai       *auth.Info
-	perms    bool
-	sync     bool // write-through
-	rfs      zx.Getter
-	c        fsCache
-	syncc    chan bool
-	redialc  chan bool
-	redialok bool // do we redial?
+	ai        *auth.Info
+	perms     bool
+	sync      bool // write-through
+	rfs       zx.Getter
+	c         fsCache
+	syncc     chan bool
+	redialc   chan bool
+	redialok  bool // do we redial?
+	offlineok bool // do we operate disconnected?
+	offl      *offline
+	cr        *conflicts
+	w         *zx.Watches
+	invalc    <-chan string // invalidations from the server, if any
 }
 
 var ctldir = zx.Dir{
@@ -60,7 +65,10 @@ var ctldir = zx.Dir{
 	"wuid":  u.Uid,
 }
 
-var _fs zx.FullFs = &Fs{}
+var (
+	_fs  zx.FullFs  = &Fs{}
+	_fs2 zx.Watcher = &Fs{}
+)
 
 type ddir zx.Dir
 
@@ -83,7 +91,22 @@ func (fs *Fs) Auth(ai *auth.Info) (zx.Fs, error) {
 	return nfs, nil
 }
 
+// Return a new caching fs for rfs, keeping the cache in memory.
+// If rfs can redial, setting the "offlineok" flag makes the cache
+// keep on working while disconnected; see offline.go.
 func New(rfs zx.Getter) (*Fs, error) {
+	return newFs(rfs, "")
+}
+
+// Return a new caching fs for rfs, keeping the cache on disk at dir,
+// so it's still there after restarts.
+// The "cachebytes" flag sets how many bytes of file data might be
+// kept (0, the default, means no limit).
+func NewDisk(rfs zx.Getter, dir string) (*Fs, error) {
+	return newFs(rfs, dir)
+}
+
+func newFs(rfs zx.Getter, dir string) (*Fs, error) {
 	rd, err := zx.Stat(rfs, "/")
 	if err != nil {
 		return nil, err
@@ -99,18 +122,24 @@ func New(rfs zx.Getter) (*Fs, error) {
 		syncc:    make(chan bool),
 		redialc:  make(chan bool),
 		redialok: ok,
+		offl:     &offline{},
+		cr:       &conflicts{},
+		w:        &zx.Watches{},
 	}
 	fs.Flags.Add("debug", &fs.Debug)
 	fs.Flags.Add("writesync", &fs.sync) // sync after changes
 	// TODO: The user u.Uid should be able to change fs.noperms
 	fs.Flags.AddRO("perms", &fs.perms)
 	fs.Flags.AddRO("redialok", &fs.redialok)
+	fs.Flags.Add("offlineok", &fs.offlineok)
+	fs.Flags.AddRO("offline", &fs.offl.on)
 	fs.Flags.Add("clear", func(...string) error {
 		fs.Stats.Clear()
+		fs.cr.clear()
 		return nil
 	})
 	fs.Flags.Add("sync", func(...string) error {
-		return fs.c.sync(fs.rfs)
+		return fs.syncCache()
 	})
 	fs.Flags.Add("inval", func(...string) error {
 		go fs.c.inval()
@@ -120,6 +149,9 @@ func New(rfs zx.Getter) (*Fs, error) {
 		fs.Flags.Add("rfsdebug", &rfs.Debug)
 		fs.Flags.Add("rfsverb", &rfs.Verb)
 	}
+	if rfs, ok := rfs.(invaler); ok {
+		fs.invalc = rfs.Invals()
+	}
 	if rfs, ok := rfs.(*zux.Fs); ok {
 		fs.Flags.Add("rfsdebug", &rfs.Debug)
 	}
@@ -131,17 +163,32 @@ func New(rfs zx.Getter) (*Fs, error) {
 	fs.Flags.Add("cachedebug", &c.Debug)
 	fs.Flags.Add("verb", &c.Verb)
 	fs.Flags.Add("cachestats", &c.stats) // the cache stats all the times
+	// transfer just the changes for files, if rfs can do that
+	_, c.deltas = rfs.(zx.Deltaer)
+	fs.Flags.Add("deltas", &c.deltas)
+	var fc fsCache = c
+	if dir != "" {
+		dc, err := newDCache(c, dir)
+		if err != nil {
+			return nil, err
+		}
+		fs.Flags.Add("cachebytes", &dc.store.budget)
+		fc = dc
+	}
 	rd["addr"] = "zxc!/"
-	if err := c.setRoot(rd); err != nil {
+	if err := fc.setRoot(rd); err != nil {
 		return nil, err
 	}
-	fs.c = c
+	fs.c = fc
 	go fs.syncer()
+	if fs.invalc != nil {
+		go fs.invaler()
+	}
 	return fs, nil
 }
 
 func (fs *Fs) Sync() error {
-	err := fs.c.sync(fs.rfs)
+	err := fs.syncCache()
 	if sfs, ok := fs.rfs.(zx.Syncer); ok {
 		if e := sfs.Sync(); e != nil && err == nil {
 			err = e
@@ -171,6 +218,11 @@ interface redialer {
 	Redial() error
 }
 
+// Trees reporting changes made by others (eg., rzx.Fs)
+interface invaler {
+	Invals() <-chan string
+}
+
 func (fs *Fs) redial() error {
 	// could place a timeout here
 	rfs, ok := fs.rfs.(redialer)
@@ -239,10 +291,26 @@ func (fs *Fs) syncer() {
 	}
 }
 
+// Invalidate cached files changed by other clients of the server.
+func (fs *Fs) invaler() {
+	for p := range fs.invalc {
+		fs.Dprintf("inval %q\n", p)
+		if p == "" {
+			// invalidations were lost
+			fs.c.inval()
+		} else {
+			fs.c.invalPath(p)
+		}
+	}
+}
+
 // Syncs and closes both the fs and the underlying fs if it has a close op.
 func (fs *Fs) Close() error {
 	close(fs.syncc)
 	close(fs.redialc)
+	if fs.invalc != nil {
+		close(fs.invalc)
+	}
 	err := fs.Sync()
 	if xfs, ok := fs.rfs.(io.Closer); ok {
 		if e := xfs.Close(); e != nil && err == nil {
@@ -254,10 +322,14 @@ func (fs *Fs) Close() error {
 
 // f must be locked
 func (fs *Fs) getMeta(f fsFile) error {
+	if fs.isOffline() {
+		return nil // use what we have
+	}
 	d, err := zx.Stat(fs.rfs, f.path())
 	if err != nil {
 		if zx.IsIOError(err) && fs.redialok {
 			fs.needRedial()
+			fs.disconnected(err)
 			return nil // have old meta; use that
 		}
 		if zx.IsNotExist(err) {
@@ -270,11 +342,15 @@ func (fs *Fs) getMeta(f fsFile) error {
 
 // f must be locked
 func (fs *Fs) getDirData(f fsFile) error {
+	if fs.isOffline() && f.oldDataOk() {
+		return nil
+	}
 	ds, err := zx.GetDir(fs.rfs, f.path())
 	if err != nil {
 		if zx.IsIOError(err) && fs.redialok && f.oldDataOk() {
 			// use the old data
 			fs.needRedial()
+			fs.disconnected(err)
 			return nil
 		}
 		if zx.IsNotExist(err) {
@@ -290,12 +366,25 @@ func (fs *Fs) getDirData(f fsFile) error {
 
 // f must be locked
 func (fs *Fs) getData(f fsFile) error {
-	c := fs.rfs.Get(f.path(), 0, -1)
-	err := f.gotData(c)
+	if fs.isOffline() && f.oldDataOk() {
+		return nil
+	}
+	var err error
+	var sums [][]byte
+	dfs, ok := fs.rfs.(zx.Deltaer)
+	if ok {
+		sums = f.oldSums(zx.DeltaBlkSz)
+	}
+	if sums != nil {
+		err = f.gotDeltas(dfs.DeltaGet(f.path(), zx.DeltaBlkSz, sums))
+	} else {
+		err = f.gotData(fs.rfs.Get(f.path(), 0, -1))
+	}
 	if err != nil {
 		if zx.IsIOError(err) && fs.redialok && f.oldDataOk() {
 			// use the old data
 			fs.needRedial()
+			fs.disconnected(err)
 			return nil
 		}
 	}
@@ -504,7 +593,7 @@ func (fs *Fs) wstat(p string, nd zx.Dir) (zx.Dir, error) {
 	}
 	d = d.Dup()
 	f.Unlock()
-	if fs.sync {
+	if fs.sync && !fs.isOffline() {
 		f.sync(fs.rfs)
 	} else {
 		fs.needSync()
@@ -519,6 +608,9 @@ func (fs *Fs) Wstat(p string, nd zx.Dir) <-chan zx.Dir {
 	d, err := fs.wstat(p, nd)
 	if err == nil {
 		fs.Dprintf("wstat %s: %s\n\t-> %s\n", p, nd, ddir(d))
+		if fs.watching() {
+			fs.changed(d, zx.Updated)
+		}
 		c <- d
 	} else {
 		fs.Dprintf("wstat %s: %s\n", p, err)
@@ -532,6 +624,7 @@ func (fs *Fs) getCtl(off, count int64, dc chan<- []byte) error {
 	fmt.Fprintf(&buf, "lfs %s:\n", fs.Tag)
 	fmt.Fprintf(&buf, "%s", fs.Flags)
 	fmt.Fprintf(&buf, "%s", fs.Stats)
+	fmt.Fprintf(&buf, "%s", fs.cr)
 	rctl, err := zx.GetAll(fs.rfs, "/Ctl")
 	if err == nil {
 		buf.Write(rctl)
@@ -650,7 +743,7 @@ func (fs *Fs) remove(p string, all bool) error {
 	}
 	err = f.remove(all)
 	f.Unlock()
-	if fs.sync {
+	if fs.sync && !fs.isOffline() {
 		f.sync(fs.rfs)
 	} else {
 		fs.needSync()
@@ -662,9 +755,15 @@ func (fs *Fs) remove(p string, all bool) error {
 func (fs *Fs) Remove(p string) <-chan error {
 	fs.Dprintf("remove %s...\n", p)
 	c := make(chan error, 1)
+	var d zx.Dir
+	if fs.watching() {
+		d, _ = fs.stat(p)
+	}
 	err := fs.remove(p, false)
 	if err != nil {
 		fs.Dprintf("remove %s: %s\n", p, err)
+	} else {
+		fs.changed(d, zx.Removed)
 	}
 	c <- err
 	close(c, err)
@@ -674,9 +773,15 @@ func (fs *Fs) Remove(p string) <-chan error {
 func (fs *Fs) RemoveAll(p string) <-chan error {
 	fs.Dprintf("removeall %s...\n", p)
 	c := make(chan error, 1)
+	var d zx.Dir
+	if fs.watching() {
+		d, _ = fs.stat(p)
+	}
 	err := fs.remove(p, true)
 	if err != nil {
 		fs.Dprintf("removeall %s: %s\n", p, err)
+	} else {
+		fs.changed(d, zx.Removed)
 	}
 	c <- err
 	close(c, err)
@@ -717,7 +822,12 @@ func (fs *Fs) move(from, to string) error {
 	if inconsistentMove(from, to) {
 		return fmt.Errorf("move %s: inconsistent move", from)
 	}
-	fs.c.sync(fs.rfs)
+	if fs.isOffline() {
+		return fs.moveOffline(from, to)
+	}
+	if err := fs.c.sync(fs.rfs); fs.disconnected(err) {
+		return fs.moveOffline(from, to)
+	}
 	fromels := zx.Elems(from)
 	ffrom, err := fs.walk(forDel, nil, fromels...)
 	if err != nil {
@@ -735,9 +845,27 @@ func (fs *Fs) move(from, to string) error {
 	// now we have a race,
 	// lock the parents, invalidate them,
 	// issue the request to the remote fs and we are done.
+	ffrom, fto, err = fs.walkParents(from, to)
 	if err != nil {
 		return err
 	}
+	defer ffrom.Unlock()
+	if fto != ffrom {
+		defer fto.Unlock()
+	}
+	ffrom.inval()
+	fto.inval()
+	if err := <-rfs.Move(from, to); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Walk to the parents of from and to and return them locked.
+// If both are the same, it's returned (and locked) just once.
+func (fs *Fs) walkParents(from, to string) (ffrom, fto fsFile, err error) {
+	fromels := zx.Elems(from)
+	toels := zx.Elems(to)
 	pfrom := fpath.Dir(from)
 	pto := fpath.Dir(to)
 	// The lock order must be this way,
@@ -747,38 +875,31 @@ func (fs *Fs) move(from, to string) error {
 	case pfrom > pto:
 		ffrom, err = fs.walk(forStat, nil, fromels[:len(fromels)-1]...)
 		if err != nil {
-			return err
+			return nil, nil, err
 		}
-		defer ffrom.Unlock()
 		fto, err = fs.walk(forStat, nil, toels[:len(toels)-1]...)
 		if err != nil {
-			return err
+			ffrom.Unlock()
+			return nil, nil, err
 		}
-		defer fto.Unlock()
 	case pfrom == pto:
 		ffrom, err = fs.walk(forStat, nil, fromels[:len(fromels)-1]...)
 		if err != nil {
-			return err
+			return nil, nil, err
 		}
-		defer ffrom.Unlock()
+		fto = ffrom
 	case pfrom < pto:
 		fto, err = fs.walk(forStat, nil, toels[:len(toels)-1]...)
 		if err != nil {
-			return err
+			return nil, nil, err
 		}
-		defer fto.Unlock()
 		ffrom, err = fs.walk(forStat, nil, fromels[:len(fromels)-1]...)
 		if err != nil {
-			return err
+			fto.Unlock()
+			return nil, nil, err
 		}
-		defer ffrom.Unlock()
-	}
-	ffrom.inval()
-	fto.inval()
-	if err := <-rfs.Move(from, to); err != nil {
-		return err
 	}
-	return nil
+	return ffrom, fto, nil
 }
 
 func (fs *Fs) Move(from, to string) <-chan error {
@@ -788,6 +909,11 @@ func (fs *Fs) Move(from, to string) <-chan error {
 	err := fs.move(from, to)
 	if err != nil {
 		fs.Dprintf("move %s: %s\n", from, err)
+	} else if fs.watching() {
+		if d, _ := fs.stat(to); d != nil {
+			d["From"], _ = zx.UseAbsPath(from)
+			fs.changed(d, zx.Moved)
+		}
 	}
 	c <- err
 	close(c, err)
@@ -854,12 +980,38 @@ func (fs *Fs) Link(oldp, newp string) <-chan error {
 	err := fs.link(oldp, newp)
 	if err != nil {
 		fs.Dprintf("link %s: %s\n", oldp, err)
+	} else if fs.watching() {
+		d, _ := fs.stat(newp)
+		fs.changed(d, zx.Created)
 	}
 	c <- err
 	close(c, err)
 	return c
 }
 
+// Symbolic links are created at the remote tree, like links are.
+func (fs *Fs) symlink(p string, d zx.Dir, c <-chan []byte) (zx.Dir, error) {
+	rfs, ok := fs.rfs.(zx.Putter)
+	if !ok {
+		return nil, fmt.Errorf("%s: symlink not supported", fs.Tag)
+	}
+	fs.c.sync(fs.rfs)
+	f, err := fs.walk(forLink, nil, zx.Elems(p)...)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Unlock()
+	f.inval()
+	rc := rfs.Put(p, d, 0, c)
+	rd := <-rc
+	err = cerror(rc)
+	fs.getDirData(f)
+	if err == nil && rd == nil {
+		rd = zx.Dir{"path": p, "name": fpath.Base(p), "type": "l"}
+	}
+	return rd, err
+}
+
 func (fs *Fs) putCtl(c <-chan []byte) error {
 	var buf bytes.Buffer
 	for d := range c {
@@ -923,6 +1075,8 @@ func (fs *Fs) put(p string, d zx.Dir, off int64, c <-chan []byte) (zx.Dir, error
 			d["size"] = "0"
 		}
 		f, err = fs.walk(forCreatAll, d, els...)
+	case "l":
+		return fs.symlink(p, d, c)
 	default:
 		return nil, fmt.Errorf("%s: bad file type '%s'", p, typ)
 	}
@@ -1003,7 +1157,7 @@ func (fs *Fs) put(p string, d zx.Dir, off int64, c <-chan []byte) (zx.Dir, error
 	if typ == "d" {
 		d := f.dir().Dup()
 		f.Unlock()
-		if fs.sync {
+		if fs.sync && !fs.isOffline() {
 			f.sync(fs.rfs)
 		} else {
 			fs.needSync()
@@ -1015,7 +1169,7 @@ func (fs *Fs) put(p string, d zx.Dir, off int64, c <-chan []byte) (zx.Dir, error
 	f.Lock()
 	d = f.dir().Dup()
 	f.Unlock()
-	if fs.sync {
+	if fs.sync && !fs.isOffline() {
 		f.sync(fs.rfs)
 	} else {
 		fs.needSync()
@@ -1032,8 +1186,17 @@ func (fs *Fs) Put(p string, d zx.Dir, off int64, c <-chan []byte) <-chan zx.Dir
 	go func() {
 		fs.Count(zx.Sput)
 		d = d.SysDup()
+		chg := zx.Updated
+		if fs.watching() {
+			if _, err := fs.stat(p); err != nil {
+				chg = zx.Created
+			}
+		}
 		d, err := fs.put(p, d, off, c)
 		if err == nil {
+			if fs.watching() {
+				fs.changed(d, chg)
+			}
 			rc <- d
 		} else {
 			fs.Dprintf("put %s: %s\n", p, err)
@@ -1057,7 +1220,9 @@ func (fs *Fs) findr(f fsFile, d zx.Dir, fp *pred.Pred, p, spref, dpref string, l
 		} else {
 			fs.Dprintf("find <- %s\n", ddir(d))
 		}
-		c <- d
+		if ok := c <- d; !ok {
+			return cerror(c)
+		}
 		return nil
 	}
 	if err != nil {
@@ -1215,7 +1380,11 @@ func (fs *Fs) FindGet(path, fpred, spref, dpref string, depth0 int) <-chan face{
 			}
 			bc := fs.Get(p, 0, -1)
 			for d := range bc {
-				c <- d
+				if ok := c <- d; !ok {
+					close(bc, cerror(c))
+					close(dc, cerror(c))
+					return
+				}
 			}
 			if err := cerror(bc); err != nil {
 				c <- err
@@ -1,15 +1,19 @@
 package zxc
 
 import (
+	"bytes"
 	"clive/net"
 	"clive/net/auth"
 	"clive/u"
 	"clive/zx"
 	"clive/zx/fscmp"
 	"clive/zx/fstest"
+	"clive/zx/rzx"
 	"clive/zx/zux"
 	"fmt"
 	"os"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -116,6 +120,10 @@ func TestAsAFile(t *testing.T) {
 	runTest(t, fstest.AsAFile)
 }
 
+func TestWatches(t *testing.T) {
+	runTest(t, fstest.Watches)
+}
+
 func TestSync(t *testing.T) {
 	os.Args[0] = "rzx.test"
 	fstest.Verb = testing.Verbose()
@@ -220,6 +228,7 @@ func TestExtChanges(t *testing.T) {
 	cfs.Dprintf("%s", out)
 	fstest.MkZXChgs(t, lfs)
 	fstest.MkZXChgs2(t, lfs)
+	defer func(old time.Duration) { cacheTout = old }(cacheTout)
 	cacheTout = time.Millisecond
 	time.Sleep(cacheTout)
 	rc = fscmp.Diff(lfs, cfs)
@@ -236,3 +245,504 @@ func TestExtChanges(t *testing.T) {
 		cfs.c.dump()
 	}
 }
+
+func TestRemoteInvals(t *testing.T) {
+	os.Args[0] = "rzx.test"
+	os.Remove("/tmp/clive.9897")
+	defer os.Remove("/tmp/clive.9897")
+	fstest.Verb = testing.Verbose()
+	fstest.MkTree(t, tdir)
+	defer os.RemoveAll(tdir)
+	lfs, err := zux.NewZX(tdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lfs.Sync()
+	srv, err := rzx.NewServer("unix!local!9897")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Serve("main", lfs); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	// two different clients; the dial addresses must differ.
+	rfs, err := rzx.Dial("unix!local!9897")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ofs, err := rzx.Dial("unix!localhost!9897")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ofs.Close()
+	cfs, err := New(rfs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cfs.Close()
+	cfs.Debug = testing.Verbose()
+	cfs.Flags.Set("cachedebug", cfs.Debug)
+	// cached files must not time out; only invalidations may refresh them
+	defer func(old time.Duration) { cacheTout = old }(cacheTout)
+	cacheTout = time.Hour
+
+	if _, err := zx.GetAll(cfs, "/a/a1"); err != nil {
+		t.Fatalf("get: %s", err)
+	}
+	if err := zx.PutAll(ofs, "/a/a1", []byte("changed\n")); err != nil {
+		t.Fatalf("put: %s", err)
+	}
+	for i := 0; i < 50; i++ {
+		dat, err := zx.GetAll(cfs, "/a/a1")
+		if err != nil {
+			t.Fatalf("get: %s", err)
+		}
+		if string(dat) == "changed\n" {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatalf("cache was not invalidated")
+}
+
+func TestDiskCache(t *testing.T) {
+	os.Args[0] = "rzx.test"
+	fstest.Verb = testing.Verbose()
+	fstest.MkTree(t, tdir)
+	defer os.RemoveAll(tdir)
+	cdir := tdir + ".cache"
+	os.RemoveAll(cdir)
+	defer os.RemoveAll(cdir)
+	lfs, err := zux.NewZX(tdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lfs.Sync()
+
+	cfs, err := NewDisk(lfs, cdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfs.Debug = testing.Verbose()
+	cfs.Flags.Set("cachedebug", cfs.Debug)
+	fstest.MkZXChgs(t, cfs)
+	if _, err := zx.GetAll(cfs, "/a/a1"); err != nil {
+		t.Fatalf("get: %s", err)
+	}
+	if err := cfs.Close(); err != nil {
+		t.Fatalf("close: %s", err)
+	}
+
+	// It must come back warm
+	cfs, err = NewDisk(lfs, cdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cfs.Close()
+	cfs.Debug = testing.Verbose()
+	cfs.Flags.Set("cachedebug", cfs.Debug)
+	out := cfs.c.(*dCache).contents()
+	cfs.Dprintf("%s", out)
+	if !strings.Contains(out, "/a/a1") {
+		t.Fatalf("cache is not warm")
+	}
+	rc := fscmp.Diff(lfs, cfs)
+	out = ""
+	for c := range rc {
+		out += fmt.Sprintf("chg %s %s\n", c.Type, c.D.Fmt())
+	}
+	cfs.Dprintf("%s", out)
+	if len(out) > 0 {
+		t.Fatalf("loaded cache has changes")
+	}
+
+	// and keep within its budget
+	if err := cfs.Ctl("cachebytes 10"); err != nil {
+		t.Fatalf("ctl: %s", err)
+	}
+	for _, p := range fstest.Files {
+		// some were removed by MkZXChgs
+		if _, err := zx.GetAll(cfs, p); err != nil && !zx.IsNotExist(err) {
+			t.Fatalf("get: %s", err)
+		}
+	}
+	st := cfs.c.(*dCache).store
+	st.flush()
+	st.Lock()
+	n := st.n
+	st.Unlock()
+	if n > 10 {
+		t.Fatalf("cache has %d bytes", n)
+	}
+}
+
+// A tree that can be taken down to test disconnected operation
+struct downFs {
+	*zux.Fs
+	down bool
+}
+
+func (fs *downFs) Redial() error {
+	if fs.down {
+		return zx.ErrIO
+	}
+	return nil
+}
+
+func (fs *downFs) Stat(p string) <-chan zx.Dir {
+	if fs.down {
+		c := make(chan zx.Dir)
+		close(c, zx.ErrIO)
+		return c
+	}
+	return fs.Fs.Stat(p)
+}
+
+func (fs *downFs) Get(p string, off, count int64) <-chan []byte {
+	if fs.down {
+		c := make(chan []byte)
+		close(c, zx.ErrIO)
+		return c
+	}
+	return fs.Fs.Get(p, off, count)
+}
+
+func (fs *downFs) Put(p string, d zx.Dir, off int64, dc <-chan []byte) <-chan zx.Dir {
+	if fs.down {
+		close(dc, zx.ErrIO)
+		c := make(chan zx.Dir)
+		close(c, zx.ErrIO)
+		return c
+	}
+	return fs.Fs.Put(p, d, off, dc)
+}
+
+func (fs *downFs) Wstat(p string, d zx.Dir) <-chan zx.Dir {
+	if fs.down {
+		c := make(chan zx.Dir)
+		close(c, zx.ErrIO)
+		return c
+	}
+	return fs.Fs.Wstat(p, d)
+}
+
+func (fs *downFs) downErr() <-chan error {
+	c := make(chan error, 1)
+	c <- zx.ErrIO
+	close(c, zx.ErrIO)
+	return c
+}
+
+func (fs *downFs) Remove(p string) <-chan error {
+	if fs.down {
+		return fs.downErr()
+	}
+	return fs.Fs.Remove(p)
+}
+
+func (fs *downFs) RemoveAll(p string) <-chan error {
+	if fs.down {
+		return fs.downErr()
+	}
+	return fs.Fs.RemoveAll(p)
+}
+
+func (fs *downFs) Move(from, to string) <-chan error {
+	if fs.down {
+		return fs.downErr()
+	}
+	return fs.Fs.Move(from, to)
+}
+
+func TestDisconnected(t *testing.T) {
+	os.Args[0] = "rzx.test"
+	fstest.Verb = testing.Verbose()
+	fstest.MkTree(t, tdir)
+	defer os.RemoveAll(tdir)
+	lfs, err := zux.NewZX(tdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lfs.Sync()
+	// an earlier conflict copy must be kept
+	if err := zx.PutAll(lfs, "/a/a1.conflict", []byte("old a1")); err != nil {
+		t.Fatalf("put: %s", err)
+	}
+	dfs := &downFs{Fs: lfs}
+	cfs, err := New(dfs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cfs.Close()
+	cfs.Debug = testing.Verbose()
+	cfs.Flags.Set("cachedebug", cfs.Debug)
+	cfs.Flags.Set("offlineok", true)
+	if _, err := zx.GetDir(cfs, "/"); err != nil {
+		t.Fatalf("getdir: %s", err)
+	}
+	for _, p := range []string{"/1", "/a/a1"} {
+		if _, err := zx.GetAll(cfs, p); err != nil {
+			t.Fatalf("get: %s", err)
+		}
+	}
+
+	dfs.down = true
+	if _, err := zx.GetAll(cfs, "/a/a1"); err != nil {
+		t.Fatalf("offline get: %s", err)
+	}
+	if err := zx.PutAll(cfs, "/1", []byte("new 1")); err != nil {
+		t.Fatalf("offline put: %s", err)
+	}
+	if err := zx.PutAll(cfs, "/a/a1", []byte("our a1")); err != nil {
+		t.Fatalf("offline put: %s", err)
+	}
+	if err := <-cfs.Move("/2", "/a/n2"); err != nil {
+		t.Fatalf("offline move: %s", err)
+	}
+	if err := <-cfs.Move("/1", "/a/a1"); !zx.IsExists(err) {
+		t.Fatalf("offline move over a file: %v", err)
+	}
+	if !cfs.isOffline() {
+		t.Fatalf("not offline")
+	}
+	if _, err := zx.Stat(cfs, "/a/n2"); err != nil {
+		t.Fatalf("offline stat: %s", err)
+	}
+	// and somebody else changes a1 meanwhile
+	if err := zx.PutAll(lfs, "/a/a1", []byte("their a1")); err != nil {
+		t.Fatalf("put: %s", err)
+	}
+
+	dfs.down = false
+	if err := cfs.Sync(); err != nil {
+		t.Fatalf("sync: %s", err)
+	}
+	if cfs.isOffline() {
+		t.Fatalf("still offline")
+	}
+	for p, v := range map[string]string{
+		"/1":               "new 1",
+		"/a/a1":            "their a1",
+		"/a/a1.conflict":   "old a1",
+		"/a/a1.conflict.1": "our a1",
+	} {
+		dat, err := zx.GetAll(lfs, p)
+		if err != nil {
+			t.Fatalf("get %s: %s", p, err)
+		}
+		if string(dat) != v {
+			t.Fatalf("%s: has %q", p, dat)
+		}
+	}
+	if _, err := zx.Stat(lfs, "/a/n2"); err != nil {
+		t.Fatalf("move not replayed: %s", err)
+	}
+	dat, err := zx.GetAll(cfs, "/a/a1")
+	if err != nil || string(dat) != "their a1" {
+		t.Fatalf("cache has %q %v", dat, err)
+	}
+	ctl, err := zx.GetAll(cfs, "/Ctl")
+	if err != nil {
+		t.Fatalf("ctl: %s", err)
+	}
+	cfs.Dprintf("ctl: %s\n", ctl)
+	if !strings.Contains(string(ctl), "/a/a1: changed in server") {
+		t.Fatalf("conflict not reported")
+	}
+}
+
+// A remote tree counting the data transferred for a file
+struct countFs {
+	*rzx.Fs
+	path       string
+	sync.Mutex // for the counters
+	ngets      int64 // bytes from gets
+	nputs      int   // calls to put
+	ndgets     int64 // bytes from delta gets
+	ndputs     int   // calls to delta put
+}
+
+func (fs *countFs) counts() (int64, int, int64, int) {
+	fs.Lock()
+	defer fs.Unlock()
+	return fs.ngets, fs.nputs, fs.ndgets, fs.ndputs
+}
+
+func (fs *countFs) Get(p string, off, count int64) <-chan []byte {
+	c := fs.Fs.Get(p, off, count)
+	if p != fs.path {
+		return c
+	}
+	rc := make(chan []byte)
+	go func() {
+		for b := range c {
+			fs.Lock()
+			fs.ngets += int64(len(b))
+			fs.Unlock()
+			if ok := rc <- b; !ok {
+				close(c, cerror(rc))
+				return
+			}
+		}
+		close(rc, cerror(c))
+	}()
+	return rc
+}
+
+func (fs *countFs) Put(p string, d zx.Dir, off int64, dc <-chan []byte) <-chan zx.Dir {
+	if p == fs.path {
+		fs.Lock()
+		fs.nputs++
+		fs.Unlock()
+	}
+	return fs.Fs.Put(p, d, off, dc)
+}
+
+func (fs *countFs) DeltaGet(p string, blksz int64, sums [][]byte) <-chan face{} {
+	c := fs.Fs.DeltaGet(p, blksz, sums)
+	rc := make(chan face{})
+	go func() {
+		for x := range c {
+			if dl, ok := x.(zx.Delta); ok && p == fs.path {
+				fs.Lock()
+				fs.ndgets += int64(len(dl.Data))
+				fs.Unlock()
+			}
+			if ok := rc <- x; !ok {
+				close(c, cerror(rc))
+				return
+			}
+		}
+		close(rc, cerror(c))
+	}()
+	return rc
+}
+
+func (fs *countFs) DeltaPut(p string, d zx.Dir, blksz int64, dc <-chan []byte) <-chan zx.Dir {
+	if p == fs.path {
+		fs.Lock()
+		fs.ndputs++
+		fs.Unlock()
+	}
+	return fs.Fs.DeltaPut(p, d, blksz, dc)
+}
+
+func TestDeltas(t *testing.T) {
+	os.Args[0] = "rzx.test"
+	os.Remove("/tmp/clive.9896")
+	defer os.Remove("/tmp/clive.9896")
+	fstest.Verb = testing.Verbose()
+	fstest.MkTree(t, tdir)
+	defer os.RemoveAll(tdir)
+	lfs, err := zux.NewZX(tdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lfs.Sync()
+	srv, err := rzx.NewServer("unix!local!9896")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Serve("main", lfs); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	xfs, err := rzx.Dial("unix!local!9896")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rfs := &countFs{Fs: xfs, path: "/a/a2"}
+	ofs, err := rzx.Dial("unix!localhost!9896")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ofs.Close()
+	cfs, err := New(rfs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cfs.Close()
+	cfs.Debug = testing.Verbose()
+	cfs.Flags.Set("cachedebug", cfs.Debug)
+
+	// grow a big file and read it through the cache
+	dat := []byte{}
+	for len(dat) < 8*zx.DeltaBlkSz {
+		dat = append(dat, fstest.FileData["/a/b/c/c3"]...)
+	}
+	// in blocks, to fit in rzx messages
+	dc := make(chan []byte, len(dat)/zx.DeltaBlkSz+1)
+	for b := dat; len(b) > 0; {
+		n := len(b)
+		if n > zx.DeltaBlkSz {
+			n = zx.DeltaBlkSz
+		}
+		dc <- b[:n]
+		b = b[n:]
+	}
+	close(dc)
+	rc := ofs.Put("/a/a2", zx.Dir{"type": "-", "mode": "0644"}, 0, dc)
+	<-rc
+	if err := cerror(rc); err != nil {
+		t.Fatalf("put: %s", err)
+	}
+	if err := cfs.Ctl("clear"); err != nil {
+		t.Fatalf("clear: %s", err)
+	}
+	if _, err := zx.GetAll(cfs, "/a/a2"); err != nil {
+		t.Fatalf("get: %s", err)
+	}
+
+	// change it in the server; we should get just the change
+	copy(dat[3*zx.DeltaBlkSz:], "changed")
+	dc = make(chan []byte, 1)
+	dc <- []byte("changed")
+	close(dc)
+	rc = ofs.Put("/a/a2", zx.Dir{}, 3*zx.DeltaBlkSz, dc)
+	<-rc
+	if err := cerror(rc); err != nil {
+		t.Fatalf("put: %s", err)
+	}
+	got := false
+	for i := 0; i < 50 && !got; i++ {
+		ndat, err := zx.GetAll(cfs, "/a/a2")
+		if err != nil {
+			t.Fatalf("get: %s", err)
+		}
+		got = bytes.Equal(dat, ndat)
+		if !got {
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+	if !got {
+		t.Fatalf("cache did not get the change")
+	}
+	ngets, _, ndgets, _ := rfs.counts()
+	t.Logf("got %d bytes, %d in deltas", ngets, ndgets)
+	if ngets != int64(len(dat)) || ndgets == 0 || ndgets > zx.DeltaBlkSz {
+		t.Fatalf("cache did not get just the change")
+	}
+
+	// change it in the cache; we should put just the change
+	copy(dat[5*zx.DeltaBlkSz:], "again")
+	dat = dat[:len(dat)-10]
+	if err := zx.PutAll(cfs, "/a/a2", dat); err != nil {
+		t.Fatalf("put: %s", err)
+	}
+	if err := cfs.Sync(); err != nil {
+		t.Fatalf("sync: %s", err)
+	}
+	ndat, err := zx.GetAll(lfs, "/a/a2")
+	if err != nil {
+		t.Fatalf("get: %s", err)
+	}
+	if !bytes.Equal(dat, ndat) {
+		t.Fatalf("server did not get the change")
+	}
+	_, nputs, _, ndputs := rfs.counts()
+	if nputs != 0 || ndputs == 0 {
+		t.Fatalf("cache did not put just the change")
+	}
+}
@@ -16,8 +16,10 @@ import (
 	"io"
 	"os"
 	fpath "path"
+	"sort"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 )
 
@@ -54,8 +56,9 @@ struct Dir {
 	Implementation of fuse handle interface.
 */
 struct Fd {
-	// everything kept at and locked by Dir
+	// everything but the open flags kept at and locked by Dir
 	*Dir
+	flags fuse.OpenFlags
 }
 
 var (
@@ -65,10 +68,35 @@ var (
 	vprintf = dbg.FlagPrintf(&Verb)
 
 	_xt *Dir
-	_nn fs.Node        = _xt
-	_nx fs.NodeXAttrer = _xt
+	_nn fs.Node           = _xt
+	_nx fs.NodeXAttrer    = _xt
+	_ns fs.NodeSymlinker  = _xt
+	_nr fs.NodeReadlinker = _xt
+	_nl fs.NodeLinker     = _xt
+	_nf fs.NodeFsyncer    = _xt
+	_fs fs.FSStatfser     = &FS{}
 )
 
+// Map a zx error to the closest errno, EPERM by default.
+func errno(err error) fuse.Error {
+	switch {
+	case zx.IsNotExist(err):
+		return fuse.ENOENT
+	case zx.IsExists(err):
+		return fuse.Errno(syscall.EEXIST)
+	case zx.IsNotEmpty(err):
+		return fuse.Errno(syscall.ENOTEMPTY)
+	case zx.IsIOError(err):
+		return fuse.EIO
+	default:
+		return fuse.EPERM
+	}
+}
+
+func isLink(d zx.Dir) bool {
+	return d["type"] == "l" || d["Link"] != ""
+}
+
 func (z *FS) String() string {
 	return fmt.Sprintf("fs[%s]", z.fs)
 }
@@ -173,43 +201,150 @@ func (zd *Dir) Attr() (*fuse.Attr, fuse.Error) {
 	zd.d = d
 	md := zd.d.Mode()
 	m := os.FileMode(md)
-	if zd.d["type"] == "d" {
+	sz := uint64(zd.d.Size())
+	switch {
+	case isLink(zd.d):
+		m |= os.ModeSymlink
+		sz = uint64(len(zd.d["Link"]))
+	case zd.d["type"] == "d":
 		m |= os.ModeDir
 	}
 	ino := zd.d.Uint("ino")
 	return &fuse.Attr{
 		Inode: ino,
 		Mode:  m,
-		Size:  uint64(zd.d.Size()),
+		Size:  sz,
 		Mtime: zd.d.Time("mtime"),
 	}, nil
 }
 
+// Report file system usage.
+// zx trees do not report it, so we make up values that keep tools happy.
+func (z *FS) Statfs(_ fs.Intr) (*fuse.StatfsResponse, fuse.Error) {
+	return &fuse.StatfsResponse{
+		Blocks:  1 << 32,
+		Bfree:   1 << 31,
+		Bavail:  1 << 31,
+		Files:   1 << 24,
+		Ffree:   1 << 23,
+		Bsize:   4096,
+		Namelen: 255,
+		Frsize:  4096,
+	}, nil
+}
+
+/*
+	User attributes of zx dirs (those neither standard nor temporary)
+	are exported as "user.name" extended attributes, and updated with Wstat.
+	zx does not keep empty attributes, thus writing an empty value
+	removes the attribute.
+*/
+const xattrPref = "user."
+
+// Attributes kept by us or by the tree that are not exported or can't be written.
+// "ino" is ours, "sumkey" is used by zux to validate sums, and
+// "proto" is set by trees along with the addr.
+var (
+	noXattr = map[string]bool{"ino": true, "sumkey": true, "proto": true}
+	roXattr = map[string]bool{"sum": true}
+)
+
+// Return the zx attribute for the xattr name, if it's a user one.
+func xattrName(name string) (string, bool) {
+	if !strings.HasPrefix(name, xattrPref) {
+		return "", false
+	}
+	a := name[len(xattrPref):]
+	if a == "" || zx.IsStd(a) || zx.IsTemp(a) || noXattr[a] {
+		return "", false
+	}
+	return a, true
+}
+
+func (zd *Dir) stat() (zx.Dir, fuse.Error) {
+	d, err := zx.Stat(zd.fs, zd.d["path"])
+	if err != nil {
+		dprintf("%s: stat: %s\n", zd, err)
+		return nil, errno(err)
+	}
+	return d, nil
+}
+
 // read extended attribute.
 func (zd *Dir) Xattr(name string) ([]byte, fuse.Error) {
-	return nil, fuse.ENOSYS
 	dprintf("%s: xattr %s\n", zd, name)
-	if zd.d[name] == "" {
+	a, ok := xattrName(name)
+	if !ok {
+		return nil, fuse.ENODATA
+	}
+	d, err := zd.stat()
+	if err != nil {
+		return nil, err
+	}
+	if d[a] == "" {
 		vprintf("%s: xattr: %s not found\n", zd, name)
 		return nil, fuse.ENODATA
 	}
-	return []byte(zd.d[name]), nil
+	return []byte(d[a]), nil
 }
 
-// write extended attribute
+// write extended attribute (nil or empty v removes it)
 func (zd *Dir) Wxattr(name string, v []byte) fuse.Error {
-	return fuse.ENOSYS
+	dprintf("%s: wxattr %s %q\n", zd, name, v)
+	a, ok := xattrName(name)
+	if !ok {
+		if strings.HasPrefix(name, xattrPref) {
+			return fuse.EPERM
+		}
+		return fuse.ENOTSUP
+	}
+	if roXattr[a] {
+		return fuse.EPERM
+	}
+	wfs, ok := zd.fs.(zx.Wstater)
+	if !ok {
+		vprintf("%s: wxattr: not a rw tree\n", zd)
+		return fuse.EPERM
+	}
+	if len(v) == 0 {
+		d, err := zd.stat()
+		if err != nil {
+			return err
+		}
+		if d[a] == "" {
+			return fuse.ENODATA
+		}
+	}
+	nd := zx.Dir{a: string(v)}
+	errc := wfs.Wstat(zd.d["path"], nd)
+	<-errc
+	if err := cerror(errc); err != nil {
+		vprintf("%s: wxattr: %s\n", zd, err)
+		return errno(err)
+	}
+	zd.Lock()
+	if len(v) == 0 {
+		delete(zd.d, a)
+	} else {
+		zd.d[a] = string(v)
+	}
+	zd.Unlock()
+	return nil
 }
 
 // list extended attributes.
 func (zd *Dir) Xattrs() []string {
-	return []string{}
-	var ats []string
-	for k := range zd.d {
-		if len(k) > 0 && k[0] >= 'A' && k[0] <= 'Z' {
-			ats = append(ats, k)
+	d, err := zd.stat()
+	if err != nil {
+		return []string{}
+	}
+	ats := []string{}
+	for k, v := range d {
+		if _, ok := xattrName(xattrPref + k); ok && v != "" {
+			ats = append(ats, xattrPref+k)
 		}
 	}
+	sort.Strings(ats)
 	return ats
 }
 
@@ -236,7 +371,7 @@ func (zd *Dir) Lookup(name string, intr fs.Intr) (fs.Node, fuse.Error) {
 func (zd *Dir) Open(flg fuse.OpenFlags, _ fs.Intr) (fs.Handle, fuse.Error) {
 	// Could re-stat the file to see if it's still ok.
 	dprintf("%s: open %v\n", zd, flg)
-	fd := &Fd{Dir: zd}
+	fd := &Fd{Dir: zd, flags: flg}
 	zd.Lock()
 	zd.fds = append(zd.fds, fd)
 	zd.Unlock()
@@ -267,9 +402,13 @@ func (zd *Dir) Open(flg fuse.OpenFlags, _ fs.Intr) (fs.Handle, fuse.Error) {
 func (zd *Dir) SetAttr(r *fuse.SetattrRequest, _ fs.Intr) fuse.Error {
 	nd := zx.Dir{}
 	if r.Valid.Mode() {
-		nd.SetMode(uint64(r.Mode))
+		nd.SetMode(uint64(r.Mode.Perm()))
 	}
-	if r.Valid.Size() && zd.d["type"] != "d" {
+	if r.Valid.Size() {
+		// truncate, perhaps through an open handle
+		if zd.d["type"] == "d" {
+			return fuse.Errno(syscall.EISDIR)
+		}
 		nd["size"] = fmt.Sprintf("%d", r.Size)
 	}
 	if r.Valid.MtimeNow() {
@@ -288,14 +427,80 @@ func (zd *Dir) SetAttr(r *fuse.SetattrRequest, _ fs.Intr) fuse.Error {
 	<-errc
 	if err := cerror(errc); err != nil {
 		vprintf("%s: wstat: %s\n", zd.d["path"], err)
-		return fuse.EPERM
+		return errno(err)
 	}
+	zd.Lock()
 	for k, v := range nd {
 		zd.d[k] = v
 	}
+	zd.Unlock()
 	return nil
 }
 
+// Data written is already at the tree, but it might need a sync.
+func (zd *Dir) Fsync(_ fs.Intr) fuse.Error {
+	dprintf("%s: fsync\n", zd.d["path"])
+	sfs, ok := zd.fs.(zx.Syncer)
+	if !ok {
+		return nil
+	}
+	if err := sfs.Sync(); err != nil {
+		vprintf("%s: fsync: %s\n", zd.d["path"], err)
+		return fuse.EIO
+	}
+	return nil
+}
+
+func (zd *Dir) Readlink(_ fs.Intr) (string, fuse.Error) {
+	d, err := zx.Stat(zd.fs, zd.d["path"])
+	if err != nil {
+		vprintf("%s: readlink: %s\n", zd.d["path"], err)
+		return "", errno(err)
+	}
+	if d["Link"] == "" {
+		return "", fuse.Errno(syscall.EINVAL)
+	}
+	return d["Link"], nil
+}
+
+func (zd *Dir) Symlink(elem, target string, intr fs.Intr) (fs.Node, fuse.Error) {
+	dprintf("%s: symlink %s %s\n", zd.d["path"], elem, target)
+	wfs, np, err := zd.elemcall(elem)
+	if err != nil {
+		vprintf("%s: symlink: %s\n", zd.d["path"], err)
+		return nil, fuse.EPERM
+	}
+	dc := make(chan []byte, 1)
+	dc <- []byte(target)
+	close(dc)
+	xc := wfs.Put(np, zx.Dir{"type": "l"}, 0, dc)
+	<-xc
+	if err := cerror(xc); err != nil {
+		vprintf("%s: symlink: %s\n", zd.d["path"], err)
+		return nil, errno(err)
+	}
+	return zd.Lookup(elem, intr)
+}
+
+func (zd *Dir) Link(elem string, old fs.Node, intr fs.Intr) (fs.Node, fuse.Error) {
+	od, ok := old.(*Dir)
+	if !ok {
+		vprintf("%s: link: not a Dir??\n", zd.d["path"])
+		return nil, fuse.EPERM
+	}
+	dprintf("%s: link %s %s\n", zd.d["path"], elem, od.d["path"])
+	wfs, np, err := zd.elemcall(elem)
+	if err != nil {
+		vprintf("%s: link: %s\n", zd.d["path"], err)
+		return nil, fuse.EPERM
+	}
+	if err := <-wfs.Link(od.d["path"], np); err != nil {
+		vprintf("%s: link: %s\n", zd.d["path"], err)
+		return nil, errno(err)
+	}
+	return zd.Lookup(elem, intr)
+}
+
 func (zd *Dir) elemcall(elem string) (wfs zx.FullFs, npath string, err error) {
 	if strings.Contains(elem, "/") || elem == "." || elem == ".." {
 		return nil, "", fmt.Errorf("bad element name '%s", elem)
@@ -402,7 +607,10 @@ func (szd *Dir) Rename(oelem, nelem string, tond fs.Node, _ fs.Intr) fuse.Error
 func (zd *Dir) dirent() fuse.Dirent {
 	d := zd.d
 	t := fuse.DT_File
-	if d["type"] == "d" {
+	switch {
+	case isLink(d):
+		t = fuse.DT_Link
+	case d["type"] == "d":
 		t = fuse.DT_Dir
 	}
 	dent := fuse.Dirent{
@@ -430,15 +638,34 @@ func (zd *Dir) Create(elem string, flg fuse.OpenFlags, mode os.FileMode, intr fs
 	//
 	// By now we keep as close to unix as we can.
 
-	nd := zx.Dir{"type": "-", "size": "0"}
-	nd.SetMode(uint64(mode))
-	dc := make(chan []byte)
-	close(dc)
-	xc := wfs.Put(np, nd, 0, dc)
-	<-xc
-	if err := cerror(xc); err != nil {
-		vprintf("%s: create %s: %s\n", zd.d["path"], elem, err)
-		return nil, nil, fuse.EPERM
+	// The kernel checks that the file does not exist before calling us,
+	// but it might have been created by others since then.
+	d, err := zx.Stat(wfs, np)
+	switch {
+	case err == nil && int(flg)&os.O_EXCL != 0:
+		return nil, nil, fuse.Errno(syscall.EEXIST)
+	case err == nil && d["type"] == "d":
+		return nil, nil, fuse.Errno(syscall.EISDIR)
+	case err == nil:
+		if int(flg)&os.O_TRUNC != 0 {
+			xc := wfs.Wstat(np, zx.Dir{"size": "0"})
+			<-xc
+			if err := cerror(xc); err != nil {
+				vprintf("%s: create %s: %s\n", zd.d["path"], elem, err)
+				return nil, nil, errno(err)
+			}
+		}
+	default:
+		nd := zx.Dir{"type": "-", "size": "0"}
+		nd.SetMode(uint64(mode.Perm()))
+		dc := make(chan []byte)
+		close(dc)
+		xc := wfs.Put(np, nd, 0, dc)
+		<-xc
+		if err := cerror(xc); err != nil {
+			vprintf("%s: create %s: %s\n", zd.d["path"], elem, err)
+			return nil, nil, errno(err)
+		}
 	}
 	// Shouldn't put return the new stat?
 	x, err := zd.Lookup(elem, intr)
@@ -447,10 +674,10 @@ func (zd *Dir) Create(elem string, flg fuse.OpenFlags, mode os.FileMode, intr fs
 		return nil, nil, err
 	}
 	xd := x.(*Dir)
-	h := &Fd{Dir: xd}
-	zd.Lock()
+	h := &Fd{Dir: xd, flags: flg}
+	xd.Lock()
 	xd.fds = append(xd.fds, h)
-	zd.Unlock()
+	xd.Unlock()
 	return x, h, err
 }
 
@@ -585,6 +812,10 @@ func (fd *Fd) Write(data []byte, off int64, _ fs.Intr) (int, fuse.Error) {
 		vprintf("%s: write: not a file\n", fd)
 		return 0, fuse.EPERM
 	}
+	if int(fd.flags)&os.O_APPEND != 0 {
+		// the kernel's idea of the file size might be stale.
+		off = -1
+	}
 	wc := make(chan []byte, 16)
 	wec := wfs.Put(d["path"], nil, off, wc)
 	tot := 0